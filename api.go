@@ -1,17 +1,22 @@
 package biboop
 
 import (
-  "appengine"
+  "github.com/dbrain/biboop-server/storage"
   "github.com/dbrain/soggy"
   "net/http"
   "errors"
+  "net"
+  "strconv"
+  "time"
 )
 
 type PollRequest struct {
   Name string `json:"name,omitempty"`
   Description string `json:"description,omitempty"`
   MinimumPollTimeSec int `json:"minimumPollTimeSec,omitempty"`
+  MaxWaitSec int `json:"maxWaitSec,omitempty"`
   ServerAPIKey string `json:"serverApiKey,omitempty"`
+  ServerSecret string `json:"serverSecret,omitempty"`
   ServerID string `json:"serverId,omitempty"`
 }
 
@@ -20,7 +25,54 @@ type UpdateRequest struct {
   Description string `json:"description,omitempty"`
   MinimumPollTimeSec int `json:"minimumPollTimeSec,omitempty"`
   ServerAPIKey string `json:"serverApiKey,omitempty"`
+  ServerSecret string `json:"serverSecret,omitempty"`
   ServerID string `json:"serverId,omitempty"`
+  Labels map[string]string `json:"labels,omitempty"`
+}
+
+type EnrollmentRequest struct {
+  EnrollmentToken string `json:"enrollmentToken,omitempty"`
+  ServerID string `json:"serverId,omitempty"`
+  Name string `json:"name,omitempty"`
+  Description string `json:"description,omitempty"`
+}
+
+type CreateEnrollmentTokenRequest struct {
+  Description string `json:"description,omitempty"`
+  ExpiresInSec int `json:"expiresInSec,omitempty"`
+}
+
+type CreatePersonalAccessTokenRequest struct {
+  Name string `json:"name,omitempty"`
+  Scopes []string `json:"scopes,omitempty"`
+  ExpiresInSec int `json:"expiresInSec,omitempty"`
+}
+
+type ServerLabelsRequest struct {
+  Labels map[string]string `json:"labels,omitempty"`
+}
+
+type ResultRequest struct {
+  ServerAPIKey string `json:"serverApiKey,omitempty"`
+  ServerSecret string `json:"serverSecret,omitempty"`
+  ServerID string `json:"serverId,omitempty"`
+  InvocationID int64 `json:"invocationId,omitempty"`
+  ExitCode int `json:"exitCode"`
+  Stdout string `json:"stdout,omitempty"`
+  Stderr string `json:"stderr,omitempty"`
+  StartedTime int64 `json:"startedTime,omitempty"`
+  FinishedTime int64 `json:"finishedTime,omitempty"`
+  DurationMs int64 `json:"durationMs,omitempty"`
+}
+
+type OutputChunkRequest struct {
+  ServerAPIKey string `json:"serverApiKey,omitempty"`
+  ServerSecret string `json:"serverSecret,omitempty"`
+  ServerID string `json:"serverId,omitempty"`
+  InvocationID int64 `json:"invocationId,omitempty"`
+  Sequence int64 `json:"sequence,omitempty"`
+  Stream string `json:"stream,omitempty"`
+  Data string `json:"data,omitempty"`
 }
 
 type CreateCommandRequest struct {
@@ -28,20 +80,187 @@ type CreateCommandRequest struct {
   Name string `json:"name,omitempty"`
   Description string `json:"description,omitempty"`
   Command string `json:"command,omitempty"`
-  Params []CommandParam `json:"params,omitempty"`
+  Params []storage.CommandParam `json:"params,omitempty"`
+  Servers []int64 `json:"servers,omitempty"`
+  Selector string `json:"selector,omitempty"`
+  RequiresApproval bool `json:"requiresApproval,omitempty"`
+  ApprovalExpirySec int `json:"approvalExpirySec,omitempty"`
+}
+
+// Replaces a command's definition. Version is the version the change was made against.
+type UpdateCommandRequest struct {
+  Version int64 `json:"version,omitempty"`
+  PublicCommand bool `json:"publicCommand,omitempty"`
+  Name string `json:"name,omitempty"`
+  Description string `json:"description,omitempty"`
+  Command string `json:"command,omitempty"`
+  Params []storage.CommandParam `json:"params,omitempty"`
+  RequiresApproval bool `json:"requiresApproval,omitempty"`
+  ApprovalExpirySec int `json:"approvalExpirySec,omitempty"`
+}
+
+type ReviewRequest struct {
+  Comment string `json:"comment,omitempty"`
+}
+
+type CreateScheduleRequest struct {
+  CommandID int64 `json:"commandId,omitempty"`
+  ServerID int64 `json:"serverId,omitempty"`
+  Expression string `json:"expression,omitempty"`
+  TimeZone string `json:"timeZone,omitempty"`
+  Params map[string]string `json:"params,omitempty"`
+}
+
+type SchedulePreviewRequest struct {
+  Expression string `json:"expression,omitempty"`
+  TimeZone string `json:"timeZone,omitempty"`
+}
+
+type CreateOrganizationRequest struct {
+  Name string `json:"name,omitempty"`
+}
+
+type InvitationRequest struct {
+  Email string `json:"email,omitempty"`
+  Role string `json:"role,omitempty"`
+}
+
+type CreateWebhookRequest struct {
+  URL string `json:"url,omitempty"`
+  Events []string `json:"events,omitempty"`
+}
+
+type MemberRoleRequest struct {
+  Role string `json:"role,omitempty"`
+}
+
+type RotateServerAPIKeyRequest struct {
+  // Left out for the default grace period, 0 stops the old key working straight away
+  GracePeriodSec *int `json:"gracePeriodSec,omitempty"`
+}
+
+type CommandServersRequest struct {
+  Servers []int64 `json:"servers,omitempty"`
+  Selector string `json:"selector,omitempty"`
+}
+
+type CreateInvocationRequest struct {
+  CommandID int64 `json:"commandId,omitempty"`
   Servers []int64 `json:"servers,omitempty"`
+  Selector string `json:"selector,omitempty"`
+  Params map[string]string `json:"params,omitempty"`
+}
+
+// Cron requests come from App Engine itself, which strips this header from external requests.
+func ApiCronRequired(ctx *soggy.Context) (int, interface{}) {
+  if !ctx.Env["runtime"].(Runtime).IsCronRequest(ctx.Req.Request) {
+    return http.StatusForbidden, map[string]interface{} { "error": "This function is only available to cron" }
+  }
+  ctx.Next(nil)
+  return 0, nil
+}
+
+func isServerAuthError(err error) bool {
+  return err == ErrInvalidServerCredential || err == ErrServerCredentialRequired || err == ErrServerAPIKeyNotFound
+}
+
+func isSelectorError(err error) bool {
+  _, invalid := err.(LabelSelectorError)
+  return invalid || err == ErrNoServersMatch || err == ErrNoMatchingServersHaveCommand
+}
+
+// Writes an audit event for a change the user has just made.
+func auditAction(ctx *soggy.Context, organizationID int64, action string, targetKind string, targetID int64, before interface{}, after interface{}) {
+  event, err := newAuditEvent(ctx, organizationID, action, targetKind, targetID, before, after)
+  recordAuditEvents(ctx, []storage.AuditEvent { event }, err)
+}
+
+func newAuditEvent(ctx *soggy.Context, organizationID int64, action string, targetKind string, targetID int64, before interface{}, after interface{}) (storage.AuditEvent, error) {
+  user := ctx.Env["user"].(storage.User)
+  diff, err := AuditDiff(before, after)
+  return storage.AuditEvent{
+    OrganizationID: organizationID,
+    ActorUserID: user.ID,
+    ActorEmail: user.Email,
+    Action: action,
+    TargetKind: targetKind,
+    TargetID: targetID,
+    RequestID: ctx.Req.ID,
+    SourceIP: sourceIP(ctx.Req),
+    Diff: diff,
+  }, err
+}
+
+// The change has already happened by the time this runs, so rather than failing the request, events that can't be
+// appended now are queued to be appended by a task that retries until they are.
+func recordAuditEvents(ctx *soggy.Context, events []storage.AuditEvent, err error) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  if err != nil {
+    // Still recorded, just without what changed
+    appCtx.Errorf("Failed to describe %d audit events starting with %s: %v", len(events), events[0].Action, err)
+  }
+
+  // Queued events keep the time of the change rather than when the task gets to them
+  now := time.Now().UTC().Unix()
+  for i := range events {
+    events[i].Time = now
+  }
+  if _, err := RecordAuditEventsNoCache(appCtx, events); err != nil {
+    appCtx.Warningf("Queueing %d audit events starting with %s after failing to record them: %v", len(events), events[0].Action, err)
+    if err := appCtx.Later(recordAuditEventsTask{ events: events }); err != nil {
+      appCtx.Criticalf("Failed to queue %d audit events starting with %s: %v", len(events), events[0].Action, err)
+    }
+  }
+}
+
+func sourceIP(req *soggy.Request) string {
+  if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+    return host
+  }
+  return req.RemoteAddr
 }
 
+// Requires a signed in user. Personal access tokens are turned away, use ApiUserOrTokenRequired where they may be used.
 func ApiUserRequired(ctx *soggy.Context) (int, interface{}) {
-  if ctx.Env["googleUser"] == nil {
+  if ctx.Env["personalAccessToken"] != nil {
+    return http.StatusForbidden, map[string]interface{} { "error": ErrTokenNotAllowed.Error() }
+  } else if ctx.Env["identity"] == nil {
     return http.StatusUnauthorized, map[string]interface{} { "error": "This function requires authorization" }
   }
   ctx.Next(nil)
   return 0, nil
 }
 
+// Requires a signed in user, or a personal access token with the given scope.
+func ApiUserOrTokenRequired(scope string) func(*soggy.Context) (int, interface{}) {
+  return func (ctx *soggy.Context) (int, interface{}) {
+    if personalAccessToken, ok := ctx.Env["personalAccessToken"].(storage.PersonalAccessToken); ok {
+      if !TokenHasScope(personalAccessToken, scope) {
+        return http.StatusForbidden, map[string]interface{} { "error": ErrTokenScopeRequired.Error(), "requiredScope": scope }
+      }
+    } else if ctx.Env["identity"] == nil {
+      return http.StatusUnauthorized, map[string]interface{} { "error": "This function requires authorization" }
+    }
+    ctx.Next(nil)
+    return 0, nil
+  }
+}
+
 func ApiMe(ctx* soggy.Context) (int, interface{}) {
-  return http.StatusOK, map[string]interface{} { "googleUser": ctx.Env["googleUser"], "user": ctx.Env["user"] }
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := GetOrganizationNoCache(appCtx, ctx.Env["user"].(storage.User).OrganizationID)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  response := map[string]interface{} { "identity": ctx.Env["identity"], "user": ctx.Env["user"], "organization": organization }
+  // New organizations start without a server API key, so the first step in setting up agents is issuing one
+  if organization.ServerAPIKeyHash == "" && organization.ServerAPIKey == "" {
+    response["serverAPIKeySetup"] = "No server API key yet. An admin issues the first with POST /api/organizations/" +
+      strconv.FormatInt(organization.ID, 10) + "/server-api-key/rotate, which returns it once"
+  }
+  return http.StatusOK, response
 }
 
 func ApiServerPoll(ctx *soggy.Context) (int, interface{}) {
@@ -52,25 +271,84 @@ func ApiServerPoll(ctx *soggy.Context) (int, interface{}) {
     return 0, nil
   } else if bodyType != soggy.BodyTypeJson {
     return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
-  } else if pollRequest.ServerID == "" || pollRequest.ServerAPIKey == "" {
-    ctx.Next(errors.New("serverId and serverAPIKey are required fields"))
+  } else if pollRequest.ServerID == "" || (pollRequest.ServerAPIKey == "" && pollRequest.ServerSecret == "") {
+    ctx.Next(errors.New("serverId and serverAPIKey or serverSecret are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := AuthenticateServerRequest(appCtx, pollRequest.ServerAPIKey, pollRequest.ServerSecret, pollRequest.ServerID)
+  if isServerAuthError(err) {
+    return http.StatusUnauthorized, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
     return 0, nil
   }
 
-  aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-  user, err := FindUserByServerAPIKey(aeCtx, pollRequest.ServerAPIKey)
+  server, err := GetServerForPollRequest(appCtx, organization, pollRequest)
   if err != nil {
     ctx.Next(err)
     return 0, nil
   }
 
-  server, err := GetServerForPollRequest(aeCtx, user, pollRequest)
+  // A long polling agent may not come back until its wait is over, so it counts towards the expected interval
+  pollIntervalSec := pollRequest.MinimumPollTimeSec
+  if pollRequest.MaxWaitSec > pollIntervalSec {
+    pollIntervalSec = pollRequest.MaxWaitSec
+  }
+  server, err = RecordServerPoll(appCtx, server, pollIntervalSec)
   if err != nil {
     ctx.Next(err)
     return 0, nil
   }
 
-  return http.StatusOK, map[string]interface{} { "server": server }
+  queueVersion := ServerQueueVersion(appCtx, server.ID)
+  server, invocations, err := DispatchQueuedInvocations(appCtx, server)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  if len(invocations) == 0 && pollRequest.MaxWaitSec > 0 {
+    server, invocations, err = WaitForQueuedInvocations(appCtx, server, queueVersion, pollRequest.MaxWaitSec)
+    if err != nil {
+      ctx.Next(err)
+      return 0, nil
+    }
+  }
+
+  commands, err := GetCommandsForServerNoCache(appCtx, server)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "server": server, "commands": commands, "invocations": invocations }
+}
+
+func ApiServerEnroll(ctx *soggy.Context) (int, interface{}) {
+  var enrollmentRequest EnrollmentRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&enrollmentRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if enrollmentRequest.EnrollmentToken == "" || enrollmentRequest.ServerID == "" {
+    ctx.Next(errors.New("enrollmentToken and serverId are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  server, serverSecret, err := EnrollServerNoCache(appCtx, enrollmentRequest)
+  if err == ErrEnrollmentTokenInvalid {
+    return http.StatusUnauthorized, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "server": server, "serverSecret": serverSecret }
 }
 
 func ApiServerUpdate(ctx *soggy.Context) (int, interface{}) {
@@ -81,19 +359,23 @@ func ApiServerUpdate(ctx *soggy.Context) (int, interface{}) {
     return 0, nil
   } else if bodyType != soggy.BodyTypeJson {
     return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
-  } else if updateRequest.ServerID == "" || updateRequest.ServerAPIKey == "" {
-    ctx.Next(errors.New("serverId and serverAPIKey are required fields"))
+  } else if updateRequest.ServerID == "" || (updateRequest.ServerAPIKey == "" && updateRequest.ServerSecret == "") {
+    ctx.Next(errors.New("serverId and serverAPIKey or serverSecret are required fields"))
     return 0, nil
+  } else if err := ValidateLabels(updateRequest.Labels); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
   }
 
-  aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-  user, err := FindUserByServerAPIKey(aeCtx, updateRequest.ServerAPIKey)
-  if err != nil {
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := AuthenticateServerRequest(appCtx, updateRequest.ServerAPIKey, updateRequest.ServerSecret, updateRequest.ServerID)
+  if isServerAuthError(err) {
+    return http.StatusUnauthorized, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
     ctx.Next(err)
     return 0, nil
   }
 
-    server, err := UpdateServerForUpdateRequest(aeCtx, user, updateRequest);
+    server, err := UpdateServerForUpdateRequest(appCtx, organization, updateRequest);
     if err != nil {
       ctx.Next(err)
       return 0, nil
@@ -102,9 +384,106 @@ func ApiServerUpdate(ctx *soggy.Context) (int, interface{}) {
   return http.StatusOK, map[string]interface{} { "server": server }
 }
 
+func ApiServerResult(ctx *soggy.Context) (int, interface{}) {
+  var resultRequest ResultRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&resultRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if resultRequest.ServerID == "" || (resultRequest.ServerAPIKey == "" && resultRequest.ServerSecret == "") || resultRequest.InvocationID == 0 {
+    ctx.Next(errors.New("serverId, serverAPIKey or serverSecret and invocationId are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := AuthenticateServerRequest(appCtx, resultRequest.ServerAPIKey, resultRequest.ServerSecret, resultRequest.ServerID)
+  if isServerAuthError(err) {
+    return http.StatusUnauthorized, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  server, err := GetServerByServerID(appCtx, organization, resultRequest.ServerID)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  invocation, err := RecordInvocationResult(appCtx, server, resultRequest)
+  if err == ErrInvocationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrInvocationNotDispatched {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "invocation": invocation }
+}
+
+func ApiServerOutput(ctx *soggy.Context) (int, interface{}) {
+  var outputChunkRequest OutputChunkRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&outputChunkRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if outputChunkRequest.ServerID == "" || (outputChunkRequest.ServerAPIKey == "" && outputChunkRequest.ServerSecret == "") || outputChunkRequest.InvocationID == 0 || outputChunkRequest.Sequence == 0 {
+    ctx.Next(errors.New("serverId, serverAPIKey or serverSecret, invocationId and sequence are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := AuthenticateServerRequest(appCtx, outputChunkRequest.ServerAPIKey, outputChunkRequest.ServerSecret, outputChunkRequest.ServerID)
+  if isServerAuthError(err) {
+    return http.StatusUnauthorized, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  server, err := GetServerByServerID(appCtx, organization, outputChunkRequest.ServerID)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  chunk := storage.OutputChunk{ Sequence: outputChunkRequest.Sequence, Stream: outputChunkRequest.Stream, Data: outputChunkRequest.Data }
+  chunk, nextSequence, err := AppendOutputChunkNoCache(appCtx, server, outputChunkRequest.InvocationID, chunk)
+  if err == ErrInvalidOutputStream || err == ErrOutputChunkTooLarge {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrInvocationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrOutputChunkOutOfOrder {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error(), "nextSequence": nextSequence }
+  } else if err == ErrInvocationNotDispatched {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "chunk": chunk, "nextSequence": nextSequence }
+}
+
 func ApiGetServers(ctx *soggy.Context) (int, interface{}) {
-  aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-  servers, err := GetServersNoCache(aeCtx, ctx.Env["user"].(User))
+  appCtx := ctx.Env["appCtx"].(Context)
+  var servers []storage.Server
+  var err error
+  if selector := ctx.Req.URL.Query().Get("selector"); selector != "" {
+    var labelSelector LabelSelector
+    if labelSelector, err = ParseLabelSelector(selector); err != nil {
+      return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+    }
+    servers, err = GetServersBySelectorNoCache(appCtx, ctx.Env["user"].(storage.User), labelSelector)
+  } else {
+    servers, err = GetServersNoCache(appCtx, ctx.Env["user"].(storage.User))
+  }
   if err != nil {
     ctx.Next(err)
     return 0, nil
@@ -113,36 +492,1238 @@ func ApiGetServers(ctx *soggy.Context) (int, interface{}) {
   return http.StatusOK, map[string]interface{} { "servers": servers }
 }
 
-func ApiCreateCommand(ctx *soggy.Context) (int, interface{}) {
-  var createCommandRequest CreateCommandRequest
+func ApiSetServerLabels(ctx *soggy.Context, serverID string) (int, interface{}) {
+  var serverLabelsRequest ServerLabelsRequest
 
-  if bodyType, _, err := ctx.Req.GetBody(&createCommandRequest); err != nil {
+  if bodyType, _, err := ctx.Req.GetBody(&serverLabelsRequest); err != nil {
     ctx.Next(err)
     return 0, nil
   } else if bodyType != soggy.BodyTypeJson {
     return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
-  } else if createCommandRequest.Name == "" || createCommandRequest.Command == "" {
-    ctx.Next(errors.New("name and command are required fields"))
+  } else if err := ValidateLabels(serverLabelsRequest.Labels); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  id, err := strconv.ParseInt(serverID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrServerNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  // Only read for the audit diff, SetServerLabelsNoCache reports any problem finding the server
+  before, _ := GetServerNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  server, err := SetServerLabelsNoCache(appCtx, ctx.Env["user"].(storage.User), id, serverLabelsRequest.Labels)
+  if err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
     return 0, nil
   }
+  auditAction(ctx, server.OrganizationID, "server.labels", AuditKindServer, server.ID, before, server)
+
+  return http.StatusOK, map[string]interface{} { "server": server }
+}
 
-  aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-  command, err := CreateCommandNoCache(aeCtx, ctx.Env["user"].(User), createCommandRequest)
+func ApiDeleteServer(ctx *soggy.Context, serverID string) (int, interface{}) {
+  id, err := strconv.ParseInt(serverID, 10, 64)
   if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrServerNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  server, err := DeleteServerNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
     ctx.Next(err)
     return 0, nil
   }
+  auditAction(ctx, server.OrganizationID, "server.delete", AuditKindServer, id, server, nil)
 
-  return http.StatusCreated, map[string]interface{} { "command": command }
+  return http.StatusOK, map[string]interface{} { "serverId": id }
 }
 
-func ApiGetCommands(ctx *soggy.Context) (int, interface{}) {
-  aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-  commands, err := GetCommandsNoCache(aeCtx, ctx.Env["user"].(User))
+func ApiRevokeServerCredential(ctx *soggy.Context, serverID string) (int, interface{}) {
+  id, err := strconv.ParseInt(serverID, 10, 64)
   if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrServerNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  server, err := RevokeServerCredentialNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
     ctx.Next(err)
     return 0, nil
   }
+  auditAction(ctx, server.OrganizationID, "server.credential.revoke", AuditKindServer, server.ID, nil, map[string]interface{} { "credentialRevokedTime": server.CredentialRevokedTime })
 
-  return http.StatusOK, map[string]interface{} { "commands": commands }
+  return http.StatusOK, map[string]interface{} { "server": server }
+}
+
+func ApiGetEnrollmentTokens(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  enrollmentTokens, err := GetEnrollmentTokensNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "enrollmentTokens": enrollmentTokens }
+}
+
+func ApiCreateEnrollmentToken(ctx *soggy.Context) (int, interface{}) {
+  var createEnrollmentTokenRequest CreateEnrollmentTokenRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createEnrollmentTokenRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  enrollmentToken, token, err := CreateEnrollmentTokenNoCache(appCtx, ctx.Env["user"].(storage.User), createEnrollmentTokenRequest.Description, createEnrollmentTokenRequest.ExpiresInSec)
+  if err == ErrInvalidEnrollmentExpiry {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, enrollmentToken.OrganizationID, "enrollment-token.create", AuditKindEnrollmentToken, enrollmentToken.ID, nil, enrollmentToken)
+
+  return http.StatusCreated, map[string]interface{} { "enrollmentToken": enrollmentToken, "token": token }
+}
+
+func ApiRevokeEnrollmentToken(ctx *soggy.Context, enrollmentTokenID string) (int, interface{}) {
+  id, err := strconv.ParseInt(enrollmentTokenID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrEnrollmentTokenNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  enrollmentToken, err := RevokeEnrollmentTokenNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrEnrollmentTokenNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, enrollmentToken.OrganizationID, "enrollment-token.revoke", AuditKindEnrollmentToken, id, nil, map[string]interface{} { "revokedTime": enrollmentToken.RevokedTime })
+
+  return http.StatusOK, map[string]interface{} { "enrollmentToken": enrollmentToken }
+}
+
+func ApiGetPersonalAccessTokens(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  personalAccessTokens, err := GetPersonalAccessTokensNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "personalAccessTokens": personalAccessTokens }
+}
+
+func ApiCreatePersonalAccessToken(ctx *soggy.Context) (int, interface{}) {
+  var createPersonalAccessTokenRequest CreatePersonalAccessTokenRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createPersonalAccessTokenRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createPersonalAccessTokenRequest.Name == "" {
+    ctx.Next(errors.New("name is a required field"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  user := ctx.Env["user"].(storage.User)
+  personalAccessToken, token, err := CreatePersonalAccessTokenNoCache(appCtx, user, createPersonalAccessTokenRequest.Name, createPersonalAccessTokenRequest.Scopes, createPersonalAccessTokenRequest.ExpiresInSec)
+  if err == ErrInvalidTokenScope || err == ErrInvalidTokenExpiry {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, user.OrganizationID, "token.create", AuditKindPersonalAccessToken, personalAccessToken.ID, nil, personalAccessToken)
+
+  return http.StatusCreated, map[string]interface{} { "personalAccessToken": personalAccessToken, "token": token }
+}
+
+func ApiRevokePersonalAccessToken(ctx *soggy.Context, personalAccessTokenID string) (int, interface{}) {
+  id, err := strconv.ParseInt(personalAccessTokenID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrPersonalAccessTokenNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  user := ctx.Env["user"].(storage.User)
+  personalAccessToken, err := RevokePersonalAccessTokenNoCache(appCtx, user, id)
+  if err == ErrPersonalAccessTokenNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, user.OrganizationID, "token.revoke", AuditKindPersonalAccessToken, id, nil, map[string]interface{} { "revokedTime": personalAccessToken.RevokedTime })
+
+  return http.StatusOK, map[string]interface{} { "personalAccessToken": personalAccessToken }
+}
+
+func ApiGetServerEvents(ctx *soggy.Context, serverID string) (int, interface{}) {
+  id, err := strconv.ParseInt(serverID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrServerNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  events, err := GetServerEventsNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "events": events }
+}
+
+func ApiCronLiveness(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  if err := CheckServerLivenessNoCache(appCtx); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} {}
+}
+
+func ApiCreateCommand(ctx *soggy.Context) (int, interface{}) {
+  var createCommandRequest CreateCommandRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createCommandRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createCommandRequest.Name == "" || createCommandRequest.Command == "" {
+    ctx.Next(errors.New("name and command are required fields"))
+    return 0, nil
+  } else if err := ValidateCommandParams(createCommandRequest.Params); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": err }
+  } else if err := ValidateCommandTemplate(createCommandRequest.Command, createCommandRequest.Params); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": err }
+  } else if err := ValidateApprovalExpiry(createCommandRequest.ApprovalExpirySec); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  var err error
+  createCommandRequest.Servers, _, err = ResolveServerSelector(appCtx, ctx.Env["user"].(storage.User), createCommandRequest.Servers, createCommandRequest.Selector, 0)
+  if isSelectorError(err) {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  command, err := CreateCommandNoCache(appCtx, ctx.Env["user"].(storage.User), createCommandRequest)
+  if err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, command.OrganizationID, "command.create", AuditKindCommand, command.ID, nil, map[string]interface{} { "command": command, "servers": createCommandRequest.Servers })
+
+  return http.StatusCreated, map[string]interface{} { "command": command }
+}
+
+func ApiGetCommands(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  commands, err := GetCommandsNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "commands": commands }
+}
+
+func ApiGetCatalog(ctx *soggy.Context) (int, interface{}) {
+  query := ctx.Req.URL.Query()
+  var afterID int64
+  var limit int
+  var err error
+  if after := query.Get("after"); after != "" {
+    if afterID, err = strconv.ParseInt(after, 10, 64); err != nil {
+      return http.StatusBadRequest, map[string]interface{} { "error": "after must be a number" }
+    }
+  }
+  if limitParam := query.Get("limit"); limitParam != "" {
+    if limit, err = strconv.Atoi(limitParam); err != nil {
+      return http.StatusBadRequest, map[string]interface{} { "error": "limit must be a number" }
+    }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  commands, nextAfterID, err := GetPublicCommandsNoCache(appCtx, query.Get("q"), afterID, limit)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  response := map[string]interface{} { "commands": commands }
+  if nextAfterID != 0 {
+    response["next"] = nextAfterID
+  }
+  return http.StatusOK, response
+}
+
+func ApiForkCommand(ctx *soggy.Context, commandID string) (int, interface{}) {
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  command, err := ForkCommandNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrCommandNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, command.OrganizationID, "command.fork", AuditKindCommand, command.ID, nil, command)
+
+  return http.StatusCreated, map[string]interface{} { "command": command }
+}
+
+func ApiGetCommand(ctx *soggy.Context, commandID string) (int, interface{}) {
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  command, err := GetCommandNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrCommandNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "command": command }
+}
+
+func ApiUpdateCommand(ctx *soggy.Context, commandID string) (int, interface{}) {
+  var updateCommandRequest UpdateCommandRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&updateCommandRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if updateCommandRequest.Version == 0 || updateCommandRequest.Name == "" || updateCommandRequest.Command == "" {
+    ctx.Next(errors.New("version, name and command are required fields"))
+    return 0, nil
+  } else if err := ValidateCommandParams(updateCommandRequest.Params); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": err }
+  } else if err := ValidateCommandTemplate(updateCommandRequest.Command, updateCommandRequest.Params); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": err }
+  } else if err := ValidateApprovalExpiry(updateCommandRequest.ApprovalExpirySec); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  before, command, err := UpdateCommandNoCache(appCtx, ctx.Env["user"].(storage.User), id, updateCommandRequest)
+  if err == ErrCommandNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrNotMember || err == ErrForbidden {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrCommandVersionConflict {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error(), "command": command }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, command.OrganizationID, "command.update", AuditKindCommand, command.ID, before, command)
+
+  return http.StatusOK, map[string]interface{} { "command": command }
+}
+
+// Deletes a command. A version query parameter makes the delete conditional on the command still being at it.
+func ApiDeleteCommand(ctx *soggy.Context, commandID string) (int, interface{}) {
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  var expectedVersion int64
+  if version := ctx.Req.URL.Query().Get("version"); version != "" {
+    if expectedVersion, err = strconv.ParseInt(version, 10, 64); err != nil || expectedVersion <= 0 {
+      return http.StatusBadRequest, map[string]interface{} { "error": "version must be a positive number" }
+    }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  command, err := DeleteCommandNoCache(appCtx, ctx.Env["user"].(storage.User), id, expectedVersion)
+  if err == ErrCommandNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrNotMember || err == ErrForbidden {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrCommandVersionConflict {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error(), "command": command }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, command.OrganizationID, "command.delete", AuditKindCommand, command.ID, command, nil)
+
+  return http.StatusOK, map[string]interface{} { "command": command }
+}
+
+func ApiGetCommandVersions(ctx *soggy.Context, commandID string) (int, interface{}) {
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  commandVersions, err := GetCommandVersionsNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrCommandNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "versions": commandVersions }
+}
+
+func ApiGetCommandVersion(ctx *soggy.Context, commandID string, version string) (int, interface{}) {
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+  versionNumber, err := strconv.ParseInt(version, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandVersionNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  commandVersion, err := GetCommandVersionNoCache(appCtx, ctx.Env["user"].(storage.User), id, versionNumber)
+  if err == ErrCommandNotFound || err == ErrCommandVersionNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "version": commandVersion }
+}
+
+func ApiAddCommandToServers(ctx *soggy.Context, commandID string) (int, interface{}) {
+  return updateCommandServers(ctx, commandID, "command.attach", AddCommandToServersNoCache)
+}
+
+func ApiRemoveCommandFromServers(ctx *soggy.Context, commandID string) (int, interface{}) {
+  return updateCommandServers(ctx, commandID, "command.detach", RemoveCommandFromServersNoCache)
+}
+
+func updateCommandServers(ctx *soggy.Context, commandID string, action string, update func(Context, storage.User, int64, []int64) error) (int, interface{}) {
+  var commandServersRequest CommandServersRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&commandServersRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if len(commandServersRequest.Servers) == 0 && commandServersRequest.Selector == "" {
+    ctx.Next(errors.New("servers or selector is a required field"))
+    return 0, nil
+  }
+
+  id, err := strconv.ParseInt(commandID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrCommandNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  commandServersRequest.Servers, _, err = ResolveServerSelector(appCtx, ctx.Env["user"].(storage.User), commandServersRequest.Servers, commandServersRequest.Selector, 0)
+  if isSelectorError(err) {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  err = update(appCtx, ctx.Env["user"].(storage.User), id, commandServersRequest.Servers)
+  if err == ErrCommandNotFound || err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, ctx.Env["user"].(storage.User).OrganizationID, action, AuditKindCommand, id, nil, map[string]interface{} { "servers": commandServersRequest.Servers })
+
+  return http.StatusOK, map[string]interface{} { "commandId": id, "servers": commandServersRequest.Servers }
+}
+
+func ApiCreateInvocation(ctx *soggy.Context) (int, interface{}) {
+  var createInvocationRequest CreateInvocationRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createInvocationRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createInvocationRequest.CommandID == 0 || (len(createInvocationRequest.Servers) == 0 && createInvocationRequest.Selector == "") {
+    ctx.Next(errors.New("commandId and servers or selector are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  var skippedServers []int64
+  var err error
+  createInvocationRequest.Servers, skippedServers, err = ResolveServerSelector(appCtx, ctx.Env["user"].(storage.User), createInvocationRequest.Servers, createInvocationRequest.Selector, createInvocationRequest.CommandID)
+  if isSelectorError(err) {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  invocations, serverErrors, err := CreateInvocationsNoCache(appCtx, ctx.Env["user"].(storage.User), createInvocationRequest)
+  if paramErrors, ok := err.(ParamErrors); ok {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": paramErrors }
+  } else if err == ErrCommandNotFound || err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrCommandNotAvailable {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditEvents := make([]storage.AuditEvent, len(invocations))
+  for i, invocation := range invocations {
+    var auditErr error
+    if auditEvents[i], auditErr = newAuditEvent(ctx, invocation.OrganizationID, "invocation.create", AuditKindInvocation, invocation.ID, nil, invocation); auditErr != nil {
+      err = auditErr
+    }
+  }
+  recordAuditEvents(ctx, auditEvents, err)
+
+  return http.StatusCreated, map[string]interface{} { "invocations": invocations, "skippedServers": skippedServers, "serverErrors": serverErrors }
+}
+
+func ApiGetInvocations(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  invocations, err := GetInvocationsNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "invocations": invocations }
+}
+
+func ApiGetInvocation(ctx *soggy.Context, invocationID string) (int, interface{}) {
+  id, err := strconv.ParseInt(invocationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrInvocationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  invocation, err := GetInvocationNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrInvocationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "invocation": invocation }
+}
+
+func ApiGetInvocationOutput(ctx *soggy.Context, invocationID string) (int, interface{}) {
+  id, err := strconv.ParseInt(invocationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrInvocationNotFound.Error() }
+  }
+
+  query := ctx.Req.URL.Query()
+  var offset int64
+  if query.Get("offset") != "" {
+    if offset, err = strconv.ParseInt(query.Get("offset"), 10, 64); err != nil || offset < 0 {
+      return http.StatusBadRequest, map[string]interface{} { "error": "offset must be a positive number" }
+    }
+  }
+  var waitSec int
+  if query.Get("wait") != "" {
+    if waitSec, err = strconv.Atoi(query.Get("wait")); err != nil || waitSec < 0 {
+      return http.StatusBadRequest, map[string]interface{} { "error": "wait must be a positive number" }
+    }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  var output InvocationOutput
+  if waitSec > 0 {
+    output, err = WaitForInvocationOutput(appCtx, ctx.Env["user"].(storage.User), id, offset, waitSec)
+  } else {
+    output, err = GetInvocationOutputNoCache(appCtx, ctx.Env["user"].(storage.User), id, offset)
+  }
+  if err == ErrInvocationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "output": output }
+}
+
+func ApiApproveInvocation(ctx *soggy.Context, invocationID string) (int, interface{}) {
+  return reviewInvocation(ctx, invocationID, true)
+}
+
+func ApiRejectInvocation(ctx *soggy.Context, invocationID string) (int, interface{}) {
+  return reviewInvocation(ctx, invocationID, false)
+}
+
+func reviewInvocation(ctx *soggy.Context, invocationID string, approve bool) (int, interface{}) {
+  var reviewRequest ReviewRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&reviewRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  }
+
+  id, err := strconv.ParseInt(invocationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrInvocationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  invocation, err := ReviewInvocationNoCache(appCtx, ctx.Env["user"].(storage.User), id, approve, reviewRequest.Comment)
+  if err == ErrInvocationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrSelfApproval {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrInvocationNotPendingApproval || err == ErrApprovalExpired {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  action := "invocation.reject"
+  if approve {
+    action = "invocation.approve"
+  }
+  auditAction(ctx, invocation.OrganizationID, action, AuditKindInvocation, invocation.ID, nil, map[string]interface{} { "state": invocation.State, "comment": invocation.ReviewComment })
+
+  return http.StatusOK, map[string]interface{} { "invocation": invocation }
+}
+
+func ApiCronApprovals(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  expired, err := ExpireApprovalsNoCache(appCtx, time.Now())
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "expired": expired }
+}
+
+func ApiCreateSchedule(ctx *soggy.Context) (int, interface{}) {
+  var createScheduleRequest CreateScheduleRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createScheduleRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createScheduleRequest.CommandID == 0 || createScheduleRequest.ServerID == 0 || createScheduleRequest.Expression == "" {
+    ctx.Next(errors.New("commandId, serverId and expression are required fields"))
+    return 0, nil
+  } else if _, err := ParseCronSchedule(createScheduleRequest.Expression, createScheduleRequest.TimeZone); err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  schedule, err := CreateScheduleNoCache(appCtx, ctx.Env["user"].(storage.User), createScheduleRequest)
+  if paramErrors, ok := err.(ParamErrors); ok {
+    return http.StatusBadRequest, map[string]interface{} { "error": "Invalid params", "params": paramErrors }
+  } else if err == ErrCommandNotFound || err == ErrServerNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrCommandNotAvailable || err == ErrScheduleNeverRuns {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, schedule.OrganizationID, "schedule.create", AuditKindSchedule, schedule.ID, nil, schedule)
+
+  return http.StatusCreated, map[string]interface{} { "schedule": schedule }
+}
+
+func ApiGetSchedules(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  schedules, err := GetSchedulesNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "schedules": schedules }
+}
+
+func ApiPreviewSchedule(ctx *soggy.Context) (int, interface{}) {
+  var schedulePreviewRequest SchedulePreviewRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&schedulePreviewRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  }
+
+  runTimes, err := PreviewSchedule(schedulePreviewRequest.Expression, schedulePreviewRequest.TimeZone, ScheduleNextRunCount)
+  if err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  return http.StatusOK, map[string]interface{} { "nextRunTimes": runTimes }
+}
+
+func ApiGetSchedulePreview(ctx *soggy.Context, scheduleID string) (int, interface{}) {
+  id, err := strconv.ParseInt(scheduleID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrScheduleNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  schedule, err := GetScheduleNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrScheduleNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  runTimes, err := PreviewSchedule(schedule.Expression, schedule.TimeZone, ScheduleNextRunCount)
+  if err != nil {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  }
+
+  return http.StatusOK, map[string]interface{} { "schedule": schedule, "nextRunTimes": runTimes }
+}
+
+func ApiPauseSchedule(ctx *soggy.Context, scheduleID string) (int, interface{}) {
+  return setSchedulePaused(ctx, scheduleID, true)
+}
+
+func ApiResumeSchedule(ctx *soggy.Context, scheduleID string) (int, interface{}) {
+  return setSchedulePaused(ctx, scheduleID, false)
+}
+
+func setSchedulePaused(ctx *soggy.Context, scheduleID string, paused bool) (int, interface{}) {
+  id, err := strconv.ParseInt(scheduleID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrScheduleNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  // Only read for the audit diff, SetSchedulePausedNoCache reports any problem finding the schedule
+  before, _ := GetScheduleNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  schedule, err := SetSchedulePausedNoCache(appCtx, ctx.Env["user"].(storage.User), id, paused)
+  if err == ErrScheduleNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrScheduleNeverRuns {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  action := "schedule.resume"
+  if paused {
+    action = "schedule.pause"
+  }
+  auditAction(ctx, schedule.OrganizationID, action, AuditKindSchedule, schedule.ID, before, schedule)
+
+  return http.StatusOK, map[string]interface{} { "schedule": schedule }
+}
+
+func ApiDeleteSchedule(ctx *soggy.Context, scheduleID string) (int, interface{}) {
+  id, err := strconv.ParseInt(scheduleID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrScheduleNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  // Only read for the audit diff, DeleteScheduleNoCache reports any problem finding the schedule
+  before, _ := GetScheduleNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  err = DeleteScheduleNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrScheduleNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, ctx.Env["user"].(storage.User).OrganizationID, "schedule.delete", AuditKindSchedule, id, before, nil)
+
+  return http.StatusOK, map[string]interface{} { "scheduleId": id }
+}
+
+func ApiCronSchedules(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  queued, err := RunDueSchedulesNoCache(appCtx, time.Now())
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "queued": queued }
+}
+
+func ApiGetOrganizations(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  organizations, err := GetOrganizationsNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "organizations": organizations }
+}
+
+func ApiCreateOrganization(ctx *soggy.Context) (int, interface{}) {
+  var createOrganizationRequest CreateOrganizationRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createOrganizationRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createOrganizationRequest.Name == "" {
+    ctx.Next(errors.New("name is a required field"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, serverAPIKey, err := CreateOrganizationNoCache(appCtx, ctx.Env["user"].(storage.User), createOrganizationRequest.Name)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, organization.ID, "organization.create", AuditKindOrganization, organization.ID, nil, map[string]interface{} { "name": organization.Name })
+
+  return http.StatusCreated, map[string]interface{} { "organization": organization, "serverAPIKey": serverAPIKey }
+}
+
+func ApiSwitchOrganization(ctx *soggy.Context, organizationID string) (int, interface{}) {
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  user, err := SwitchOrganizationNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrNotMember {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, id, "organization.switch", AuditKindUser, user.ID, map[string]interface{} { "organizationId": ctx.Env["user"].(storage.User).OrganizationID }, map[string]interface{} { "organizationId": user.OrganizationID })
+
+  return http.StatusOK, map[string]interface{} { "user": user }
+}
+
+func ApiGetMembers(ctx *soggy.Context, organizationID string) (int, interface{}) {
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  members, err := GetMembersNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrNotMember {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "members": members }
+}
+
+func ApiRemoveMember(ctx *soggy.Context, organizationID string, memberUserID string) (int, interface{}) {
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+  memberID, err := strconv.ParseInt(memberUserID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrNotMember.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  err = RemoveMemberNoCache(appCtx, ctx.Env["user"].(storage.User), id, memberID)
+  if err == ErrNotMember || err == ErrCannotRemoveMember || err == ErrForbidden || err == ErrLastAdmin {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrOrganizationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, id, "member.remove", AuditKindUser, memberID, map[string]interface{} { "userId": memberID }, nil)
+
+  return http.StatusOK, map[string]interface{} { "organizationId": id, "userId": memberID }
+}
+
+func ApiSetMemberRole(ctx *soggy.Context, organizationID string, memberUserID string) (int, interface{}) {
+  var memberRoleRequest MemberRoleRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&memberRoleRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  }
+
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+  memberID, err := strconv.ParseInt(memberUserID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrNotMember.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  // Only read for the audit diff, SetMemberRoleNoCache reports any problem finding the membership
+  before, _ := GetMembershipNoCache(appCtx, id, memberID)
+  membership, err := SetMemberRoleNoCache(appCtx, ctx.Env["user"].(storage.User), id, memberID, memberRoleRequest.Role)
+  if err == ErrInvalidRole {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrNotMember || err == ErrForbidden || err == ErrLastAdmin {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, id, "member.role", AuditKindUser, memberID, before, membership)
+
+  return http.StatusOK, map[string]interface{} { "membership": membership }
+}
+
+func ApiRotateServerAPIKey(ctx *soggy.Context, organizationID string) (int, interface{}) {
+  var rotateRequest RotateServerAPIKeyRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&rotateRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  }
+
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+
+  if id != ctx.Env["user"].(storage.User).OrganizationID {
+    return http.StatusForbidden, map[string]interface{} { "error": ErrNotCurrentOrganization.Error() }
+  }
+
+  gracePeriodSec := DefaultServerAPIKeyGracePeriodSec
+  if rotateRequest.GracePeriodSec != nil {
+    gracePeriodSec = *rotateRequest.GracePeriodSec
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, serverAPIKey, err := RotateServerAPIKeyNoCache(appCtx, id, gracePeriodSec)
+  status, response := serverAPIKeyResponse(ctx, organization, err, "organization.server-api-key.rotate")
+  if status == http.StatusOK {
+    // The only time the new key is ever shown
+    response.(map[string]interface{})["serverAPIKey"] = serverAPIKey
+  }
+  return status, response
+}
+
+func ApiRevokePreviousServerAPIKey(ctx *soggy.Context, organizationID string) (int, interface{}) {
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  } else if id != ctx.Env["user"].(storage.User).OrganizationID {
+    return http.StatusForbidden, map[string]interface{} { "error": ErrNotCurrentOrganization.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  organization, err := RevokePreviousServerAPIKeyNoCache(appCtx, id)
+  return serverAPIKeyResponse(ctx, organization, err, "organization.server-api-key.revoke-previous")
+}
+
+func serverAPIKeyResponse(ctx *soggy.Context, organization storage.Organization, err error, action string) (int, interface{}) {
+  if err == ErrInvalidGracePeriod {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrOrganizationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  // Only the timings go in the audit log, never the keys themselves
+  auditAction(ctx, organization.ID, action, AuditKindOrganization, organization.ID, nil, map[string]interface{} {
+    "serverAPIKeyCreatedTime": organization.ServerAPIKeyCreatedTime,
+    "previousServerAPIKeyExpiresTime": organization.PreviousServerAPIKeyExpiresTime,
+  })
+
+  return http.StatusOK, map[string]interface{} { "organization": organization }
+}
+
+func ApiCreateInvitation(ctx *soggy.Context, organizationID string) (int, interface{}) {
+  var invitationRequest InvitationRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&invitationRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if invitationRequest.Email == "" {
+    ctx.Next(errors.New("email is a required field"))
+    return 0, nil
+  }
+
+  id, err := strconv.ParseInt(organizationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrOrganizationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  invitation, err := CreateInvitationNoCache(appCtx, ctx.Env["user"].(storage.User), id, invitationRequest.Email, invitationRequest.Role)
+  if err == ErrInvalidRole {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrNotMember || err == ErrForbidden {
+    return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrOrganizationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, id, "invitation.create", AuditKindInvitation, invitation.ID, nil, invitation)
+
+  return http.StatusCreated, map[string]interface{} { "invitation": invitation }
+}
+
+func ApiGetInvitations(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  invitations, err := GetInvitationsNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "invitations": invitations }
+}
+
+func ApiAcceptInvitation(ctx *soggy.Context, invitationID string) (int, interface{}) {
+  return respondToInvitation(ctx, invitationID, true)
+}
+
+func ApiDeclineInvitation(ctx *soggy.Context, invitationID string) (int, interface{}) {
+  return respondToInvitation(ctx, invitationID, false)
+}
+
+func respondToInvitation(ctx *soggy.Context, invitationID string, accept bool) (int, interface{}) {
+  id, err := strconv.ParseInt(invitationID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrInvitationNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  invitation, err := RespondToInvitationNoCache(appCtx, ctx.Env["user"].(storage.User), id, accept)
+  if err == ErrInvitationNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err == ErrAlreadyMember {
+    return http.StatusConflict, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  action := "invitation.decline"
+  if accept {
+    action = "invitation.accept"
+  }
+  auditAction(ctx, invitation.OrganizationID, action, AuditKindInvitation, invitation.ID, nil, map[string]interface{} { "state": invitation.State })
+
+  return http.StatusOK, map[string]interface{} { "invitation": invitation }
+}
+
+func ApiGetAuditEvents(ctx *soggy.Context) (int, interface{}) {
+  query := ctx.Req.URL.Query()
+  filter := AuditFilter{
+    Action: query.Get("action"),
+    TargetKind: query.Get("targetKind"),
+  }
+
+  var err error
+  for name, value := range map[string]*int64 { "actorUserId": &filter.ActorUserID, "targetId": &filter.TargetID,
+      "since": &filter.Since, "until": &filter.Until, "before": &filter.Before } {
+    if query.Get(name) == "" {
+      continue
+    } else if *value, err = strconv.ParseInt(query.Get(name), 10, 64); err != nil {
+      return http.StatusBadRequest, map[string]interface{} { "error": name + " must be a number" }
+    }
+  }
+  if limit := query.Get("limit"); limit != "" {
+    if filter.Limit, err = strconv.Atoi(limit); err != nil {
+      return http.StatusBadRequest, map[string]interface{} { "error": "limit must be a number" }
+    }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  events, err := GetAuditEventsNoCache(appCtx, ctx.Env["user"].(storage.User), filter)
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "events": events }
+}
+
+func ApiVerifyAuditEvents(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  verification, err := VerifyAuditChainNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "verification": verification }
+}
+
+func ApiGetWebhooks(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  webhooks, err := GetWebhooksNoCache(appCtx, ctx.Env["user"].(storage.User))
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "webhooks": webhooks }
+}
+
+func ApiCreateWebhook(ctx *soggy.Context) (int, interface{}) {
+  var createWebhookRequest CreateWebhookRequest
+
+  if bodyType, _, err := ctx.Req.GetBody(&createWebhookRequest); err != nil {
+    ctx.Next(err)
+    return 0, nil
+  } else if bodyType != soggy.BodyTypeJson {
+    return http.StatusBadRequest, map[string]interface{} { "error": "JSON request expected" }
+  } else if createWebhookRequest.URL == "" || len(createWebhookRequest.Events) == 0 {
+    ctx.Next(errors.New("url and events are required fields"))
+    return 0, nil
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  webhook, err := CreateWebhookNoCache(appCtx, ctx.Env["user"].(storage.User), createWebhookRequest.URL, createWebhookRequest.Events)
+  if err == ErrInvalidWebhookURL || err == ErrInvalidWebhookEvent {
+    return http.StatusBadRequest, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  audited := webhook
+  audited.Secret = ""
+  auditAction(ctx, webhook.OrganizationID, "webhook.create", AuditKindWebhook, webhook.ID, nil, audited)
+
+  return http.StatusCreated, map[string]interface{} { "webhook": webhook }
+}
+
+func ApiDeleteWebhook(ctx *soggy.Context, webhookID string) (int, interface{}) {
+  id, err := strconv.ParseInt(webhookID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrWebhookNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  webhook, err := DeleteWebhookNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrWebhookNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, webhook.OrganizationID, "webhook.delete", AuditKindWebhook, id, webhook, nil)
+
+  return http.StatusOK, map[string]interface{} { "webhookId": id }
+}
+
+func ApiGetWebhookDeliveries(ctx *soggy.Context, webhookID string) (int, interface{}) {
+  id, err := strconv.ParseInt(webhookID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrWebhookNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  deliveries, err := GetWebhookDeliveriesNoCache(appCtx, ctx.Env["user"].(storage.User), id)
+  if err == ErrWebhookNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "deliveries": deliveries }
+}
+
+func ApiRedeliverWebhook(ctx *soggy.Context, webhookID string, deliveryID string) (int, interface{}) {
+  id, err := strconv.ParseInt(webhookID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrWebhookNotFound.Error() }
+  }
+  originalID, err := strconv.ParseInt(deliveryID, 10, 64)
+  if err != nil {
+    return http.StatusNotFound, map[string]interface{} { "error": ErrWebhookDeliveryNotFound.Error() }
+  }
+
+  appCtx := ctx.Env["appCtx"].(Context)
+  delivery, err := RedeliverWebhookNoCache(appCtx, ctx.Env["user"].(storage.User), id, originalID)
+  if err == ErrWebhookNotFound || err == ErrWebhookDeliveryNotFound {
+    return http.StatusNotFound, map[string]interface{} { "error": err.Error() }
+  } else if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+  auditAction(ctx, delivery.OrganizationID, "webhook.redeliver", AuditKindWebhookDelivery, delivery.ID, nil, map[string]interface{} { "webhookId": id, "redeliveryOfId": originalID })
+
+  return http.StatusCreated, map[string]interface{} { "delivery": delivery }
+}
+
+func ApiCronWebhooks(ctx *soggy.Context) (int, interface{}) {
+  appCtx := ctx.Env["appCtx"].(Context)
+  attempted, err := DeliverWebhooksNoCache(appCtx, appCtx.HTTPClient(), time.Now())
+  if err != nil {
+    ctx.Next(err)
+    return 0, nil
+  }
+
+  return http.StatusOK, map[string]interface{} { "attempted": attempted }
 }
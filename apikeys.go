@@ -0,0 +1,197 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "time"
+)
+
+// New organizations have no server API key until an admin rotates one in, so an agent set up before then lands here.
+var ErrServerAPIKeyNotFound = errors.New("Server API key not recognised. An organization has none until an admin issues its first with POST /api/organizations/{id}/server-api-key/rotate")
+var ErrInvalidGracePeriod = errors.New("gracePeriodSec must be between 0 and 2592000")
+
+// Server API keys are random and only their hash is stored, so a key is shown once when it is issued and never again.
+// The prefix lets a leaked key be recognised, and the first few characters are kept to tell keys apart.
+const (
+  serverAPIKeyPrefix = "bbk_"
+  serverAPIKeyHintLength = len(serverAPIKeyPrefix) + 8
+)
+
+// How long a rotated out server API key keeps working when the rotation doesn't say.
+const DefaultServerAPIKeyGracePeriodSec = 24 * 60 * 60
+const MaxServerAPIKeyGracePeriodSec = 30 * 24 * 60 * 60
+
+// Cached organizations are dropped on rotation and revocation, the expiry only bounds how long a lost delete matters.
+const serverAPIKeyCacheExpiration = 5 * time.Minute
+
+func newServerAPIKey() (string, error) {
+  random, err := randomHex(32)
+  if err != nil {
+    return "", err
+  }
+  return serverAPIKeyPrefix + random, nil
+}
+
+// Makes serverAPIKey the organization's current key. Keys from before keys were hashed don't get a hint as they
+// start with the owner's email.
+func setServerAPIKey(organization *storage.Organization, serverAPIKey string, now int64) {
+  organization.ServerAPIKey = ""
+  organization.ServerAPIKeyHash = hashSecret(serverAPIKey)
+  organization.ServerAPIKeyHint = ""
+  if len(serverAPIKey) > serverAPIKeyHintLength && serverAPIKey[:len(serverAPIKeyPrefix)] == serverAPIKeyPrefix {
+    organization.ServerAPIKeyHint = serverAPIKey[:serverAPIKeyHintLength]
+  }
+  organization.ServerAPIKeyCreatedTime = now
+  organization.ServerAPIKeyLastUsedTime = 0
+}
+
+func acceptsServerAPIKey(organization storage.Organization, serverAPIKey string, now int64) bool {
+  if secretMatches(serverAPIKey, organization.ServerAPIKeyHash) {
+    return true
+  }
+  return now < organization.PreviousServerAPIKeyExpiresTime && secretMatches(serverAPIKey, organization.PreviousServerAPIKeyHash)
+}
+
+func clearServerAPIKeyCache(ctx Context, organization storage.Organization) {
+  keys := []string {}
+  for _, hash := range []string { organization.ServerAPIKeyHash, organization.PreviousServerAPIKeyHash } {
+    if hash != "" {
+      keys = append(keys, organizationCacheKey(hash))
+    }
+  }
+  ctx.Cache().Delete(keys...)
+}
+
+// Hashes the plain text keys an organization stored before keys were hashed. The keys themselves keep working until
+// they are rotated out.
+func hashLegacyServerAPIKeysNoCache(ctx Context, organizationID int64) (storage.Organization, error) {
+  var organization storage.Organization
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if organization, err = tx.GetOrganization(organizationID); err != nil {
+      return err
+    }
+
+    if organization.ServerAPIKey != "" {
+      organization.ServerAPIKeyHash = hashSecret(organization.ServerAPIKey)
+      organization.ServerAPIKey = ""
+    }
+    if organization.PreviousServerAPIKey != "" {
+      organization.PreviousServerAPIKeyHash = hashSecret(organization.PreviousServerAPIKey)
+      organization.PreviousServerAPIKey = ""
+    }
+    organization, err = tx.PutOrganization(organization)
+    return err
+  })
+  return organization, err
+}
+
+// Notes that a server API key was used, in a task so agent requests never wait on the organization.
+func recordServerAPIKeyUse(ctx Context, organization storage.Organization, serverAPIKey string) {
+  serverAPIKeyHash := hashSecret(serverAPIKey)
+  lastUsedTime := organization.ServerAPIKeyLastUsedTime
+  if serverAPIKeyHash != organization.ServerAPIKeyHash {
+    lastUsedTime = organization.PreviousServerAPIKeyLastUsedTime
+  }
+  recordUsage(ctx, organizationCacheKey(serverAPIKeyHash), lastUsedTime, recordServerAPIKeyUseTask{
+    organizationID: organization.ID,
+    serverAPIKeyHash: serverAPIKeyHash,
+    now: time.Now().UTC().Unix(),
+  })
+}
+
+func recordServerAPIKeyUseNoCache(ctx Context, organizationID int64, serverAPIKeyHash string, now int64) error {
+  return ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    organization, err := tx.GetOrganization(organizationID)
+    if err == ErrOrganizationNotFound {
+      return nil
+    } else if err != nil {
+      return err
+    }
+    if serverAPIKeyHash == organization.ServerAPIKeyHash {
+      organization.ServerAPIKeyLastUsedTime = now
+    } else if serverAPIKeyHash == organization.PreviousServerAPIKeyHash {
+      organization.PreviousServerAPIKeyLastUsedTime = now
+    } else {
+      return nil
+    }
+    _, err = tx.PutOrganization(organization)
+    return err
+  })
+}
+
+// Issues the organization a new server API key, returned here and nowhere else. The current key keeps working for
+// gracePeriodSec so agents can be moved over, or stops working straight away when it is 0. Any key that was already on
+// its way out stops working straight away.
+func RotateServerAPIKeyNoCache(ctx Context, organizationID int64, gracePeriodSec int) (storage.Organization, string, error) {
+  if gracePeriodSec < 0 || gracePeriodSec > MaxServerAPIKeyGracePeriodSec {
+    return storage.Organization{}, "", ErrInvalidGracePeriod
+  }
+
+  serverAPIKey, err := newServerAPIKey()
+  if err != nil {
+    return storage.Organization{}, "", err
+  }
+
+  organization, err := updateServerAPIKeyNoCache(ctx, organizationID, func (organization *storage.Organization, now int64) {
+    // Plain text keys from before keys were hashed are hashed on their way out
+    if organization.ServerAPIKey != "" {
+      organization.ServerAPIKeyHash = hashSecret(organization.ServerAPIKey)
+    }
+    organization.PreviousServerAPIKey = ""
+    organization.PreviousServerAPIKeyHash = ""
+    organization.PreviousServerAPIKeyExpiresTime = 0
+    organization.PreviousServerAPIKeyLastUsedTime = 0
+    if organization.ServerAPIKeyHash != "" && gracePeriodSec > 0 {
+      organization.PreviousServerAPIKeyHash = organization.ServerAPIKeyHash
+      organization.PreviousServerAPIKeyExpiresTime = now + int64(gracePeriodSec)
+      organization.PreviousServerAPIKeyLastUsedTime = organization.ServerAPIKeyLastUsedTime
+    }
+    setServerAPIKey(organization, serverAPIKey, now)
+  })
+  if err != nil {
+    return organization, "", err
+  }
+  return organization, serverAPIKey, nil
+}
+
+// Ends the grace period of a rotated out server API key immediately.
+func RevokePreviousServerAPIKeyNoCache(ctx Context, organizationID int64) (storage.Organization, error) {
+  return updateServerAPIKeyNoCache(ctx, organizationID, func (organization *storage.Organization, now int64) {
+    organization.PreviousServerAPIKey = ""
+    organization.PreviousServerAPIKeyHash = ""
+    organization.PreviousServerAPIKeyExpiresTime = 0
+    organization.PreviousServerAPIKeyLastUsedTime = 0
+  })
+}
+
+func updateServerAPIKeyNoCache(ctx Context, organizationID int64, update func(*storage.Organization, int64)) (storage.Organization, error) {
+  var organization storage.Organization
+  var replaced storage.Organization
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if organization, err = tx.GetOrganization(organizationID); err != nil {
+      return err
+    }
+
+    replaced = organization
+    update(&organization, time.Now().UTC().Unix())
+    organization, err = tx.PutOrganization(organization)
+    return err
+  })
+  if err != nil {
+    return organization, err
+  }
+
+  // Both the keys that were live before and any still live now must be looked up afresh
+  if replaced.ServerAPIKey != "" {
+    replaced.ServerAPIKeyHash = hashSecret(replaced.ServerAPIKey)
+  }
+  if replaced.PreviousServerAPIKey != "" {
+    replaced.PreviousServerAPIKeyHash = hashSecret(replaced.PreviousServerAPIKey)
+  }
+  clearServerAPIKeyCache(ctx, replaced)
+  clearServerAPIKeyCache(ctx, organization)
+
+  return organization, nil
+}
@@ -0,0 +1,137 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "time"
+)
+
+var ErrInvocationNotPendingApproval = errors.New("Invocation is not waiting for approval")
+var ErrApprovalExpired = errors.New("Invocation waited too long for approval and has expired")
+var ErrSelfApproval = errors.New("Invocations must be reviewed by someone other than the person who requested them")
+var ErrInvalidApprovalExpiry = errors.New("approvalExpirySec must be between 0 and 604800")
+
+// How long an invocation of a command that requires approval waits for a reviewer when the command doesn't say.
+const DefaultApprovalExpirySec = 24 * 60 * 60
+const MaxApprovalExpirySec = 7 * 24 * 60 * 60
+
+func ValidateApprovalExpiry(approvalExpirySec int) error {
+  if approvalExpirySec < 0 || approvalExpirySec > MaxApprovalExpirySec {
+    return ErrInvalidApprovalExpiry
+  }
+  return nil
+}
+
+// Holds a new invocation back for review if its command requires approval.
+func requireApproval(command storage.Command, invocation *storage.Invocation) {
+  if !command.RequiresApproval {
+    return
+  }
+
+  expirySec := command.ApprovalExpirySec
+  if expirySec <= 0 {
+    expirySec = DefaultApprovalExpirySec
+  }
+  invocation.State = InvocationStatePendingApproval
+  invocation.ApprovalExpiresTime = invocation.CreatedTime + int64(expirySec)
+}
+
+// Approves or rejects an invocation that is waiting for approval. The reviewer must be someone other than the
+// requester. An approved invocation is queued for its server like any other, a rejected one never runs.
+func ReviewInvocationNoCache(ctx Context, user storage.User, invocationID int64, approve bool, comment string) (storage.Invocation, error) {
+  var invocation storage.Invocation
+  var server storage.Server
+  expired := false
+
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    expired = false
+    if invocation, err = tx.GetInvocation(invocationID); err != nil {
+      return err
+    }
+
+    now := time.Now().UTC().Unix()
+    if invocation.OrganizationID != user.OrganizationID {
+      return ErrInvocationNotFound
+    } else if invocation.State != InvocationStatePendingApproval {
+      return ErrInvocationNotPendingApproval
+    } else if invocation.UserID == user.ID {
+      return ErrSelfApproval
+    } else if now > invocation.ApprovalExpiresTime {
+      // Store the expiry rather than failing the transaction so it sticks
+      invocation.State = InvocationStateExpired
+      expired = true
+      _, err := tx.PutInvocation(invocation)
+      return err
+    }
+
+    invocation.ReviewedByUserID = user.ID
+    invocation.ReviewedByEmail = user.Email
+    invocation.ReviewComment = comment
+    invocation.ReviewedTime = now
+    if !approve {
+      invocation.State = InvocationStateRejected
+      _, err := tx.PutInvocation(invocation)
+      return err
+    }
+
+    invocation.State = InvocationStateQueued
+    if _, err := tx.PutInvocation(invocation); err != nil {
+      return err
+    }
+    if server, err = tx.GetServer(invocation.ServerID); err != nil {
+      return err
+    }
+    server.PendingCommands++
+    _, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return invocation, err
+  } else if expired {
+    return invocation, ErrApprovalExpired
+  }
+
+  if invocation.State == InvocationStateQueued {
+    ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+    signalServerQueue(ctx, server.ID)
+  }
+  return invocation, nil
+}
+
+// Marks every invocation whose approval window has passed as expired. Driven by cron.
+func ExpireApprovalsNoCache(ctx Context, now time.Time) (int, error) {
+  nowUnix := now.UTC().Unix()
+
+  invocationIDs, err := ctx.Storage().GetExpiredApprovalIDs(nowUnix)
+  if err != nil {
+    return 0, err
+  }
+
+  expired := 0
+  for _, invocationID := range invocationIDs {
+    var changed bool
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      changed = false
+      invocation, err := tx.GetInvocation(invocationID)
+      if err != nil {
+        return err
+      }
+      if invocation.State != InvocationStatePendingApproval || invocation.ApprovalExpiresTime >= nowUnix {
+        return nil
+      }
+      invocation.State = InvocationStateExpired
+      _, err = tx.PutInvocation(invocation)
+      changed = err == nil
+      return err
+    })
+    if err != nil {
+      return expired, err
+    }
+    if changed {
+      expired++
+    }
+  }
+
+  return expired, nil
+}
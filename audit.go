@@ -0,0 +1,282 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "reflect"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var ErrAuditOrganizationMismatch = errors.New("Audit events must belong to the same organization")
+
+// How many events a single audit query returns when no limit is given, and the most it will ever return.
+const (
+  DefaultAuditLimit = 50
+  MaxAuditLimit = 500
+)
+
+// What an audit event's target is. These are the datastore kinds the targets are kept as on App Engine, so events
+// recorded before there was a standalone server filter the same way.
+const (
+  AuditKindUser = "User"
+  AuditKindOrganization = "Organization"
+  AuditKindInvitation = "Invitation"
+  AuditKindServer = "Server"
+  AuditKindCommand = "Command"
+  AuditKindInvocation = "Invocation"
+  AuditKindSchedule = "Schedule"
+  AuditKindEnrollmentToken = "EnrollmentToken"
+  AuditKindPersonalAccessToken = "PersonalAccessToken"
+  AuditKindWebhook = "Webhook"
+  AuditKindWebhookDelivery = "WebhookDelivery"
+)
+
+type AuditChange struct {
+  From interface{} `json:"from,omitempty"`
+  To interface{} `json:"to,omitempty"`
+}
+
+type AuditFilter struct {
+  ActorUserID int64
+  Action string
+  TargetKind string
+  TargetID int64
+  Since int64
+  Until int64
+  Before int64
+  Limit int
+}
+
+type AuditVerification struct {
+  Valid bool `json:"valid"`
+  Events int64 `json:"events"`
+  BrokenSequence int64 `json:"brokenSequence,omitempty"`
+  Reason string `json:"reason,omitempty"`
+}
+
+// Each event carries the hash of the one before it so an edited, removed or reordered event breaks the chain from that
+// point on.
+func auditEventHash(event storage.AuditEvent) string {
+  fields := []string {
+    event.PreviousHash,
+    strconv.FormatInt(event.Sequence, 10),
+    strconv.FormatInt(event.OrganizationID, 10),
+    strconv.FormatInt(event.Time, 10),
+    strconv.FormatInt(event.ActorUserID, 10),
+    event.ActorEmail,
+    event.Action,
+    event.TargetKind,
+    strconv.FormatInt(event.TargetID, 10),
+    event.RequestID,
+    event.SourceIP,
+    event.Diff,
+  }
+  // Length prefixes stop two different events hashing the same by moving text between neighbouring fields
+  hash := sha256.New()
+  for _, field := range fields {
+    hash.Write([]byte(strconv.Itoa(len(field)) + ":" + field + "\n"))
+  }
+  return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Describes what changed between two versions of an entity as a JSON object of field name to from/to values. Either
+// side may be nil for a create or delete.
+func AuditDiff(before interface{}, after interface{}) (string, error) {
+  beforeFields, err := auditFields(before)
+  if err != nil {
+    return "", err
+  }
+  afterFields, err := auditFields(after)
+  if err != nil {
+    return "", err
+  }
+
+  changes := make(map[string]AuditChange)
+  for name, value := range beforeFields {
+    if afterValue, ok := afterFields[name]; !ok || !reflect.DeepEqual(value, afterValue) {
+      changes[name] = AuditChange{ From: value, To: afterFields[name] }
+    }
+  }
+  for name, value := range afterFields {
+    if _, ok := beforeFields[name]; !ok {
+      changes[name] = AuditChange{ To: value }
+    }
+  }
+
+  if len(changes) == 0 {
+    return "", nil
+  }
+  diff, err := json.Marshal(changes)
+  return string(diff), err
+}
+
+func auditFields(entity interface{}) (map[string]interface{}, error) {
+  fields := make(map[string]interface{})
+  if entity == nil {
+    return fields, nil
+  }
+
+  encoded, err := json.Marshal(entity)
+  if err != nil {
+    return fields, err
+  }
+  err = json.Unmarshal(encoded, &fields)
+  return fields, err
+}
+
+
+// Appends events to their organization's audit log in a single transaction, filling in the sequence and hashes, and the
+// time if it isn't set. All of the events must belong to the same organization.
+func RecordAuditEventsNoCache(ctx Context, events []storage.AuditEvent) ([]storage.AuditEvent, error) {
+  if len(events) == 0 {
+    return events, nil
+  }
+
+  organizationID := events[0].OrganizationID
+  now := time.Now().UTC().Unix()
+  for i := range events {
+    if events[i].OrganizationID != organizationID {
+      return events, ErrAuditOrganizationMismatch
+    }
+    if events[i].Time == 0 {
+      events[i].Time = now
+    }
+  }
+
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    chain, err := tx.GetAuditChain(organizationID)
+    if err != nil && err != storage.ErrAuditChainNotFound {
+      return err
+    }
+
+    for i := range events {
+      events[i].Sequence = chain.LastSequence + 1
+      events[i].PreviousHash = chain.LastHash
+      events[i].Hash = auditEventHash(events[i])
+
+      chain.LastSequence = events[i].Sequence
+      chain.LastHash = events[i].Hash
+    }
+
+    if err := tx.PutAuditEvents(events); err != nil {
+      return err
+    }
+    return tx.PutAuditChain(organizationID, chain)
+  })
+  if err != nil {
+    return events, err
+  }
+
+  for i := range events {
+    events[i].ID = events[i].Sequence
+  }
+  return events, nil
+}
+
+// Lists the newest audit events in the user's current organization that match the filter. Events are scanned newest
+// first, so Before can be set to the lowest sequence seen to fetch the next page.
+func GetAuditEventsNoCache(ctx Context, user storage.User, filter AuditFilter) ([]storage.AuditEvent, error) {
+  events := []storage.AuditEvent {}
+
+  limit := filter.Limit
+  if limit <= 0 {
+    limit = DefaultAuditLimit
+  } else if limit > MaxAuditLimit {
+    limit = MaxAuditLimit
+  }
+
+  // Events are read a page at a time, newest first, until enough match
+  before := filter.Before
+  for len(events) < limit {
+    page, err := ctx.Storage().GetAuditEvents(user.OrganizationID, before, MaxAuditLimit)
+    if err != nil {
+      return events, err
+    } else if len(page) == 0 {
+      break
+    }
+
+    for _, event := range page {
+      // Sequences only ever go up with time so nothing older can match once we pass Since
+      if filter.Since > 0 && event.Time < filter.Since {
+        return events, nil
+      }
+      if (filter.Until > 0 && event.Time > filter.Until) ||
+          (filter.ActorUserID != 0 && event.ActorUserID != filter.ActorUserID) ||
+          (filter.Action != "" && event.Action != filter.Action && !strings.HasPrefix(event.Action, filter.Action + ".")) ||
+          (filter.TargetKind != "" && event.TargetKind != filter.TargetKind) ||
+          (filter.TargetID != 0 && event.TargetID != filter.TargetID) {
+        continue
+      }
+
+      events = append(events, event)
+      if len(events) == limit {
+        break
+      }
+    }
+    before = page[len(page) - 1].Sequence
+    if before <= 1 {
+      break
+    }
+  }
+
+  return events, nil
+}
+
+// Walks the user's current organization's audit log from the start, recomputing every hash. Reports the first event
+// that was altered, removed or inserted out of order.
+func VerifyAuditChainNoCache(ctx Context, user storage.User) (AuditVerification, error) {
+  var verification AuditVerification
+  chain, err := ctx.Storage().GetAuditChain(user.OrganizationID)
+  if err == storage.ErrAuditChainNotFound {
+    verification.Valid = true
+    return verification, nil
+  } else if err != nil {
+    return verification, err
+  }
+
+  broken := func (sequence int64, reason string) (AuditVerification, error) {
+    verification.BrokenSequence = sequence
+    verification.Reason = reason
+    return verification, nil
+  }
+
+  previousHash := ""
+  after := int64(0)
+  for {
+    page, err := ctx.Storage().GetAuditEventsAfter(user.OrganizationID, after, MaxAuditLimit)
+    if err != nil {
+      return verification, err
+    } else if len(page) == 0 {
+      break
+    }
+
+    for _, event := range page {
+      expectedSequence := verification.Events + 1
+      if event.ID != event.Sequence || event.Sequence != expectedSequence {
+        return broken(expectedSequence, "Event is missing or out of order")
+      } else if event.OrganizationID != user.OrganizationID {
+        return broken(event.Sequence, "Event belongs to another organization")
+      } else if event.PreviousHash != previousHash {
+        return broken(event.Sequence, "Event does not follow the previous event")
+      } else if event.Hash != auditEventHash(event) {
+        return broken(event.Sequence, "Event has been modified")
+      }
+
+      previousHash = event.Hash
+      verification.Events++
+    }
+    after = page[len(page) - 1].Sequence
+  }
+
+  if verification.Events != chain.LastSequence || previousHash != chain.LastHash {
+    return broken(verification.Events + 1, "Events have been removed from the end of the log")
+  }
+
+  verification.Valid = true
+  return verification, nil
+}
@@ -1,132 +1,271 @@
+// +build appengine
+
 package biboop
 
 import (
   "appengine"
-  "appengine/user"
+  "appengine/delay"
   "appengine/urlfetch"
+  "appengine/user"
+  "errors"
+  "github.com/dbrain/biboop-server/jwtauth"
+  "github.com/dbrain/biboop-server/storage"
   "github.com/dbrain/soggy"
   "strings"
   "net/http"
   "encoding/json"
   "io/ioutil"
+  "net/url"
+  "os"
   "strconv"
+  "time"
 )
 
-type AppEngineWebMiddleware struct {}
-func (middleware *AppEngineWebMiddleware) Execute(ctx *soggy.Context) {
-  aeCtx := appengine.NewContext(ctx.Req.Request)
-  ctx.Env["aeCtx"] = aeCtx
-
-  googleUser := user.Current(aeCtx)
-  if googleUser != nil {
-    ctx.Env["googleUser"] = googleUser
-    biboopUser, err := GetOrCreateUser(aeCtx, googleUser.Email)
-    if err != nil {
-      ctx.Next(err)
-      return
-    }
-    ctx.Env["user"] = biboopUser
+var errUnknownTask = errors.New("Unknown task")
+
+// The request's appengine.Context, with storage in the datastore and caching in memcache.
+type appEngineContext struct {
+  appengine.Context
+}
+
+func newAppEngineContext(ctx appengine.Context) *appEngineContext {
+  return &appEngineContext{ Context: ctx }
+}
+
+func (ctx *appEngineContext) Storage() storage.Storage {
+  return storage.NewAppEngineStorage(ctx.Context)
+}
+
+func (ctx *appEngineContext) Cache() storage.Cache {
+  return storage.NewAppEngineCache(ctx.Context)
+}
+
+func (ctx *appEngineContext) HTTPClient() *http.Client {
+  return urlfetch.Client(ctx.Context)
+}
+
+// Tasks run in the task queue through delay, each under the name it has always had so tasks queued before an upgrade
+// still run after it.
+var recordServerAPIKeyUseLater = delay.Func("recordServerAPIKeyUse", func (ctx appengine.Context, organizationID int64, serverAPIKeyHash string, now int64) error {
+  return recordServerAPIKeyUseTask{ organizationID: organizationID, serverAPIKeyHash: serverAPIKeyHash, now: now }.Run(newAppEngineContext(ctx))
+})
+
+var recordPersonalAccessTokenUseLater = delay.Func("recordPersonalAccessTokenUse", func (ctx appengine.Context, personalAccessTokenID int64, now int64) error {
+  return recordPersonalAccessTokenUseTask{ tokenID: personalAccessTokenID, now: now }.Run(newAppEngineContext(ctx))
+})
+
+var recordAuditEventsLater = delay.Func("recordAuditEvents", func (ctx appengine.Context, events []storage.AuditEvent) error {
+  return recordAuditEventsTask{ events: events }.Run(newAppEngineContext(ctx))
+})
+
+func (ctx *appEngineContext) Later(task Task) error {
+  switch task := task.(type) {
+    case recordServerAPIKeyUseTask:
+      return recordServerAPIKeyUseLater.Call(ctx.Context, task.organizationID, task.serverAPIKeyHash, task.now)
+    case recordPersonalAccessTokenUseTask:
+      return recordPersonalAccessTokenUseLater.Call(ctx.Context, task.tokenID, task.now)
+    case recordAuditEventsTask:
+      return recordAuditEventsLater.Call(ctx.Context, task.events)
   }
+  return errUnknownTask
+}
+
+// Signs people in to the web pages with the users service and to the API with Google bearer tokens, or JWTs from the
+// issuers in auth.json.
+type appEngineRuntime struct {}
 
-  ctx.Next(nil)
+func (runtime *appEngineRuntime) NewContext(req *http.Request) Context {
+  return newAppEngineContext(appengine.NewContext(req))
 }
 
-type AppEngineApiMiddleware struct{}
-func (middleware *AppEngineApiMiddleware) Execute(ctx *soggy.Context) {
-  aeCtx := appengine.NewContext(ctx.Req.Request)
-  urlfetchClient := urlfetch.Client(aeCtx)
-  ctx.Env["aeCtx"] = aeCtx
-  ctx.Env["urlfetchClient"] = urlfetchClient
+func (runtime *appEngineRuntime) IdentifyWebRequest(ctx Context, req *http.Request) (*Identity, error) {
+  googleUser := user.Current(ctx.(*appEngineContext).Context)
+  if googleUser == nil {
+    return nil, nil
+  }
+  return &Identity{ Email: googleUser.Email }, nil
+}
 
-  authHeader := ctx.Req.Request.Header.Get("Authorization");
-  if strings.HasPrefix(authHeader, "Bearer ") {
-    googleUser := loadUserDetails(ctx, authHeader, urlfetchClient)
-    if googleUser != nil {
-      ctx.Env["googleUser"] = googleUser
-      biboopUser, err := GetOrCreateUser(aeCtx, googleUser["email"].(string))
-      if err != nil {
-        ctx.Next(err)
-        return
-      }
+func (runtime *appEngineRuntime) IdentifyApiRequest(ctx Context, req *http.Request) (*Identity, error) {
+  authHeader := req.Header.Get("Authorization")
+  if !strings.HasPrefix(authHeader, "Bearer ") {
+    return nil, nil
+  }
+  if token := strings.TrimPrefix(authHeader, "Bearer "); tokenVerifier != nil && jwtauth.LooksLikeJWT(token) {
+    return verifyLocalToken(ctx, token)
+  }
+  return loadUserDetails(ctx, authHeader)
+}
 
-      ctx.Env["user"] = biboopUser
-      ctx.Next(nil)
-    }
-  } else {
-    ctx.Next(nil)
+func (runtime *appEngineRuntime) LoginURL(ctx Context, dest string) (string, error) {
+  return user.LoginURL(ctx.(*appEngineContext).Context, dest)
+}
+
+func (runtime *appEngineRuntime) LogoutURL(ctx Context, dest string) (string, error) {
+  return user.LogoutURL(ctx.(*appEngineContext).Context, dest)
+}
+
+// App Engine strips this header from anything that doesn't come from its cron service.
+func (runtime *appEngineRuntime) IsCronRequest(req *http.Request) bool {
+  return req.Header.Get("X-AppEngine-Cron") == "true"
+}
+
+// JWT bearer tokens from the issuers in auth.json, when it exists, are verified locally instead of by asking Google.
+var tokenVerifier *jwtauth.Verifier
+
+const authConfigPath = "auth.json"
+
+type AuthConfig struct {
+  Issuers []jwtauth.IssuerConfig `json:"issuers"`
+}
+
+func loadTokenVerifier(path string) (*jwtauth.Verifier, error) {
+  file, err := os.Open(path)
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
   }
+  defer file.Close()
+
+  var authConfig AuthConfig
+  if err := json.NewDecoder(file).Decode(&authConfig); err != nil {
+    return nil, err
+  }
+  return jwtauth.NewVerifier(authConfig.Issuers)
 }
 
-func loadUserDetails(ctx *soggy.Context, authHeader string, urlfetchClient *http.Client) map[string]interface{} {
-  req, _ := http.NewRequest("GET", "https://www.googleapis.com/oauth2/v3/userinfo?alt=json", nil)
-  req.Header.Add("Authorization", authHeader)
-  resp, err := urlfetchClient.Do(req)
-  if err != nil || resp.StatusCode != http.StatusOK {
-      sendAuthFailure(ctx.Res, http.StatusUnauthorized, "authorization_failed")
-  } else {
-    body, err := ioutil.ReadAll(resp.Body)
-    if err != nil {
-      sendAuthFailure(ctx.Res, http.StatusUnauthorized, "authorization_parse_failed")
-    } else {
-      var googleUser map[string]interface{}
-      err := json.Unmarshal(body, &googleUser)
-      if err != nil {
-        sendAuthFailure(ctx.Res, http.StatusUnauthorized, "authorization_body_parse_failed")
-      } else {
-        return googleUser
-      }
-    }
+// Returns who a JWT bearer token signed by a configured issuer belongs to.
+func verifyLocalToken(ctx Context, token string) (*Identity, error) {
+  claims, email, err := tokenVerifier.Verify(token, ctx.HTTPClient())
+  if err != nil {
+    ctx.Infof("Rejected bearer token: %v", err)
+    return nil, AuthFailureInvalid
   }
-  return nil
+  name, _ := claims["name"].(string)
+  return &Identity{ Email: email, Name: name }, nil
 }
 
-func sendAuthFailure(res *soggy.Response, status int, reason string) {
-  res.Set("Content-Type", "application/json; charset=utf-8")
-  jsonOut, err := json.Marshal(map[string]interface{} { "error": reason })
-  if err == nil {
-    res.Set("Content-Length", strconv.Itoa(len(jsonOut)))
-    res.WriteHeader(status)
-    _, err = res.Write(jsonOut)
+// How long a verified Google token is trusted before Google is asked again, at most. Tokens that expire sooner are
+// cached until they expire and tokens Google won't give an expiry for aren't cached at all.
+const googleTokenCacheExpiration = 5 * time.Minute
+
+// How long Google's refusal of a token is remembered, so a client retrying with a bad token doesn't reach Google each
+// time. Errors talking to Google aren't remembered as they say nothing about the token.
+const googleTokenFailureCacheExpiration = 30 * time.Second
+
+// What a token verified as. Only one of User and Failure is set.
+type googleTokenCacheEntry struct {
+  User *Identity
+  Failure string
+}
+
+func googleTokenCacheKey(authHeader string) string {
+  return "GoogleToken-" + hashSecret(authHeader)
+}
+
+// Returns who a Google bearer token belongs to. Verified tokens are cached by their hash so every API call doesn't wait
+// on Google.
+func loadUserDetails(ctx Context, authHeader string) (*Identity, error) {
+  cacheKey := googleTokenCacheKey(authHeader)
+
+  var cached googleTokenCacheEntry
+  if err := ctx.Cache().Get(cacheKey, &cached); err == nil && (cached.User != nil || cached.Failure != "") {
+    if cached.Failure != "" {
+      return nil, AuthFailure(cached.Failure)
+    }
+    return cached.User, nil
+  }
+
+  googleUser, failure, expiration := fetchUserDetails(ctx, authHeader)
+  if expiration > 0 {
+    ctx.Cache().Set(cacheKey, googleTokenCacheEntry{ User: googleUser, Failure: failure }, expiration)
   }
+  if failure != "" {
+    return nil, AuthFailure(failure)
+  }
+  return googleUser, nil
 }
 
-func startWebServer() *soggy.Server {
-  webServer := soggy.NewServer("/")
+// Asks Google who a bearer token belongs to. Returns the user or the reason it failed, and how long the answer can
+// be cached for, which is zero if it shouldn't be.
+func fetchUserDetails(ctx Context, authHeader string) (*Identity, string, time.Duration) {
+  req, _ := http.NewRequest("GET", "https://www.googleapis.com/oauth2/v3/userinfo?alt=json", nil)
+  req.Header.Add("Authorization", authHeader)
+  resp, err := ctx.HTTPClient().Do(req)
+  if err != nil {
+    return nil, "authorization_failed", 0
+  }
+  defer resp.Body.Close()
 
-  webServer.Get("/", WebIndex)
-  webServer.Get("/dashboard", WebUserRequired, WebDashboard)
-  webServer.Get("/me", WebUserRequired, WebMe)
-  webServer.Get("/logout", WebLogout)
+  if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden {
+    return nil, "authorization_failed", googleTokenFailureCacheExpiration
+  } else if resp.StatusCode != http.StatusOK {
+    return nil, "authorization_failed", 0
+  }
 
-  webServer.All(soggy.ANY_PATH, func (context *soggy.Context) (int, interface{}) {
-    return 404, map[string]interface{} { "error": "Path not found" }
-  })
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, "authorization_parse_failed", 0
+  }
+  var googleUser Identity
+  if err := json.Unmarshal(body, &googleUser); err != nil {
+    return nil, "authorization_body_parse_failed", 0
+  }
 
-  webServer.Use(&AppEngineWebMiddleware{}, webServer.Router)
-  return webServer
+  expiration := fetchTokenExpiresIn(ctx, strings.TrimPrefix(authHeader, "Bearer "), time.Now().UTC())
+  if expiration > googleTokenCacheExpiration {
+    expiration = googleTokenCacheExpiration
+  }
+  return &googleUser, "", expiration
 }
 
-func startApiServer() *soggy.Server {
-  apiServer := soggy.NewServer("/api")
-  apiServer.Get("/me", ApiUserRequired, ApiMe)
-  apiServer.Post("/server/poll", ApiServerPoll)
-  apiServer.Post("/server/update", ApiServerUpdate)
-  apiServer.Get("/servers", ApiUserRequired, ApiGetServers)
-  apiServer.Get("/commands", ApiUserRequired, ApiGetCommands)
-  apiServer.Post("/commands", ApiUserRequired, ApiCreateCommand)
+// Returns how long until a token expires, or zero if it already has or Google won't say.
+func fetchTokenExpiresIn(ctx Context, token string, now time.Time) time.Duration {
+  resp, err := ctx.HTTPClient().Get("https://www.googleapis.com/oauth2/v3/tokeninfo?access_token=" + url.QueryEscape(token))
+  if err != nil {
+    ctx.Warningf("Failed to look up token expiry: %v", err)
+    return 0
+  }
+  defer resp.Body.Close()
 
-  apiServer.All(soggy.ANY_PATH, func (context *soggy.Context) (int, interface{}) {
-    return 404, map[string]interface{} { "error": "Path not found" }
-  })
+  var tokenInfo struct {
+    Exp string `json:"exp"`
+    ExpiresIn string `json:"expires_in"`
+  }
+  if resp.StatusCode != http.StatusOK {
+    return 0
+  } else if err := json.NewDecoder(resp.Body).Decode(&tokenInfo); err != nil {
+    return 0
+  }
+  return tokenExpiresIn(tokenInfo.Exp, tokenInfo.ExpiresIn, now)
+}
 
-  apiServer.Use(&AppEngineApiMiddleware{}, apiServer.Router)
-  return apiServer
+// Works out how long a token has left from tokeninfo's exp, the time it expires, or failing that its expires_in.
+// Returns zero if neither can be read or the token has less than a second left, which memcache would keep forever.
+func tokenExpiresIn(exp string, expiresIn string, now time.Time) time.Duration {
+  var remaining time.Duration
+  if expiresTime, err := strconv.ParseInt(exp, 10, 64); err == nil {
+    remaining = time.Unix(expiresTime, 0).Sub(now)
+  } else if expiresInSec, err := strconv.ParseInt(expiresIn, 10, 64); err == nil {
+    remaining = time.Duration(expiresInSec) * time.Second
+  }
+  if remaining < time.Second {
+    return 0
+  }
+  return remaining
 }
 
 func startServer() {
+  var err error
+  if tokenVerifier, err = loadTokenVerifier(authConfigPath); err != nil {
+    panic(err)
+  }
+
+  runtime := &appEngineRuntime{}
   app := soggy.NewApp()
-  app.AddServers(startWebServer())
-  app.AddServers(startApiServer())
+  app.AddServers(NewWebServer(runtime))
+  app.AddServers(NewApiServer(runtime))
   app.BindHandlers()
 }
 
@@ -0,0 +1,81 @@
+// +build !appengine
+
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "github.com/dbrain/biboop-server/jwtauth"
+  "os"
+)
+
+type Config struct {
+  // Address to listen on, host:port
+  Listen string `json:"listen,omitempty"`
+  // File to keep everything in, everything is kept in memory and lost on exit when empty
+  DataFile string `json:"dataFile,omitempty"`
+  ViewPath string `json:"viewPath,omitempty"`
+  StaticPath string `json:"staticPath,omitempty"`
+  Identity IdentityConfig `json:"identity,omitempty"`
+}
+
+type IdentityConfig struct {
+  // Which identity provider works out who made each request
+  Provider string `json:"provider,omitempty"`
+  // The request header a trusted proxy puts the signed in user's email in, for the header provider
+  Header string `json:"header,omitempty"`
+  // Bearer tokens and the email each belongs to, for the token provider
+  Tokens map[string]string `json:"tokens,omitempty"`
+  // Issuers whose JWTs are trusted and where their keys are, for the oidc provider
+  Issuers []jwtauth.IssuerConfig `json:"issuers,omitempty"`
+}
+
+func defaultConfig() Config {
+  return Config{
+    Listen: "127.0.0.1:8080",
+    ViewPath: "./views",
+    StaticPath: "./public",
+    // The header provider trusts whoever can reach the server, so it is only used when asked for along with its header
+    Identity: IdentityConfig{ Provider: IdentityProviderToken },
+  }
+}
+
+// Builds the config from the defaults, then the config file if one is given, then any flags that were set.
+func loadConfig(args []string) (Config, error) {
+  config := defaultConfig()
+
+  flags := flag.NewFlagSet("biboop-server", flag.ExitOnError)
+  configPath := flags.String("config", "", "JSON config file")
+  listen := flags.String("listen", config.Listen, "address to listen on")
+  dataFile := flags.String("data", "", "file to keep data in, in memory only when empty")
+  viewPath := flags.String("views", config.ViewPath, "directory holding the web views")
+  staticPath := flags.String("public", config.StaticPath, "directory holding the static web files")
+  identityProvider := flags.String("identity", config.Identity.Provider, "identity provider to use")
+  identityHeader := flags.String("identity-header", config.Identity.Header, "header holding the user's email for the header identity provider")
+  if err := flags.Parse(args); err != nil {
+    return config, err
+  }
+
+  if *configPath != "" {
+    file, err := os.Open(*configPath)
+    if err != nil {
+      return config, err
+    }
+    defer file.Close()
+    if err := json.NewDecoder(file).Decode(&config); err != nil {
+      return config, err
+    }
+  }
+
+  flags.Visit(func (set *flag.Flag) {
+    switch set.Name {
+      case "listen": config.Listen = *listen
+      case "data": config.DataFile = *dataFile
+      case "views": config.ViewPath = *viewPath
+      case "public": config.StaticPath = *staticPath
+      case "identity": config.Identity.Provider = *identityProvider
+      case "identity-header": config.Identity.Header = *identityHeader
+    }
+  })
+  return config, nil
+}
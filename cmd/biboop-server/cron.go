@@ -0,0 +1,41 @@
+// +build !appengine
+
+package main
+
+import (
+  "github.com/dbrain/biboop-server"
+  "log"
+  "time"
+)
+
+// Does what App Engine's cron does with cron.yaml, running each job in the background on the same schedule.
+func startCron(runtime *standaloneRuntime) {
+  runEvery(runtime, "liveness", time.Minute, func (ctx biboop.Context) error {
+    return biboop.CheckServerLivenessNoCache(ctx)
+  })
+  runEvery(runtime, "schedules", time.Minute, func (ctx biboop.Context) error {
+    _, err := biboop.RunDueSchedulesNoCache(ctx, time.Now())
+    return err
+  })
+  runEvery(runtime, "webhooks", time.Minute, func (ctx biboop.Context) error {
+    _, err := biboop.DeliverWebhooksNoCache(ctx, ctx.HTTPClient(), time.Now())
+    return err
+  })
+  runEvery(runtime, "approvals", 5 * time.Minute, func (ctx biboop.Context) error {
+    _, err := biboop.ExpireApprovalsNoCache(ctx, time.Now())
+    return err
+  })
+}
+
+// Runs the job every interval, one run at a time. A failed run is logged and the job carries on.
+func runEvery(runtime *standaloneRuntime, name string, interval time.Duration, job func (biboop.Context) error) {
+  go func () {
+    ticks := time.Tick(interval)
+    for {
+      <-ticks
+      if err := job(&standaloneContext{ runtime: runtime }); err != nil {
+        log.Printf("ERROR: Cron job %s failed: %v", name, err)
+      }
+    }
+  }()
+}
@@ -0,0 +1,139 @@
+// +build !appengine
+
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "github.com/dbrain/biboop-server"
+  "github.com/dbrain/biboop-server/jwtauth"
+  "net/http"
+  "strings"
+  "time"
+)
+
+var ErrUnknownIdentityProvider = errors.New("Unknown identity provider")
+var ErrInvalidCredentials = errors.New("Credentials are invalid")
+
+const (
+  IdentityProviderHeader = "header"
+  IdentityProviderToken = "token"
+  IdentityProviderOIDC = "oidc"
+)
+
+// How long fetching an issuer's keys may take.
+const jwksFetchTimeout = 10 * time.Second
+
+
+// IdentityProvider stands in for App Engine's users service and Google's userinfo lookup. Identify returns nil for a
+// request that carries no credentials and ErrInvalidCredentials, or another error, for one whose credentials are no
+// good.
+type IdentityProvider interface {
+  Identify(req *http.Request) (*biboop.Identity, error)
+}
+
+// Identity providers by the name they are configured with.
+var identityProviders = map[string]func(IdentityConfig) (IdentityProvider, error) {
+  IdentityProviderHeader: newHeaderIdentityProvider,
+  IdentityProviderToken: newTokenIdentityProvider,
+  IdentityProviderOIDC: newOIDCIdentityProvider,
+}
+
+func newIdentityProvider(config IdentityConfig) (IdentityProvider, error) {
+  newProvider, ok := identityProviders[config.Provider]
+  if !ok {
+    return nil, ErrUnknownIdentityProvider
+  }
+  return newProvider(config)
+}
+
+// Trusts a header set by an authenticating proxy in front of biboop. The proxy must strip the header from anything
+// it passes through.
+type HeaderIdentityProvider struct {
+  header string
+}
+
+func newHeaderIdentityProvider(config IdentityConfig) (IdentityProvider, error) {
+  if config.Header == "" {
+    return nil, errors.New("The header identity provider needs a header")
+  }
+  return &HeaderIdentityProvider{ header: config.Header }, nil
+}
+
+func (provider *HeaderIdentityProvider) Identify(req *http.Request) (*biboop.Identity, error) {
+  email := strings.TrimSpace(req.Header.Get(provider.header))
+  if email == "" {
+    return nil, nil
+  }
+  return &biboop.Identity{ Email: email }, nil
+}
+
+// Accepts bearer tokens from a fixed list, each belonging to one email. Only hashes of the tokens are kept.
+type TokenIdentityProvider struct {
+  emails map[string]string
+}
+
+func hashToken(token string) string {
+  hash := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(hash[:])
+}
+
+func newTokenIdentityProvider(config IdentityConfig) (IdentityProvider, error) {
+  if len(config.Tokens) == 0 {
+    return nil, errors.New("The token identity provider needs at least one token")
+  }
+  provider := &TokenIdentityProvider{ emails: make(map[string]string) }
+  for token, email := range config.Tokens {
+    provider.emails[hashToken(token)] = email
+  }
+  return provider, nil
+}
+
+func bearerToken(req *http.Request) string {
+  authHeader := req.Header.Get("Authorization")
+  if !strings.HasPrefix(authHeader, "Bearer ") {
+    return ""
+  }
+  return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+func (provider *TokenIdentityProvider) Identify(req *http.Request) (*biboop.Identity, error) {
+  token := bearerToken(req)
+  if token == "" {
+    return nil, nil
+  }
+  // Looked up by hash so how long the lookup takes says nothing about the token
+  email, ok := provider.emails[hashToken(token)]
+  if !ok {
+    return nil, ErrInvalidCredentials
+  }
+  return &biboop.Identity{ Email: email }, nil
+}
+
+// Accepts JWT bearer tokens signed by the configured issuers, checked locally against each issuer's keys.
+type OIDCIdentityProvider struct {
+  verifier *jwtauth.Verifier
+  client *http.Client
+}
+
+func newOIDCIdentityProvider(config IdentityConfig) (IdentityProvider, error) {
+  verifier, err := jwtauth.NewVerifier(config.Issuers)
+  if err != nil {
+    return nil, err
+  }
+  return &OIDCIdentityProvider{ verifier: verifier, client: &http.Client{ Timeout: jwksFetchTimeout } }, nil
+}
+
+func (provider *OIDCIdentityProvider) Identify(req *http.Request) (*biboop.Identity, error) {
+  token := bearerToken(req)
+  if token == "" {
+    return nil, nil
+  }
+  claims, email, err := provider.verifier.Verify(token, provider.client)
+  if err != nil {
+    return nil, err
+  }
+  name, _ := claims["name"].(string)
+  return &biboop.Identity{ Email: email, Name: name }, nil
+}
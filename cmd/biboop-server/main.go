@@ -0,0 +1,57 @@
+// +build !appengine
+
+// Command biboop-server runs biboop on an ordinary host instead of App Engine. It serves the same web pages and API,
+// and runs the jobs cron.yaml has App Engine run, itself. Data is kept in a local file, or only in memory, and an
+// identity provider stands in for Google sign in.
+//
+//     biboop-server -config /etc/biboop/config.json -data /var/lib/biboop/biboop.db
+//
+// Everything can also be set in a JSON config file given with -config, flags override the file. It listens on
+// 127.0.0.1:8080 and accepts the bearer tokens listed in the config unless told otherwise. The header identity
+// provider trusts a header set by a proxy, so it must be chosen with -identity header and given -identity-header, and
+// the server should only be reachable through that proxy.
+package main
+
+import (
+  "github.com/dbrain/biboop-server"
+  "github.com/dbrain/biboop-server/storage"
+  "github.com/dbrain/soggy"
+  "log"
+  "os"
+)
+
+func openStorage(config Config) (storage.Storage, error) {
+  if config.DataFile == "" {
+    log.Println("No data file given, nothing will be kept after exit")
+    return storage.NewMemoryStorage(), nil
+  }
+  return storage.OpenFileStorage(config.DataFile)
+}
+
+func main() {
+  config, err := loadConfig(os.Args[1:])
+  if err != nil {
+    log.Fatalln("Failed to load config:", err)
+  }
+
+  store, err := openStorage(config)
+  if err != nil {
+    log.Fatalln("Failed to open storage:", err)
+  }
+  identityProvider, err := newIdentityProvider(config.Identity)
+  if err != nil {
+    log.Fatalln("Failed to set up the", config.Identity.Provider, "identity provider:", err)
+  }
+
+  runtime := newStandaloneRuntime(store, identityProvider)
+  webServer, err := startWebServer(config, runtime)
+  if err != nil {
+    log.Fatalln("Failed to set up the web server:", err)
+  }
+
+  startCron(runtime)
+  app := soggy.NewApp()
+  app.AddServers(webServer)
+  app.AddServers(biboop.NewApiServer(runtime))
+  app.Listen(config.Listen)
+}
@@ -0,0 +1,153 @@
+// +build !appengine
+
+package main
+
+import (
+  "github.com/dbrain/biboop-server"
+  "github.com/dbrain/biboop-server/storage"
+  "github.com/dbrain/soggy"
+  "log"
+  "net/http"
+  "path/filepath"
+  "time"
+)
+
+// How long requests to other services, such as webhook deliveries, may take.
+const httpClientTimeout = 30 * time.Second
+
+// Tasks that fail are retried, backing off from a second and doubling up to a minute between attempts.
+const (
+  taskMinBackoff = time.Second
+  taskMaxBackoff = time.Minute
+)
+
+// Runs biboop on an ordinary host. Everything shares the one storage and cache, and an identity provider stands in for
+// App Engine's users service and Google sign in.
+type standaloneRuntime struct {
+  storage storage.Storage
+  cache storage.Cache
+  identityProvider IdentityProvider
+  client *http.Client
+}
+
+func newStandaloneRuntime(store storage.Storage, identityProvider IdentityProvider) *standaloneRuntime {
+  return &standaloneRuntime{
+    storage: store,
+    cache: storage.NewMemoryCache(),
+    identityProvider: identityProvider,
+    client: &http.Client{ Timeout: httpClientTimeout },
+  }
+}
+
+func (runtime *standaloneRuntime) NewContext(req *http.Request) biboop.Context {
+  return &standaloneContext{ runtime: runtime }
+}
+
+func (runtime *standaloneRuntime) IdentifyWebRequest(ctx biboop.Context, req *http.Request) (*biboop.Identity, error) {
+  return runtime.identify(ctx, req)
+}
+
+func (runtime *standaloneRuntime) IdentifyApiRequest(ctx biboop.Context, req *http.Request) (*biboop.Identity, error) {
+  return runtime.identify(ctx, req)
+}
+
+func (runtime *standaloneRuntime) identify(ctx biboop.Context, req *http.Request) (*biboop.Identity, error) {
+  identity, err := runtime.identityProvider.Identify(req)
+  if err != nil {
+    ctx.Infof("Rejected credentials: %v", err)
+    return nil, biboop.AuthFailureInvalid
+  }
+  return identity, nil
+}
+
+// Signing in and out is left to whatever sits in front of a standalone server, so there are no pages to send anyone to.
+func (runtime *standaloneRuntime) LoginURL(ctx biboop.Context, dest string) (string, error) {
+  return "", nil
+}
+
+func (runtime *standaloneRuntime) LogoutURL(ctx biboop.Context, dest string) (string, error) {
+  return "", nil
+}
+
+// Cron jobs run inside the server, see startCron, so no request is ever one of them.
+func (runtime *standaloneRuntime) IsCronRequest(req *http.Request) bool {
+  return false
+}
+
+type standaloneContext struct {
+  runtime *standaloneRuntime
+}
+
+func (ctx *standaloneContext) Debugf(format string, args ...interface{}) {
+  log.Printf("DEBUG: " + format, args...)
+}
+
+func (ctx *standaloneContext) Infof(format string, args ...interface{}) {
+  log.Printf("INFO: " + format, args...)
+}
+
+func (ctx *standaloneContext) Warningf(format string, args ...interface{}) {
+  log.Printf("WARNING: " + format, args...)
+}
+
+func (ctx *standaloneContext) Errorf(format string, args ...interface{}) {
+  log.Printf("ERROR: " + format, args...)
+}
+
+func (ctx *standaloneContext) Criticalf(format string, args ...interface{}) {
+  log.Printf("CRITICAL: " + format, args...)
+}
+
+func (ctx *standaloneContext) Storage() storage.Storage {
+  return ctx.runtime.storage
+}
+
+func (ctx *standaloneContext) Cache() storage.Cache {
+  return ctx.runtime.cache
+}
+
+func (ctx *standaloneContext) HTTPClient() *http.Client {
+  return ctx.runtime.client
+}
+
+// Runs the task in the background, retrying until it succeeds. Tasks still waiting when the server exits are lost.
+func (ctx *standaloneContext) Later(task biboop.Task) error {
+  go func () {
+    backoff := taskMinBackoff
+    for {
+      err := task.Run(&standaloneContext{ runtime: ctx.runtime })
+      if err == nil {
+        return
+      }
+      log.Printf("ERROR: Task %T failed, retrying in %v: %v", task, backoff, err)
+      time.Sleep(backoff)
+      if backoff *= 2; backoff > taskMaxBackoff {
+        backoff = taskMaxBackoff
+      }
+    }
+  }()
+  return nil
+}
+
+// soggy wants view and static paths relative to the working directory, absolute ones are used as they are.
+func setServerPath(server *soggy.Server, name string, path string) error {
+  if filepath.IsAbs(path) {
+    server.Config[name] = path
+    return nil
+  } else if name == soggy.CONFIG_VIEW_PATH {
+    return server.Config.SetViewPath(path)
+  }
+  return server.Config.SetStaticPath(path)
+}
+
+// The web server also serves the static files App Engine serves from app.yaml.
+func startWebServer(config Config, runtime *standaloneRuntime) (*soggy.Server, error) {
+  webServer := biboop.NewWebServer(runtime, soggy.NewStaticServerMiddleware("/"))
+  if err := setServerPath(webServer, soggy.CONFIG_VIEW_PATH, config.ViewPath); err != nil {
+    return nil, err
+  }
+  if err := setServerPath(webServer, soggy.CONFIG_STATIC_PATH, config.StaticPath); err != nil {
+    return nil, err
+  }
+  return webServer, nil
+}
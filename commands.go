@@ -0,0 +1,252 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "time"
+)
+
+var ErrCommandVersionConflict = errors.New("Command has changed since that version, fetch it again and reapply the change")
+var ErrCommandVersionNotFound = storage.ErrCommandVersionNotFound
+
+// Commands from before commands were versioned are their own first version.
+func normalizeCommandVersion(command *storage.Command) {
+  if command.Version == 0 {
+    command.Version = 1
+  }
+}
+
+// Stores the command as it is now as its current version. Must run in a transaction.
+func putCommandVersion(tx storage.Storage, command storage.Command, editedByUserID int64, now int64) error {
+  commandVersion := storage.CommandVersion{
+    CommandID: command.ID,
+    Version: command.Version,
+    OrganizationID: command.OrganizationID,
+    EditedByUserID: editedByUserID,
+    CreatedTime: now,
+    PublicCommand: command.PublicCommand,
+    Name: command.Name,
+    Description: command.Description,
+    Command: command.Command,
+    Params: command.Params,
+    RequiresApproval: command.RequiresApproval,
+    ApprovalExpirySec: command.ApprovalExpirySec,
+  }
+  _, err := tx.PutCommandVersion(commandVersion)
+  return err
+}
+
+// Stores a new command along with its first version.
+func putNewCommandNoCache(ctx Context, command storage.Command) (storage.Command, error) {
+  command.Version = 1
+  command.CreatedTime = time.Now().UTC().Unix()
+  command.UpdatedTime = command.CreatedTime
+  var stored storage.Command
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if stored, err = tx.PutCommand(command); err != nil {
+      return err
+    }
+    return putCommandVersion(tx, stored, stored.UserID, stored.CreatedTime)
+  })
+  if err != nil {
+    return command, err
+  }
+  return stored, nil
+}
+
+// Only the user who created a command, or an admin of its organization, may change or delete it.
+func requireCommandOwnerNoCache(ctx Context, user storage.User, command storage.Command) error {
+  if command.UserID == user.ID {
+    return nil
+  }
+  _, err := requireRoleNoCache(ctx, command.OrganizationID, user.ID, RoleAdmin)
+  return err
+}
+
+// Loads the command for a change, checking it is still at the version the change was made against.
+func getCommandForChange(tx storage.Storage, user storage.User, commandID int64, expectedVersion int64) (storage.Command, error) {
+  command, err := tx.GetCommand(commandID)
+  if err != nil {
+    return storage.Command{}, err
+  } else if command.OrganizationID != user.OrganizationID {
+    return storage.Command{}, ErrCommandNotFound
+  }
+
+  normalizeCommandVersion(&command)
+  if expectedVersion != 0 && command.Version != expectedVersion {
+    return command, ErrCommandVersionConflict
+  }
+  return command, nil
+}
+
+// Replaces the command's definition with the request's, as long as nobody has changed it since the request's version.
+// Returns the command before and after the change. The version being replaced stays in the command's history.
+func UpdateCommandNoCache(ctx Context, user storage.User, commandID int64, updateRequest UpdateCommandRequest) (storage.Command, storage.Command, error) {
+  var before storage.Command
+  var command storage.Command
+
+  existing, err := getCommandForChange(ctx.Storage(), user, commandID, 0)
+  if err != nil {
+    return existing, existing, err
+  } else if err := requireCommandOwnerNoCache(ctx, user, existing); err != nil {
+    return existing, existing, err
+  }
+
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    before, err = getCommandForChange(tx, user, commandID, updateRequest.Version)
+    if err != nil {
+      command = before
+      return err
+    }
+
+    now := time.Now().UTC().Unix()
+    if exists, err := commandVersionExists(tx, commandID, before.Version); err != nil {
+      return err
+    } else if !exists {
+      // Commands from before versioning get their original definition kept before it is replaced
+      if err := putCommandVersion(tx, before, before.UserID, now); err != nil {
+        return err
+      }
+    }
+
+    command = before
+    command.PublicCommand = updateRequest.PublicCommand
+    command.Name = updateRequest.Name
+    command.Description = updateRequest.Description
+    command.Command = updateRequest.Command
+    command.Params = updateRequest.Params
+    command.RequiresApproval = updateRequest.RequiresApproval
+    command.ApprovalExpirySec = updateRequest.ApprovalExpirySec
+    command.Version = before.Version + 1
+    command.UpdatedTime = now
+
+    if _, err := tx.PutCommand(command); err != nil {
+      return err
+    }
+    return putCommandVersion(tx, command, user.ID, now)
+  })
+  return before, command, err
+}
+
+// Deletes the command. When expectedVersion is set the command is only deleted if it is still at that version. The
+// command's version history is kept. The command is then taken off the servers it was available on and the schedules
+// that run it are paused, so neither is left pointing at a command that no longer exists.
+func DeleteCommandNoCache(ctx Context, user storage.User, commandID int64, expectedVersion int64) (storage.Command, error) {
+  var command storage.Command
+
+  existing, err := getCommandForChange(ctx.Storage(), user, commandID, 0)
+  if err != nil {
+    return existing, err
+  } else if err := requireCommandOwnerNoCache(ctx, user, existing); err != nil {
+    return existing, err
+  }
+
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    command, err = getCommandForChange(tx, user, commandID, expectedVersion)
+    if err != nil {
+      return err
+    }
+
+    if exists, err := commandVersionExists(tx, commandID, command.Version); err != nil {
+      return err
+    } else if !exists {
+      if err := putCommandVersion(tx, command, command.UserID, time.Now().UTC().Unix()); err != nil {
+        return err
+      }
+    }
+    return tx.DeleteCommand(commandID)
+  })
+  if err != nil {
+    return command, err
+  }
+
+  if err := detachDeletedCommandNoCache(ctx, command); err != nil {
+    ctx.Errorf("Failed to detach deleted command %d: %v", command.ID, err)
+  }
+  return command, nil
+}
+
+func detachDeletedCommandNoCache(ctx Context, command storage.Command) error {
+  servers, err := ctx.Storage().GetServers(command.OrganizationID)
+  if err != nil {
+    return err
+  }
+  for _, server := range servers {
+    if !IsCommandAvailable(server, command.ID) {
+      continue
+    }
+    if err := setCommandAvailableNoCache(ctx, server.ID, command.ID, false); err != nil && err != ErrServerNotFound {
+      return err
+    }
+  }
+
+  return pauseCommandSchedulesNoCache(ctx, command.ID)
+}
+
+func commandVersionExists(tx storage.Storage, commandID int64, version int64) (bool, error) {
+  if _, err := tx.GetCommandVersion(commandID, version); err == ErrCommandVersionNotFound {
+    return false, nil
+  } else if err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+// Lists every version of a command, oldest first. History outlives the command, so this works for deleted commands too.
+func GetCommandVersionsNoCache(ctx Context, user storage.User, commandID int64) ([]storage.CommandVersion, error) {
+  commandVersions, err := ctx.Storage().GetCommandVersions(commandID)
+  if err != nil {
+    return commandVersions, err
+  }
+
+  if len(commandVersions) == 0 {
+    // Commands from before versioning have no history until they are first changed
+    command, err := GetCommandNoCache(ctx, user, commandID)
+    if err != nil {
+      return commandVersions, err
+    }
+    return []storage.CommandVersion { commandVersionOf(command) }, nil
+  } else if commandVersions[0].OrganizationID != user.OrganizationID {
+    return []storage.CommandVersion {}, ErrCommandNotFound
+  }
+  return commandVersions, nil
+}
+
+func GetCommandVersionNoCache(ctx Context, user storage.User, commandID int64, version int64) (storage.CommandVersion, error) {
+  commandVersion, err := ctx.Storage().GetCommandVersion(commandID, version)
+  if err == ErrCommandVersionNotFound {
+    // Commands from before versioning are only at version 1 until they are first changed
+    command, err := GetCommandNoCache(ctx, user, commandID)
+    if err != nil {
+      return storage.CommandVersion{}, err
+    } else if command.Version != version {
+      return storage.CommandVersion{}, ErrCommandVersionNotFound
+    }
+    return commandVersionOf(command), nil
+  } else if err != nil {
+    return commandVersion, err
+  } else if commandVersion.OrganizationID != user.OrganizationID {
+    return storage.CommandVersion{}, ErrCommandNotFound
+  }
+  return commandVersion, nil
+}
+
+func commandVersionOf(command storage.Command) storage.CommandVersion {
+  return storage.CommandVersion{
+    CommandID: command.ID,
+    Version: command.Version,
+    OrganizationID: command.OrganizationID,
+    EditedByUserID: command.UserID,
+    CreatedTime: command.CreatedTime,
+    PublicCommand: command.PublicCommand,
+    Name: command.Name,
+    Description: command.Description,
+    Command: command.Command,
+    Params: command.Params,
+    RequiresApproval: command.RequiresApproval,
+    ApprovalExpirySec: command.ApprovalExpirySec,
+  }
+}
@@ -0,0 +1,57 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "net/http"
+)
+
+// Context is what a request is handled with, whichever runtime it arrived on. On App Engine it wraps the request's
+// appengine.Context, with storage in the datastore and caching in memcache.
+type Context interface {
+  Debugf(format string, args ...interface{})
+  Infof(format string, args ...interface{})
+  Warningf(format string, args ...interface{})
+  Errorf(format string, args ...interface{})
+  Criticalf(format string, args ...interface{})
+
+  Storage() storage.Storage
+  Cache() storage.Cache
+  // Runs task after the request, retrying it until it succeeds
+  Later(task Task) error
+  // For requests to other services, such as webhook deliveries and token lookups
+  HTTPClient() *http.Client
+}
+
+// Work done after the request that asked for it, with a context of its own. Tasks are only ever the ones below, so
+// App Engine can run each through its own delay function.
+type Task interface {
+  Run(ctx Context) error
+}
+
+type recordServerAPIKeyUseTask struct {
+  organizationID int64
+  serverAPIKeyHash string
+  now int64
+}
+
+func (task recordServerAPIKeyUseTask) Run(ctx Context) error {
+  return recordServerAPIKeyUseNoCache(ctx, task.organizationID, task.serverAPIKeyHash, task.now)
+}
+
+type recordPersonalAccessTokenUseTask struct {
+  tokenID int64
+  now int64
+}
+
+func (task recordPersonalAccessTokenUseTask) Run(ctx Context) error {
+  return recordPersonalAccessTokenUseNoCache(ctx, task.tokenID, task.now)
+}
+
+type recordAuditEventsTask struct {
+  events []storage.AuditEvent
+}
+
+func (task recordAuditEventsTask) Run(ctx Context) error {
+  _, err := RecordAuditEventsNoCache(ctx, task.events)
+  return err
+}
@@ -0,0 +1,54 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "net/http"
+  "testing"
+)
+
+// A Context over in memory storage and cache, for testing without App Engine. Tasks run as soon as they are queued.
+type testContext struct {
+  t *testing.T
+  storage *storage.MemoryStorage
+  cache *storage.MemoryCache
+}
+
+func newTestContext(t *testing.T) *testContext {
+  return &testContext{ t: t, storage: storage.NewMemoryStorage(), cache: storage.NewMemoryCache() }
+}
+
+func (ctx *testContext) Debugf(format string, args ...interface{}) {
+  ctx.t.Logf("DEBUG: " + format, args...)
+}
+
+func (ctx *testContext) Infof(format string, args ...interface{}) {
+  ctx.t.Logf("INFO: " + format, args...)
+}
+
+func (ctx *testContext) Warningf(format string, args ...interface{}) {
+  ctx.t.Logf("WARNING: " + format, args...)
+}
+
+func (ctx *testContext) Errorf(format string, args ...interface{}) {
+  ctx.t.Logf("ERROR: " + format, args...)
+}
+
+func (ctx *testContext) Criticalf(format string, args ...interface{}) {
+  ctx.t.Logf("CRITICAL: " + format, args...)
+}
+
+func (ctx *testContext) Storage() storage.Storage {
+  return ctx.storage
+}
+
+func (ctx *testContext) Cache() storage.Cache {
+  return ctx.cache
+}
+
+func (ctx *testContext) Later(task Task) error {
+  return task.Run(ctx)
+}
+
+func (ctx *testContext) HTTPClient() *http.Client {
+  return http.DefaultClient
+}
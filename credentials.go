@@ -0,0 +1,280 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var ErrEnrollmentTokenNotFound = storage.ErrEnrollmentTokenNotFound
+var ErrEnrollmentTokenInvalid = errors.New("Enrollment token is invalid, expired or already used")
+var ErrInvalidServerCredential = errors.New("Server credential is invalid")
+var ErrServerCredentialRequired = errors.New("This server has enrolled and must authenticate with its own server secret")
+var ErrInvalidEnrollmentExpiry = errors.New("expiresInSec must be between 0 and 2592000")
+
+// Enrollment tokens are handed to a new agent out of band and traded for that server's own secret on first contact.
+const (
+  enrollmentTokenPrefix = "bbe_"
+  serverSecretPrefix = "bbs_"
+  DefaultEnrollmentExpirySec = 24 * 60 * 60
+  MaxEnrollmentExpirySec = 30 * 24 * 60 * 60
+)
+
+func randomHex(size int) (string, error) {
+  bytes := make([]byte, size)
+  if _, err := rand.Read(bytes); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(bytes), nil
+}
+
+func hashSecret(secret string) string {
+  hash := sha256.Sum256([]byte(secret))
+  return hex.EncodeToString(hash[:])
+}
+
+func secretMatches(secret string, secretHash string) bool {
+  return secretHash != "" && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(secretHash)) == 1
+}
+
+// Last used times are kept to the minute, so a busy agent or script queues at most one write a minute.
+const usageResolutionSec = 60
+
+// Queues record to note that a key or token was used, unless it was last used within the minute or another request
+// has already queued it. usageKey names the key or token, never the secret itself. Failing to queue never fails the
+// request using the key.
+func recordUsage(ctx Context, usageKey string, lastUsedTime int64, record Task) {
+  if time.Now().UTC().Unix() - lastUsedTime < usageResolutionSec {
+    return
+  }
+  if err := ctx.Cache().Add("Usage-" + usageKey, true, usageResolutionSec * time.Second); err == storage.ErrNotStored {
+    return
+  }
+  if err := ctx.Later(record); err != nil {
+    ctx.Errorf("Failed to queue recording use of %s: %v", usageKey, err)
+  }
+}
+
+// Server secrets carry the organization they belong to so the server can be found without searching for the secret.
+func newServerSecret(organizationID int64) (string, error) {
+  random, err := randomHex(32)
+  if err != nil {
+    return "", err
+  }
+  return serverSecretPrefix + strconv.FormatInt(organizationID, 10) + "_" + random, nil
+}
+
+func parseServerSecret(serverSecret string) (int64, bool) {
+  if !strings.HasPrefix(serverSecret, serverSecretPrefix) {
+    return 0, false
+  }
+  parts := strings.SplitN(strings.TrimPrefix(serverSecret, serverSecretPrefix), "_", 2)
+  if len(parts) != 2 {
+    return 0, false
+  }
+  organizationID, err := strconv.ParseInt(parts[0], 10, 64)
+  return organizationID, err == nil
+}
+
+// Works out which organization an agent request belongs to. Enrolled agents send their own server secret, which only
+// ever authenticates the one server it was issued to. Older agents send the organization's server API key, which is
+// refused for any server that has enrolled or had its credential revoked.
+func AuthenticateServerRequest(ctx Context, serverAPIKey string, serverSecret string, serverID string) (storage.Organization, error) {
+  if serverSecret != "" {
+    organizationID, ok := parseServerSecret(serverSecret)
+    if !ok {
+      return storage.Organization{}, ErrInvalidServerCredential
+    }
+    organization, err := GetOrganizationNoCache(ctx, organizationID)
+    if err == ErrOrganizationNotFound {
+      return organization, ErrInvalidServerCredential
+    } else if err != nil {
+      return organization, err
+    }
+
+    server, err := GetServerByServerID(ctx, organization, serverID)
+    if err == ErrServerNotFound || (err == nil && !secretMatches(serverSecret, server.CredentialHash)) {
+      return storage.Organization{}, ErrInvalidServerCredential
+    } else if err != nil {
+      return storage.Organization{}, err
+    }
+    return organization, nil
+  }
+
+  organization, err := FindOrganizationByServerAPIKey(ctx, serverAPIKey)
+  if err == ErrOrganizationNotFound {
+    return organization, ErrServerAPIKeyNotFound
+  } else if err != nil {
+    return organization, err
+  }
+  server, err := GetServerByServerID(ctx, organization, serverID)
+  if err == nil && (server.CredentialHash != "" || server.CredentialRevokedTime != 0) {
+    return storage.Organization{}, ErrServerCredentialRequired
+  } else if err != nil && err != ErrServerNotFound {
+    return storage.Organization{}, err
+  }
+  return organization, nil
+}
+
+// Creates a one-time enrollment token. The token itself is only returned here, just its hash is stored.
+func CreateEnrollmentTokenNoCache(ctx Context, user storage.User, description string, expiresInSec int) (storage.EnrollmentToken, string, error) {
+  var enrollmentToken storage.EnrollmentToken
+
+  if expiresInSec < 0 || expiresInSec > MaxEnrollmentExpirySec {
+    return enrollmentToken, "", ErrInvalidEnrollmentExpiry
+  } else if expiresInSec == 0 {
+    expiresInSec = DefaultEnrollmentExpirySec
+  }
+
+  random, err := randomHex(32)
+  if err != nil {
+    return enrollmentToken, "", err
+  }
+  token := enrollmentTokenPrefix + random
+
+  enrollmentToken.OrganizationID = user.OrganizationID
+  enrollmentToken.CreatedByUserID = user.ID
+  enrollmentToken.Description = description
+  enrollmentToken.TokenHash = hashSecret(token)
+  enrollmentToken.CreatedTime = time.Now().UTC().Unix()
+  enrollmentToken.ExpiresTime = enrollmentToken.CreatedTime + int64(expiresInSec)
+
+  enrollmentToken, err = ctx.Storage().PutEnrollmentToken(enrollmentToken)
+  if err != nil {
+    return enrollmentToken, "", err
+  }
+  return enrollmentToken, token, nil
+}
+
+func GetEnrollmentTokensNoCache(ctx Context, user storage.User) ([]storage.EnrollmentToken, error) {
+  enrollmentTokens, err := ctx.Storage().GetEnrollmentTokens(user.OrganizationID)
+  if enrollmentTokens == nil {
+    enrollmentTokens = []storage.EnrollmentToken {}
+  }
+  return enrollmentTokens, err
+}
+
+// Stops an unused enrollment token from being used. Servers that already enrolled with it are unaffected.
+func RevokeEnrollmentTokenNoCache(ctx Context, user storage.User, enrollmentTokenID int64) (storage.EnrollmentToken, error) {
+  var enrollmentToken storage.EnrollmentToken
+
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if enrollmentToken, err = tx.GetEnrollmentToken(enrollmentTokenID); err != nil {
+      return err
+    } else if enrollmentToken.OrganizationID != user.OrganizationID {
+      return ErrEnrollmentTokenNotFound
+    }
+
+    if enrollmentToken.RevokedTime == 0 {
+      enrollmentToken.RevokedTime = time.Now().UTC().Unix()
+    }
+    enrollmentToken, err = tx.PutEnrollmentToken(enrollmentToken)
+    return err
+  })
+  return enrollmentToken, err
+}
+
+// Trades an enrollment token for a secret belonging to just this server, creating the server if it is new. Enrolling
+// an existing server replaces whatever credential it had. Returns the server and its secret, which is never shown
+// again.
+func EnrollServerNoCache(ctx Context, enrollmentRequest EnrollmentRequest) (storage.Server, string, error) {
+  var server storage.Server
+
+  foundToken, err := ctx.Storage().GetEnrollmentTokenByHash(hashSecret(enrollmentRequest.EnrollmentToken))
+  if err == ErrEnrollmentTokenNotFound {
+    return server, "", ErrEnrollmentTokenInvalid
+  } else if err != nil {
+    return server, "", err
+  }
+  organization := storage.Organization{ ID: foundToken.OrganizationID }
+
+  existing, err := getServerByServerIDNoCache(ctx, organization, enrollmentRequest.ServerID)
+  if err != nil && err != ErrServerNotFound {
+    return server, "", err
+  }
+  created := err == ErrServerNotFound
+
+  secret, err := newServerSecret(organization.ID)
+  if err != nil {
+    return server, "", err
+  }
+
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    enrollmentToken, err := tx.GetEnrollmentToken(foundToken.ID)
+    if err != nil {
+      return err
+    }
+    now := time.Now().UTC().Unix()
+    if enrollmentToken.UsedTime != 0 || enrollmentToken.RevokedTime != 0 || now > enrollmentToken.ExpiresTime {
+      return ErrEnrollmentTokenInvalid
+    }
+
+    server = storage.Server{}
+    if !created {
+      if server, err = tx.GetServer(existing.ID); err != nil {
+        return err
+      }
+    } else {
+      server.OrganizationID = organization.ID
+      server.ServerID = enrollmentRequest.ServerID
+      server.Name = enrollmentRequest.Name
+      server.Description = enrollmentRequest.Description
+    }
+    server.CredentialHash = hashSecret(secret)
+    server.CredentialIssuedTime = now
+    server.CredentialRevokedTime = 0
+
+    if server, err = tx.PutServer(server); err != nil {
+      return err
+    }
+
+    enrollmentToken.UsedTime = now
+    enrollmentToken.UsedByServerID = server.ID
+    _, err = tx.PutEnrollmentToken(enrollmentToken)
+    return err
+  })
+  if err != nil {
+    return server, "", err
+  }
+
+  ctx.Cache().Delete(serverCacheKey(organization.ID, server.ServerID))
+  if created {
+    if err := QueueWebhookEventNoCache(ctx, organization.ID, WebhookEventServerCreated, map[string]interface{} { "server": server }); err != nil {
+      ctx.Errorf("Failed to queue %s webhooks for server %d: %v", WebhookEventServerCreated, server.ID, err)
+    }
+  }
+  return server, secret, nil
+}
+
+// Revokes one server's credential without affecting any other server. The agent is locked out until it enrolls again
+// with a new token.
+func RevokeServerCredentialNoCache(ctx Context, user storage.User, serverID int64) (storage.Server, error) {
+  if _, err := GetServerNoCache(ctx, user, serverID); err != nil {
+    return storage.Server{}, err
+  }
+
+  var server storage.Server
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if server, err = tx.GetServer(serverID); err != nil {
+      return err
+    }
+    server.CredentialHash = ""
+    server.CredentialRevokedTime = time.Now().UTC().Unix()
+    server, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return server, err
+  }
+
+  ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+  return server, nil
+}
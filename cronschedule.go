@@ -0,0 +1,191 @@
+package biboop
+
+import (
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var ErrInvalidCronExpression = errors.New("Invalid cron expression")
+var ErrTimeZoneRequired = errors.New("An explicit time zone is required")
+
+var cronMacros = map[string]string {
+  "@yearly": "0 0 1 1 *",
+  "@annually": "0 0 1 1 *",
+  "@monthly": "0 0 1 * *",
+  "@weekly": "0 0 * * 0",
+  "@daily": "0 0 * * *",
+  "@midnight": "0 0 * * *",
+  "@hourly": "0 * * * *",
+}
+
+var cronMonthNames = map[string]int {
+  "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+  "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int {
+  "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// Searching further ahead than this means the expression can never match, e.g. "0 0 30 2 *".
+const cronSearchYears = 5
+
+// A parsed five field cron expression (minute hour day-of-month month day-of-week) bound to a time zone.
+// Each field is a bit set of the values it matches.
+type CronSchedule struct {
+  minute uint64
+  hour uint64
+  dayOfMonth uint64
+  month uint64
+  dayOfWeek uint64
+  dayOfMonthAny bool
+  dayOfWeekAny bool
+  location *time.Location
+}
+
+func ParseCronSchedule(expression string, timeZone string) (*CronSchedule, error) {
+  if timeZone == "" {
+    return nil, ErrTimeZoneRequired
+  }
+  location, err := time.LoadLocation(timeZone)
+  if err != nil {
+    return nil, errors.New("Unknown time zone " + timeZone)
+  }
+
+  expression = strings.TrimSpace(expression)
+  if macro, ok := cronMacros[strings.ToLower(expression)]; ok {
+    expression = macro
+  }
+
+  fields := strings.Fields(expression)
+  if len(fields) != 5 {
+    return nil, ErrInvalidCronExpression
+  }
+
+  schedule := &CronSchedule{ location: location }
+  if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+    return nil, err
+  }
+  if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+    return nil, err
+  }
+  if schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+    return nil, err
+  }
+  if schedule.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+    return nil, err
+  }
+  if schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+    return nil, err
+  }
+
+  // 7 is an alias for Sunday
+  if schedule.dayOfWeek & (1 << 7) != 0 {
+    schedule.dayOfWeek |= 1
+  }
+  schedule.dayOfMonthAny = fields[2] == "*" || fields[2] == "?"
+  schedule.dayOfWeekAny = fields[4] == "*" || fields[4] == "?"
+  return schedule, nil
+}
+
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+  var bits uint64
+
+  for _, part := range strings.Split(field, ",") {
+    step := 1
+    if slash := strings.Index(part, "/"); slash >= 0 {
+      var err error
+      if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+        return 0, errors.New("Invalid step in cron field " + field)
+      }
+      part = part[:slash]
+    }
+
+    start, end := min, max
+    if part != "*" && part != "?" {
+      bounds := strings.SplitN(part, "-", 2)
+      var err error
+      if start, err = parseCronValue(bounds[0], names); err != nil {
+        return 0, errors.New("Invalid value in cron field " + field)
+      }
+      end = start
+      if len(bounds) == 2 {
+        if end, err = parseCronValue(bounds[1], names); err != nil {
+          return 0, errors.New("Invalid range in cron field " + field)
+        }
+      } else if step > 1 {
+        end = max
+      }
+    }
+
+    if start < min || end > max || start > end {
+      return 0, errors.New("Out of range value in cron field " + field)
+    }
+    for value := start; value <= end; value += step {
+      bits |= 1 << uint(value)
+    }
+  }
+
+  return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+  if named, ok := names[strings.ToLower(value)]; ok {
+    return named, nil
+  }
+  return strconv.Atoi(value)
+}
+
+func (schedule *CronSchedule) dayMatches(t time.Time) bool {
+  dayOfMonth := schedule.dayOfMonth & (1 << uint(t.Day())) != 0
+  dayOfWeek := schedule.dayOfWeek & (1 << uint(t.Weekday())) != 0
+
+  // As in Vixie cron, when both day fields are restricted a day matching either one is enough
+  if schedule.dayOfMonthAny || schedule.dayOfWeekAny {
+    return dayOfMonth && dayOfWeek
+  }
+  return dayOfMonth || dayOfWeek
+}
+
+// Returns the first time strictly after the given time that the schedule fires, or the zero time if it never does.
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+  location := schedule.location
+  t := after.In(location).Truncate(time.Minute).Add(time.Minute)
+  limit := t.AddDate(cronSearchYears, 0, 0)
+
+  for t.Before(limit) {
+    previous := t
+    if schedule.month & (1 << uint(t.Month())) == 0 {
+      t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, location)
+    } else if !schedule.dayMatches(t) {
+      t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, location)
+    } else if schedule.hour & (1 << uint(t.Hour())) == 0 {
+      t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, location)
+    } else if schedule.minute & (1 << uint(t.Minute())) == 0 {
+      t = t.Add(time.Minute)
+    } else {
+      return t
+    }
+
+    // A wall clock time inside a daylight saving gap can normalise to an earlier instant, so always move forward
+    if !t.After(previous) {
+      t = previous.Add(time.Minute)
+    }
+  }
+
+  return time.Time{}
+}
+
+// Returns up to count upcoming run times after the given time.
+func (schedule *CronSchedule) NextTimes(after time.Time, count int) []time.Time {
+  var times []time.Time
+  for len(times) < count {
+    if after = schedule.Next(after); after.IsZero() {
+      break
+    }
+    times = append(times, after)
+  }
+  return times
+}
@@ -0,0 +1,140 @@
+package biboop
+
+import (
+  "testing"
+  "time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+  location, err := time.LoadLocation(name)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return location
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+  tests := []struct {
+    expression string
+    timeZone string
+  }{
+    { "* * * * *", "" },
+    { "* * * * *", "Mars/Olympus_Mons" },
+    { "", "UTC" },
+    { "* * * *", "UTC" },
+    { "* * * * * *", "UTC" },
+    { "@fortnightly", "UTC" },
+    { "60 * * * *", "UTC" },
+    { "* 24 * * *", "UTC" },
+    { "* * 0 * *", "UTC" },
+    { "* * 32 * *", "UTC" },
+    { "* * * 0 *", "UTC" },
+    { "* * * 13 *", "UTC" },
+    { "* * * * 8", "UTC" },
+    { "*/0 * * * *", "UTC" },
+    { "*/x * * * *", "UTC" },
+    { "30-10 * * * *", "UTC" },
+    { "1-x * * * *", "UTC" },
+    { "x * * * *", "UTC" },
+    { "1,,2 * * * *", "UTC" },
+    { "* * * foo *", "UTC" },
+  }
+
+  for _, test := range tests {
+    if _, err := ParseCronSchedule(test.expression, test.timeZone); err == nil {
+      t.Errorf("ParseCronSchedule(%q, %q) returned no error", test.expression, test.timeZone)
+    }
+  }
+
+  if _, err := ParseCronSchedule("* * * * *", ""); err != ErrTimeZoneRequired {
+    t.Errorf("ParseCronSchedule without a time zone returned %v, expected %v", err, ErrTimeZoneRequired)
+  }
+}
+
+func TestCronScheduleNextTimes(t *testing.T) {
+  utc := time.UTC
+  newYork := mustLoadLocation(t, "America/New_York")
+  sydney := mustLoadLocation(t, "Australia/Sydney")
+  // 2026-01-01 is a Thursday
+  newYear := time.Date(2026, 1, 1, 0, 0, 0, 0, utc)
+
+  tests := []struct {
+    name string
+    expression string
+    timeZone string
+    after time.Time
+    expected []time.Time
+  }{
+    { "every minute is strictly after", "* * * * *", "UTC", time.Date(2026, 1, 1, 10, 0, 30, 0, utc),
+      []time.Time { time.Date(2026, 1, 1, 10, 1, 0, 0, utc), time.Date(2026, 1, 1, 10, 2, 0, 0, utc) } },
+    { "a matching time isn't repeated", "0 10 * * *", "UTC", time.Date(2026, 1, 1, 10, 0, 0, 0, utc),
+      []time.Time { time.Date(2026, 1, 2, 10, 0, 0, 0, utc) } },
+    { "steps and ranges", "*/20 9-10 * * *", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 1, 9, 0, 0, 0, utc), time.Date(2026, 1, 1, 9, 20, 0, 0, utc), time.Date(2026, 1, 1, 9, 40, 0, 0, utc), time.Date(2026, 1, 1, 10, 0, 0, 0, utc) } },
+    { "stepped start", "5/30 * * * *", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 1, 0, 5, 0, 0, utc), time.Date(2026, 1, 1, 0, 35, 0, 0, utc) } },
+    { "macro in capitals", "@DAILY", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 2, 0, 0, 0, 0, utc) } },
+    { "names", "0 0 * feb mon", "UTC", newYear,
+      []time.Time { time.Date(2026, 2, 2, 0, 0, 0, 0, utc), time.Date(2026, 2, 9, 0, 0, 0, 0, utc) } },
+    // Midnight UTC is already 11:00 on the 1st in Sydney
+    { "in the schedule's time zone", "0 9 * * mon-fri", "Australia/Sydney", newYear,
+      []time.Time { time.Date(2026, 1, 2, 9, 0, 0, 0, sydney), time.Date(2026, 1, 5, 9, 0, 0, 0, sydney), time.Date(2026, 1, 6, 9, 0, 0, 0, sydney) } },
+
+    // When both day fields are restricted either one matching is enough, otherwise the restricted one has to
+    { "day of month or day of week", "0 0 13 * fri", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 2, 0, 0, 0, 0, utc), time.Date(2026, 1, 9, 0, 0, 0, 0, utc), time.Date(2026, 1, 13, 0, 0, 0, 0, utc), time.Date(2026, 1, 16, 0, 0, 0, 0, utc) } },
+    { "day of month only", "0 0 13 * *", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 13, 0, 0, 0, 0, utc), time.Date(2026, 2, 13, 0, 0, 0, 0, utc) } },
+    { "day of month with ? for day of week", "0 0 13 * ?", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 13, 0, 0, 0, 0, utc), time.Date(2026, 2, 13, 0, 0, 0, 0, utc) } },
+    { "day of week only", "0 0 * * 5", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 2, 0, 0, 0, 0, utc), time.Date(2026, 1, 9, 0, 0, 0, 0, utc) } },
+    { "stepped day of month is still restricted", "0 0 */10 * fri", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 2, 0, 0, 0, 0, utc), time.Date(2026, 1, 9, 0, 0, 0, 0, utc), time.Date(2026, 1, 11, 0, 0, 0, 0, utc) } },
+
+    { "7 is Sunday", "5 4 * * 7", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 4, 4, 5, 0, 0, utc), time.Date(2026, 1, 11, 4, 5, 0, 0, utc) } },
+    { "0 is Sunday", "5 4 * * 0", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 4, 4, 5, 0, 0, utc), time.Date(2026, 1, 11, 4, 5, 0, 0, utc) } },
+    { "range ending in 7", "0 0 * * 6-7", "UTC", newYear,
+      []time.Time { time.Date(2026, 1, 3, 0, 0, 0, 0, utc), time.Date(2026, 1, 4, 0, 0, 0, 0, utc), time.Date(2026, 1, 10, 0, 0, 0, 0, utc) } },
+
+    { "30th of February never comes", "0 0 30 2 *", "UTC", newYear, nil },
+    { "31st of a 30 day month never comes", "0 0 31 4,6,9,11 *", "UTC", newYear, nil },
+    { "29th of February comes in leap years", "0 0 29 2 *", "UTC", newYear,
+      []time.Time { time.Date(2028, 2, 29, 0, 0, 0, 0, utc) } },
+
+    // New York skips from 02:00 to 03:00 on 2026-03-08, and a time that doesn't exist that day is skipped with it
+    { "every minute across a daylight saving gap", "* * * * *", "America/New_York", time.Date(2026, 3, 8, 1, 58, 0, 0, newYork),
+      []time.Time { time.Date(2026, 3, 8, 1, 59, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 1, 0, 0, newYork) } },
+    { "time inside a daylight saving gap", "30 2 * * *", "America/New_York", time.Date(2026, 3, 7, 12, 0, 0, 0, newYork),
+      []time.Time { time.Date(2026, 3, 9, 2, 30, 0, 0, newYork) } },
+    { "hourly across a daylight saving gap", "0 * * * *", "America/New_York", time.Date(2026, 3, 8, 0, 30, 0, 0, newYork),
+      []time.Time { time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Date(2026, 3, 8, 4, 0, 0, 0, newYork) } },
+  }
+
+  for _, test := range tests {
+    schedule, err := ParseCronSchedule(test.expression, test.timeZone)
+    if err != nil {
+      t.Errorf("%s: ParseCronSchedule(%q) returned %v", test.name, test.expression, err)
+      continue
+    }
+
+    count := len(test.expected)
+    if count == 0 {
+      count = 1
+    }
+    times := schedule.NextTimes(test.after, count)
+    if len(times) != len(test.expected) {
+      t.Errorf("%s: NextTimes returned %v, expected %v", test.name, times, test.expected)
+      continue
+    }
+    for i := range times {
+      if !times[i].Equal(test.expected[i]) {
+        t.Errorf("%s: NextTimes returned %v, expected %v", test.name, times, test.expected)
+        break
+      }
+    }
+  }
+}
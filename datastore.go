@@ -1,299 +1,586 @@
 package biboop
 
 import (
-  "appengine"
-  "appengine/datastore"
-  "appengine/memcache"
-  "github.com/dbrain/soggy"
+  "github.com/dbrain/biboop-server/storage"
   "time"
   "strconv"
   "errors"
-  "log"
 )
 
-var DatastoreKindUser = "User"
-var DatastoreKindServer = "Server"
-var DatastoreKindCommand = "Command"
+var ErrUserNotFound = storage.ErrUserNotFound
+var ErrServerNotFound = storage.ErrServerNotFound
+var ErrCommandNotFound = storage.ErrCommandNotFound
+var ErrCommandNotAvailable = errors.New("Command is not available on server")
+var ErrInvocationNotFound = storage.ErrInvocationNotFound
+var ErrInvocationNotDispatched = errors.New("Invocation has not been dispatched")
+
+const (
+  InvocationStateQueued = storage.InvocationStateQueued
+  InvocationStateDispatched = storage.InvocationStateDispatched
+  InvocationStateCompleted = storage.InvocationStateCompleted
+  InvocationStateFailed = storage.InvocationStateFailed
+  InvocationStatePendingApproval = storage.InvocationStatePendingApproval
+  InvocationStateRejected = storage.InvocationStateRejected
+  InvocationStateExpired = storage.InvocationStateExpired
+)
 
-var ErrUserNotFound = errors.New("User not found")
-var ErrServerNotFound = errors.New("Server not found")
+func GetOrCreateUser(ctx Context, email string) (storage.User, error) {
+  var user storage.User
 
-type User struct {
-  ID int64 `json:"id,omitempty" datastore:"-"`
-  Email string `json:"email,omitempty"`
-  ServerAPIKey string `json:"serverAPIKey,omitempty"`
+  cacheKey := userCacheKey(email)
+  err := ctx.Cache().Get(cacheKey, &user)
+  // Users cached before organizations existed, or part way through moving into one, still need moving
+  if err == nil && (user.OrganizationID == 0 || user.OrganizationMigrationPending) {
+    err = storage.ErrCacheMiss
+  }
+  if err == storage.ErrCacheMiss {
+    if user, err = getOrCreateUserNoCache(ctx, email); err != nil {
+      return user, err
+    }
+    ctx.Cache().Set(cacheKey, user, 0)
+  } else if err != nil {
+    return user, err
+  }
+  return user, nil
 }
 
-type Server struct {
-  ID int64 `json:"id,omitempty" datastore:"-"`
-  UserID int64 `json:"userId,omitempty"`
-  ServerID string `json:"serverId,omitempty"`
-  Name string `json:"name,omitempty"`
-  Description string `json:"description,omitempty"`
-  LastPollTime int64 `json:"lastPollTime,omitempty"`
-  PendingCommands int `json:"pendingCommands,omitempty"`
-  AvailableCommands []*datastore.Key `json:"-"`
-}
+func getOrCreateUserNoCache(ctx Context, email string) (storage.User, error) {
+  // Concurrent first requests from a new user all get the one user back
+  user, err := ctx.Storage().GetOrCreateUser(email)
+  if err != nil {
+    return user, err
+  }
+
+  if user.OrganizationID == 0 || user.OrganizationMigrationPending {
+    if err = ensureUserOrganizationNoCache(ctx, &user); err != nil {
+      return user, err
+    }
+  }
 
-type CommandParam struct {
-  Name string `json:"name,omitempty"`
-  Type string `json:"type,omitempty"`
-  PossibleValues []string `json:"PossibleValues,omitempty"`
-  Description string `json:"description,omitempty"`
-  DefaultValue string `json:"defaultValue,omitempty"`
+  return user, nil
 }
 
-type Command struct {
-  ID int64 `json:"id,omitempty" datastore:"-"`
-  UserID int64 `json:"userId,omitempty"`
-  PublicCommand bool `json:"publicCommand,omitempty"`
-  Name string `json:"name,omitempty"`
-  Description string `json:"description,omitempty"`
-  Command string `json:"command,omitempty"`
-  Params []CommandParam `json:"params,omitempty"`
+func GetServerForPollRequest(ctx Context, organization storage.Organization, pollRequest PollRequest) (storage.Server, error) {
+  return GetServerByServerID(ctx, organization, pollRequest.ServerID)
 }
 
-func GetOrCreateUser(ctx appengine.Context, email string) (User, error) {
-  var user User
-  var userKey *datastore.Key
+func GetServerByServerID(ctx Context, organization storage.Organization, serverID string) (storage.Server, error) {
+  var server storage.Server
 
-  cacheKey := "User-" + email
-  if item, err := memcache.Gob.Get(ctx, cacheKey, &user); err == memcache.ErrCacheMiss {
-    if userKey, user, err = getOrCreateUserNoCache(ctx, email); err != nil {
-      return user, err
-    } else {
-      user.ID = userKey.IntID()
-      item = &memcache.Item{
-        Key: cacheKey,
-        Object: user,
-      }
-      memcache.Gob.Set(ctx, item)
+  cacheKey := serverCacheKey(organization.ID, serverID)
+  if err := ctx.Cache().Get(cacheKey, &server); err == storage.ErrCacheMiss {
+    if server, err = getServerByServerIDNoCache(ctx, organization, serverID); err != nil {
+      return server, err
     }
+    ctx.Cache().Set(cacheKey, server, 0)
   } else if err != nil {
-    return user, err
+    return server, err
   }
-  return user, nil
+
+  return server, nil
+}
+
+func serverCacheKey(organizationID int64, serverID string) string {
+  return "Server-" + strconv.FormatInt(organizationID, 10) + "-" + serverID
 }
 
-func getOrCreateUserNoCache(ctx appengine.Context, email string) (*datastore.Key, User, error) {
-  var user User
-  var userKey *datastore.Key
-  var err error
+func getServerByServerIDNoCache(ctx Context, organization storage.Organization, serverID string) (storage.Server, error) {
+  return ctx.Storage().GetServerByServerID(organization.ID, serverID)
+}
 
-  query := datastore.NewQuery(DatastoreKindUser).
-         Filter("Email =", email).
-         Limit(1)
+func UpdateServerForUpdateRequest(ctx Context, organization storage.Organization, updateRequest UpdateRequest) (storage.Server, error) {
+  serverStorage := ctx.Storage()
 
-  for cursor := query.Run(ctx); ; {
-    if cursorKey, err := cursor.Next(&user); err == datastore.Done {
-      break
-    } else if err != nil {
-      return userKey, user, err
-    } else {
-      userKey = cursorKey
+  server, err := serverStorage.GetServerByServerID(organization.ID, updateRequest.ServerID)
+  if err != nil && err != ErrServerNotFound {
+    return server, err
+  }
+
+  created := err == ErrServerNotFound
+  if created {
+    ctx.Infof("Creating server %s", updateRequest.ServerID)
+    server = storage.Server{}
+    server.OrganizationID = organization.ID
+    server.ServerID = updateRequest.ServerID
+    server.Name = updateRequest.Name
+    server.Description = updateRequest.Description
+    server.PendingCommands = 0
+    if server, err = serverStorage.PutServer(server); err != nil {
+      return server, err
     }
   }
 
-  if userKey == nil {
-    userKey = datastore.NewIncompleteKey(ctx, DatastoreKindUser, nil)
-    user.Email = email
-    user.ServerAPIKey = email + "-" + strconv.FormatInt(time.Now().Unix(), 10) + "-" + soggy.UIDString()
-    if userKey, err = datastore.Put(ctx, userKey, &user); err != nil {
-      return userKey, user, err
+  if updateRequest.MinimumPollTimeSec > 0 {
+    server.PollIntervalSec = updateRequest.MinimumPollTimeSec
+  }
+  if updateRequest.Labels != nil {
+    server.AgentLabels = labelsFromMap(updateRequest.Labels)
+  }
+  if err := markServerPolledNoCache(serverStorage, &server); err != nil {
+    return server, err
+  }
+
+  if server, err = serverStorage.PutServer(server); err != nil {
+    return server, err
+  }
+  ctx.Cache().Delete(serverCacheKey(organization.ID, server.ServerID))
+
+  if created {
+    if err := QueueWebhookEventNoCache(ctx, organization.ID, WebhookEventServerCreated, map[string]interface{} { "server": server }); err != nil {
+      ctx.Errorf("Failed to queue %s webhooks for server %d: %v", WebhookEventServerCreated, server.ID, err)
     }
   }
 
-  return userKey, user, err
+  return server, nil
 }
 
-func GetServerForPollRequest(ctx appengine.Context, user User, pollRequest PollRequest) (Server, error) {
-  var server Server
-  var serverKey *datastore.Key
+func GetServerNoCache(ctx Context, user storage.User, serverID int64) (storage.Server, error) {
+  server, err := ctx.Storage().GetServer(serverID)
+  if err != nil {
+    return server, err
+  } else if server.OrganizationID != user.OrganizationID {
+    return storage.Server{}, ErrServerNotFound
+  }
+  return server, nil
+}
 
-  cacheKey := "Server-" + strconv.FormatInt(user.ID, 10) + "-" + pollRequest.ServerID
-  if item, err := memcache.Gob.Get(ctx, cacheKey, &server); err == memcache.ErrCacheMiss {
-    if serverKey, server, err = getServerForPollRequestNoCache(ctx, user, pollRequest); err != nil {
-      return server, err
-    } else {
-      server.ID = serverKey.IntID()
-      item = &memcache.Item{
-        Key: cacheKey,
-        Object: server,
-      }
-      memcache.Gob.Set(ctx, item)
-    }
-  } else if err != nil {
+func DeleteServerNoCache(ctx Context, user storage.User, serverID int64) (storage.Server, error) {
+  server, err := GetServerNoCache(ctx, user, serverID)
+  if err != nil {
     return server, err
   }
 
+  if err := ctx.Storage().DeleteServer(serverID); err != nil {
+    return server, err
+  }
+  ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
   return server, nil
 }
 
-func getServerForPollRequestNoCache(ctx appengine.Context, user User, pollRequest PollRequest) (*datastore.Key, Server, error) {
-  var server Server
-  var serverKey *datastore.Key
+func GetServersNoCache(ctx Context, user storage.User) ([]storage.Server, error) {
+  servers, err := ctx.Storage().GetServers(user.OrganizationID)
+  if err != nil {
+    return servers, err
+  }
+
+  now := time.Now().UTC().Unix()
+  for i := range servers {
+    servers[i].Status, _ = ServerStatus(servers[i], now)
+  }
+  return servers, nil
+}
 
-  query := datastore.NewQuery(DatastoreKindServer).
-           Filter("UserID =", user.ID).
-           Filter("ServerID =", pollRequest.ServerID).
-           Limit(1)
+func CreateCommandNoCache(ctx Context, user storage.User, commandRequest CreateCommandRequest) (storage.Command, error) {
+  var command storage.Command
+  for _, serverID := range commandRequest.Servers {
+    if _, err := GetServerNoCache(ctx, user, serverID); err != nil {
+      return command, err
+    }
+  }
 
-  for cursor := query.Run(ctx); ; {
-    if cursorKey, err := cursor.Next(&server); err == datastore.Done {
-      break
-    } else if err != nil {
-      return serverKey, server, err
-    } else {
-      serverKey = cursorKey
+  command.UserID = user.ID
+  command.OrganizationID = user.OrganizationID
+  command.PublicCommand = commandRequest.PublicCommand
+  command.Name = commandRequest.Name
+  command.Description = commandRequest.Description
+  command.Command = commandRequest.Command
+  command.Params = commandRequest.Params
+  command.RequiresApproval = commandRequest.RequiresApproval
+  command.ApprovalExpirySec = commandRequest.ApprovalExpirySec
+
+  command, err := putNewCommandNoCache(ctx, command)
+  if err != nil {
+    return command, err
+  }
+
+  if len(commandRequest.Servers) > 0 {
+    if err := AddCommandToServersNoCache(ctx, user, command.ID, commandRequest.Servers); err != nil {
+      return command, err
     }
   }
+  return command, nil
+}
 
-  if server.ServerID == "" {
-    return serverKey, server, ErrServerNotFound
+func GetCommandsNoCache(ctx Context, user storage.User) ([]storage.Command, error) {
+  commands, err := ctx.Storage().GetCommands(user.OrganizationID)
+  if err != nil {
+    return commands, err
   }
 
-  return serverKey, server, nil
+  for i := range commands {
+    normalizeCommandVersion(&commands[i])
+  }
+  return commands, nil
 }
 
-func FindUserByServerAPIKey(ctx appengine.Context, serverAPIKey string) (User, error) {
-  var user User
-  var userKey *datastore.Key
+// Returns a page of the public commands matching search and the afterID to pass for the next page, 0 on the last.
+func GetPublicCommandsNoCache(ctx Context, search string, afterID int64, limit int) ([]storage.Command, int64, error) {
+  return storage.SearchPublicCommands(ctx.Storage(), search, afterID, limit)
+}
 
-  cacheKey := "User-" + serverAPIKey
-  if item, err := memcache.Gob.Get(ctx, cacheKey, &user); err == memcache.ErrCacheMiss {
-    if userKey, user, err = findUserByServerAPIKeyNoCache(ctx, serverAPIKey); err != nil {
-      return user, err
-    } else {
-      user.ID = userKey.IntID()
-      item = &memcache.Item{
-        Key: cacheKey,
-        Object: user,
+func GetPublicCommandNoCache(ctx Context, commandID int64) (storage.Command, error) {
+  command, err := ctx.Storage().GetCommand(commandID)
+  if err != nil {
+    return command, err
+  } else if !command.PublicCommand {
+    return storage.Command{}, ErrCommandNotFound
+  }
+  return command, nil
+}
+
+// Copies a public command and its params into the user's account as a private command.
+func ForkCommandNoCache(ctx Context, user storage.User, commandID int64) (storage.Command, error) {
+  publicCommand, err := GetPublicCommandNoCache(ctx, commandID)
+  if err != nil {
+    return publicCommand, err
+  }
+
+  var command storage.Command
+  command.UserID = user.ID
+  command.OrganizationID = user.OrganizationID
+  command.Name = publicCommand.Name
+  command.Description = publicCommand.Description
+  command.Command = publicCommand.Command
+  command.Params = append([]storage.CommandParam(nil), publicCommand.Params...)
+  command.ForkedFromID = publicCommand.ID
+  command.RequiresApproval = publicCommand.RequiresApproval
+  command.ApprovalExpirySec = publicCommand.ApprovalExpirySec
+  return putNewCommandNoCache(ctx, command)
+}
+
+func AddCommandToServersNoCache(ctx Context, user storage.User, commandID int64, serverIds []int64) (error) {
+  return updateServerCommandsNoCache(ctx, user, commandID, serverIds, true)
+}
+
+func RemoveCommandFromServersNoCache(ctx Context, user storage.User, commandID int64, serverIds []int64) (error) {
+  return updateServerCommandsNoCache(ctx, user, commandID, serverIds, false)
+}
+
+func updateServerCommandsNoCache(ctx Context, user storage.User, commandID int64, serverIds []int64, available bool) (error) {
+  if _, err := GetCommandNoCache(ctx, user, commandID); err != nil {
+    return err
+  }
+
+  for _, serverID := range serverIds {
+    if _, err := GetServerNoCache(ctx, user, serverID); err != nil {
+      return err
+    }
+    if err := setCommandAvailableNoCache(ctx, serverID, commandID, available); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Adds the command to or removes it from the commands the server may run, without checking who either belongs to.
+func setCommandAvailableNoCache(ctx Context, serverID int64, commandID int64, available bool) error {
+  var server storage.Server
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if server, err = tx.GetServer(serverID); err != nil {
+      return err
+    }
+
+    var availableCommands []int64
+    for _, availableCommand := range server.AvailableCommands {
+      if availableCommand != commandID {
+        availableCommands = append(availableCommands, availableCommand)
       }
-      memcache.Gob.Set(ctx, item)
     }
-  } else if err != nil {
-    return user, err
+    if available {
+      availableCommands = append(availableCommands, commandID)
+    }
+    server.AvailableCommands = availableCommands
+
+    _, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return err
   }
-  return user, nil
+
+  ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+  return nil
 }
 
-func findUserByServerAPIKeyNoCache(ctx appengine.Context, serverAPIKey string) (*datastore.Key, User, error) {
-  var user User
-  var userKey *datastore.Key
+func IsCommandAvailable(server storage.Server, commandID int64) bool {
+  for _, availableCommand := range server.AvailableCommands {
+    if availableCommand == commandID {
+      return true
+    }
+  }
+  return false
+}
 
-  query := datastore.NewQuery(DatastoreKindUser).
-           Filter("ServerAPIKey =", serverAPIKey).
-           Limit(1)
+// Loads the commands a server is allowed to run, skipping any that have since been deleted.
+func GetCommandsForServerNoCache(ctx Context, server storage.Server) ([]storage.Command, error) {
+  var commands []storage.Command
+  commandStorage := ctx.Storage()
 
-  for cursor := query.Run(ctx); ; {
-    if cursorKey, err := cursor.Next(&user); err == datastore.Done {
-      break
+  for _, commandID := range server.AvailableCommands {
+    command, err := commandStorage.GetCommand(commandID)
+    if err == ErrCommandNotFound {
+      continue
     } else if err != nil {
-      return cursorKey, user, err
-    } else {
-      userKey = cursorKey
+      return commands, err
     }
+    commands = append(commands, command)
+  }
+
+  return commands, nil
+}
+
+func GetCommandNoCache(ctx Context, user storage.User, commandID int64) (storage.Command, error) {
+  command, err := ctx.Storage().GetCommand(commandID)
+  if err != nil {
+    return command, err
+  } else if command.OrganizationID != user.OrganizationID {
+    return storage.Command{}, ErrCommandNotFound
+  }
+  normalizeCommandVersion(&command)
+  return command, nil
+}
+
+// Builds a queued invocation of the command on the server, checking the args against the command's params. Commands
+// that require approval get an invocation that waits for review instead.
+func newInvocationNoCache(ctx Context, user storage.User, commandID int64, serverID int64, args map[string]string) (storage.Invocation, error) {
+  var invocation storage.Invocation
+
+  command, err := GetCommandNoCache(ctx, user, commandID)
+  if err != nil {
+    return invocation, err
+  }
+
+  server, err := GetServerNoCache(ctx, user, serverID)
+  if err != nil {
+    return invocation, err
+  } else if !IsCommandAvailable(server, command.ID) {
+    return invocation, ErrCommandNotAvailable
   }
 
-  if userKey == nil {
-    return userKey, user, ErrUserNotFound
+  params, err := ResolveParams(command.Params, args)
+  if err != nil {
+    return invocation, err
   }
 
-  return userKey, user, nil
+  commandLine, err := RenderCommand(command.Command, params)
+  if err != nil {
+    return invocation, err
+  }
+
+  invocation = storage.Invocation{
+    UserID: user.ID,
+    OrganizationID: user.OrganizationID,
+    CommandID: command.ID,
+    CommandVersion: command.Version,
+    ServerID: server.ID,
+    Command: commandLine,
+    Params: params,
+    State: InvocationStateQueued,
+    CreatedTime: time.Now().UTC().Unix(),
+  }
+  requireApproval(command, &invocation)
+  return invocation, nil
 }
 
-func UpdateServerForUpdateRequest(ctx appengine.Context, user User, updateRequest UpdateRequest) (Server, error) {
-  var server Server
-  var serverKey *datastore.Key
+// A server an invocation couldn't be queued on.
+type InvocationServerError struct {
+  ServerID int64 `json:"serverId"`
+  Message string `json:"message"`
+}
 
-  query := datastore.NewQuery(DatastoreKindServer).
-           Filter("UserID =", user.ID).
-           Filter("ServerID =", updateRequest.ServerID).
-           Limit(1)
+// Queues an invocation of the command on each server. Every invocation is checked before any is stored, then each is
+// stored in its own transaction. When some can't be stored the rest are still returned along with an error for each
+// server that was missed; an error is only returned once none could be stored.
+func CreateInvocationsNoCache(ctx Context, user storage.User, invocationRequest CreateInvocationRequest) ([]storage.Invocation, []InvocationServerError, error) {
+  var invocations []storage.Invocation
+  var serverErrors []InvocationServerError
+
+  for _, serverID := range invocationRequest.Servers {
+    invocation, err := newInvocationNoCache(ctx, user, invocationRequest.CommandID, serverID, invocationRequest.Params)
+    if err != nil {
+      return nil, serverErrors, err
+    }
+    invocations = append(invocations, invocation)
+  }
 
-  for cursor := query.Run(ctx); ; {
-    if cursorKey, err := cursor.Next(&server); err == datastore.Done {
-      break
-    } else if err != nil {
-      return server, err
-    } else {
-      serverKey = cursorKey
+  var queued []storage.Invocation
+  var lastErr error
+  for i := range invocations {
+    var server storage.Server
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      var err error
+      server, err = putQueuedInvocation(tx, &invocations[i])
+      return err
+    })
+    if err != nil {
+      ctx.Errorf("Failed to queue invocation of command %d on server %d: %v", invocations[i].CommandID, invocations[i].ServerID, err)
+      serverErrors = append(serverErrors, InvocationServerError{ ServerID: invocations[i].ServerID, Message: err.Error() })
+      lastErr = err
+      continue
     }
+
+    queued = append(queued, invocations[i])
+    ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+    signalServerQueue(ctx, server.ID)
   }
 
-  if serverKey == nil {
-    log.Println("Creating server")
-    serverKey = datastore.NewIncompleteKey(ctx, DatastoreKindServer, nil)
-    server.UserID = user.ID
-    server.ServerID = updateRequest.ServerID
-    server.Name = updateRequest.Name
-    server.Description = updateRequest.Description
-    server.LastPollTime = time.Now().UTC().Unix()
-    server.PendingCommands = 0
-  } else {
-    server.LastPollTime = time.Now().UTC().Unix()
+  if len(queued) == 0 && lastErr != nil {
+    return queued, serverErrors, lastErr
   }
+  return queued, serverErrors, nil
+}
 
-  if _, err := datastore.Put(ctx, serverKey, &server); err != nil {
-    return server, err
+// Stores a new invocation and, unless it is waiting for approval, counts it against its server's pending commands.
+// Run it inside a transaction, then clear the server's cache entry and signal its queue once the transaction commits.
+func putQueuedInvocation(tx storage.Storage, invocation *storage.Invocation) (storage.Server, error) {
+  storedServer, err := tx.GetServer(invocation.ServerID)
+  if err != nil {
+    return storedServer, err
+  }
+  if invocation.State == InvocationStateQueued {
+    storedServer.PendingCommands++
+    if storedServer, err = tx.PutServer(storedServer); err != nil {
+      return storedServer, err
+    }
   }
 
-  return server, nil
+  storedInvocation, err := tx.PutInvocation(*invocation)
+  if err != nil {
+    return storedServer, err
+  }
+  invocation.ID = storedInvocation.ID
+  return storedServer, nil
 }
 
-func GetServersNoCache(ctx appengine.Context, user User) ([]Server, error) {
-  var servers []Server
+// Moves every queued invocation for the server to dispatched and returns them in the order they were queued.
+// Each invocation is claimed in its own transaction so concurrent polls never hand out the same invocation twice.
+func DispatchQueuedInvocations(ctx Context, server storage.Server) (storage.Server, []storage.Invocation, error) {
+  var invocations []storage.Invocation
+
+  invocationIDs, err := ctx.Storage().GetQueuedInvocationIDs(server.ID)
+  if err != nil {
+    return server, invocations, err
+  }
 
-  query := datastore.NewQuery(DatastoreKindServer).
-    Filter("UserID =", user.ID)
+  for _, invocationID := range invocationIDs {
+    var invocation storage.Invocation
+    var claimed bool
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      claimed = false
+      storedInvocation, err := tx.GetInvocation(invocationID)
+      if err != nil {
+        return err
+      }
+      if storedInvocation.State != InvocationStateQueued {
+        return nil
+      }
+      storedInvocation.State = InvocationStateDispatched
+      storedInvocation.DispatchedTime = time.Now().UTC().Unix()
+      if storedInvocation, err = tx.PutInvocation(storedInvocation); err != nil {
+        return err
+      }
 
-  if keys, err := query.GetAll(ctx, &servers); err != nil {
-    return servers, err
-  } else {
-    for i, key := range keys {
-      servers[i].ID = key.IntID()
+      storedServer, err := tx.GetServer(server.ID)
+      if err != nil {
+        return err
+      }
+      if storedServer.PendingCommands > 0 {
+        storedServer.PendingCommands--
+      }
+      if _, err := tx.PutServer(storedServer); err != nil {
+        return err
+      }
+      invocation = storedInvocation
+      server.PendingCommands = storedServer.PendingCommands
+      claimed = true
+      return nil
+    })
+    if err != nil {
+      return server, invocations, err
+    }
+
+    if claimed {
+      invocations = append(invocations, invocation)
     }
   }
 
-  return servers, nil
+  if len(invocations) > 0 {
+    ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+  }
+
+  return server, invocations, nil
 }
 
-func CreateCommandNoCache(ctx appengine.Context, user User, commandRequest CreateCommandRequest) (Command, error) {
-  var command Command
-  commandKey := datastore.NewIncompleteKey(ctx, DatastoreKindCommand, nil)
-  command.UserID = user.ID
-  command.PublicCommand = commandRequest.PublicCommand
-  command.Name = commandRequest.Name
-  command.Description = commandRequest.Description
-  command.Command = commandRequest.Command
-  command.Params = commandRequest.Params
+func GetInvocationsNoCache(ctx Context, user storage.User) ([]storage.Invocation, error) {
+  return ctx.Storage().GetInvocations(user.OrganizationID)
+}
 
-  if _, err := datastore.Put(ctx, commandKey, &command); err != nil {
-    return command, err
+func GetInvocationNoCache(ctx Context, user storage.User, invocationID int64) (storage.Invocation, error) {
+  invocation, err := ctx.Storage().GetInvocation(invocationID)
+  if err != nil {
+    return invocation, err
+  } else if invocation.OrganizationID != user.OrganizationID {
+    return storage.Invocation{}, ErrInvocationNotFound
   }
-  return command, nil
+  return invocation, nil
 }
 
-func GetCommandsNoCache(ctx appengine.Context, user User) ([]Command, error) {
-  var commands []Command
+func RecordInvocationResult(ctx Context, server storage.Server, resultRequest ResultRequest) (storage.Invocation, error) {
+  var invocation storage.Invocation
 
-  query := datastore.NewQuery(DatastoreKindCommand).
-    Filter("UserID =", user.ID)
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if invocation, err = tx.GetInvocation(resultRequest.InvocationID); err != nil {
+      return err
+    }
 
-  for cursor := query.Run(ctx); ; {
-    var command Command
-    if _, err := cursor.Next(&command); err == datastore.Done {
-      break
-    } else if err != nil {
-      return commands, err
+    if invocation.ServerID != server.ID {
+      return ErrInvocationNotFound
+    } else if invocation.State != InvocationStateDispatched {
+      return ErrInvocationNotDispatched
+    }
+
+    if resultRequest.ExitCode == 0 {
+      invocation.State = InvocationStateCompleted
     } else {
-      commands = append(commands, command)
+      invocation.State = InvocationStateFailed
+    }
+    invocation.CompletedTime = time.Now().UTC().Unix()
+    invocation.ExitCode = resultRequest.ExitCode
+    invocation.Stdout = resultRequest.Stdout
+    invocation.Stderr = resultRequest.Stderr
+    invocation.StartedTime = resultRequest.StartedTime
+    invocation.FinishedTime = resultRequest.FinishedTime
+    invocation.DurationMs = resultRequest.DurationMs
+    if invocation.DurationMs == 0 && invocation.FinishedTime > invocation.StartedTime {
+      invocation.DurationMs = (invocation.FinishedTime - invocation.StartedTime) * 1000
+    }
+
+    outputStream, err := tx.GetOutputStream(resultRequest.InvocationID)
+    if err != nil {
+      return err
     }
+    invocation.OutputChunks = outputStream.Chunks
+    invocation.OutputBytes = outputStream.Bytes
+
+    invocation, err = tx.PutInvocation(invocation)
+    return err
+  })
+  if err != nil {
+    return invocation, err
   }
 
-  return commands, nil
-}
+  signalInvocationOutput(ctx, invocation.ID)
 
-func AddCommandToServersNoCache(ctx appengine.Context, user User, serverIds []int64) (error) {
-  return nil
+  event := WebhookEventInvocationCompleted
+  if invocation.State == InvocationStateFailed {
+    event = WebhookEventInvocationFailed
+  }
+  if err := QueueWebhookEventNoCache(ctx, invocation.OrganizationID, event, map[string]interface{} { "invocation": invocation, "server": server }); err != nil {
+    ctx.Errorf("Failed to queue %s webhooks for invocation %d: %v", event, invocation.ID, err)
+  }
+
+  return invocation, nil
 }
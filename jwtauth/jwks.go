@@ -0,0 +1,214 @@
+package jwtauth
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rsa"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "sync"
+  "time"
+)
+
+var ErrUnsupportedKey = errors.New("Unsupported JSON web key")
+
+// How long keys fetched from a JWKS URL are used before they are fetched again, and how soon after a fetch an
+// unknown key ID may cause another. Identity providers publish new keys ahead of using them, so the wait only matters
+// when one rotates in a hurry.
+const (
+  jwksCacheDuration = time.Hour
+  jwksRefetchInterval = time.Minute
+)
+
+type jsonWebKey struct {
+  KeyType string `json:"kty"`
+  KeyID string `json:"kid"`
+  Use string `json:"use"`
+  Algorithm string `json:"alg"`
+  N string `json:"n"`
+  E string `json:"e"`
+  Curve string `json:"crv"`
+  X string `json:"x"`
+  Y string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+  Keys []jsonWebKey `json:"keys"`
+}
+
+// A key ready to check signatures with. Algorithm is only set when the key is limited to one.
+type verificationKey struct {
+  algorithm string
+  publicKey crypto.PublicKey
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+  decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+  if err != nil {
+    return nil, err
+  }
+  return new(big.Int).SetBytes(decoded), nil
+}
+
+func (key jsonWebKey) verificationKey() (verificationKey, error) {
+  switch key.KeyType {
+    case "RSA":
+      n, err := decodeBigInt(key.N)
+      if err != nil {
+        return verificationKey{}, err
+      }
+      e, err := decodeBigInt(key.E)
+      if err != nil {
+        return verificationKey{}, err
+      } else if e.BitLen() > 31 || e.Int64() < 3 {
+        return verificationKey{}, ErrUnsupportedKey
+      }
+      return verificationKey{ algorithm: key.Algorithm, publicKey: &rsa.PublicKey{ N: n, E: int(e.Int64()) } }, nil
+
+    case "EC":
+      var curve elliptic.Curve
+      switch key.Curve {
+        case "P-256": curve = elliptic.P256()
+        case "P-384": curve = elliptic.P384()
+        case "P-521": curve = elliptic.P521()
+        default: return verificationKey{}, ErrUnsupportedKey
+      }
+      x, err := decodeBigInt(key.X)
+      if err != nil {
+        return verificationKey{}, err
+      }
+      y, err := decodeBigInt(key.Y)
+      if err != nil {
+        return verificationKey{}, err
+      }
+      if !curve.IsOnCurve(x, y) {
+        return verificationKey{}, ErrUnsupportedKey
+      }
+      return verificationKey{ algorithm: key.Algorithm, publicKey: &ecdsa.PublicKey{ Curve: curve, X: x, Y: y } }, nil
+  }
+  return verificationKey{}, ErrUnsupportedKey
+}
+
+// Parses a JWKS document into keys by key ID. Keys meant for something other than signatures, or of a type we can't
+// use, are skipped.
+func parseKeySet(document []byte) (map[string]verificationKey, error) {
+  var keySet jsonWebKeySet
+  if err := json.Unmarshal(document, &keySet); err != nil {
+    return nil, err
+  }
+
+  keys := make(map[string]verificationKey)
+  for _, key := range keySet.Keys {
+    if key.Use != "" && key.Use != "sig" {
+      continue
+    }
+    if verificationKey, err := key.verificationKey(); err == nil {
+      keys[key.KeyID] = verificationKey
+    }
+  }
+  return keys, nil
+}
+
+// An issuer's keys, read once from a file or fetched from a URL and kept for a while.
+type keySource struct {
+  url string
+  lock sync.Mutex
+  keys map[string]verificationKey
+  fetchedTime time.Time
+  fetchErr error
+  // Closed when the fetch under way finishes, nil when there isn't one
+  fetching chan struct{}
+}
+
+func newFileKeySource(path string) (*keySource, error) {
+  document, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  keys, err := parseKeySet(document)
+  if err != nil {
+    return nil, err
+  }
+  return &keySource{ keys: keys }, nil
+}
+
+func newURLKeySource(url string) *keySource {
+  return &keySource{ url: url }
+}
+
+// Returns the key with the given ID, fetching the key set again if it is stale or doesn't have the key yet.
+func (source *keySource) key(keyID string, client *http.Client, now time.Time) (verificationKey, error) {
+  source.lock.Lock()
+  defer source.lock.Unlock()
+
+  key, ok := source.keys[keyID]
+  if source.url == "" {
+    if !ok {
+      return key, ErrUnknownKey
+    }
+    return key, nil
+  }
+
+  stale := now.Sub(source.fetchedTime) > jwksCacheDuration
+  if stale || (!ok && (source.fetching != nil || now.Sub(source.fetchedTime) > jwksRefetchInterval)) {
+    source.refresh(client, now)
+    // Keys we already have are better than none when the identity provider can't be reached
+    if source.keys == nil && source.fetchErr != nil {
+      return key, source.fetchErr
+    }
+    key, ok = source.keys[keyID]
+  }
+  if !ok {
+    return key, ErrUnknownKey
+  }
+  return key, nil
+}
+
+// Fetches the key set again, or waits for the fetch already under way. Called with the lock held, which is let go
+// while fetching so requests with keys we already have aren't held up by the identity provider.
+func (source *keySource) refresh(client *http.Client, now time.Time) {
+  if fetching := source.fetching; fetching != nil {
+    source.lock.Unlock()
+    <-fetching
+    source.lock.Lock()
+    return
+  }
+
+  fetching := make(chan struct{})
+  source.fetching = fetching
+  // Note the attempt even if it fails so a broken identity provider isn't asked again on every request
+  source.fetchedTime = now
+  source.lock.Unlock()
+
+  keys, err := fetchKeySet(source.url, client)
+
+  source.lock.Lock()
+  if err == nil {
+    source.keys = keys
+  }
+  source.fetchErr = err
+  source.fetching = nil
+  close(fetching)
+}
+
+func fetchKeySet(url string, client *http.Client) (map[string]verificationKey, error) {
+  resp, err := client.Get(url)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, errors.New("Fetching " + url + " returned " + resp.Status)
+  }
+
+  var document json.RawMessage
+  if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+    return nil, err
+  }
+  return parseKeySet(document)
+}
@@ -0,0 +1,199 @@
+package jwtauth
+
+import (
+  "crypto/elliptic"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Serves a key set that tests can change, counting fetches. While blocked, fetches wait until unblocked.
+type testKeySetServer struct {
+  *httptest.Server
+  lock sync.Mutex
+  keys []jsonWebKey
+  status int
+  fetches int
+  blocked chan struct{}
+  // Sent to as each fetch arrives
+  fetched chan struct{}
+}
+
+func newTestKeySetServer(keys ...jsonWebKey) *testKeySetServer {
+  server := &testKeySetServer{ keys: keys, status: http.StatusOK, fetched: make(chan struct{}, 100) }
+  server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+  return server
+}
+
+func (server *testKeySetServer) serve(res http.ResponseWriter, req *http.Request) {
+  server.lock.Lock()
+  server.fetches++
+  blocked := server.blocked
+  keys := server.keys
+  status := server.status
+  server.lock.Unlock()
+
+  server.fetched <- struct{}{}
+  if blocked != nil {
+    <-blocked
+  }
+  res.WriteHeader(status)
+  json.NewEncoder(res).Encode(jsonWebKeySet{ Keys: keys })
+}
+
+func (server *testKeySetServer) set(change func(*testKeySetServer)) {
+  server.lock.Lock()
+  defer server.lock.Unlock()
+  change(server)
+}
+
+func (server *testKeySetServer) fetchCount() int {
+  server.lock.Lock()
+  defer server.lock.Unlock()
+  return server.fetches
+}
+
+func TestKeySourceRefetchesForUnknownKeys(t *testing.T) {
+  first := publicJWK("first", "ES256", ecdsaKey(t, elliptic.P256()))
+  second := publicJWK("second", "ES256", ecdsaKey(t, elliptic.P256()))
+  server := newTestKeySetServer(first)
+  defer server.Close()
+  source := newURLKeySource(server.URL)
+  start := time.Unix(1500000000, 0)
+
+  steps := []struct {
+    name string
+    keyID string
+    after time.Duration
+    expectedErr error
+    expectedFetches int
+  }{
+    { "first lookup", "first", 0, nil, 1 },
+    { "known key", "first", time.Second, nil, 1 },
+    { "unknown key straight after a fetch", "second", 30 * time.Second, ErrUnknownKey, 1 },
+    { "unknown key once the refetch interval has passed", "second", jwksRefetchInterval + time.Second, nil, 2 },
+    { "unknown key the issuer doesn't have", "third", jwksRefetchInterval + 2 * time.Second, ErrUnknownKey, 2 },
+    { "unknown key the issuer doesn't have, later", "third", 2 * jwksRefetchInterval + 2 * time.Second, ErrUnknownKey, 3 },
+    { "known key once the key set is stale", "first", jwksCacheDuration + 3 * jwksRefetchInterval, nil, 4 },
+  }
+
+  for i, step := range steps {
+    if i == 3 {
+      server.set(func (server *testKeySetServer) { server.keys = []jsonWebKey { first, second } })
+    }
+    _, err := source.key(step.keyID, http.DefaultClient, start.Add(step.after))
+    if err != step.expectedErr {
+      t.Errorf("%s: key returned %v, expected %v", step.name, err, step.expectedErr)
+    }
+    if fetches := server.fetchCount(); fetches != step.expectedFetches {
+      t.Errorf("%s: key set was fetched %d times, expected %d", step.name, fetches, step.expectedFetches)
+    }
+  }
+}
+
+func TestKeySourceFetchesOnceForConcurrentLookups(t *testing.T) {
+  first := publicJWK("first", "ES256", ecdsaKey(t, elliptic.P256()))
+  second := publicJWK("second", "ES256", ecdsaKey(t, elliptic.P256()))
+  server := newTestKeySetServer(first)
+  defer server.Close()
+  source := newURLKeySource(server.URL)
+  start := time.Unix(1500000000, 0)
+
+  if _, err := source.key("first", http.DefaultClient, start); err != nil {
+    t.Fatal(err)
+  }
+  <-server.fetched
+
+  blocked := make(chan struct{})
+  server.set(func (server *testKeySetServer) {
+    server.keys = []jsonWebKey { first, second }
+    server.blocked = blocked
+  })
+
+  // Lookups for a key we don't have yet all wait on the one fetch
+  now := start.Add(jwksRefetchInterval + time.Second)
+  const lookups = 10
+  errs := make(chan error, lookups)
+  for i := 0; i < lookups; i++ {
+    go func () {
+      _, err := source.key("second", http.DefaultClient, now)
+      errs <- err
+    }()
+  }
+  <-server.fetched
+
+  // Lookups for a key we already have don't wait on it
+  known := make(chan error, 1)
+  go func () {
+    _, err := source.key("first", http.DefaultClient, now)
+    known <- err
+  }()
+  select {
+    case err := <-known:
+      if err != nil {
+        t.Errorf("known key returned %v during a fetch", err)
+      }
+    case <-time.After(5 * time.Second):
+      t.Errorf("known key waited on a fetch")
+  }
+
+  // Give the lookups for the new key time to reach the fetch before it finishes
+  time.Sleep(50 * time.Millisecond)
+  close(blocked)
+  for i := 0; i < lookups; i++ {
+    if err := <-errs; err != nil {
+      t.Errorf("lookup %d returned %v, expected the new key", i, err)
+    }
+  }
+  if fetches := server.fetchCount(); fetches != 2 {
+    t.Errorf("key set was fetched %d times, expected 2", fetches)
+  }
+}
+
+func TestKeySourceKeepsKeysWhenFetchesFail(t *testing.T) {
+  first := publicJWK("first", "ES256", ecdsaKey(t, elliptic.P256()))
+  server := newTestKeySetServer(first)
+  defer server.Close()
+  start := time.Unix(1500000000, 0)
+
+  failing := newURLKeySource(server.URL)
+  server.set(func (server *testKeySetServer) { server.status = http.StatusInternalServerError })
+  if _, err := failing.key("first", http.DefaultClient, start); err == nil || err == ErrUnknownKey {
+    t.Errorf("key with no key set and a failing fetch returned %v, expected the fetch's error", err)
+  }
+
+  source := newURLKeySource(server.URL)
+  server.set(func (server *testKeySetServer) { server.status = http.StatusOK })
+  if _, err := source.key("first", http.DefaultClient, start); err != nil {
+    t.Fatal(err)
+  }
+  server.set(func (server *testKeySetServer) { server.status = http.StatusInternalServerError })
+  if _, err := source.key("first", http.DefaultClient, start.Add(jwksCacheDuration + time.Second)); err != nil {
+    t.Errorf("key once stale with a failing fetch returned %v, expected the key already fetched", err)
+  }
+}
+
+func TestParseKeySetSkipsUnusableKeys(t *testing.T) {
+  signing := publicJWK("signing", "", ecdsaKey(t, elliptic.P256()))
+  signing.Use = "sig"
+  encryption := publicJWK("encryption", "", ecdsaKey(t, elliptic.P256()))
+  encryption.Use = "enc"
+  offCurve := publicJWK("off-curve", "", ecdsaKey(t, elliptic.P256()))
+  offCurve.X, offCurve.Y = offCurve.Y, offCurve.X
+  symmetric := jsonWebKey{ KeyType: "oct", KeyID: "symmetric" }
+
+  document, err := json.Marshal(jsonWebKeySet{ Keys: []jsonWebKey { signing, encryption, offCurve, symmetric } })
+  if err != nil {
+    t.Fatal(err)
+  }
+  keys, err := parseKeySet(document)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := keys["signing"]; !ok || len(keys) != 1 {
+    t.Errorf("parsed keys %v, expected only the signing key", keys)
+  }
+}
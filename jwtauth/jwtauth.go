@@ -0,0 +1,236 @@
+// Package jwtauth verifies signed JWT bearer tokens locally, against the keys of the issuers it is configured to
+// trust, so an identity provider's tokens can be accepted without asking the provider about each one.
+package jwtauth
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/rsa"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "math/big"
+  "net/http"
+  "strings"
+  "time"
+)
+
+var ErrMalformedToken = errors.New("Token is not a signed JWT")
+var ErrUnsupportedAlgorithm = errors.New("Token is signed with an unsupported algorithm")
+var ErrUnknownIssuer = errors.New("Token was issued by an issuer that isn't trusted")
+var ErrUnknownKey = errors.New("Token was signed with an unknown key")
+var ErrInvalidSignature = errors.New("Token signature is invalid")
+var ErrWrongAudience = errors.New("Token is not meant for this audience")
+var ErrExpired = errors.New("Token has expired or is not valid yet")
+var ErrNoEmail = errors.New("Token does not carry a verified email")
+var ErrNoKeySet = errors.New("An issuer needs either jwksFile or jwksUrl")
+var ErrNoAudience = errors.New("An issuer needs at least one audience")
+
+// How far apart our clock and the issuer's may be.
+const clockLeeway = time.Minute
+
+type IssuerConfig struct {
+  // Must match the token's iss claim exactly
+  Issuer string `json:"issuer"`
+  // Tokens must name at least one of these in their aud claim
+  Audiences []string `json:"audiences"`
+  // Where the issuer's signing keys are, either a JWKS file or a URL to fetch one from
+  JWKSFile string `json:"jwksFile,omitempty"`
+  JWKSURL string `json:"jwksUrl,omitempty"`
+  // The claim holding the user's email, email when not set
+  EmailClaim string `json:"emailClaim,omitempty"`
+  // Accept the email claim without an email_verified claim of true. Only for issuers that only hand out emails they
+  // have verified themselves.
+  TrustEmailClaim bool `json:"trustEmailClaim,omitempty"`
+}
+
+type Claims map[string]interface{}
+
+type issuer struct {
+  config IssuerConfig
+  keys *keySource
+}
+
+type Verifier struct {
+  issuers map[string]*issuer
+}
+
+func NewVerifier(configs []IssuerConfig) (*Verifier, error) {
+  verifier := &Verifier{ issuers: make(map[string]*issuer) }
+  for _, config := range configs {
+    if len(config.Audiences) == 0 {
+      return nil, ErrNoAudience
+    }
+    if config.EmailClaim == "" {
+      config.EmailClaim = "email"
+    }
+
+    var keys *keySource
+    var err error
+    if config.JWKSFile != "" {
+      keys, err = newFileKeySource(config.JWKSFile)
+    } else if config.JWKSURL != "" {
+      keys = newURLKeySource(config.JWKSURL)
+    } else {
+      err = ErrNoKeySet
+    }
+    if err != nil {
+      return nil, err
+    }
+    verifier.issuers[config.Issuer] = &issuer{ config: config, keys: keys }
+  }
+  return verifier, nil
+}
+
+// Whether a bearer token looks like a JWT rather than an opaque token, so callers can tell which way to check it.
+func LooksLikeJWT(token string) bool {
+  return strings.Count(token, ".") == 2
+}
+
+type header struct {
+  Algorithm string `json:"alg"`
+  KeyID string `json:"kid"`
+}
+
+func decodeSegment(segment string, v interface{}) error {
+  decoded, err := base64.RawURLEncoding.DecodeString(segment)
+  if err != nil {
+    return ErrMalformedToken
+  }
+  if err := json.Unmarshal(decoded, v); err != nil {
+    return ErrMalformedToken
+  }
+  return nil
+}
+
+// Checks a token's signature and claims and returns the claims along with the email they carry. client is used to
+// fetch key sets from issuers configured with a URL.
+func (verifier *Verifier) Verify(token string, client *http.Client) (Claims, string, error) {
+  segments := strings.Split(token, ".")
+  if len(segments) != 3 {
+    return nil, "", ErrMalformedToken
+  }
+
+  var tokenHeader header
+  if err := decodeSegment(segments[0], &tokenHeader); err != nil {
+    return nil, "", err
+  }
+  var claims Claims
+  if err := decodeSegment(segments[1], &claims); err != nil {
+    return nil, "", err
+  }
+  signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+  if err != nil {
+    return nil, "", ErrMalformedToken
+  }
+
+  issuerName, _ := claims["iss"].(string)
+  tokenIssuer, ok := verifier.issuers[issuerName]
+  if !ok {
+    return nil, "", ErrUnknownIssuer
+  }
+
+  now := time.Now()
+  key, err := tokenIssuer.keys.key(tokenHeader.KeyID, client, now)
+  if err != nil {
+    return nil, "", err
+  }
+  if key.algorithm != "" && key.algorithm != tokenHeader.Algorithm {
+    return nil, "", ErrUnsupportedAlgorithm
+  }
+  if err := verifySignature(tokenHeader.Algorithm, key.publicKey, segments[0] + "." + segments[1], signature); err != nil {
+    return nil, "", err
+  }
+
+  if err := claims.checkTimes(now); err != nil {
+    return nil, "", err
+  }
+  if !claims.hasAudience(tokenIssuer.config.Audiences) {
+    return nil, "", ErrWrongAudience
+  }
+
+  email, _ := claims[tokenIssuer.config.EmailClaim].(string)
+  verified, _ := claims["email_verified"].(bool)
+  if email == "" || !(verified || tokenIssuer.config.TrustEmailClaim) {
+    return nil, "", ErrNoEmail
+  }
+  return claims, email, nil
+}
+
+func verifySignature(algorithm string, publicKey crypto.PublicKey, signed string, signature []byte) error {
+  if len(algorithm) != 5 {
+    return ErrUnsupportedAlgorithm
+  }
+  var hash crypto.Hash
+  switch algorithm[2:] {
+    case "256": hash = crypto.SHA256
+    case "384": hash = crypto.SHA384
+    case "512": hash = crypto.SHA512
+    default: return ErrUnsupportedAlgorithm
+  }
+  hasher := hash.New()
+  hasher.Write([]byte(signed))
+  digest := hasher.Sum(nil)
+
+  switch algorithm[:2] {
+    case "RS":
+      rsaKey, ok := publicKey.(*rsa.PublicKey)
+      if !ok || rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature) != nil {
+        return ErrInvalidSignature
+      }
+      return nil
+
+    case "ES":
+      ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+      if !ok {
+        return ErrInvalidSignature
+      }
+      // ES signatures are r and s side by side, each as long as the curve's order
+      size := (ecdsaKey.Curve.Params().BitSize + 7) / 8
+      if len(signature) != 2 * size {
+        return ErrInvalidSignature
+      }
+      r := new(big.Int).SetBytes(signature[:size])
+      s := new(big.Int).SetBytes(signature[size:])
+      if !ecdsa.Verify(ecdsaKey, digest, r, s) {
+        return ErrInvalidSignature
+      }
+      return nil
+  }
+  return ErrUnsupportedAlgorithm
+}
+
+func (claims Claims) checkTimes(now time.Time) error {
+  expires, ok := claims["exp"].(float64)
+  if !ok || now.Add(-clockLeeway).Unix() >= int64(expires) {
+    return ErrExpired
+  }
+  if notBefore, ok := claims["nbf"].(float64); ok && now.Add(clockLeeway).Unix() < int64(notBefore) {
+    return ErrExpired
+  }
+  return nil
+}
+
+// The aud claim may be a single string or a list of them.
+func (claims Claims) hasAudience(audiences []string) bool {
+  var tokenAudiences []string
+  switch aud := claims["aud"].(type) {
+    case string:
+      tokenAudiences = []string { aud }
+    case []interface{}:
+      for _, audience := range aud {
+        if audience, ok := audience.(string); ok {
+          tokenAudiences = append(tokenAudiences, audience)
+        }
+      }
+  }
+
+  for _, tokenAudience := range tokenAudiences {
+    for _, audience := range audiences {
+      if tokenAudience == audience {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -0,0 +1,327 @@
+package jwtauth
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/json"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+const (
+  testIssuer = "https://issuer.example.com"
+  testTrustingIssuer = "https://trusting.example.com"
+  testAudience = "biboop"
+)
+
+var testRSAKey *rsa.PrivateKey
+var testRSAKeyOnce sync.Once
+
+// Generating an RSA key is slow, so every test shares one.
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+  testRSAKeyOnce.Do(func () {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+      t.Fatal(err)
+    }
+    testRSAKey = key
+  })
+  return testRSAKey
+}
+
+func ecdsaKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+  key, err := ecdsa.GenerateKey(curve, rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return key
+}
+
+func encodeBigInt(i *big.Int) string {
+  return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// The JWK for a key's public half, limited to alg when it is set.
+func publicJWK(kid string, alg string, key crypto.Signer) jsonWebKey {
+  switch publicKey := key.Public().(type) {
+    case *rsa.PublicKey:
+      return jsonWebKey{ KeyType: "RSA", KeyID: kid, Algorithm: alg, N: encodeBigInt(publicKey.N), E: encodeBigInt(big.NewInt(int64(publicKey.E))) }
+    case *ecdsa.PublicKey:
+      return jsonWebKey{ KeyType: "EC", KeyID: kid, Algorithm: alg, Curve: publicKey.Curve.Params().Name, X: encodeBigInt(publicKey.X), Y: encodeBigInt(publicKey.Y) }
+  }
+  panic("unsupported key")
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+  encoded, err := json.Marshal(v)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+var testHashes = map[string]crypto.Hash { "256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512 }
+
+func sign(t *testing.T, alg string, key crypto.Signer, signed string) []byte {
+  hash := testHashes[alg[2:]]
+  hasher := hash.New()
+  hasher.Write([]byte(signed))
+  digest := hasher.Sum(nil)
+
+  switch privateKey := key.(type) {
+    case *rsa.PrivateKey:
+      signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, hash, digest)
+      if err != nil {
+        t.Fatal(err)
+      }
+      return signature
+    case *ecdsa.PrivateKey:
+      r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest)
+      if err != nil {
+        t.Fatal(err)
+      }
+      // r and s are padded to the size of the curve's order and put side by side
+      size := (privateKey.Curve.Params().BitSize + 7) / 8
+      signature := make([]byte, 2 * size)
+      copy(signature[size - len(r.Bytes()):size], r.Bytes())
+      copy(signature[2 * size - len(s.Bytes()):], s.Bytes())
+      return signature
+  }
+  t.Fatal("unsupported key")
+  return nil
+}
+
+func signedPart(t *testing.T, alg string, kid string, claims Claims) string {
+  return encodeSegment(t, map[string]string { "alg": alg, "kid": kid, "typ": "JWT" }) + "." + encodeSegment(t, claims)
+}
+
+func signToken(t *testing.T, alg string, kid string, key crypto.Signer, claims Claims) string {
+  signed := signedPart(t, alg, kid, claims)
+  return signed + "." + base64.RawURLEncoding.EncodeToString(sign(t, alg, key, signed))
+}
+
+func validClaims(issuer string) Claims {
+  now := time.Now().Unix()
+  return Claims {
+    "iss": issuer,
+    "aud": testAudience,
+    "exp": float64(now + 300),
+    "iat": float64(now),
+    "email": "someone@example.com",
+    "email_verified": true,
+  }
+}
+
+func withClaims(claims Claims, changes Claims) Claims {
+  changed := Claims {}
+  for name, value := range claims {
+    changed[name] = value
+  }
+  for name, value := range changes {
+    if value == nil {
+      delete(changed, name)
+    } else {
+      changed[name] = value
+    }
+  }
+  return changed
+}
+
+func writeKeySet(t *testing.T, dir string, keys ...jsonWebKey) string {
+  document, err := json.Marshal(jsonWebKeySet{ Keys: keys })
+  if err != nil {
+    t.Fatal(err)
+  }
+  file, err := ioutil.TempFile(dir, "jwks")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  if _, err := file.Write(document); err != nil {
+    t.Fatal(err)
+  }
+  return file.Name()
+}
+
+func TestVerify(t *testing.T) {
+  dir, err := ioutil.TempDir("", "biboop-jwtauth")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  rsaPrivateKey := rsaKey(t)
+  es256Key := ecdsaKey(t, elliptic.P256())
+  es384Key := ecdsaKey(t, elliptic.P384())
+  es512Key := ecdsaKey(t, elliptic.P521())
+  keySet := writeKeySet(t, dir,
+    publicJWK("rsa", "RS256", rsaPrivateKey),
+    publicJWK("rsa-any", "", rsaPrivateKey),
+    publicJWK("es256", "ES256", es256Key),
+    publicJWK("es384", "ES384", es384Key),
+    publicJWK("es512", "ES512", es512Key))
+  verifier, err := NewVerifier([]IssuerConfig {
+    { Issuer: testIssuer, Audiences: []string { testAudience }, JWKSFile: keySet },
+    { Issuer: testTrustingIssuer, Audiences: []string { "other", testAudience }, JWKSFile: keySet, EmailClaim: "upn", TrustEmailClaim: true },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  claims := validClaims(testIssuer)
+  valid := signToken(t, "RS256", "rsa", rsaPrivateKey, claims)
+  signed := signedPart(t, "RS256", "rsa", claims)
+  es256Signature := sign(t, "ES256", es256Key, signedPart(t, "ES256", "es256", claims))
+  es384Signature := sign(t, "ES384", es384Key, signedPart(t, "ES384", "es384", claims))
+  es512Signature := sign(t, "ES512", es512Key, signedPart(t, "ES512", "es512", claims))
+
+  // An HMAC keyed with the RSA public key, the classic way of getting a symmetric algorithm past an asymmetric key
+  publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaPrivateKey.Public())
+  if err != nil {
+    t.Fatal(err)
+  }
+  hs256Signed := signedPart(t, "HS256", "rsa-any", claims)
+  hs256Mac := hmac.New(crypto.SHA256.New, publicKeyBytes)
+  hs256Mac.Write([]byte(hs256Signed))
+
+  withSignature := func (signed string, signature []byte) string {
+    return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+  }
+
+  tests := []struct {
+    name string
+    token string
+    expectedEmail string
+    expectedErr error
+  }{
+    { "valid RS256", valid, "someone@example.com", nil },
+    { "valid ES256", withSignature(signedPart(t, "ES256", "es256", claims), es256Signature), "someone@example.com", nil },
+    { "valid ES384", withSignature(signedPart(t, "ES384", "es384", claims), es384Signature), "someone@example.com", nil },
+    { "valid ES512", withSignature(signedPart(t, "ES512", "es512", claims), es512Signature), "someone@example.com", nil },
+    { "not three segments", "a.b", "", ErrMalformedToken },
+    { "header that isn't JSON", base64.RawURLEncoding.EncodeToString([]byte("not json")) + "." + valid[len(signed) - len(encodeSegment(t, claims)):], "", ErrMalformedToken },
+    { "tampered claims", signedPart(t, "RS256", "rsa", withClaims(claims, Claims { "email": "someone-else@example.com" })) + valid[len(signed):], "", ErrInvalidSignature },
+    { "alg none against a key limited to RS256", signedPart(t, "none", "rsa", claims) + ".", "", ErrUnsupportedAlgorithm },
+    { "alg none against a key of any algorithm", signedPart(t, "none", "rsa-any", claims) + ".", "", ErrUnsupportedAlgorithm },
+    { "HS256 against a key limited to RS256", withSignature(signedPart(t, "HS256", "rsa", claims), hs256Mac.Sum(nil)), "", ErrUnsupportedAlgorithm },
+    { "HS256 against a key of any algorithm", withSignature(hs256Signed, hs256Mac.Sum(nil)), "", ErrUnsupportedAlgorithm },
+    { "RS256 signature with ES256 named", withSignature(signedPart(t, "ES256", "rsa-any", claims), sign(t, "RS256", rsaPrivateKey, signedPart(t, "ES256", "rsa-any", claims))), "", ErrInvalidSignature },
+    { "unknown kid", signToken(t, "RS256", "someone-elses", rsaPrivateKey, claims), "", ErrUnknownKey },
+    { "kid of a different key", signToken(t, "ES256", "es384", es256Key, claims), "", ErrUnsupportedAlgorithm },
+    { "ES256 signature a byte short", withSignature(signedPart(t, "ES256", "es256", claims), es256Signature[1:]), "", ErrInvalidSignature },
+    { "ES256 signature a byte long", withSignature(signedPart(t, "ES256", "es256", claims), append([]byte { 0 }, es256Signature...)), "", ErrInvalidSignature },
+    { "ES384 signature a byte short", withSignature(signedPart(t, "ES384", "es384", claims), es384Signature[1:]), "", ErrInvalidSignature },
+    { "ES384 signature a byte long", withSignature(signedPart(t, "ES384", "es384", claims), append([]byte { 0 }, es384Signature...)), "", ErrInvalidSignature },
+    { "ES512 signature a byte short", withSignature(signedPart(t, "ES512", "es512", claims), es512Signature[1:]), "", ErrInvalidSignature },
+    { "ES512 signature a byte long", withSignature(signedPart(t, "ES512", "es512", claims), append([]byte { 0 }, es512Signature...)), "", ErrInvalidSignature },
+    { "ES256 signature against a P-384 key", withSignature(signedPart(t, "ES384", "es384", claims), es256Signature), "", ErrInvalidSignature },
+    { "unknown issuer", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "iss": "https://elsewhere.example.com" })), "", ErrUnknownIssuer },
+    { "expired", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "exp": float64(time.Now().Unix() - 120) })), "", ErrExpired },
+    { "no exp", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "exp": nil })), "", ErrExpired },
+    { "not valid yet", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "nbf": float64(time.Now().Unix() + 120) })), "", ErrExpired },
+    { "aud as an array", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "aud": []interface{} { "other", testAudience } })), "someone@example.com", nil },
+    { "wrong aud", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "aud": "other" })), "", ErrWrongAudience },
+    { "wrong aud in an array", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "aud": []interface{} { "other" } })), "", ErrWrongAudience },
+    { "email_verified false", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "email_verified": false })), "", ErrNoEmail },
+    { "email_verified missing", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "email_verified": nil })), "", ErrNoEmail },
+    { "email_verified as a string", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "email_verified": "true" })), "", ErrNoEmail },
+    { "no email", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(claims, Claims { "email": nil })), "", ErrNoEmail },
+    { "trusted email claim without email_verified", signToken(t, "RS256", "rsa", rsaPrivateKey, withClaims(validClaims(testTrustingIssuer), Claims { "upn": "upn@example.com", "email_verified": false })), "upn@example.com", nil },
+    { "trusted issuer missing its email claim", signToken(t, "RS256", "rsa", rsaPrivateKey, validClaims(testTrustingIssuer)), "", ErrNoEmail },
+  }
+
+  for _, test := range tests {
+    _, email, err := verifier.Verify(test.token, nil)
+    if err != test.expectedErr || email != test.expectedEmail {
+      t.Errorf("%s: Verify returned %q, %v, expected %q, %v", test.name, email, err, test.expectedEmail, test.expectedErr)
+    }
+  }
+}
+
+func TestCheckTimesLeeway(t *testing.T) {
+  now := time.Unix(1500000000, 0)
+  leeway := int64(clockLeeway / time.Second)
+
+  tests := []struct {
+    name string
+    claims Claims
+    expectedErr error
+  }{
+    { "exp just inside the leeway", Claims { "exp": float64(now.Unix() - leeway + 1) }, nil },
+    { "exp at the end of the leeway", Claims { "exp": float64(now.Unix() - leeway) }, ErrExpired },
+    { "exp still ahead", Claims { "exp": float64(now.Unix() + 1) }, nil },
+    { "no exp", Claims {}, ErrExpired },
+    { "exp as a string", Claims { "exp": "2000000000" }, ErrExpired },
+    { "nbf at the end of the leeway", Claims { "exp": float64(now.Unix() + 300), "nbf": float64(now.Unix() + leeway) }, nil },
+    { "nbf just past the leeway", Claims { "exp": float64(now.Unix() + 300), "nbf": float64(now.Unix() + leeway + 1) }, ErrExpired },
+    { "nbf already passed", Claims { "exp": float64(now.Unix() + 300), "nbf": float64(now.Unix() - 1) }, nil },
+  }
+
+  for _, test := range tests {
+    if err := test.claims.checkTimes(now); err != test.expectedErr {
+      t.Errorf("%s: checkTimes returned %v, expected %v", test.name, err, test.expectedErr)
+    }
+  }
+}
+
+func TestHasAudience(t *testing.T) {
+  audiences := []string { "first", "second" }
+
+  tests := []struct {
+    name string
+    aud interface{}
+    expected bool
+  }{
+    { "string", "second", true },
+    { "other string", "third", false },
+    { "array", []interface{} { "third", "first" }, true },
+    { "array of others", []interface{} { "third" }, false },
+    { "array with a number", []interface{} { 1.0, "first" }, true },
+    { "empty array", []interface{} {}, false },
+    { "number", 1.0, false },
+    { "missing", nil, false },
+  }
+
+  for _, test := range tests {
+    claims := Claims {}
+    if test.aud != nil {
+      claims["aud"] = test.aud
+    }
+    if got := claims.hasAudience(audiences); got != test.expected {
+      t.Errorf("%s: hasAudience returned %v, expected %v", test.name, got, test.expected)
+    }
+  }
+}
+
+func TestNewVerifierChecksConfig(t *testing.T) {
+  tests := []struct {
+    name string
+    config IssuerConfig
+    expectedErr error
+  }{
+    { "no audience", IssuerConfig{ Issuer: testIssuer, JWKSURL: "https://issuer.example.com/jwks" }, ErrNoAudience },
+    { "no key set", IssuerConfig{ Issuer: testIssuer, Audiences: []string { testAudience } }, ErrNoKeySet },
+    { "key set URL", IssuerConfig{ Issuer: testIssuer, Audiences: []string { testAudience }, JWKSURL: "https://issuer.example.com/jwks" }, nil },
+  }
+
+  for _, test := range tests {
+    if _, err := NewVerifier([]IssuerConfig { test.config }); err != test.expectedErr {
+      t.Errorf("%s: NewVerifier returned %v, expected %v", test.name, err, test.expectedErr)
+    }
+  }
+
+  if _, err := NewVerifier([]IssuerConfig {{ Issuer: testIssuer, Audiences: []string { testAudience }, JWKSFile: filepath.Join(os.TempDir(), "biboop-missing-jwks") }}); err == nil {
+    t.Errorf("NewVerifier with a missing JWKS file returned no error")
+  }
+}
@@ -0,0 +1,228 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "regexp"
+  "sort"
+  "strings"
+)
+
+var ErrNoServersMatch = errors.New("No servers match the selector")
+var ErrNoMatchingServersHaveCommand = errors.New("No servers matching the selector have the command")
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+var labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9_./-]*$`)
+
+const (
+  LabelOperatorEquals = "="
+  LabelOperatorNotEquals = "!="
+  LabelOperatorExists = "exists"
+  LabelOperatorNotExists = "!exists"
+)
+
+type LabelSelectorError string
+
+func (err LabelSelectorError) Error() string {
+  return string(err)
+}
+
+type LabelRequirement struct {
+  Key string
+  Operator string
+  Value string
+}
+
+// A parsed label selector such as "role=db,env!=staging". Every requirement must match.
+// Supported requirements are key=value, key==value, key!=value, key (exists) and !key (does not exist).
+type LabelSelector []LabelRequirement
+
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+  var labelSelector LabelSelector
+
+  for _, part := range strings.Split(selector, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      return nil, LabelSelectorError("Empty requirement in label selector " + selector)
+    }
+
+    var requirement LabelRequirement
+    switch {
+    case strings.Contains(part, "!="):
+      pieces := strings.SplitN(part, "!=", 2)
+      requirement = LabelRequirement{ strings.TrimSpace(pieces[0]), LabelOperatorNotEquals, strings.TrimSpace(pieces[1]) }
+    case strings.Contains(part, "=="):
+      pieces := strings.SplitN(part, "==", 2)
+      requirement = LabelRequirement{ strings.TrimSpace(pieces[0]), LabelOperatorEquals, strings.TrimSpace(pieces[1]) }
+    case strings.Contains(part, "="):
+      pieces := strings.SplitN(part, "=", 2)
+      requirement = LabelRequirement{ strings.TrimSpace(pieces[0]), LabelOperatorEquals, strings.TrimSpace(pieces[1]) }
+    case strings.HasPrefix(part, "!"):
+      requirement = LabelRequirement{ strings.TrimSpace(part[1:]), LabelOperatorNotExists, "" }
+    default:
+      requirement = LabelRequirement{ part, LabelOperatorExists, "" }
+    }
+
+    if !labelKeyPattern.MatchString(requirement.Key) {
+      return nil, LabelSelectorError("Invalid label key in selector requirement " + part)
+    } else if !labelValuePattern.MatchString(requirement.Value) {
+      return nil, LabelSelectorError("Invalid label value in selector requirement " + part)
+    }
+    labelSelector = append(labelSelector, requirement)
+  }
+
+  return labelSelector, nil
+}
+
+func (labelSelector LabelSelector) Matches(labels map[string]string) bool {
+  for _, requirement := range labelSelector {
+    value, exists := labels[requirement.Key]
+    switch requirement.Operator {
+    case LabelOperatorEquals:
+      if !exists || value != requirement.Value {
+        return false
+      }
+    case LabelOperatorNotEquals:
+      if exists && value == requirement.Value {
+        return false
+      }
+    case LabelOperatorExists:
+      if !exists {
+        return false
+      }
+    case LabelOperatorNotExists:
+      if exists {
+        return false
+      }
+    }
+  }
+  return true
+}
+
+func ValidateLabels(labels map[string]string) error {
+  for key, value := range labels {
+    if !labelKeyPattern.MatchString(key) {
+      return errors.New("Invalid label key " + key)
+    } else if !labelValuePattern.MatchString(value) {
+      return errors.New("Invalid value for label " + key)
+    }
+  }
+  return nil
+}
+
+func labelsFromMap(labels map[string]string) []storage.ServerLabel {
+  var serverLabels []storage.ServerLabel
+  for key, value := range labels {
+    serverLabels = append(serverLabels, storage.ServerLabel{ Key: key, Value: value })
+  }
+  sort.Sort(serverLabelsByKey(serverLabels))
+  return serverLabels
+}
+
+type serverLabelsByKey []storage.ServerLabel
+
+func (labels serverLabelsByKey) Len() int {
+  return len(labels)
+}
+
+func (labels serverLabelsByKey) Less(i, j int) bool {
+  return labels[i].Key < labels[j].Key
+}
+
+func (labels serverLabelsByKey) Swap(i, j int) {
+  labels[i], labels[j] = labels[j], labels[i]
+}
+
+// The labels selectors match against. Labels set by the user win over those the agent reports.
+func ServerLabels(server storage.Server) map[string]string {
+  labels := make(map[string]string)
+  for _, label := range server.AgentLabels {
+    labels[label.Key] = label.Value
+  }
+  for _, label := range server.Labels {
+    labels[label.Key] = label.Value
+  }
+  return labels
+}
+
+func GetServersBySelectorNoCache(ctx Context, user storage.User, labelSelector LabelSelector) ([]storage.Server, error) {
+  var matched []storage.Server
+
+  servers, err := GetServersNoCache(ctx, user)
+  if err != nil {
+    return matched, err
+  }
+
+  for _, server := range servers {
+    if labelSelector.Matches(ServerLabels(server)) {
+      matched = append(matched, server)
+    }
+  }
+  return matched, nil
+}
+
+// Adds the IDs of the user's servers matching the selector to serverIds. An empty selector leaves them as they are.
+// When commandID is set, matching servers the command isn't available on are left out and returned as skipped, so a
+// selector that also catches servers without the command doesn't fail the whole request.
+func ResolveServerSelector(ctx Context, user storage.User, serverIds []int64, selector string, commandID int64) ([]int64, []int64, error) {
+  var skipped []int64
+  if selector == "" {
+    return serverIds, skipped, nil
+  }
+
+  labelSelector, err := ParseLabelSelector(selector)
+  if err != nil {
+    return serverIds, skipped, err
+  }
+
+  servers, err := GetServersBySelectorNoCache(ctx, user, labelSelector)
+  if err != nil {
+    return serverIds, skipped, err
+  } else if len(servers) == 0 {
+    return serverIds, skipped, ErrNoServersMatch
+  }
+
+  selected := make(map[int64]bool)
+  for _, serverID := range serverIds {
+    selected[serverID] = true
+  }
+  for _, server := range servers {
+    if selected[server.ID] {
+      continue
+    } else if commandID != 0 && !IsCommandAvailable(server, commandID) {
+      skipped = append(skipped, server.ID)
+      continue
+    }
+    selected[server.ID] = true
+    serverIds = append(serverIds, server.ID)
+  }
+
+  if len(serverIds) == 0 {
+    return serverIds, skipped, ErrNoMatchingServersHaveCommand
+  }
+  return serverIds, skipped, nil
+}
+
+// Replaces the labels the user has set on the server. Labels reported by the agent are kept separately.
+func SetServerLabelsNoCache(ctx Context, user storage.User, serverID int64, labels map[string]string) (storage.Server, error) {
+  if _, err := GetServerNoCache(ctx, user, serverID); err != nil {
+    return storage.Server{}, err
+  }
+
+  var server storage.Server
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if server, err = tx.GetServer(serverID); err != nil {
+      return err
+    }
+    server.Labels = labelsFromMap(labels)
+    server, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return server, err
+  }
+
+  ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+  return server, nil
+}
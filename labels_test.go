@@ -0,0 +1,82 @@
+package biboop
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+  tests := []struct {
+    selector string
+    expected LabelSelector
+    expectedErr error
+  }{
+    { "role=db", LabelSelector {{ "role", LabelOperatorEquals, "db" }}, nil },
+    { "role==db", LabelSelector {{ "role", LabelOperatorEquals, "db" }}, nil },
+    { " role = db , env != staging ", LabelSelector {{ "role", LabelOperatorEquals, "db" }, { "env", LabelOperatorNotEquals, "staging" }}, nil },
+    { "gpu", LabelSelector {{ "gpu", LabelOperatorExists, "" }}, nil },
+    { "!gpu", LabelSelector {{ "gpu", LabelOperatorNotExists, "" }}, nil },
+    { "! gpu", LabelSelector {{ "gpu", LabelOperatorNotExists, "" }}, nil },
+    { "env!=", LabelSelector {{ "env", LabelOperatorNotEquals, "" }}, nil },
+    { "example.com/tier=web-1.a_b", LabelSelector {{ "example.com/tier", LabelOperatorEquals, "web-1.a_b" }}, nil },
+    { "", nil, LabelSelectorError("Empty requirement in label selector ") },
+    { "role=db,,gpu", nil, LabelSelectorError("Empty requirement in label selector role=db,,gpu") },
+    { "role=db,", nil, LabelSelectorError("Empty requirement in label selector role=db,") },
+    { "=db", nil, LabelSelectorError("Invalid label key in selector requirement =db") },
+    { "!=db", nil, LabelSelectorError("Invalid label key in selector requirement !=db") },
+    { "!role=db", nil, LabelSelectorError("Invalid label key in selector requirement !role=db") },
+    { "!", nil, LabelSelectorError("Invalid label key in selector requirement !") },
+    { "-role", nil, LabelSelectorError("Invalid label key in selector requirement -role") },
+    { "role-", nil, LabelSelectorError("Invalid label key in selector requirement role-") },
+    { "ro le=db", nil, LabelSelectorError("Invalid label key in selector requirement ro le=db") },
+    { "role=d b", nil, LabelSelectorError("Invalid label value in selector requirement role=d b") },
+    { "role=a=b", nil, LabelSelectorError("Invalid label value in selector requirement role=a=b") },
+    { "role=$(id)", nil, LabelSelectorError("Invalid label value in selector requirement role=$(id)") },
+  }
+
+  for _, test := range tests {
+    labelSelector, err := ParseLabelSelector(test.selector)
+    if !reflect.DeepEqual(labelSelector, test.expected) || !reflect.DeepEqual(err, test.expectedErr) {
+      t.Errorf("ParseLabelSelector(%q) returned %v, %v, expected %v, %v", test.selector, labelSelector, err, test.expected, test.expectedErr)
+    }
+  }
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+  labels := map[string]string { "role": "db", "env": "production", "empty": "" }
+
+  tests := []struct {
+    selector string
+    expected bool
+  }{
+    { "role=db", true },
+    { "role=web", false },
+    { "missing=db", false },
+    { "role!=web", true },
+    { "role!=db", false },
+    { "missing!=db", true },
+    { "empty!=", false },
+    { "empty=", true },
+    { "role", true },
+    { "empty", true },
+    { "missing", false },
+    { "!missing", true },
+    { "!role", false },
+    { "!empty", false },
+    { "role=db,env=production,!gpu", true },
+    { "role=db,env=staging", false },
+  }
+
+  for _, test := range tests {
+    labelSelector, err := ParseLabelSelector(test.selector)
+    if err != nil {
+      t.Errorf("ParseLabelSelector(%q) returned %v", test.selector, err)
+    } else if got := labelSelector.Matches(labels); got != test.expected {
+      t.Errorf("%q matched %v, expected %v", test.selector, got, test.expected)
+    }
+  }
+
+  if !(LabelSelector {}).Matches(nil) {
+    t.Errorf("an empty selector didn't match")
+  }
+}
@@ -0,0 +1,169 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "time"
+)
+
+
+const (
+  ServerStatusOnline = "online"
+  ServerStatusLate = "late"
+  ServerStatusOffline = "offline"
+)
+
+// Servers that have never reported a poll interval are expected to poll at least this often.
+const DefaultPollIntervalSec = 60
+
+// A server is late once it has missed this many poll intervals and offline once it has missed offlineAfterIntervals.
+const lateAfterIntervals = 2
+const offlineAfterIntervals = 5
+
+
+// Derives the server's status from its last poll, along with the time that status took effect.
+func ServerStatus(server storage.Server, now int64) (string, int64) {
+  interval := int64(server.PollIntervalSec)
+  if interval <= 0 {
+    interval = DefaultPollIntervalSec
+  }
+
+  if server.LastPollTime == 0 {
+    return ServerStatusOffline, 0
+  }
+
+  elapsed := now - server.LastPollTime
+  switch {
+  case elapsed <= interval * lateAfterIntervals:
+    return ServerStatusOnline, server.LastPollTime
+  case elapsed <= interval * offlineAfterIntervals:
+    return ServerStatusLate, server.LastPollTime + interval * lateAfterIntervals
+  }
+  return ServerStatusOffline, server.LastPollTime + interval * offlineAfterIntervals
+}
+
+// Stores an event if the server's derived status differs from the one last recorded. The caller saves the server.
+func recordServerStatusNoCache(tx storage.Storage, server *storage.Server, now int64) error {
+  if server.LastPollTime == 0 {
+    return nil
+  }
+
+  status, since := ServerStatus(*server, now)
+  if status == server.Status {
+    return nil
+  }
+
+  event := storage.ServerEvent{
+    UserID: server.UserID,
+    OrganizationID: server.OrganizationID,
+    ServerID: server.ID,
+    FromStatus: server.Status,
+    ToStatus: status,
+    Time: since,
+  }
+  if _, err := tx.PutServerEvent(event); err != nil {
+    return err
+  }
+
+  server.Status = status
+  return nil
+}
+
+// Marks the server as polled now. Any transition to late or offline that was missed since the last poll is
+// recorded first so the event history shows how long the server was dark. The caller saves the server.
+func markServerPolledNoCache(tx storage.Storage, server *storage.Server) error {
+  now := time.Now().UTC().Unix()
+  if err := recordServerStatusNoCache(tx, server, now); err != nil {
+    return err
+  }
+  server.LastPollTime = now
+  return recordServerStatusNoCache(tx, server, now)
+}
+
+func RecordServerPoll(ctx Context, server storage.Server, pollIntervalSec int) (storage.Server, error) {
+  serverID := server.ID
+
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if server, err = tx.GetServer(serverID); err != nil {
+      return err
+    }
+    if pollIntervalSec > 0 {
+      server.PollIntervalSec = pollIntervalSec
+    }
+    if err := markServerPolledNoCache(tx, &server); err != nil {
+      return err
+    }
+    server, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return server, err
+  }
+
+  ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+  return server, nil
+}
+
+// Records status transitions for every server whose derived status has changed. Driven by cron.
+func CheckServerLivenessNoCache(ctx Context) error {
+  now := time.Now().UTC().Unix()
+
+  servers, err := ctx.Storage().GetAllServers()
+  if err != nil {
+    return err
+  }
+
+  for i := range servers {
+    if status, _ := ServerStatus(servers[i], now); status == servers[i].Status || servers[i].LastPollTime == 0 {
+      continue
+    }
+
+    var server storage.Server
+    var previousStatus string
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      var err error
+      if server, err = tx.GetServer(servers[i].ID); err != nil {
+        return err
+      }
+      previousStatus = server.Status
+      if err := recordServerStatusNoCache(tx, &server, now); err != nil {
+        return err
+      }
+      server, err = tx.PutServer(server)
+      return err
+    })
+    if err != nil {
+      return err
+    }
+
+    ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+
+    if server.Status == ServerStatusOffline && previousStatus != ServerStatusOffline {
+      if err := QueueWebhookEventNoCache(ctx, server.OrganizationID, WebhookEventServerOffline, map[string]interface{} { "server": server }); err != nil {
+        ctx.Errorf("Failed to queue %s webhooks for server %d: %v", WebhookEventServerOffline, server.ID, err)
+      }
+    }
+  }
+
+  return nil
+}
+
+// Lists the server's status transitions newest first. Each event's duration runs until the next transition, or now.
+func GetServerEventsNoCache(ctx Context, user storage.User, serverID int64) ([]storage.ServerEvent, error) {
+  if _, err := GetServerNoCache(ctx, user, serverID); err != nil {
+    return nil, err
+  }
+
+  events, err := ctx.Storage().GetServerEvents(serverID)
+  if err != nil {
+    return events, err
+  }
+
+  until := time.Now().UTC().Unix()
+  for i := range events {
+    events[i].DurationSec = until - events[i].Time
+    until = events[i].Time
+  }
+
+  return events, nil
+}
@@ -0,0 +1,69 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "strconv"
+  "time"
+)
+
+// Requests on App Engine are cut off at 60 seconds, so waits are capped well below that.
+const MaxLongPollWaitSec = 50
+
+// How often a waiting poll checks whether anything has been queued for its server.
+var longPollCheckInterval = 500 * time.Millisecond
+
+// The cache can lose a signal to eviction or an outage, so every this many checks a waiting poll looks at storage
+// whether or not it saw one.
+const longPollDatastoreCheckEvery = 10
+
+func serverQueueCacheKey(serverID int64) string {
+  return "ServerQueue-" + strconv.FormatInt(serverID, 10)
+}
+
+// Returns a counter that changes whenever an invocation is queued for the server. Waiting polls watch it in
+// the cache rather than querying storage each time they check.
+func ServerQueueVersion(ctx Context, serverID int64) uint64 {
+  version, _ := ctx.Cache().Increment(serverQueueCacheKey(serverID), 0, 0)
+  return version
+}
+
+func signalServerQueue(ctx Context, serverID int64) {
+  ctx.Cache().Increment(serverQueueCacheKey(serverID), 1, 0)
+}
+
+// Holds the poll open until an invocation is queued for the server or maxWaitSec passes, then dispatches
+// whatever is queued. Read queueVersion before the poll's own dispatch so nothing queued in between is missed.
+func WaitForQueuedInvocations(ctx Context, server storage.Server, queueVersion uint64, maxWaitSec int) (storage.Server, []storage.Invocation, error) {
+  var invocations []storage.Invocation
+  err := waitForSignal(ctx, serverQueueCacheKey(server.ID), queueVersion, maxWaitSec, func () (bool, error) {
+    var err error
+    server, invocations, err = DispatchQueuedInvocations(ctx, server)
+    return len(invocations) > 0, err
+  })
+  return server, invocations, err
+}
+
+// Calls check until it finds something, fails or maxWaitSec passes. check is called whenever the cached counter at
+// versionKey moves away from version, whenever the cache can't be read, and every longPollDatastoreCheckEvery checks
+// regardless.
+func waitForSignal(ctx Context, versionKey string, version uint64, maxWaitSec int, check func () (bool, error)) error {
+  if maxWaitSec > MaxLongPollWaitSec {
+    maxWaitSec = MaxLongPollWaitSec
+  }
+
+  deadline := time.Now().Add(time.Duration(maxWaitSec) * time.Second)
+  for checks := 1; time.Now().Before(deadline); checks++ {
+    time.Sleep(longPollCheckInterval)
+
+    latest, err := ctx.Cache().Increment(versionKey, 0, 0)
+    if err == nil && latest == version && checks % longPollDatastoreCheckEvery != 0 {
+      continue
+    }
+    version = latest
+    if found, err := check(); err != nil || found {
+      return err
+    }
+  }
+
+  return nil
+}
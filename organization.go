@@ -0,0 +1,410 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "strings"
+  "time"
+)
+
+var ErrOrganizationNotFound = storage.ErrOrganizationNotFound
+var ErrNotMember = storage.ErrMembershipNotFound
+var ErrAlreadyMember = errors.New("Already a member of this organization")
+var ErrInvitationNotFound = storage.ErrInvitationNotFound
+var ErrCannotRemoveMember = errors.New("The owner of a personal organization cannot be removed from it")
+
+const (
+  InvitationStatePending = storage.InvitationStatePending
+  InvitationStateAccepted = storage.InvitationStateAccepted
+  InvitationStateDeclined = storage.InvitationStateDeclined
+)
+
+func userCacheKey(email string) string {
+  return "User-" + email
+}
+
+func organizationCacheKey(serverAPIKeyHash string) string {
+  return "Organization-" + serverAPIKeyHash
+}
+
+// Creates the organization with serverAPIKey as its server API key, or with no key at all if it is empty.
+func createOrganization(tx storage.Storage, userID int64, email string, organization storage.Organization, serverAPIKey string) (storage.Organization, error) {
+  organization.CreatedTime = time.Now().UTC().Unix()
+  if serverAPIKey != "" {
+    setServerAPIKey(&organization, serverAPIKey, organization.CreatedTime)
+  }
+
+  organization, err := tx.PutOrganization(organization)
+  if err != nil {
+    return organization, err
+  }
+
+  membership := storage.Membership{
+    OrganizationID: organization.ID,
+    UserID: userID,
+    Email: email,
+    Role: RoleAdmin,
+    CreatedTime: organization.CreatedTime,
+  }
+  if _, err := tx.PutMembership(membership); err != nil {
+    return organization, err
+  }
+
+  return organization, nil
+}
+
+// Creates an organization along with its first server API key, which is returned here and never again.
+func CreateOrganizationNoCache(ctx Context, user storage.User, name string) (storage.Organization, string, error) {
+  serverAPIKey, err := newServerAPIKey()
+  if err != nil {
+    return storage.Organization{}, "", err
+  }
+
+  var organization storage.Organization
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    organization, err = createOrganization(tx, user.ID, user.Email, storage.Organization{ Name: name }, serverAPIKey)
+    return err
+  })
+  return organization, serverAPIKey, err
+}
+
+// Gives a user a personal organization. A user from before organizations existed has their server API key and
+// everything they own moved into it, so existing agents keep working. New users get no key until they rotate one in.
+// The organization is created and recorded on the user in one transaction so racing requests can't make two, and a
+// move that fails part way is picked up again against the same organization by the user's next request.
+func ensureUserOrganizationNoCache(ctx Context, user *storage.User) error {
+  if user.OrganizationID == 0 {
+    legacyServerAPIKey := user.ServerAPIKey
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      storedUser, err := tx.GetUser(user.ID)
+      if err != nil {
+        return err
+      } else if storedUser.OrganizationID != 0 {
+        *user = storedUser
+        return nil
+      }
+
+      organization, err := createOrganization(tx, storedUser.ID, storedUser.Email, storage.Organization{
+        Name: storedUser.Email,
+        PersonalUserID: storedUser.ID,
+      }, storedUser.ServerAPIKey)
+      if err != nil {
+        return err
+      }
+      storedUser.OrganizationID = organization.ID
+      storedUser.OrganizationMigrationPending = true
+      storedUser.ServerAPIKey = ""
+      if storedUser, err = tx.PutUser(storedUser); err != nil {
+        return err
+      }
+      *user = storedUser
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+
+    // Drop the entry the old per user key lookup cached
+    if legacyServerAPIKey != "" {
+      ctx.Cache().Delete("User-" + legacyServerAPIKey)
+    }
+  }
+
+  if !user.OrganizationMigrationPending {
+    return nil
+  }
+  if err := ctx.Storage().MigrateUserEntities(user.ID, user.OrganizationID); err != nil {
+    return err
+  }
+
+  migratedUser, err := setUserOrganizationMigratedNoCache(ctx, user.ID)
+  if err != nil {
+    return err
+  }
+  *user = migratedUser
+  return nil
+}
+
+func setUserOrganizationMigratedNoCache(ctx Context, userID int64) (storage.User, error) {
+  var user storage.User
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if user, err = tx.GetUser(userID); err != nil {
+      return err
+    }
+    user.OrganizationMigrationPending = false
+    user, err = tx.PutUser(user)
+    return err
+  })
+  return user, err
+}
+
+// Finds the organization a server API key belongs to. A rotated out key keeps working until its grace period ends.
+// Organizations are found and cached by the key's hash, and the key is checked against the organization on every call,
+// so an expired key is refused even while its entry is still cached. Rotating or revoking a key clears its entries.
+func FindOrganizationByServerAPIKey(ctx Context, serverAPIKey string) (storage.Organization, error) {
+  var organization storage.Organization
+  if serverAPIKey == "" {
+    return organization, ErrOrganizationNotFound
+  }
+
+  serverAPIKeyHash := hashSecret(serverAPIKey)
+  cacheKey := organizationCacheKey(serverAPIKeyHash)
+  if err := ctx.Cache().Get(cacheKey, &organization); err == storage.ErrCacheMiss {
+    if organization, err = findOrganizationByServerAPIKeyNoCache(ctx, serverAPIKey, serverAPIKeyHash); err != nil {
+      return organization, err
+    }
+    ctx.Cache().Set(cacheKey, organization, serverAPIKeyCacheExpiration)
+  } else if err != nil {
+    return organization, err
+  }
+
+  if !acceptsServerAPIKey(organization, serverAPIKey, time.Now().UTC().Unix()) {
+    ctx.Cache().Delete(cacheKey)
+    return storage.Organization{}, ErrOrganizationNotFound
+  }
+  recordServerAPIKeyUse(ctx, organization, serverAPIKey)
+  return organization, nil
+}
+
+func findOrganizationByServerAPIKeyNoCache(ctx Context, serverAPIKey string, serverAPIKeyHash string) (storage.Organization, error) {
+  // A key that was rotated out may still be inside its grace period
+  organization, err := ctx.Storage().GetOrganizationByServerAPIKeyHash(serverAPIKeyHash)
+  if err != ErrOrganizationNotFound {
+    return organization, err
+  }
+
+  // Organizations from before keys were hashed still hold them in plain text
+  organization, err = ctx.Storage().GetOrganizationByLegacyServerAPIKey(serverAPIKey)
+  if err == nil {
+    return hashLegacyServerAPIKeysNoCache(ctx, organization.ID)
+  } else if err != ErrOrganizationNotFound {
+    return organization, err
+  }
+
+  // Agents of users who have not signed in since organizations were added still hold a per user key
+  user, err := ctx.Storage().GetUserByServerAPIKey(serverAPIKey)
+  if err == ErrUserNotFound {
+    return storage.Organization{}, ErrOrganizationNotFound
+  } else if err != nil {
+    return storage.Organization{}, err
+  }
+
+  if err := ensureUserOrganizationNoCache(ctx, &user); err != nil {
+    return storage.Organization{}, err
+  }
+  ctx.Cache().Delete(userCacheKey(user.Email))
+
+  return GetOrganizationNoCache(ctx, user.OrganizationID)
+}
+
+func GetOrganizationNoCache(ctx Context, organizationID int64) (storage.Organization, error) {
+  return ctx.Storage().GetOrganization(organizationID)
+}
+
+func GetMembershipNoCache(ctx Context, organizationID int64, userID int64) (storage.Membership, error) {
+  return ctx.Storage().GetMembership(organizationID, userID)
+}
+
+func GetOrganizationsNoCache(ctx Context, user storage.User) ([]storage.Organization, error) {
+  var organizations []storage.Organization
+
+  memberships, err := ctx.Storage().GetUserMemberships(user.ID)
+  if err != nil {
+    return organizations, err
+  }
+
+  for _, membership := range memberships {
+    organization, err := GetOrganizationNoCache(ctx, membership.OrganizationID)
+    if err == ErrOrganizationNotFound {
+      continue
+    } else if err != nil {
+      return organizations, err
+    }
+    organizations = append(organizations, organization)
+  }
+
+  return organizations, nil
+}
+
+func GetMembersNoCache(ctx Context, user storage.User, organizationID int64) ([]storage.Membership, error) {
+  if _, err := GetMembershipNoCache(ctx, organizationID, user.ID); err != nil {
+    return nil, err
+  }
+  return ctx.Storage().GetMemberships(organizationID)
+}
+
+// Makes the organization the one the user acts in. The user must be a member.
+func SwitchOrganizationNoCache(ctx Context, user storage.User, organizationID int64) (storage.User, error) {
+  if _, err := GetMembershipNoCache(ctx, organizationID, user.ID); err != nil {
+    return user, err
+  }
+  return setUserOrganizationNoCache(ctx, user.ID, organizationID)
+}
+
+func setUserOrganizationNoCache(ctx Context, userID int64, organizationID int64) (storage.User, error) {
+  var user storage.User
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if user, err = tx.GetUser(userID); err != nil {
+      return err
+    }
+    user.OrganizationID = organizationID
+    user, err = tx.PutUser(user)
+    return err
+  })
+  if err != nil {
+    return user, err
+  }
+
+  ctx.Cache().Delete(userCacheKey(user.Email))
+  return user, nil
+}
+
+// Removes a member. Anyone who was acting in the organization is moved back to their personal organization.
+func RemoveMemberNoCache(ctx Context, user storage.User, organizationID int64, memberUserID int64) error {
+  // Anyone may leave, but only admins can remove someone else
+  requiredRole := RoleAdmin
+  if memberUserID == user.ID {
+    requiredRole = RoleViewer
+  }
+  if _, err := requireRoleNoCache(ctx, organizationID, user.ID, requiredRole); err != nil {
+    return err
+  }
+
+  organization, err := GetOrganizationNoCache(ctx, organizationID)
+  if err != nil {
+    return err
+  } else if organization.PersonalUserID == memberUserID {
+    return ErrCannotRemoveMember
+  }
+
+  membership, err := GetMembershipNoCache(ctx, organizationID, memberUserID)
+  if err != nil {
+    return err
+  }
+  if EffectiveRole(membership) == RoleAdmin {
+    if err := ensureOtherAdminNoCache(ctx, organizationID, memberUserID); err != nil {
+      return err
+    }
+  }
+  if err := ctx.Storage().DeleteMembership(organizationID, memberUserID); err != nil {
+    return err
+  }
+  ctx.Cache().Delete(membershipCacheKey(organizationID, memberUserID))
+
+  member, err := ctx.Storage().GetUser(memberUserID)
+  if err != nil {
+    return err
+  }
+  if member.OrganizationID == organizationID {
+    // Clearing the organization gives them a fresh personal organization on their next request
+    personalOrganizationID := int64(0)
+    if personal, err := ctx.Storage().GetPersonalOrganization(memberUserID); err == nil {
+      personalOrganizationID = personal.ID
+    } else if err != ErrOrganizationNotFound {
+      return err
+    }
+    if _, err := setUserOrganizationNoCache(ctx, memberUserID, personalOrganizationID); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func CreateInvitationNoCache(ctx Context, user storage.User, organizationID int64, email string, role string) (storage.Invitation, error) {
+  var invitation storage.Invitation
+
+  if role == "" {
+    role = RoleViewer
+  } else if !IsValidRole(role) {
+    return invitation, ErrInvalidRole
+  }
+  if _, err := requireRoleNoCache(ctx, organizationID, user.ID, RoleAdmin); err != nil {
+    return invitation, err
+  }
+
+  organization, err := GetOrganizationNoCache(ctx, organizationID)
+  if err != nil {
+    return invitation, err
+  }
+
+  invitation.OrganizationID = organizationID
+  invitation.OrganizationName = organization.Name
+  invitation.Email = strings.ToLower(strings.TrimSpace(email))
+  invitation.Role = role
+  invitation.InvitedByUserID = user.ID
+  invitation.State = InvitationStatePending
+  invitation.CreatedTime = time.Now().UTC().Unix()
+
+  return ctx.Storage().PutInvitation(invitation)
+}
+
+// Lists the pending invitations addressed to the user's email.
+func GetInvitationsNoCache(ctx Context, user storage.User) ([]storage.Invitation, error) {
+  return ctx.Storage().GetPendingInvitations(strings.ToLower(user.Email))
+}
+
+// Accepts or declines an invitation. The invitation and the membership it adds change together in one transaction, so
+// an invitation can't be accepted twice or be left pending with its member added.
+func RespondToInvitationNoCache(ctx Context, user storage.User, invitationID int64, accept bool) (storage.Invitation, error) {
+  invitation, err := ctx.Storage().GetInvitation(invitationID)
+  if err != nil {
+    return invitation, err
+  }
+  if accept {
+    // Moves a membership from before memberships were keyed by organization and user to where the transaction checks
+    if _, err := GetMembershipNoCache(ctx, invitation.OrganizationID, user.ID); err != nil && err != ErrNotMember {
+      return invitation, err
+    }
+  }
+
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if invitation, err = tx.GetInvitation(invitationID); err != nil {
+      return err
+    }
+    if invitation.Email != strings.ToLower(user.Email) || invitation.State != InvitationStatePending {
+      return ErrInvitationNotFound
+    }
+
+    now := time.Now().UTC().Unix()
+    if accept {
+      if _, err := tx.GetMembership(invitation.OrganizationID, user.ID); err == nil {
+        return ErrAlreadyMember
+      } else if err != ErrNotMember {
+        return err
+      }
+
+      membership := storage.Membership{
+        OrganizationID: invitation.OrganizationID,
+        UserID: user.ID,
+        Email: user.Email,
+        Role: invitation.Role,
+        CreatedTime: now,
+      }
+      if _, err := tx.PutMembership(membership); err != nil {
+        return err
+      }
+      invitation.State = InvitationStateAccepted
+    } else {
+      invitation.State = InvitationStateDeclined
+    }
+
+    invitation.RespondedTime = now
+    invitation, err = tx.PutInvitation(invitation)
+    return err
+  })
+  if err == ErrInvitationNotFound {
+    return storage.Invitation{}, err
+  } else if err != nil {
+    return invitation, err
+  }
+
+  if accept {
+    ctx.Cache().Delete(membershipCacheKey(invitation.OrganizationID, user.ID))
+  }
+  return invitation, nil
+}
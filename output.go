@@ -0,0 +1,169 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "strconv"
+  "time"
+  "unicode/utf8"
+)
+
+
+var ErrOutputChunkOutOfOrder = errors.New("Output chunk is out of order")
+var ErrOutputChunkTooLarge = errors.New("Output chunk is too large")
+var ErrInvalidOutputStream = errors.New("Output stream must be stdout or stderr")
+
+const (
+  OutputStreamStdout = "stdout"
+  OutputStreamStderr = "stderr"
+)
+
+// Chunks are stored as their own entities, so each must stay well inside the datastore's entity size limit.
+const MaxOutputChunkBytes = 256 * 1024
+
+// How many chunks a single fetch returns.
+const outputFetchLimit = 100
+
+
+type InvocationOutput struct {
+  Chunks []storage.OutputChunk `json:"chunks"`
+  NextOffset int64 `json:"nextOffset"`
+  // Set once the invocation has finished and every chunk up to NextOffset has been returned
+  Done bool `json:"done"`
+}
+
+
+func invocationOutputCacheKey(invocationID int64) string {
+  return "InvocationOutput-" + strconv.FormatInt(invocationID, 10)
+}
+
+// Returns a counter that changes whenever output is appended to the invocation or it finishes. Followers watch it in
+// the cache the same way waiting polls watch the server queue.
+func InvocationOutputVersion(ctx Context, invocationID int64) uint64 {
+  version, _ := ctx.Cache().Increment(invocationOutputCacheKey(invocationID), 0, 0)
+  return version
+}
+
+func signalInvocationOutput(ctx Context, invocationID int64) {
+  ctx.Cache().Increment(invocationOutputCacheKey(invocationID), 1, 0)
+}
+
+// Appends a chunk of output to a running invocation. Chunks must arrive in sequence, one after the other. A chunk the
+// server already has is accepted again without being stored twice, so agents can safely retry, and a gap returns
+// ErrOutputChunkOutOfOrder along with the sequence the server expects next.
+func AppendOutputChunkNoCache(ctx Context, server storage.Server, invocationID int64, chunk storage.OutputChunk) (storage.OutputChunk, int64, error) {
+  if chunk.Stream != OutputStreamStdout && chunk.Stream != OutputStreamStderr {
+    return chunk, 0, ErrInvalidOutputStream
+  } else if len(chunk.Data) > MaxOutputChunkBytes {
+    return chunk, 0, ErrOutputChunkTooLarge
+  }
+
+  invocation, err := ctx.Storage().GetInvocation(invocationID)
+  if err != nil {
+    return chunk, 0, err
+  } else if invocation.ServerID != server.ID {
+    return chunk, 0, ErrInvocationNotFound
+  }
+
+  var expectedSequence int64
+  appended := false
+
+  err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    outputStream, err := tx.GetOutputStream(invocationID)
+    if err != nil {
+      return err
+    }
+
+    expectedSequence = outputStream.Chunks + 1
+    if chunk.Sequence > 0 && chunk.Sequence < expectedSequence {
+      // Already stored, hand back what we kept so the agent can carry on
+      chunk, err = tx.GetOutputChunk(invocationID, chunk.Sequence)
+      return err
+    } else if chunk.Sequence != expectedSequence {
+      return ErrOutputChunkOutOfOrder
+    } else if invocation.State != InvocationStateDispatched {
+      return ErrInvocationNotDispatched
+    }
+
+    chunk.Offset = outputStream.Bytes
+    chunk.EndOffset = chunk.Offset + int64(len(chunk.Data))
+    chunk.Time = time.Now().UTC().Unix()
+    if err := tx.PutOutputChunk(invocationID, chunk); err != nil {
+      return err
+    }
+
+    outputStream.Chunks = chunk.Sequence
+    outputStream.Bytes = chunk.EndOffset
+    err = tx.PutOutputStream(invocationID, outputStream)
+    appended = err == nil
+    return err
+  })
+  if err != nil {
+    return chunk, expectedSequence, err
+  }
+
+  if appended {
+    signalInvocationOutput(ctx, invocationID)
+    expectedSequence++
+  }
+  return chunk, expectedSequence, nil
+}
+
+// Returns the invocation's output from a byte offset onwards. The first chunk is trimmed so the output starts at the
+// offset, or at the next character when the offset falls inside one.
+func GetInvocationOutputNoCache(ctx Context, user storage.User, invocationID int64, offset int64) (InvocationOutput, error) {
+  output := InvocationOutput{ Chunks: []storage.OutputChunk {}, NextOffset: offset }
+
+  invocation, err := GetInvocationNoCache(ctx, user, invocationID)
+  if err != nil {
+    return output, err
+  }
+
+  outputStream, err := ctx.Storage().GetOutputStream(invocationID)
+  if err != nil {
+    return output, err
+  }
+
+  chunks, err := ctx.Storage().GetOutputChunks(invocationID, offset, outputFetchLimit)
+  if err != nil {
+    return output, err
+  } else if chunks != nil {
+    output.Chunks = chunks
+  }
+
+  for i := range output.Chunks {
+    chunk := &output.Chunks[i]
+    if chunk.Offset < offset {
+      // Never start part way through a character
+      start := offset - chunk.Offset
+      for start < int64(len(chunk.Data)) && !utf8.RuneStart(chunk.Data[start]) {
+        start++
+      }
+      chunk.Data = chunk.Data[start:]
+      chunk.Offset += start
+    }
+    output.NextOffset = chunk.EndOffset
+  }
+
+  finished := invocation.State == InvocationStateCompleted || invocation.State == InvocationStateFailed
+  output.Done = finished && output.NextOffset >= outputStream.Bytes
+  return output, nil
+}
+
+// Follows an invocation's output live. Waits up to maxWaitSec for output past the offset to arrive, or for the
+// invocation to finish, before returning whatever is there.
+func WaitForInvocationOutput(ctx Context, user storage.User, invocationID int64, offset int64, maxWaitSec int) (InvocationOutput, error) {
+  // Read the version first so anything appended while we look is still noticed
+  version := InvocationOutputVersion(ctx, invocationID)
+  output, err := GetInvocationOutputNoCache(ctx, user, invocationID, offset)
+  if err != nil || len(output.Chunks) > 0 || output.Done {
+    return output, err
+  }
+
+  err = waitForSignal(ctx, invocationOutputCacheKey(invocationID), version, maxWaitSec, func () (bool, error) {
+    var err error
+    output, err = GetInvocationOutputNoCache(ctx, user, invocationID, offset)
+    return len(output.Chunks) > 0 || output.Done, err
+  })
+  return output, err
+}
@@ -0,0 +1,216 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Placeholders in Command.Command look like {{name}} and are replaced with the shell escaped param value.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+var shellSafePattern = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+const (
+  ParamTypeString = "string"
+  ParamTypeInt = "int"
+  ParamTypeBool = "bool"
+  ParamTypeEnum = "enum"
+  ParamTypeRegex = "regex"
+)
+
+type ParamError struct {
+  Name string `json:"name"`
+  Message string `json:"message"`
+}
+
+type ParamErrors []ParamError
+
+func (paramErrors ParamErrors) Error() string {
+  messages := make([]string, len(paramErrors))
+  for i, paramError := range paramErrors {
+    messages[i] = paramError.Name + ": " + paramError.Message
+  }
+  return "Invalid params (" + strings.Join(messages, ", ") + ")"
+}
+
+// Checks that a command's param definitions are usable before the command is stored.
+func ValidateCommandParams(params []storage.CommandParam) error {
+  var paramErrors ParamErrors
+  seen := make(map[string]bool)
+
+  for _, param := range params {
+    if param.Name == "" {
+      paramErrors = append(paramErrors, ParamError{ "", "name is required" })
+      continue
+    } else if seen[param.Name] {
+      paramErrors = append(paramErrors, ParamError{ param.Name, "is defined more than once" })
+      continue
+    }
+    seen[param.Name] = true
+
+    switch param.Type {
+    case "", ParamTypeString, ParamTypeInt, ParamTypeBool:
+    case ParamTypeEnum:
+      if len(param.PossibleValues) == 0 {
+        paramErrors = append(paramErrors, ParamError{ param.Name, "enum params require possible values" })
+        continue
+      }
+    case ParamTypeRegex:
+      if param.Pattern == "" {
+        paramErrors = append(paramErrors, ParamError{ param.Name, "regex params require a pattern" })
+        continue
+      } else if _, err := regexp.Compile(param.Pattern); err != nil {
+        paramErrors = append(paramErrors, ParamError{ param.Name, "pattern does not compile: " + err.Error() })
+        continue
+      }
+    default:
+      paramErrors = append(paramErrors, ParamError{ param.Name, "unknown type " + param.Type })
+      continue
+    }
+
+    if param.DefaultValue != "" {
+      if _, message := checkParamValue(param, param.DefaultValue); message != "" {
+        paramErrors = append(paramErrors, ParamError{ param.Name, "default value " + message })
+      }
+    }
+  }
+
+  if len(paramErrors) > 0 {
+    return paramErrors
+  }
+  return nil
+}
+
+// Checks the supplied arguments against the command's params, filling in defaults for anything missing.
+// Params without a default are required. The resolved values are returned in the order the params are defined.
+func ResolveParams(params []storage.CommandParam, args map[string]string) ([]storage.InvocationParam, error) {
+  var paramErrors ParamErrors
+  var resolved []storage.InvocationParam
+  defined := make(map[string]bool)
+
+  for _, param := range params {
+    defined[param.Name] = true
+    value, supplied := args[param.Name]
+    if !supplied {
+      if param.DefaultValue == "" {
+        paramErrors = append(paramErrors, ParamError{ param.Name, "is required" })
+        continue
+      }
+      value = param.DefaultValue
+    }
+
+    if value, message := checkParamValue(param, value); message != "" {
+      paramErrors = append(paramErrors, ParamError{ param.Name, message })
+    } else {
+      resolved = append(resolved, storage.InvocationParam{ Name: param.Name, Value: value })
+    }
+  }
+
+  var unknown []string
+  for name := range args {
+    if !defined[name] {
+      unknown = append(unknown, name)
+    }
+  }
+  sort.Strings(unknown)
+  for _, name := range unknown {
+    paramErrors = append(paramErrors, ParamError{ name, "is not a param of this command" })
+  }
+
+  if len(paramErrors) > 0 {
+    return nil, paramErrors
+  }
+  return resolved, nil
+}
+
+// Returns the canonical form of the value, or a message describing why it is not valid for the param.
+func checkParamValue(param storage.CommandParam, value string) (string, string) {
+  switch param.Type {
+  case ParamTypeInt:
+    intValue, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+      return value, "must be an integer"
+    }
+    value = strconv.FormatInt(intValue, 10)
+  case ParamTypeBool:
+    boolValue, err := strconv.ParseBool(value)
+    if err != nil {
+      return value, "must be true or false"
+    }
+    value = strconv.FormatBool(boolValue)
+  case ParamTypeRegex:
+    pattern, err := regexp.Compile("^(?:" + param.Pattern + ")$")
+    if err != nil {
+      return value, "has an invalid pattern"
+    } else if !pattern.MatchString(value) {
+      return value, "must match " + param.Pattern
+    }
+  }
+
+  if len(param.PossibleValues) > 0 {
+    for _, possibleValue := range param.PossibleValues {
+      if value == possibleValue {
+        return value, ""
+      }
+    }
+    return value, "must be one of " + strings.Join(param.PossibleValues, ", ")
+  }
+
+  return value, ""
+}
+
+// Checks that every placeholder in the command refers to a defined param.
+func ValidateCommandTemplate(command string, params []storage.CommandParam) error {
+  var paramErrors ParamErrors
+  defined := make(map[string]bool)
+  for _, param := range params {
+    defined[param.Name] = true
+  }
+
+  reported := make(map[string]bool)
+  for _, match := range placeholderPattern.FindAllStringSubmatch(command, -1) {
+    if name := match[1]; !defined[name] && !reported[name] {
+      reported[name] = true
+      paramErrors = append(paramErrors, ParamError{ name, "is used in the command but is not a param" })
+    }
+  }
+
+  if len(paramErrors) > 0 {
+    return paramErrors
+  }
+  return nil
+}
+
+// Replaces each placeholder in the command with its resolved value, shell escaped.
+func RenderCommand(command string, params []storage.InvocationParam) (string, error) {
+  var paramErrors ParamErrors
+  values := make(map[string]string)
+  for _, param := range params {
+    values[param.Name] = param.Value
+  }
+
+  rendered := placeholderPattern.ReplaceAllStringFunc(command, func (placeholder string) string {
+    name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+    value, ok := values[name]
+    if !ok {
+      paramErrors = append(paramErrors, ParamError{ name, "has no value" })
+      return placeholder
+    }
+    return ShellEscape(value)
+  })
+
+  if len(paramErrors) > 0 {
+    return command, paramErrors
+  }
+  return rendered, nil
+}
+
+// Quotes the value for a POSIX shell. Values made only of safe characters are left as they are.
+func ShellEscape(value string) string {
+  if shellSafePattern.MatchString(value) {
+    return value
+  }
+  return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
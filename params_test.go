@@ -0,0 +1,171 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "os/exec"
+  "reflect"
+  "testing"
+)
+
+var shellEscapeTests = []struct {
+  name string
+  value string
+  expected string
+}{
+  { "safe characters", "web-1.example.com:8080/path,a=b@c%d+e", "web-1.example.com:8080/path,a=b@c%d+e" },
+  { "empty", "", "''" },
+  { "space", "two words", "'two words'" },
+  { "single quote", "it's", `'it'\''s'` },
+  { "only single quotes", "''", `''\'''\'''` },
+  { "command substitution", "$(rm -rf /)", "'$(rm -rf /)'" },
+  { "variable", "$HOME", "'$HOME'" },
+  { "backticks", "`id`", "'`id`'" },
+  { "newline", "first\nsecond", "'first\nsecond'" },
+  { "semicolon", "a; reboot", "'a; reboot'" },
+  { "glob", "*", "'*'" },
+  { "tilde", "~root", "'~root'" },
+  { "double quotes and backslash", `"\"`, `'"\"'` },
+}
+
+func TestShellEscape(t *testing.T) {
+  for _, test := range shellEscapeTests {
+    if got := ShellEscape(test.value); got != test.expected {
+      t.Errorf("%s: ShellEscape(%q) = %q, expected %q", test.name, test.value, got, test.expected)
+    }
+  }
+}
+
+// The escaped value has to come back out of a real shell as exactly what went in.
+func TestShellEscapeRoundTrips(t *testing.T) {
+  if _, err := exec.LookPath("sh"); err != nil {
+    t.Skip("no sh to run")
+  }
+  for _, test := range shellEscapeTests {
+    output, err := exec.Command("sh", "-c", "printf %s " + ShellEscape(test.value)).Output()
+    if err != nil {
+      t.Errorf("%s: sh failed: %v", test.name, err)
+    } else if string(output) != test.value {
+      t.Errorf("%s: sh printed %q, expected %q", test.name, output, test.value)
+    }
+  }
+}
+
+func TestValidateCommandParams(t *testing.T) {
+  tests := []struct {
+    name string
+    params []storage.CommandParam
+    expected error
+  }{
+    { "no params", nil, nil },
+    { "every type", []storage.CommandParam {
+      { Name: "plain" },
+      { Name: "count", Type: ParamTypeInt, DefaultValue: "3" },
+      { Name: "force", Type: ParamTypeBool, DefaultValue: "false" },
+      { Name: "env", Type: ParamTypeEnum, PossibleValues: []string { "staging", "production" }, DefaultValue: "staging" },
+      { Name: "branch", Type: ParamTypeRegex, Pattern: "[a-z0-9-]+", DefaultValue: "main" },
+    }, nil },
+    { "no name", []storage.CommandParam {{ Type: ParamTypeInt }}, ParamErrors {{ "", "name is required" }} },
+    { "defined twice", []storage.CommandParam {{ Name: "a" }, { Name: "a" }}, ParamErrors {{ "a", "is defined more than once" }} },
+    { "unknown type", []storage.CommandParam {{ Name: "a", Type: "float" }}, ParamErrors {{ "a", "unknown type float" }} },
+    { "enum without values", []storage.CommandParam {{ Name: "a", Type: ParamTypeEnum }}, ParamErrors {{ "a", "enum params require possible values" }} },
+    { "regex without a pattern", []storage.CommandParam {{ Name: "a", Type: ParamTypeRegex }}, ParamErrors {{ "a", "regex params require a pattern" }} },
+    { "regex that doesn't compile", []storage.CommandParam {{ Name: "a", Type: ParamTypeRegex, Pattern: "(" }},
+      ParamErrors {{ "a", "pattern does not compile: error parsing regexp: missing closing ): `(`" }} },
+    { "int default that isn't", []storage.CommandParam {{ Name: "a", Type: ParamTypeInt, DefaultValue: "three" }}, ParamErrors {{ "a", "default value must be an integer" }} },
+    { "enum default that isn't possible", []storage.CommandParam {{ Name: "a", Type: ParamTypeEnum, PossibleValues: []string { "x", "y" }, DefaultValue: "z" }},
+      ParamErrors {{ "a", "default value must be one of x, y" }} },
+    { "regex default matching only part of the pattern", []storage.CommandParam {{ Name: "a", Type: ParamTypeRegex, Pattern: "a|b", DefaultValue: "ab" }},
+      ParamErrors {{ "a", "default value must match a|b" }} },
+    { "every problem reported", []storage.CommandParam {{ Name: "a", Type: "float" }, { Name: "b", Type: ParamTypeEnum }},
+      ParamErrors {{ "a", "unknown type float" }, { "b", "enum params require possible values" }} },
+  }
+
+  for _, test := range tests {
+    if err := ValidateCommandParams(test.params); !reflect.DeepEqual(err, test.expected) {
+      t.Errorf("%s: ValidateCommandParams returned %v, expected %v", test.name, err, test.expected)
+    }
+  }
+}
+
+func TestResolveParams(t *testing.T) {
+  params := []storage.CommandParam {
+    { Name: "count", Type: ParamTypeInt, DefaultValue: "1" },
+    { Name: "force", Type: ParamTypeBool, DefaultValue: "false" },
+    { Name: "env", Type: ParamTypeEnum, PossibleValues: []string { "staging", "production" } },
+    { Name: "branch", Type: ParamTypeRegex, Pattern: "main|release-[0-9]+", DefaultValue: "main" },
+  }
+
+  tests := []struct {
+    name string
+    args map[string]string
+    expected []storage.InvocationParam
+    expectedErr error
+  }{
+    { "defaults filled in", map[string]string { "env": "staging" },
+      []storage.InvocationParam {{ Name: "count", Value: "1" }, { Name: "force", Value: "false" }, { Name: "env", Value: "staging" }, { Name: "branch", Value: "main" }}, nil },
+    { "values made canonical", map[string]string { "count": "007", "force": "TRUE", "env": "production", "branch": "release-12" },
+      []storage.InvocationParam {{ Name: "count", Value: "7" }, { Name: "force", Value: "true" }, { Name: "env", Value: "production" }, { Name: "branch", Value: "release-12" }}, nil },
+    { "required param missing", map[string]string {}, nil, ParamErrors {{ "env", "is required" }} },
+    { "not an int", map[string]string { "env": "staging", "count": "1; reboot" }, nil, ParamErrors {{ "count", "must be an integer" }} },
+    { "int out of range", map[string]string { "env": "staging", "count": "99999999999999999999" }, nil, ParamErrors {{ "count", "must be an integer" }} },
+    { "not a bool", map[string]string { "env": "staging", "force": "yes" }, nil, ParamErrors {{ "force", "must be true or false" }} },
+    { "not a possible value", map[string]string { "env": "Staging" }, nil, ParamErrors {{ "env", "must be one of staging, production" }} },
+    { "regex matched at the start only", map[string]string { "env": "staging", "branch": "main; reboot" }, nil, ParamErrors {{ "branch", "must match main|release-[0-9]+" }} },
+    { "regex matched at the end only", map[string]string { "env": "staging", "branch": "$(id)release-1" }, nil, ParamErrors {{ "branch", "must match main|release-[0-9]+" }} },
+    { "regex matched across a newline", map[string]string { "env": "staging", "branch": "main\nrelease-1" }, nil, ParamErrors {{ "branch", "must match main|release-[0-9]+" }} },
+    { "unknown args in order", map[string]string { "env": "staging", "zebra": "", "apple": "" }, nil,
+      ParamErrors {{ "apple", "is not a param of this command" }, { "zebra", "is not a param of this command" }} },
+  }
+
+  for _, test := range tests {
+    resolved, err := ResolveParams(params, test.args)
+    if !reflect.DeepEqual(err, test.expectedErr) || !reflect.DeepEqual(resolved, test.expected) {
+      t.Errorf("%s: ResolveParams returned %v, %v, expected %v, %v", test.name, resolved, err, test.expected, test.expectedErr)
+    }
+  }
+}
+
+func TestValidateCommandTemplate(t *testing.T) {
+  params := []storage.CommandParam {{ Name: "host" }, { Name: "port" }}
+
+  tests := []struct {
+    name string
+    command string
+    expected error
+  }{
+    { "defined params", "nc -z {{host}} {{ port }}", nil },
+    { "no placeholders", "uptime", nil },
+    { "undefined param reported once", "ping {{hots}} && ping {{hots}}", ParamErrors {{ "hots", "is used in the command but is not a param" }} },
+    { "single braces left alone", "awk '{print $1}'", nil },
+  }
+
+  for _, test := range tests {
+    if err := ValidateCommandTemplate(test.command, params); !reflect.DeepEqual(err, test.expected) {
+      t.Errorf("%s: ValidateCommandTemplate returned %v, expected %v", test.name, err, test.expected)
+    }
+  }
+}
+
+func TestRenderCommand(t *testing.T) {
+  tests := []struct {
+    name string
+    command string
+    params []storage.InvocationParam
+    expected string
+    expectedErr error
+  }{
+    { "safe value", "ping -c {{count}} {{host}}", []storage.InvocationParam {{ Name: "count", Value: "3" }, { Name: "host", Value: "web-1" }}, "ping -c 3 web-1", nil },
+    { "value quoted", "echo {{message}}", []storage.InvocationParam {{ Name: "message", Value: "it's $(id) `id`\nnext" }}, "echo 'it'\\''s $(id) `id`\nnext'", nil },
+    { "spaces inside the braces", "echo {{ message }}", []storage.InvocationParam {{ Name: "message", Value: "hi" }}, "echo hi", nil },
+    { "value used twice", "{{a}}{{a}}", []storage.InvocationParam {{ Name: "a", Value: "x y" }}, "'x y''x y'", nil },
+    { "placeholder in a value isn't rendered again", "echo {{a}} {{b}}", []storage.InvocationParam {{ Name: "a", Value: "{{b}}" }, { Name: "b", Value: "c" }}, "echo '{{b}}' c", nil },
+    { "missing value", "echo {{message}}", nil, "echo {{message}}", ParamErrors {{ "message", "has no value" }} },
+  }
+
+  for _, test := range tests {
+    rendered, err := RenderCommand(test.command, test.params)
+    if rendered != test.expected || !reflect.DeepEqual(err, test.expectedErr) {
+      t.Errorf("%s: RenderCommand returned %q, %v, expected %q, %v", test.name, rendered, err, test.expected, test.expectedErr)
+    }
+  }
+}
@@ -0,0 +1,159 @@
+package biboop
+
+import (
+  "errors"
+  "github.com/dbrain/biboop-server/storage"
+  "github.com/dbrain/soggy"
+  "net/http"
+  "strconv"
+)
+
+var ErrForbidden = errors.New("Your role does not allow this")
+var ErrInvalidRole = errors.New("Role must be viewer, operator or admin")
+var ErrLastAdmin = errors.New("An organization must keep at least one admin")
+var ErrNotCurrentOrganization = errors.New("Switch to this organization first, roles are checked in your current organization")
+
+// Viewers can list servers and results, operators can also manage commands and launch invocations, and admins can
+// also manage members, rotate keys and delete servers.
+const (
+  RoleViewer = "viewer"
+  RoleOperator = "operator"
+  RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int { RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3 }
+
+func IsValidRole(role string) bool {
+  _, valid := roleRanks[role]
+  return valid
+}
+
+func RoleAllows(role string, requiredRole string) bool {
+  return roleRanks[role] >= roleRanks[requiredRole]
+}
+
+// Memberships from before roles existed had full access, so they are treated as admins.
+func EffectiveRole(membership storage.Membership) string {
+  if membership.Role == "" {
+    return RoleAdmin
+  }
+  return membership.Role
+}
+
+func membershipCacheKey(organizationID int64, userID int64) string {
+  return "Membership-" + strconv.FormatInt(organizationID, 10) + "-" + strconv.FormatInt(userID, 10)
+}
+
+func GetMembership(ctx Context, organizationID int64, userID int64) (storage.Membership, error) {
+  var membership storage.Membership
+
+  cacheKey := membershipCacheKey(organizationID, userID)
+  if err := ctx.Cache().Get(cacheKey, &membership); err == storage.ErrCacheMiss {
+    if membership, err = GetMembershipNoCache(ctx, organizationID, userID); err != nil {
+      return membership, err
+    }
+    ctx.Cache().Set(cacheKey, membership, 0)
+  } else if err != nil {
+    return membership, err
+  }
+  return membership, nil
+}
+
+func requireRoleNoCache(ctx Context, organizationID int64, userID int64, requiredRole string) (storage.Membership, error) {
+  membership, err := GetMembershipNoCache(ctx, organizationID, userID)
+  if err != nil {
+    return membership, err
+  } else if !RoleAllows(EffectiveRole(membership), requiredRole) {
+    return membership, ErrForbidden
+  }
+  return membership, nil
+}
+
+// Route middleware that only lets the request through if the user holds at least the role in their current organization.
+func ApiRoleRequired(requiredRole string) func(*soggy.Context) (int, interface{}) {
+  return func (ctx *soggy.Context) (int, interface{}) {
+    user, ok := ctx.Env["user"].(storage.User)
+    if !ok {
+      return http.StatusUnauthorized, map[string]interface{} { "error": "This function requires authorization" }
+    }
+
+    appCtx := ctx.Env["appCtx"].(Context)
+    membership, err := GetMembership(appCtx, user.OrganizationID, user.ID)
+    if err == ErrNotMember {
+      return http.StatusForbidden, map[string]interface{} { "error": err.Error() }
+    } else if err != nil {
+      ctx.Next(err)
+      return 0, nil
+    } else if !RoleAllows(EffectiveRole(membership), requiredRole) {
+      return http.StatusForbidden, map[string]interface{} { "error": ErrForbidden.Error(), "requiredRole": requiredRole }
+    }
+
+    ctx.Env["membership"] = membership
+    ctx.Next(nil)
+    return 0, nil
+  }
+}
+
+func WebRoleRequired(requiredRole string) func(*soggy.Context) {
+  return func (ctx *soggy.Context) {
+    user, ok := ctx.Env["user"].(storage.User)
+    if !ok {
+      http.Error(ctx.Res, "This page requires authorization", http.StatusUnauthorized)
+      return
+    }
+
+    appCtx := ctx.Env["appCtx"].(Context)
+    membership, err := GetMembership(appCtx, user.OrganizationID, user.ID)
+    if err == ErrNotMember || (err == nil && !RoleAllows(EffectiveRole(membership), requiredRole)) {
+      http.Error(ctx.Res, ErrForbidden.Error(), http.StatusForbidden)
+      return
+    } else if err != nil {
+      ctx.Next(err)
+      return
+    }
+
+    ctx.Env["membership"] = membership
+    ctx.Next(nil)
+  }
+}
+
+// Changes a member's role. Only admins can do this and the last admin cannot be demoted.
+func SetMemberRoleNoCache(ctx Context, user storage.User, organizationID int64, memberUserID int64, role string) (storage.Membership, error) {
+  if !IsValidRole(role) {
+    return storage.Membership{}, ErrInvalidRole
+  }
+  if _, err := requireRoleNoCache(ctx, organizationID, user.ID, RoleAdmin); err != nil {
+    return storage.Membership{}, err
+  }
+
+  membership, err := GetMembershipNoCache(ctx, organizationID, memberUserID)
+  if err != nil {
+    return membership, err
+  }
+  if EffectiveRole(membership) == RoleAdmin && role != RoleAdmin {
+    if err := ensureOtherAdminNoCache(ctx, organizationID, memberUserID); err != nil {
+      return membership, err
+    }
+  }
+
+  membership.Role = role
+  if _, err := ctx.Storage().PutMembership(membership); err != nil {
+    return membership, err
+  }
+  ctx.Cache().Delete(membershipCacheKey(organizationID, memberUserID))
+  return membership, nil
+}
+
+func ensureOtherAdminNoCache(ctx Context, organizationID int64, userID int64) error {
+  memberships, err := ctx.Storage().GetMemberships(organizationID)
+  if err != nil {
+    return err
+  }
+
+  for _, membership := range memberships {
+    if membership.UserID != userID && EffectiveRole(membership) == RoleAdmin {
+      return nil
+    }
+  }
+  return ErrLastAdmin
+}
@@ -0,0 +1,233 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "time"
+)
+
+var ErrScheduleNotFound = storage.ErrScheduleNotFound
+var ErrScheduleNeverRuns = errors.New("Schedule never runs")
+
+// How many upcoming run times a preview lists.
+const ScheduleNextRunCount = 5
+
+func scheduleArgs(schedule storage.Schedule) map[string]string {
+  args := make(map[string]string)
+  for _, param := range schedule.Params {
+    args[param.Name] = param.Value
+  }
+  return args
+}
+
+// Lists the next run times for an expression without saving anything.
+func PreviewSchedule(expression string, timeZone string, count int) ([]time.Time, error) {
+  cronSchedule, err := ParseCronSchedule(expression, timeZone)
+  if err != nil {
+    return nil, err
+  }
+  return cronSchedule.NextTimes(time.Now(), count), nil
+}
+
+func nextScheduleRunTime(schedule storage.Schedule, after time.Time) (int64, error) {
+  cronSchedule, err := ParseCronSchedule(schedule.Expression, schedule.TimeZone)
+  if err != nil {
+    return 0, err
+  }
+  next := cronSchedule.Next(after)
+  if next.IsZero() {
+    return 0, ErrScheduleNeverRuns
+  }
+  return next.Unix(), nil
+}
+
+func CreateScheduleNoCache(ctx Context, user storage.User, scheduleRequest CreateScheduleRequest) (storage.Schedule, error) {
+  var schedule storage.Schedule
+
+  // Build a throwaway invocation so bad args or an unassigned command are rejected up front
+  invocation, err := newInvocationNoCache(ctx, user, scheduleRequest.CommandID, scheduleRequest.ServerID, scheduleRequest.Params)
+  if err != nil {
+    return schedule, err
+  }
+
+  schedule.UserID = user.ID
+  schedule.OrganizationID = user.OrganizationID
+  schedule.CommandID = invocation.CommandID
+  schedule.ServerID = invocation.ServerID
+  schedule.Expression = scheduleRequest.Expression
+  schedule.TimeZone = scheduleRequest.TimeZone
+  schedule.CreatedTime = time.Now().UTC().Unix()
+  for name, value := range scheduleRequest.Params {
+    schedule.Params = append(schedule.Params, storage.InvocationParam{ Name: name, Value: value })
+  }
+  if schedule.NextRunTime, err = nextScheduleRunTime(schedule, time.Now()); err != nil {
+    return schedule, err
+  }
+
+  return ctx.Storage().PutSchedule(schedule)
+}
+
+func GetSchedulesNoCache(ctx Context, user storage.User) ([]storage.Schedule, error) {
+  return ctx.Storage().GetSchedules(user.OrganizationID)
+}
+
+func GetScheduleNoCache(ctx Context, user storage.User, scheduleID int64) (storage.Schedule, error) {
+  schedule, err := ctx.Storage().GetSchedule(scheduleID)
+  if err != nil {
+    return schedule, err
+  } else if schedule.OrganizationID != user.OrganizationID {
+    return storage.Schedule{}, ErrScheduleNotFound
+  }
+  return schedule, nil
+}
+
+// Pauses or resumes a schedule. Resuming picks up from the next run time after now rather than catching up.
+func SetSchedulePausedNoCache(ctx Context, user storage.User, scheduleID int64, paused bool) (storage.Schedule, error) {
+  if _, err := GetScheduleNoCache(ctx, user, scheduleID); err != nil {
+    return storage.Schedule{}, err
+  }
+
+  var schedule storage.Schedule
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if schedule, err = tx.GetSchedule(scheduleID); err != nil {
+      return err
+    }
+
+    if !paused && schedule.Paused {
+      if schedule.NextRunTime, err = nextScheduleRunTime(schedule, time.Now()); err != nil {
+        return err
+      }
+    }
+    schedule.Paused = paused
+
+    schedule, err = tx.PutSchedule(schedule)
+    return err
+  })
+  return schedule, err
+}
+
+func DeleteScheduleNoCache(ctx Context, user storage.User, scheduleID int64) error {
+  if _, err := GetScheduleNoCache(ctx, user, scheduleID); err != nil {
+    return err
+  }
+  return ctx.Storage().DeleteSchedule(scheduleID)
+}
+
+// Queues an invocation for every schedule that is due and moves it on to its next run time. Runs missed while
+// the scheduler was not being triggered are skipped rather than queued all at once. A schedule that fails is logged,
+// has the failure recorded and is tried again on the next run, without holding up the rest. Returns how many were queued.
+func RunDueSchedulesNoCache(ctx Context, now time.Time) (int, error) {
+  queued := 0
+
+  scheduleIDs, err := ctx.Storage().GetDueScheduleIDs(now.Unix())
+  if err != nil {
+    return queued, err
+  }
+
+  for _, scheduleID := range scheduleIDs {
+    schedule, err := ctx.Storage().GetSchedule(scheduleID)
+    if err != nil {
+      ctx.Errorf("Failed to load schedule %d: %v", scheduleID, err)
+      continue
+    }
+
+    // Build the invocation outside the transaction to keep it to the schedule, server and invocation groups
+    dueTime := schedule.NextRunTime
+    user := storage.User{ ID: schedule.UserID, OrganizationID: schedule.OrganizationID }
+    invocation, invocationErr := newInvocationNoCache(ctx, user, schedule.CommandID, schedule.ServerID, scheduleArgs(schedule))
+
+    var server storage.Server
+    err = ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      var err error
+      if schedule, err = tx.GetSchedule(scheduleID); err != nil {
+        return err
+      }
+      if schedule.Paused || schedule.NextRunTime != dueTime {
+        invocation.ID = 0
+        return nil
+      }
+
+      if invocationErr != nil {
+        schedule.LastError = invocationErr.Error()
+      } else {
+        invocation.ScheduleID = scheduleID
+        if server, err = putQueuedInvocation(tx, &invocation); err != nil {
+          return err
+        }
+        schedule.LastError = ""
+        schedule.LastInvocationID = invocation.ID
+      }
+
+      schedule.LastRunTime = now.Unix()
+      if schedule.NextRunTime, err = nextScheduleRunTime(schedule, now); err != nil {
+        schedule.LastError = err.Error()
+        schedule.Paused = true
+      }
+      _, err = tx.PutSchedule(schedule)
+      return err
+    })
+    if err != nil {
+      ctx.Errorf("Failed to run schedule %d: %v", scheduleID, err)
+      recordScheduleErrorNoCache(ctx, scheduleID, dueTime, err)
+      continue
+    }
+
+    if invocation.ID != 0 {
+      ctx.Cache().Delete(serverCacheKey(server.OrganizationID, server.ServerID))
+      signalServerQueue(ctx, server.ID)
+      queued++
+    }
+  }
+
+  return queued, nil
+}
+
+// Pauses every schedule that runs the command, noting why. Used once the command has been deleted.
+func pauseCommandSchedulesNoCache(ctx Context, commandID int64) error {
+  scheduleIDs, err := ctx.Storage().GetCommandScheduleIDs(commandID)
+  if err != nil {
+    return err
+  }
+
+  for _, scheduleID := range scheduleIDs {
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      schedule, err := tx.GetSchedule(scheduleID)
+      if err == ErrScheduleNotFound {
+        return nil
+      } else if err != nil {
+        return err
+      }
+      if schedule.Paused {
+        return nil
+      }
+      schedule.Paused = true
+      schedule.LastError = ErrCommandNotFound.Error()
+      _, err = tx.PutSchedule(schedule)
+      return err
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Notes why a due schedule couldn't be run, leaving it due so the next run tries again.
+func recordScheduleErrorNoCache(ctx Context, scheduleID int64, dueTime int64, runErr error) {
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    schedule, err := tx.GetSchedule(scheduleID)
+    if err != nil {
+      return err
+    }
+    if schedule.NextRunTime != dueTime {
+      return nil
+    }
+    schedule.LastError = runErr.Error()
+    _, err = tx.PutSchedule(schedule)
+    return err
+  })
+  if err != nil {
+    ctx.Errorf("Failed to record the error for schedule %d: %v", scheduleID, err)
+  }
+}
@@ -0,0 +1,212 @@
+package biboop
+
+import (
+  "encoding/json"
+  "github.com/dbrain/soggy"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// Who made a request, as the runtime's sign in sees it. Users are matched up by email.
+type Identity struct {
+  Email string `json:"email,omitempty"`
+  Name string `json:"name,omitempty"`
+}
+
+// Credentials that were refused, with the reason sent back to the client.
+type AuthFailure string
+
+func (failure AuthFailure) Error() string {
+  return string(failure)
+}
+
+const AuthFailureInvalid = AuthFailure("authorization_failed")
+
+// Runtime is what differs between serving biboop on App Engine and serving it standalone: where a request's storage
+// and cache are, who signed in and how they sign in and out. The handlers and everything behind them are shared.
+type Runtime interface {
+  NewContext(req *http.Request) Context
+  // Returns who signed in to the web pages, nil if nobody has
+  IdentifyWebRequest(ctx Context, req *http.Request) (*Identity, error)
+  // Returns who an API request's credentials belong to, nil if it has none. Personal access tokens are dealt with
+  // before this is asked. Credentials that are no good return an AuthFailure.
+  IdentifyApiRequest(ctx Context, req *http.Request) (*Identity, error)
+  // Where to sign in and come back to dest, empty when signing in is left to something in front of the server
+  LoginURL(ctx Context, dest string) (string, error)
+  LogoutURL(ctx Context, dest string) (string, error)
+  // Whether the request came from the runtime's scheduler
+  IsCronRequest(req *http.Request) bool
+}
+
+// Sets the request up for the handlers: the runtime, a context to work in, and who made the request along with their
+// user if anyone signed in.
+type WebMiddleware struct {
+  runtime Runtime
+}
+
+func (middleware *WebMiddleware) Execute(ctx *soggy.Context) {
+  appCtx := middleware.runtime.NewContext(ctx.Req.Request)
+  ctx.Env["runtime"] = middleware.runtime
+  ctx.Env["appCtx"] = appCtx
+
+  identity, err := middleware.runtime.IdentifyWebRequest(appCtx, ctx.Req.Request)
+  identifyRequest(ctx, appCtx, identity, err)
+}
+
+type ApiMiddleware struct {
+  runtime Runtime
+}
+
+func (middleware *ApiMiddleware) Execute(ctx *soggy.Context) {
+  appCtx := middleware.runtime.NewContext(ctx.Req.Request)
+  ctx.Env["runtime"] = middleware.runtime
+  ctx.Env["appCtx"] = appCtx
+
+  authHeader := ctx.Req.Request.Header.Get("Authorization")
+  if token := strings.TrimPrefix(authHeader, "Bearer "); strings.HasPrefix(authHeader, "Bearer ") && IsPersonalAccessToken(token) {
+    // Personal access tokens act as their user but aren't a sign in, so identity is left unset
+    personalAccessToken, biboopUser, err := AuthenticatePersonalAccessToken(appCtx, token)
+    if err == ErrPersonalAccessTokenInvalid {
+      sendAuthFailure(ctx.Res, http.StatusUnauthorized, string(AuthFailureInvalid))
+      return
+    } else if err != nil {
+      ctx.Next(err)
+      return
+    }
+
+    ctx.Env["personalAccessToken"] = personalAccessToken
+    ctx.Env["user"] = biboopUser
+    ctx.Next(nil)
+    return
+  }
+
+  identity, err := middleware.runtime.IdentifyApiRequest(appCtx, ctx.Req.Request)
+  identifyRequest(ctx, appCtx, identity, err)
+}
+
+func identifyRequest(ctx *soggy.Context, appCtx Context, identity *Identity, err error) {
+  if failure, ok := err.(AuthFailure); ok {
+    sendAuthFailure(ctx.Res, http.StatusUnauthorized, string(failure))
+    return
+  } else if err != nil {
+    ctx.Next(err)
+    return
+  } else if identity == nil {
+    ctx.Next(nil)
+    return
+  }
+
+  biboopUser, err := GetOrCreateUser(appCtx, identity.Email)
+  if err != nil {
+    ctx.Next(err)
+    return
+  }
+  ctx.Env["identity"] = identity
+  ctx.Env["user"] = biboopUser
+  ctx.Next(nil)
+}
+
+func sendAuthFailure(res *soggy.Response, status int, reason string) {
+  res.Set("Content-Type", "application/json; charset=utf-8")
+  jsonOut, err := json.Marshal(map[string]interface{} { "error": reason })
+  if err == nil {
+    res.Set("Content-Length", strconv.Itoa(len(jsonOut)))
+    res.WriteHeader(status)
+    res.Write(jsonOut)
+  }
+}
+
+// Builds the web server. Middleware passed in runs ahead of biboop's own, standalone uses it to serve static files.
+func NewWebServer(runtime Runtime, middleware ...soggy.Middleware) *soggy.Server {
+  webServer := soggy.NewServer("/")
+
+  webServer.Get("/", WebIndex)
+  webServer.Get("/dashboard", WebUserRequired, WebRoleRequired(RoleViewer), WebDashboard)
+  webServer.Get("/me", WebUserRequired, WebMe)
+  webServer.Get("/logout", WebLogout)
+
+  webServer.All(soggy.ANY_PATH, func (context *soggy.Context) (int, interface{}) {
+    return 404, map[string]interface{} { "error": "Path not found" }
+  })
+
+  middleware = append(middleware, &WebMiddleware{ runtime: runtime }, webServer.Router)
+  webServer.Use(middleware...)
+  return webServer
+}
+
+func NewApiServer(runtime Runtime) *soggy.Server {
+  apiServer := soggy.NewServer("/api")
+  apiServer.Get("/me", ApiUserRequired, ApiMe)
+  apiServer.Post("/server/poll", ApiServerPoll)
+  apiServer.Post("/server/enroll", ApiServerEnroll)
+  apiServer.Post("/server/update", ApiServerUpdate)
+  apiServer.Post("/server/result", ApiServerResult)
+  apiServer.Post("/server/output", ApiServerOutput)
+  apiServer.Get("/servers", ApiUserOrTokenRequired(ScopeReadServers), ApiRoleRequired(RoleViewer), ApiGetServers)
+  apiServer.Get("/servers/([0-9]+)/events", ApiUserOrTokenRequired(ScopeReadServers), ApiRoleRequired(RoleViewer), ApiGetServerEvents)
+  apiServer.Put("/servers/([0-9]+)/labels", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiSetServerLabels)
+  apiServer.Delete("/servers/([0-9]+)", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiDeleteServer)
+  apiServer.Post("/servers/([0-9]+)/credential/revoke", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiRevokeServerCredential)
+  apiServer.Get("/enrollment-tokens", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiGetEnrollmentTokens)
+  apiServer.Post("/enrollment-tokens", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiCreateEnrollmentToken)
+  apiServer.Delete("/enrollment-tokens/([0-9]+)", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiRevokeEnrollmentToken)
+  apiServer.Get("/tokens", ApiUserRequired, ApiGetPersonalAccessTokens)
+  apiServer.Post("/tokens", ApiUserRequired, ApiCreatePersonalAccessToken)
+  apiServer.Delete("/tokens/([0-9]+)", ApiUserRequired, ApiRevokePersonalAccessToken)
+  apiServer.Get("/commands", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleViewer), ApiGetCommands)
+  apiServer.Post("/commands", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiCreateCommand)
+  apiServer.Get("/commands/([0-9]+)", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleViewer), ApiGetCommand)
+  apiServer.Put("/commands/([0-9]+)", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiUpdateCommand)
+  apiServer.Delete("/commands/([0-9]+)", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiDeleteCommand)
+  apiServer.Get("/commands/([0-9]+)/versions", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleViewer), ApiGetCommandVersions)
+  apiServer.Get("/commands/([0-9]+)/versions/([0-9]+)", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleViewer), ApiGetCommandVersion)
+  apiServer.Post("/commands/([0-9]+)/attach", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiAddCommandToServers)
+  apiServer.Post("/commands/([0-9]+)/detach", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiRemoveCommandFromServers)
+  apiServer.Get("/catalog", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleViewer), ApiGetCatalog)
+  apiServer.Post("/catalog/([0-9]+)/fork", ApiUserOrTokenRequired(ScopeManageCommands), ApiRoleRequired(RoleOperator), ApiForkCommand)
+  apiServer.Get("/invocations", ApiUserOrTokenRequired(ScopeRunCommands), ApiRoleRequired(RoleViewer), ApiGetInvocations)
+  apiServer.Post("/invocations", ApiUserOrTokenRequired(ScopeRunCommands), ApiRoleRequired(RoleOperator), ApiCreateInvocation)
+  apiServer.Get("/invocations/([0-9]+)", ApiUserOrTokenRequired(ScopeRunCommands), ApiRoleRequired(RoleViewer), ApiGetInvocation)
+  apiServer.Post("/invocations/([0-9]+)/approve", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiApproveInvocation)
+  apiServer.Post("/invocations/([0-9]+)/reject", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiRejectInvocation)
+  apiServer.Get("/invocations/([0-9]+)/output", ApiUserOrTokenRequired(ScopeRunCommands), ApiRoleRequired(RoleViewer), ApiGetInvocationOutput)
+
+  apiServer.Get("/schedules", ApiUserRequired, ApiRoleRequired(RoleViewer), ApiGetSchedules)
+  apiServer.Post("/schedules", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiCreateSchedule)
+  apiServer.Post("/schedules/preview", ApiUserRequired, ApiRoleRequired(RoleViewer), ApiPreviewSchedule)
+  apiServer.Get("/schedules/([0-9]+)/preview", ApiUserRequired, ApiRoleRequired(RoleViewer), ApiGetSchedulePreview)
+  apiServer.Post("/schedules/([0-9]+)/pause", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiPauseSchedule)
+  apiServer.Post("/schedules/([0-9]+)/resume", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiResumeSchedule)
+  apiServer.Delete("/schedules/([0-9]+)", ApiUserRequired, ApiRoleRequired(RoleOperator), ApiDeleteSchedule)
+  apiServer.Get("/organizations", ApiUserRequired, ApiGetOrganizations)
+  apiServer.Post("/organizations", ApiUserRequired, ApiCreateOrganization)
+  apiServer.Post("/organizations/([0-9]+)/switch", ApiUserRequired, ApiSwitchOrganization)
+  apiServer.Get("/organizations/([0-9]+)/members", ApiUserRequired, ApiGetMembers)
+  apiServer.Put("/organizations/([0-9]+)/members/([0-9]+)", ApiUserRequired, ApiSetMemberRole)
+  apiServer.Delete("/organizations/([0-9]+)/members/([0-9]+)", ApiUserRequired, ApiRemoveMember)
+  apiServer.Post("/organizations/([0-9]+)/invitations", ApiUserRequired, ApiCreateInvitation)
+  apiServer.Post("/organizations/([0-9]+)/server-api-key/rotate", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiRotateServerAPIKey)
+  apiServer.Post("/organizations/([0-9]+)/server-api-key/revoke-previous", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiRevokePreviousServerAPIKey)
+  apiServer.Get("/invitations", ApiUserRequired, ApiGetInvitations)
+  apiServer.Post("/invitations/([0-9]+)/accept", ApiUserRequired, ApiAcceptInvitation)
+  apiServer.Post("/invitations/([0-9]+)/decline", ApiUserRequired, ApiDeclineInvitation)
+  apiServer.Get("/audit", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiGetAuditEvents)
+  apiServer.Get("/audit/verify", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiVerifyAuditEvents)
+  apiServer.Get("/webhooks", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiGetWebhooks)
+  apiServer.Post("/webhooks", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiCreateWebhook)
+  apiServer.Delete("/webhooks/([0-9]+)", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiDeleteWebhook)
+  apiServer.Get("/webhooks/([0-9]+)/deliveries", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiGetWebhookDeliveries)
+  apiServer.Post("/webhooks/([0-9]+)/deliveries/([0-9]+)/redeliver", ApiUserRequired, ApiRoleRequired(RoleAdmin), ApiRedeliverWebhook)
+  apiServer.Get("/cron/liveness", ApiCronRequired, ApiCronLiveness)
+  apiServer.Get("/cron/schedules", ApiCronRequired, ApiCronSchedules)
+  apiServer.Get("/cron/webhooks", ApiCronRequired, ApiCronWebhooks)
+  apiServer.Get("/cron/approvals", ApiCronRequired, ApiCronApprovals)
+
+  apiServer.All(soggy.ANY_PATH, func (context *soggy.Context) (int, interface{}) {
+    return 404, map[string]interface{} { "error": "Path not found" }
+  })
+
+  apiServer.Use(&ApiMiddleware{ runtime: runtime }, apiServer.Router)
+  return apiServer
+}
@@ -0,0 +1,952 @@
+// +build appengine
+
+package storage
+
+import (
+  "appengine"
+  "appengine/datastore"
+  "appengine/memcache"
+  "reflect"
+  "sort"
+  "strconv"
+  "time"
+)
+
+// The kinds are the ones the app has always used.
+const (
+  datastoreKindUser = "User"
+  datastoreKindUserEmail = "UserEmail"
+  datastoreKindOrganization = "Organization"
+  datastoreKindMembership = "Membership"
+  datastoreKindInvitation = "Invitation"
+  datastoreKindServer = "Server"
+  datastoreKindServerEvent = "ServerEvent"
+  datastoreKindCommand = "Command"
+  datastoreKindCommandVersion = "CommandVersion"
+  datastoreKindInvocation = "Invocation"
+  datastoreKindOutputStream = "OutputStream"
+  datastoreKindOutputChunk = "OutputChunk"
+  datastoreKindSchedule = "Schedule"
+  datastoreKindEnrollmentToken = "EnrollmentToken"
+  datastoreKindPersonalAccessToken = "PersonalAccessToken"
+  datastoreKindAuditChain = "AuditChain"
+  datastoreKindAuditEvent = "AuditEvent"
+  datastoreKindWebhook = "Webhook"
+  datastoreKindWebhookDelivery = "WebhookDelivery"
+)
+
+// Kinds that belonged to a single user before organizations existed and are moved into their personal organization.
+var organizationOwnedKinds = []string { datastoreKindServer, datastoreKindCommand, datastoreKindInvocation, datastoreKindSchedule, datastoreKindServerEvent }
+
+// AppEngineStorage keeps entities in the App Engine datastore. Transactions are cross group, so a transaction may
+// touch up to the datastore's limit of entity groups. Caching is left to the caller, who knows when a change has
+// committed.
+type AppEngineStorage struct {
+  ctx appengine.Context
+  // Set on the Storage a transaction runs against
+  transaction bool
+}
+
+func NewAppEngineStorage(ctx appengine.Context) *AppEngineStorage {
+  return &AppEngineStorage{ ctx: ctx }
+}
+
+// A server as it is stored, which keeps the commands it may run as datastore keys.
+type appEngineServer struct {
+  UserID int64
+  OrganizationID int64
+  ServerID string
+  Name string
+  Description string
+  LastPollTime int64
+  PollIntervalSec int
+  Status string
+  Labels []ServerLabel
+  AgentLabels []ServerLabel
+  PendingCommands int
+  AvailableCommands []*datastore.Key
+  CredentialHash string `datastore:",noindex"`
+  CredentialIssuedTime int64
+  CredentialRevokedTime int64
+}
+
+func (storage *AppEngineStorage) fromAppEngineServer(key *datastore.Key, stored appEngineServer) Server {
+  server := Server{
+    ID: key.IntID(),
+    UserID: stored.UserID,
+    OrganizationID: stored.OrganizationID,
+    ServerID: stored.ServerID,
+    Name: stored.Name,
+    Description: stored.Description,
+    LastPollTime: stored.LastPollTime,
+    PollIntervalSec: stored.PollIntervalSec,
+    Status: stored.Status,
+    Labels: stored.Labels,
+    AgentLabels: stored.AgentLabels,
+    PendingCommands: stored.PendingCommands,
+    CredentialHash: stored.CredentialHash,
+    CredentialIssuedTime: stored.CredentialIssuedTime,
+    CredentialRevokedTime: stored.CredentialRevokedTime,
+  }
+  for _, commandKey := range stored.AvailableCommands {
+    server.AvailableCommands = append(server.AvailableCommands, commandKey.IntID())
+  }
+  return server
+}
+
+func (storage *AppEngineStorage) toAppEngineServer(server Server) appEngineServer {
+  stored := appEngineServer{
+    UserID: server.UserID,
+    OrganizationID: server.OrganizationID,
+    ServerID: server.ServerID,
+    Name: server.Name,
+    Description: server.Description,
+    LastPollTime: server.LastPollTime,
+    PollIntervalSec: server.PollIntervalSec,
+    Status: server.Status,
+    Labels: server.Labels,
+    AgentLabels: server.AgentLabels,
+    PendingCommands: server.PendingCommands,
+    CredentialHash: server.CredentialHash,
+    CredentialIssuedTime: server.CredentialIssuedTime,
+    CredentialRevokedTime: server.CredentialRevokedTime,
+  }
+  for _, commandID := range server.AvailableCommands {
+    stored.AvailableCommands = append(stored.AvailableCommands, datastore.NewKey(storage.ctx, datastoreKindCommand, "", commandID, nil))
+  }
+  return stored
+}
+
+// Returns the key to put an entity under, a new one when it has no ID.
+func (storage *AppEngineStorage) entityKey(kind string, id int64) *datastore.Key {
+  if id == 0 {
+    return datastore.NewIncompleteKey(storage.ctx, kind, nil)
+  }
+  return datastore.NewKey(storage.ctx, kind, "", id, nil)
+}
+
+func (storage *AppEngineStorage) GetUser(id int64) (User, error) {
+  var user User
+  if err := datastore.Get(storage.ctx, storage.entityKey(datastoreKindUser, id), &user); err == datastore.ErrNoSuchEntity {
+    return user, ErrUserNotFound
+  } else if err != nil {
+    return user, err
+  }
+  user.ID = id
+  return user, nil
+}
+
+func (storage *AppEngineStorage) GetUserByEmail(email string) (User, error) {
+  var users []User
+  keys, err := datastore.NewQuery(datastoreKindUser).
+    Filter("Email =", email).
+    Limit(1).
+    GetAll(storage.ctx, &users)
+  if err != nil {
+    return User{}, err
+  } else if len(keys) == 0 {
+    return User{}, ErrUserNotFound
+  }
+  users[0].ID = keys[0].IntID()
+  return users[0], nil
+}
+
+func (storage *AppEngineStorage) GetUserByServerAPIKey(serverAPIKey string) (User, error) {
+  var users []User
+  keys, err := datastore.NewQuery(datastoreKindUser).
+    Filter("ServerAPIKey =", serverAPIKey).
+    Limit(1).
+    GetAll(storage.ctx, &users)
+  if err != nil {
+    return User{}, err
+  } else if len(keys) == 0 {
+    return User{}, ErrUserNotFound
+  }
+  users[0].ID = keys[0].IntID()
+  return users[0], nil
+}
+
+func (storage *AppEngineStorage) PutUser(user User) (User, error) {
+  key, err := datastore.Put(storage.ctx, storage.entityKey(datastoreKindUser, user.ID), &user)
+  if err != nil {
+    return user, err
+  }
+  user.ID = key.IntID()
+  return user, nil
+}
+
+func (storage *AppEngineStorage) GetServer(id int64) (Server, error) {
+  var stored appEngineServer
+  key := storage.entityKey(datastoreKindServer, id)
+  if err := datastore.Get(storage.ctx, key, &stored); err == datastore.ErrNoSuchEntity {
+    return Server{}, ErrServerNotFound
+  } else if err != nil {
+    return Server{}, err
+  }
+  return storage.fromAppEngineServer(key, stored), nil
+}
+
+func (storage *AppEngineStorage) GetServerByServerID(organizationID int64, serverID string) (Server, error) {
+  servers, err := storage.findServers(datastore.NewQuery(datastoreKindServer).
+    Filter("OrganizationID =", organizationID).
+    Filter("ServerID =", serverID).
+    Limit(1))
+  if err != nil {
+    return Server{}, err
+  } else if len(servers) == 0 {
+    return Server{}, ErrServerNotFound
+  }
+  return servers[0], nil
+}
+
+func (storage *AppEngineStorage) GetServers(organizationID int64) ([]Server, error) {
+  return storage.findServers(datastore.NewQuery(datastoreKindServer).Filter("OrganizationID =", organizationID))
+}
+
+func (storage *AppEngineStorage) GetAllServers() ([]Server, error) {
+  return storage.findServers(datastore.NewQuery(datastoreKindServer))
+}
+
+func (storage *AppEngineStorage) findServers(query *datastore.Query) ([]Server, error) {
+  servers := []Server {}
+  var stored []appEngineServer
+  keys, err := query.GetAll(storage.ctx, &stored)
+  if err != nil {
+    return servers, err
+  }
+  for i, key := range keys {
+    servers = append(servers, storage.fromAppEngineServer(key, stored[i]))
+  }
+  return servers, nil
+}
+
+func (storage *AppEngineStorage) PutServer(server Server) (Server, error) {
+  stored := storage.toAppEngineServer(server)
+  key, err := datastore.Put(storage.ctx, storage.entityKey(datastoreKindServer, server.ID), &stored)
+  if err != nil {
+    return server, err
+  }
+  server.ID = key.IntID()
+  return server, nil
+}
+
+func (storage *AppEngineStorage) DeleteServer(id int64) error {
+  if _, err := storage.GetServer(id); err != nil {
+    return err
+  }
+  return datastore.Delete(storage.ctx, storage.entityKey(datastoreKindServer, id))
+}
+
+func (storage *AppEngineStorage) GetCommand(id int64) (Command, error) {
+  var command Command
+  if err := datastore.Get(storage.ctx, storage.entityKey(datastoreKindCommand, id), &command); err == datastore.ErrNoSuchEntity {
+    return command, ErrCommandNotFound
+  } else if err != nil {
+    return command, err
+  }
+  command.ID = id
+  return command, nil
+}
+
+func (storage *AppEngineStorage) GetCommands(organizationID int64) ([]Command, error) {
+  return storage.findCommands(datastore.NewQuery(datastoreKindCommand).Filter("OrganizationID =", organizationID))
+}
+
+func (storage *AppEngineStorage) GetPublicCommands(afterID int64, limit int) ([]Command, error) {
+  query := datastore.NewQuery(datastoreKindCommand).Filter("PublicCommand =", true).Order("__key__").Limit(limit)
+  if afterID != 0 {
+    query = query.Filter("__key__ >", storage.entityKey(datastoreKindCommand, afterID))
+  }
+  return storage.findCommands(query)
+}
+
+func (storage *AppEngineStorage) findCommands(query *datastore.Query) ([]Command, error) {
+  commands := []Command {}
+  keys, err := query.GetAll(storage.ctx, &commands)
+  if err != nil {
+    return commands, err
+  }
+  for i, key := range keys {
+    commands[i].ID = key.IntID()
+  }
+  return commands, nil
+}
+
+func (storage *AppEngineStorage) PutCommand(command Command) (Command, error) {
+  key, err := datastore.Put(storage.ctx, storage.entityKey(datastoreKindCommand, command.ID), &command)
+  if err != nil {
+    return command, err
+  }
+  command.ID = key.IntID()
+  return command, nil
+}
+
+func (storage *AppEngineStorage) DeleteCommand(id int64) error {
+  if _, err := storage.GetCommand(id); err != nil {
+    return err
+  }
+  return datastore.Delete(storage.ctx, storage.entityKey(datastoreKindCommand, id))
+}
+
+// Reads the entity stored under key into what entity points to.
+func (storage *AppEngineStorage) getEntity(key *datastore.Key, entity interface{}, notFound error) error {
+  if err := datastore.Get(storage.ctx, key, entity); err == datastore.ErrNoSuchEntity {
+    return notFound
+  } else if err != nil {
+    return err
+  }
+  return nil
+}
+
+// Puts what entity points to, setting the ID id points to from the key it was put under.
+func (storage *AppEngineStorage) putEntity(kind string, id *int64, entity interface{}) error {
+  key, err := datastore.Put(storage.ctx, storage.entityKey(kind, *id), entity)
+  if err != nil {
+    return err
+  }
+  *id = key.IntID()
+  return nil
+}
+
+func (storage *AppEngineStorage) deleteEntity(key *datastore.Key, notFound error) error {
+  if err := storage.getEntity(key, &datastore.PropertyList{}, notFound); err != nil {
+    return err
+  }
+  return datastore.Delete(storage.ctx, key)
+}
+
+// Runs query into the slice entities points to, setting each entity's ID from its key.
+func (storage *AppEngineStorage) findEntities(query *datastore.Query, entities interface{}) error {
+  keys, err := query.GetAll(storage.ctx, entities)
+  if err != nil {
+    return err
+  }
+  slice := reflect.ValueOf(entities).Elem()
+  for i, key := range keys {
+    slice.Index(i).FieldByName("ID").SetInt(key.IntID())
+  }
+  return nil
+}
+
+func (storage *AppEngineStorage) findIDs(query *datastore.Query) ([]int64, error) {
+  ids := []int64 {}
+  keys, err := query.KeysOnly().GetAll(storage.ctx, nil)
+  if err != nil {
+    return ids, err
+  }
+  for _, key := range keys {
+    ids = append(ids, key.IntID())
+  }
+  return ids, nil
+}
+
+func (storage *AppEngineStorage) RunInTransaction(fn func(tx Storage) error) error {
+  if storage.transaction {
+    return ErrNestedTransaction
+  }
+  return datastore.RunInTransaction(storage.ctx, func (tc appengine.Context) error {
+    return fn(&AppEngineStorage{ ctx: tc, transaction: true })
+  }, &datastore.TransactionOptions{ XG: true })
+}
+
+// Marks an email as taken, keyed by the email, so creating its user can be a transaction on a single key.
+type appEngineUserEmail struct {
+  UserID int64
+}
+
+func (storage *AppEngineStorage) GetOrCreateUser(email string) (User, error) {
+  if user, err := storage.GetUserByEmail(email); err != ErrUserNotFound {
+    return user, err
+  }
+
+  var user User
+  err := storage.RunInTransaction(func (tx Storage) error {
+    tc := tx.(*AppEngineStorage)
+    emailKey := datastore.NewKey(tc.ctx, datastoreKindUserEmail, email, 0, nil)
+    var userEmail appEngineUserEmail
+    if err := datastore.Get(tc.ctx, emailKey, &userEmail); err == nil {
+      var err error
+      user, err = tc.GetUser(userEmail.UserID)
+      return err
+    } else if err != datastore.ErrNoSuchEntity {
+      return err
+    }
+
+    var err error
+    if user, err = tc.PutUser(User{ Email: email }); err != nil {
+      return err
+    }
+    _, err = datastore.Put(tc.ctx, emailKey, &appEngineUserEmail{ UserID: user.ID })
+    return err
+  })
+  return user, err
+}
+
+func (storage *AppEngineStorage) MigrateUserEntities(userID int64, organizationID int64) error {
+  for _, kind := range organizationOwnedKinds {
+    var entities []datastore.PropertyList
+    keys, err := datastore.NewQuery(kind).Filter("UserID =", userID).GetAll(storage.ctx, &entities)
+    if err != nil {
+      return err
+    }
+
+    for i, entity := range entities {
+      owned := false
+      migrated := datastore.PropertyList{}
+      for _, property := range entity {
+        if property.Name != "OrganizationID" {
+          migrated = append(migrated, property)
+        } else if organizationID, ok := property.Value.(int64); ok && organizationID != 0 {
+          owned = true
+        }
+      }
+      if owned {
+        continue
+      }
+      migrated = append(migrated, datastore.Property{ Name: "OrganizationID", Value: organizationID })
+      if _, err := datastore.Put(storage.ctx, keys[i], &migrated); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+func (storage *AppEngineStorage) GetOrganization(id int64) (Organization, error) {
+  var organization Organization
+  if err := storage.getEntity(storage.entityKey(datastoreKindOrganization, id), &organization, ErrOrganizationNotFound); err != nil {
+    return Organization{}, err
+  }
+  organization.ID = id
+  return organization, nil
+}
+
+func (storage *AppEngineStorage) GetOrganizationByServerAPIKeyHash(serverAPIKeyHash string) (Organization, error) {
+  return storage.findOrganization("ServerAPIKeyHash =", "PreviousServerAPIKeyHash =", serverAPIKeyHash)
+}
+
+func (storage *AppEngineStorage) GetOrganizationByLegacyServerAPIKey(serverAPIKey string) (Organization, error) {
+  return storage.findOrganization("ServerAPIKey =", "PreviousServerAPIKey =", serverAPIKey)
+}
+
+func (storage *AppEngineStorage) GetPersonalOrganization(userID int64) (Organization, error) {
+  return storage.findOrganization("PersonalUserID =", "", userID)
+}
+
+// Finds the organization where either filter matches value.
+func (storage *AppEngineStorage) findOrganization(filter string, otherFilter string, value interface{}) (Organization, error) {
+  if value == "" {
+    return Organization{}, ErrOrganizationNotFound
+  }
+  for _, filter := range []string { filter, otherFilter } {
+    if filter == "" {
+      continue
+    }
+    var organizations []Organization
+    if err := storage.findEntities(datastore.NewQuery(datastoreKindOrganization).Filter(filter, value).Limit(1), &organizations); err != nil {
+      return Organization{}, err
+    } else if len(organizations) > 0 {
+      return organizations[0], nil
+    }
+  }
+  return Organization{}, ErrOrganizationNotFound
+}
+
+func (storage *AppEngineStorage) PutOrganization(organization Organization) (Organization, error) {
+  if err := storage.putEntity(datastoreKindOrganization, &organization.ID, &organization); err != nil {
+    return organization, err
+  }
+  return organization, nil
+}
+
+func (storage *AppEngineStorage) membershipKey(organizationID int64, userID int64) *datastore.Key {
+  return datastore.NewKey(storage.ctx, datastoreKindMembership, strconv.FormatInt(organizationID, 10) + "-" + strconv.FormatInt(userID, 10), 0, nil)
+}
+
+func (storage *AppEngineStorage) GetMembership(organizationID int64, userID int64) (Membership, error) {
+  var membership Membership
+  if err := storage.getEntity(storage.membershipKey(organizationID, userID), &membership, ErrMembershipNotFound); err == ErrMembershipNotFound && !storage.transaction {
+    return storage.rekeyLegacyMembership(organizationID, userID)
+  } else if err != nil {
+    return Membership{}, err
+  }
+  return membership, nil
+}
+
+// Memberships from before they were keyed by organization and user have generated IDs. One is moved under its key the
+// first time it is looked up. The query can return a membership that is already gone, so each is read again by key.
+func (storage *AppEngineStorage) rekeyLegacyMembership(organizationID int64, userID int64) (Membership, error) {
+  legacyKeys, err := datastore.NewQuery(datastoreKindMembership).
+    Filter("OrganizationID =", organizationID).
+    Filter("UserID =", userID).
+    KeysOnly().
+    GetAll(storage.ctx, nil)
+  if err != nil {
+    return Membership{}, err
+  }
+
+  for _, legacyKey := range legacyKeys {
+    if legacyKey.IntID() == 0 {
+      continue
+    }
+    var membership Membership
+    err := datastore.RunInTransaction(storage.ctx, func (tc appengine.Context) error {
+      membership = Membership{}
+      if err := datastore.Get(tc, legacyKey, &membership); err != nil {
+        return err
+      }
+      if _, err := datastore.Put(tc, (&AppEngineStorage{ ctx: tc }).membershipKey(organizationID, userID), &membership); err != nil {
+        return err
+      }
+      return datastore.Delete(tc, legacyKey)
+    }, &datastore.TransactionOptions{ XG: true })
+    if err == nil {
+      return membership, nil
+    } else if err != datastore.ErrNoSuchEntity {
+      return membership, err
+    }
+  }
+  return Membership{}, ErrMembershipNotFound
+}
+
+func (storage *AppEngineStorage) GetMemberships(organizationID int64) ([]Membership, error) {
+  return storage.findMemberships(datastore.NewQuery(datastoreKindMembership).Filter("OrganizationID =", organizationID))
+}
+
+func (storage *AppEngineStorage) GetUserMemberships(userID int64) ([]Membership, error) {
+  return storage.findMemberships(datastore.NewQuery(datastoreKindMembership).Filter("UserID =", userID))
+}
+
+func (storage *AppEngineStorage) findMemberships(query *datastore.Query) ([]Membership, error) {
+  memberships := []Membership {}
+  if _, err := query.GetAll(storage.ctx, &memberships); err != nil {
+    return memberships, err
+  }
+  sort.Sort(membershipsByKey(memberships))
+  return memberships, nil
+}
+
+func (storage *AppEngineStorage) PutMembership(membership Membership) (Membership, error) {
+  if _, err := datastore.Put(storage.ctx, storage.membershipKey(membership.OrganizationID, membership.UserID), &membership); err != nil {
+    return membership, err
+  }
+  return membership, nil
+}
+
+func (storage *AppEngineStorage) DeleteMembership(organizationID int64, userID int64) error {
+  return storage.deleteEntity(storage.membershipKey(organizationID, userID), ErrMembershipNotFound)
+}
+
+func (storage *AppEngineStorage) GetInvitation(id int64) (Invitation, error) {
+  var invitation Invitation
+  if err := storage.getEntity(storage.entityKey(datastoreKindInvitation, id), &invitation, ErrInvitationNotFound); err != nil {
+    return Invitation{}, err
+  }
+  invitation.ID = id
+  return invitation, nil
+}
+
+func (storage *AppEngineStorage) GetPendingInvitations(email string) ([]Invitation, error) {
+  invitations := []Invitation {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindInvitation).
+    Filter("Email =", email).
+    Filter("State =", InvitationStatePending), &invitations)
+  return invitations, err
+}
+
+func (storage *AppEngineStorage) PutInvitation(invitation Invitation) (Invitation, error) {
+  if err := storage.putEntity(datastoreKindInvitation, &invitation.ID, &invitation); err != nil {
+    return invitation, err
+  }
+  return invitation, nil
+}
+
+func (storage *AppEngineStorage) GetServerEvents(serverID int64) ([]ServerEvent, error) {
+  events := []ServerEvent {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindServerEvent).
+    Filter("ServerID =", serverID).
+    Order("-Time"), &events)
+  return events, err
+}
+
+func (storage *AppEngineStorage) PutServerEvent(event ServerEvent) (ServerEvent, error) {
+  if err := storage.putEntity(datastoreKindServerEvent, &event.ID, &event); err != nil {
+    return event, err
+  }
+  return event, nil
+}
+
+// Versions are children of their command keyed by version number.
+func (storage *AppEngineStorage) commandVersionKey(commandID int64, version int64) *datastore.Key {
+  return datastore.NewKey(storage.ctx, datastoreKindCommandVersion, "", version, storage.entityKey(datastoreKindCommand, commandID))
+}
+
+func (storage *AppEngineStorage) GetCommandVersion(commandID int64, version int64) (CommandVersion, error) {
+  var commandVersion CommandVersion
+  if err := storage.getEntity(storage.commandVersionKey(commandID, version), &commandVersion, ErrCommandVersionNotFound); err != nil {
+    return CommandVersion{}, err
+  }
+  commandVersion.CommandID = commandID
+  commandVersion.Version = version
+  return commandVersion, nil
+}
+
+func (storage *AppEngineStorage) GetCommandVersions(commandID int64) ([]CommandVersion, error) {
+  commandVersions := []CommandVersion {}
+  keys, err := datastore.NewQuery(datastoreKindCommandVersion).
+    Ancestor(storage.entityKey(datastoreKindCommand, commandID)).
+    Order("__key__").
+    GetAll(storage.ctx, &commandVersions)
+  if err != nil {
+    return commandVersions, err
+  }
+  for i, key := range keys {
+    commandVersions[i].CommandID = commandID
+    commandVersions[i].Version = key.IntID()
+  }
+  return commandVersions, nil
+}
+
+func (storage *AppEngineStorage) PutCommandVersion(version CommandVersion) (CommandVersion, error) {
+  if _, err := datastore.Put(storage.ctx, storage.commandVersionKey(version.CommandID, version.Version), &version); err != nil {
+    return version, err
+  }
+  return version, nil
+}
+
+func (storage *AppEngineStorage) GetInvocation(id int64) (Invocation, error) {
+  var invocation Invocation
+  if err := storage.getEntity(storage.entityKey(datastoreKindInvocation, id), &invocation, ErrInvocationNotFound); err != nil {
+    return Invocation{}, err
+  }
+  invocation.ID = id
+  return invocation, nil
+}
+
+func (storage *AppEngineStorage) GetInvocations(organizationID int64) ([]Invocation, error) {
+  invocations := []Invocation {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindInvocation).
+    Filter("OrganizationID =", organizationID).
+    Order("-CreatedTime"), &invocations)
+  return invocations, err
+}
+
+func (storage *AppEngineStorage) GetQueuedInvocationIDs(serverID int64) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindInvocation).
+    Filter("ServerID =", serverID).
+    Filter("State =", InvocationStateQueued).
+    Order("CreatedTime"))
+}
+
+func (storage *AppEngineStorage) GetExpiredApprovalIDs(now int64) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindInvocation).
+    Filter("State =", InvocationStatePendingApproval).
+    Filter("ApprovalExpiresTime <", now))
+}
+
+func (storage *AppEngineStorage) PutInvocation(invocation Invocation) (Invocation, error) {
+  if err := storage.putEntity(datastoreKindInvocation, &invocation.ID, &invocation); err != nil {
+    return invocation, err
+  }
+  return invocation, nil
+}
+
+func (storage *AppEngineStorage) GetOutputStream(invocationID int64) (OutputStream, error) {
+  var stream OutputStream
+  if err := storage.getEntity(storage.entityKey(datastoreKindOutputStream, invocationID), &stream, nil); err != nil {
+    return OutputStream{}, err
+  }
+  return stream, nil
+}
+
+func (storage *AppEngineStorage) PutOutputStream(invocationID int64, stream OutputStream) error {
+  _, err := datastore.Put(storage.ctx, storage.entityKey(datastoreKindOutputStream, invocationID), &stream)
+  return err
+}
+
+// Chunks are children of their invocation's output stream keyed by sequence, so appending output is a single entity
+// group transaction.
+func (storage *AppEngineStorage) outputChunkKey(invocationID int64, sequence int64) *datastore.Key {
+  return datastore.NewKey(storage.ctx, datastoreKindOutputChunk, "", sequence, storage.entityKey(datastoreKindOutputStream, invocationID))
+}
+
+func (storage *AppEngineStorage) GetOutputChunk(invocationID int64, sequence int64) (OutputChunk, error) {
+  var chunk OutputChunk
+  if err := storage.getEntity(storage.outputChunkKey(invocationID, sequence), &chunk, ErrOutputChunkNotFound); err != nil {
+    return OutputChunk{}, err
+  }
+  return chunk, nil
+}
+
+func (storage *AppEngineStorage) GetOutputChunks(invocationID int64, afterOffset int64, limit int) ([]OutputChunk, error) {
+  chunks := []OutputChunk {}
+  _, err := datastore.NewQuery(datastoreKindOutputChunk).
+    Ancestor(storage.entityKey(datastoreKindOutputStream, invocationID)).
+    Filter("EndOffset >", afterOffset).
+    Order("EndOffset").
+    Limit(limit).
+    GetAll(storage.ctx, &chunks)
+  return chunks, err
+}
+
+func (storage *AppEngineStorage) PutOutputChunk(invocationID int64, chunk OutputChunk) error {
+  _, err := datastore.Put(storage.ctx, storage.outputChunkKey(invocationID, chunk.Sequence), &chunk)
+  return err
+}
+
+func (storage *AppEngineStorage) GetSchedule(id int64) (Schedule, error) {
+  var schedule Schedule
+  if err := storage.getEntity(storage.entityKey(datastoreKindSchedule, id), &schedule, ErrScheduleNotFound); err != nil {
+    return Schedule{}, err
+  }
+  schedule.ID = id
+  return schedule, nil
+}
+
+func (storage *AppEngineStorage) GetSchedules(organizationID int64) ([]Schedule, error) {
+  schedules := []Schedule {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindSchedule).Filter("OrganizationID =", organizationID), &schedules)
+  return schedules, err
+}
+
+func (storage *AppEngineStorage) GetDueScheduleIDs(now int64) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindSchedule).
+    Filter("Paused =", false).
+    Filter("NextRunTime <=", now))
+}
+
+func (storage *AppEngineStorage) GetCommandScheduleIDs(commandID int64) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindSchedule).Filter("CommandID =", commandID))
+}
+
+func (storage *AppEngineStorage) PutSchedule(schedule Schedule) (Schedule, error) {
+  if err := storage.putEntity(datastoreKindSchedule, &schedule.ID, &schedule); err != nil {
+    return schedule, err
+  }
+  return schedule, nil
+}
+
+func (storage *AppEngineStorage) DeleteSchedule(id int64) error {
+  return storage.deleteEntity(storage.entityKey(datastoreKindSchedule, id), ErrScheduleNotFound)
+}
+
+func (storage *AppEngineStorage) GetEnrollmentToken(id int64) (EnrollmentToken, error) {
+  var token EnrollmentToken
+  if err := storage.getEntity(storage.entityKey(datastoreKindEnrollmentToken, id), &token, ErrEnrollmentTokenNotFound); err != nil {
+    return EnrollmentToken{}, err
+  }
+  token.ID = id
+  return token, nil
+}
+
+func (storage *AppEngineStorage) GetEnrollmentTokenByHash(tokenHash string) (EnrollmentToken, error) {
+  var tokens []EnrollmentToken
+  if err := storage.findEntities(datastore.NewQuery(datastoreKindEnrollmentToken).Filter("TokenHash =", tokenHash).Limit(1), &tokens); err != nil {
+    return EnrollmentToken{}, err
+  } else if len(tokens) == 0 {
+    return EnrollmentToken{}, ErrEnrollmentTokenNotFound
+  }
+  return tokens[0], nil
+}
+
+func (storage *AppEngineStorage) GetEnrollmentTokens(organizationID int64) ([]EnrollmentToken, error) {
+  tokens := []EnrollmentToken {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindEnrollmentToken).Filter("OrganizationID =", organizationID), &tokens)
+  return tokens, err
+}
+
+func (storage *AppEngineStorage) PutEnrollmentToken(token EnrollmentToken) (EnrollmentToken, error) {
+  if err := storage.putEntity(datastoreKindEnrollmentToken, &token.ID, &token); err != nil {
+    return token, err
+  }
+  return token, nil
+}
+
+func (storage *AppEngineStorage) GetPersonalAccessToken(id int64) (PersonalAccessToken, error) {
+  var token PersonalAccessToken
+  if err := storage.getEntity(storage.entityKey(datastoreKindPersonalAccessToken, id), &token, ErrPersonalAccessTokenNotFound); err != nil {
+    return PersonalAccessToken{}, err
+  }
+  token.ID = id
+  return token, nil
+}
+
+func (storage *AppEngineStorage) GetPersonalAccessTokenByHash(tokenHash string) (PersonalAccessToken, error) {
+  var tokens []PersonalAccessToken
+  if err := storage.findEntities(datastore.NewQuery(datastoreKindPersonalAccessToken).Filter("TokenHash =", tokenHash).Limit(1), &tokens); err != nil {
+    return PersonalAccessToken{}, err
+  } else if len(tokens) == 0 {
+    return PersonalAccessToken{}, ErrPersonalAccessTokenNotFound
+  }
+  return tokens[0], nil
+}
+
+func (storage *AppEngineStorage) GetPersonalAccessTokens(userID int64) ([]PersonalAccessToken, error) {
+  tokens := []PersonalAccessToken {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindPersonalAccessToken).Filter("UserID =", userID), &tokens)
+  return tokens, err
+}
+
+func (storage *AppEngineStorage) PutPersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error) {
+  if err := storage.putEntity(datastoreKindPersonalAccessToken, &token.ID, &token); err != nil {
+    return token, err
+  }
+  return token, nil
+}
+
+func (storage *AppEngineStorage) GetAuditChain(organizationID int64) (AuditChain, error) {
+  var chain AuditChain
+  if err := storage.getEntity(storage.entityKey(datastoreKindAuditChain, organizationID), &chain, ErrAuditChainNotFound); err != nil {
+    return AuditChain{}, err
+  }
+  return chain, nil
+}
+
+func (storage *AppEngineStorage) PutAuditChain(organizationID int64, chain AuditChain) error {
+  _, err := datastore.Put(storage.ctx, storage.entityKey(datastoreKindAuditChain, organizationID), &chain)
+  return err
+}
+
+func (storage *AppEngineStorage) GetAuditEvents(organizationID int64, beforeSequence int64, limit int) ([]AuditEvent, error) {
+  query := datastore.NewQuery(datastoreKindAuditEvent).
+    Ancestor(storage.entityKey(datastoreKindAuditChain, organizationID)).
+    Order("-Sequence").
+    Limit(limit)
+  if beforeSequence > 0 {
+    query = query.Filter("Sequence <", beforeSequence)
+  }
+  events := []AuditEvent {}
+  err := storage.findEntities(query, &events)
+  return events, err
+}
+
+func (storage *AppEngineStorage) GetAuditEventsAfter(organizationID int64, afterSequence int64, limit int) ([]AuditEvent, error) {
+  events := []AuditEvent {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindAuditEvent).
+    Ancestor(storage.entityKey(datastoreKindAuditChain, organizationID)).
+    Filter("Sequence >", afterSequence).
+    Order("Sequence").
+    Limit(limit), &events)
+  return events, err
+}
+
+// Events are children of their organization's chain keyed by sequence, so appending is a single entity group
+// transaction.
+func (storage *AppEngineStorage) PutAuditEvents(events []AuditEvent) error {
+  if len(events) == 0 {
+    return nil
+  }
+  keys := make([]*datastore.Key, len(events))
+  for i, event := range events {
+    keys[i] = datastore.NewKey(storage.ctx, datastoreKindAuditEvent, "", event.Sequence, storage.entityKey(datastoreKindAuditChain, event.OrganizationID))
+  }
+  _, err := datastore.PutMulti(storage.ctx, keys, events)
+  return err
+}
+
+func (storage *AppEngineStorage) GetWebhook(id int64) (Webhook, error) {
+  var webhook Webhook
+  if err := storage.getEntity(storage.entityKey(datastoreKindWebhook, id), &webhook, ErrWebhookNotFound); err != nil {
+    return Webhook{}, err
+  }
+  webhook.ID = id
+  return webhook, nil
+}
+
+func (storage *AppEngineStorage) GetWebhooks(organizationID int64) ([]Webhook, error) {
+  webhooks := []Webhook {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindWebhook).Filter("OrganizationID =", organizationID), &webhooks)
+  return webhooks, err
+}
+
+func (storage *AppEngineStorage) GetEventWebhookIDs(organizationID int64, event string) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindWebhook).
+    Filter("OrganizationID =", organizationID).
+    Filter("Events =", event))
+}
+
+func (storage *AppEngineStorage) PutWebhook(webhook Webhook) (Webhook, error) {
+  if err := storage.putEntity(datastoreKindWebhook, &webhook.ID, &webhook); err != nil {
+    return webhook, err
+  }
+  return webhook, nil
+}
+
+func (storage *AppEngineStorage) DeleteWebhook(id int64) error {
+  return storage.deleteEntity(storage.entityKey(datastoreKindWebhook, id), ErrWebhookNotFound)
+}
+
+func (storage *AppEngineStorage) GetWebhookDelivery(id int64) (WebhookDelivery, error) {
+  var delivery WebhookDelivery
+  if err := storage.getEntity(storage.entityKey(datastoreKindWebhookDelivery, id), &delivery, ErrWebhookDeliveryNotFound); err != nil {
+    return WebhookDelivery{}, err
+  }
+  delivery.ID = id
+  return delivery, nil
+}
+
+func (storage *AppEngineStorage) GetWebhookDeliveries(webhookID int64) ([]WebhookDelivery, error) {
+  deliveries := []WebhookDelivery {}
+  err := storage.findEntities(datastore.NewQuery(datastoreKindWebhookDelivery).
+    Filter("WebhookID =", webhookID).
+    Order("-CreatedTime"), &deliveries)
+  return deliveries, err
+}
+
+func (storage *AppEngineStorage) GetDueWebhookDeliveryIDs(now int64) ([]int64, error) {
+  return storage.findIDs(datastore.NewQuery(datastoreKindWebhookDelivery).
+    Filter("State =", WebhookDeliveryStatePending).
+    Filter("NextAttemptTime <=", now))
+}
+
+func (storage *AppEngineStorage) PutWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+  if err := storage.putEntity(datastoreKindWebhookDelivery, &delivery.ID, &delivery); err != nil {
+    return delivery, err
+  }
+  return delivery, nil
+}
+
+// AppEngineCache is a Cache in memcache, with values encoded as gobs.
+type AppEngineCache struct {
+  ctx appengine.Context
+}
+
+func NewAppEngineCache(ctx appengine.Context) *AppEngineCache {
+  return &AppEngineCache{ ctx: ctx }
+}
+
+func appEngineCacheError(err error) error {
+  switch err {
+    case memcache.ErrCacheMiss:
+      return ErrCacheMiss
+    case memcache.ErrNotStored:
+      return ErrNotStored
+  }
+  return err
+}
+
+func (cache *AppEngineCache) Get(key string, value interface{}) error {
+  _, err := memcache.Gob.Get(cache.ctx, key, value)
+  return appEngineCacheError(err)
+}
+
+func (cache *AppEngineCache) Set(key string, value interface{}, expiration time.Duration) error {
+  return appEngineCacheError(memcache.Gob.Set(cache.ctx, &memcache.Item{ Key: key, Object: value, Expiration: expiration }))
+}
+
+func (cache *AppEngineCache) Add(key string, value interface{}, expiration time.Duration) error {
+  return appEngineCacheError(memcache.Gob.Add(cache.ctx, &memcache.Item{ Key: key, Object: value, Expiration: expiration }))
+}
+
+func (cache *AppEngineCache) Delete(keys ...string) error {
+  for _, key := range keys {
+    if err := memcache.Delete(cache.ctx, key); err != nil && err != memcache.ErrCacheMiss {
+      return err
+    }
+  }
+  return nil
+}
+
+func (cache *AppEngineCache) Increment(key string, delta int64, initial uint64) (uint64, error) {
+  return memcache.Increment(cache.ctx, key, delta, initial)
+}
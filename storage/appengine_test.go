@@ -0,0 +1,27 @@
+// +build appengine
+
+package storage
+
+import (
+  "appengine/aetest"
+  "testing"
+)
+
+func TestAppEngineStorageConforms(t *testing.T) {
+  var contexts []aetest.Context
+  defer func() {
+    for _, ctx := range contexts {
+      ctx.Close()
+    }
+  }()
+
+  // Queries in the checks read straight after writes, which needs a strongly consistent datastore
+  expectConformance(t, func() (Storage, error) {
+    ctx, err := aetest.NewContext(&aetest.Options{ StronglyConsistentDatastore: true })
+    if err != nil {
+      return nil, err
+    }
+    contexts = append(contexts, ctx)
+    return NewAppEngineStorage(ctx), nil
+  })
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+  "bytes"
+  "encoding/gob"
+  "errors"
+  "strconv"
+  "sync"
+  "time"
+)
+
+var ErrCacheMiss = errors.New("Cache miss")
+var ErrNotStored = errors.New("Cache item not stored")
+
+// Cache holds values that can be looked up again from storage, and counters requests use to signal each other.
+// Anything cached may be gone at any time, so nothing may rely on it being there.
+type Cache interface {
+  // Decodes what is cached under key into what value points to
+  Get(key string, value interface{}) error
+  // Caches value under key, until expiration has passed if it isn't 0
+  Set(key string, value interface{}, expiration time.Duration) error
+  // Like Set, but returns ErrNotStored rather than replace what is already cached
+  Add(key string, value interface{}, expiration time.Duration) error
+  // Keys that aren't cached are skipped
+  Delete(keys ...string) error
+  // Adds delta to the counter under key, starting it at initial if it isn't cached, and returns the new count
+  Increment(key string, delta int64, initial uint64) (uint64, error)
+}
+
+type memoryCacheItem struct {
+  value []byte
+  expires time.Time
+}
+
+// MemoryCache is a Cache for a single process. Expired items are dropped when they are next looked at.
+type MemoryCache struct {
+  lock sync.Mutex
+  items map[string]memoryCacheItem
+}
+
+func NewMemoryCache() *MemoryCache {
+  return &MemoryCache{ items: make(map[string]memoryCacheItem) }
+}
+
+// Returns what is cached under key, if it hasn't expired. Call with the lock held.
+func (cache *MemoryCache) item(key string) (memoryCacheItem, bool) {
+  item, ok := cache.items[key]
+  if ok && !item.expires.IsZero() && !time.Now().Before(item.expires) {
+    delete(cache.items, key)
+    return item, false
+  }
+  return item, ok
+}
+
+func (cache *MemoryCache) Get(key string, value interface{}) error {
+  cache.lock.Lock()
+  item, ok := cache.item(key)
+  cache.lock.Unlock()
+
+  if !ok {
+    return ErrCacheMiss
+  }
+  return gob.NewDecoder(bytes.NewReader(item.value)).Decode(value)
+}
+
+func (cache *MemoryCache) Set(key string, value interface{}, expiration time.Duration) error {
+  return cache.store(key, value, expiration, true)
+}
+
+func (cache *MemoryCache) Add(key string, value interface{}, expiration time.Duration) error {
+  return cache.store(key, value, expiration, false)
+}
+
+func (cache *MemoryCache) store(key string, value interface{}, expiration time.Duration, replace bool) error {
+  var encoded bytes.Buffer
+  if err := gob.NewEncoder(&encoded).Encode(value); err != nil {
+    return err
+  }
+  item := memoryCacheItem{ value: encoded.Bytes() }
+  if expiration > 0 {
+    item.expires = time.Now().Add(expiration)
+  }
+
+  cache.lock.Lock()
+  defer cache.lock.Unlock()
+  if _, ok := cache.item(key); ok && !replace {
+    return ErrNotStored
+  }
+  cache.items[key] = item
+  return nil
+}
+
+func (cache *MemoryCache) Delete(keys ...string) error {
+  cache.lock.Lock()
+  defer cache.lock.Unlock()
+  for _, key := range keys {
+    delete(cache.items, key)
+  }
+  return nil
+}
+
+// Counters are kept as decimal text, as memcache keeps them.
+func (cache *MemoryCache) Increment(key string, delta int64, initial uint64) (uint64, error) {
+  cache.lock.Lock()
+  defer cache.lock.Unlock()
+
+  count := initial
+  item, ok := cache.item(key)
+  if ok {
+    var err error
+    if count, err = strconv.ParseUint(string(item.value), 10, 64); err != nil {
+      return 0, errors.New("Cached value under " + key + " is not a counter")
+    }
+  }
+  if delta < 0 && uint64(-delta) > count {
+    count = 0
+  } else {
+    count += uint64(delta)
+  }
+  item.value = []byte(strconv.FormatUint(count, 10))
+  cache.items[key] = item
+  return count, nil
+}
@@ -0,0 +1,973 @@
+package storage
+
+import (
+  "fmt"
+  "reflect"
+)
+
+// A single conformance check, run against its own empty store.
+type conformanceCheck struct {
+  name string
+  run func(storage Storage) error
+}
+
+var conformanceChecks = []conformanceCheck {
+  { "users are stored and found by ID and email", checkUsers },
+  { "missing users are not found", checkMissingUsers },
+  { "users are found by their legacy server API key", checkUserServerAPIKeys },
+  { "servers are stored, listed by organization and found by server ID", checkServers },
+  { "deleted servers are gone", checkDeleteServer },
+  { "stored servers can't be changed through returned slices", checkServerCopies },
+  { "commands are stored and listed by organization and publicity", checkCommands },
+  { "public commands are listed a page at a time", checkPublicCommandPages },
+  { "deleted commands are gone", checkDeleteCommand },
+  { "racing calls for a new user's email get one user", checkGetOrCreateUser },
+  { "users' legacy entities move into their organization", checkMigrateUserEntities },
+  { "organizations are found by server API key and personal user", checkOrganizations },
+  { "memberships are keyed by organization and user", checkMemberships },
+  { "pending invitations are found by email", checkInvitations },
+  { "command versions are kept per command", checkCommandVersions },
+  { "invocations are listed newest first and found by state", checkInvocations },
+  { "output chunks are paged by offset", checkOutput },
+  { "schedules are found when due and by command", checkSchedules },
+  { "tokens are found by hash", checkTokens },
+  { "audit events are paged both ways by sequence", checkAuditEvents },
+  { "webhooks and deliveries are found by event and when due", checkWebhooks },
+  { "transactions make all their changes or none", checkTransactions },
+}
+
+// CheckConformance runs the checks every backend has to pass. newStorage is called for each check and must return an
+// empty store. Returns one error for each check that failed, or none when the backend conforms.
+func CheckConformance(newStorage func() (Storage, error)) []error {
+  var failures []error
+  for _, check := range conformanceChecks {
+    storage, err := newStorage()
+    if err != nil {
+      failures = append(failures, fmt.Errorf("%s: could not create storage: %v", check.name, err))
+    } else if err := check.run(storage); err != nil {
+      failures = append(failures, fmt.Errorf("%s: %v", check.name, err))
+    }
+  }
+  return failures
+}
+
+func expectEqual(what string, got interface{}, expected interface{}) error {
+  if !reflect.DeepEqual(got, expected) {
+    return fmt.Errorf("%s was %+v, expected %+v", what, got, expected)
+  }
+  return nil
+}
+
+func checkUsers(storage Storage) error {
+  first, err := storage.PutUser(User{ Email: "first@example.com", OrganizationID: 10 })
+  if err != nil {
+    return err
+  }
+  second, err := storage.PutUser(User{ Email: "second@example.com", OrganizationID: 20 })
+  if err != nil {
+    return err
+  }
+  if first.ID == 0 || second.ID == 0 || first.ID == second.ID {
+    return fmt.Errorf("new users were given IDs %d and %d", first.ID, second.ID)
+  }
+
+  if found, err := storage.GetUser(first.ID); err != nil {
+    return err
+  } else if err := expectEqual("user found by ID", found, first); err != nil {
+    return err
+  }
+  if found, err := storage.GetUserByEmail("second@example.com"); err != nil {
+    return err
+  } else if err := expectEqual("user found by email", found, second); err != nil {
+    return err
+  }
+
+  first.OrganizationID = 30
+  if updated, err := storage.PutUser(first); err != nil {
+    return err
+  } else if updated.ID != first.ID {
+    return fmt.Errorf("updating user %d moved it to %d", first.ID, updated.ID)
+  }
+  found, err := storage.GetUser(first.ID)
+  if err != nil {
+    return err
+  }
+  return expectEqual("updated user", found, first)
+}
+
+func checkMissingUsers(storage Storage) error {
+  if _, err := storage.GetUser(12345); err != ErrUserNotFound {
+    return fmt.Errorf("getting a missing user returned %v", err)
+  }
+  if _, err := storage.GetUserByEmail("missing@example.com"); err != ErrUserNotFound {
+    return fmt.Errorf("finding a missing email returned %v", err)
+  }
+  return nil
+}
+
+func checkUserServerAPIKeys(storage Storage) error {
+  legacy, err := storage.PutUser(User{ Email: "legacy@example.com", ServerAPIKey: "legacy-key" })
+  if err != nil {
+    return err
+  }
+  if _, err := storage.PutUser(User{ Email: "migrated@example.com", OrganizationID: 10 }); err != nil {
+    return err
+  }
+
+  if found, err := storage.GetUserByServerAPIKey("legacy-key"); err != nil {
+    return err
+  } else if err := expectEqual("user found by server API key", found, legacy); err != nil {
+    return err
+  }
+  if _, err := storage.GetUserByServerAPIKey("other-key"); err != ErrUserNotFound {
+    return fmt.Errorf("finding an unknown server API key returned %v", err)
+  }
+  return nil
+}
+
+func checkServers(storage Storage) error {
+  web := Server{
+    OrganizationID: 10,
+    ServerID: "web-1",
+    Name: "Web",
+    Labels: []ServerLabel { { Key: "role", Value: "web" } },
+    AgentLabels: []ServerLabel { { Key: "os", Value: "linux" } },
+    AvailableCommands: []int64 { 7, 9 },
+    CredentialHash: "hash",
+  }
+  database := Server{ OrganizationID: 10, ServerID: "db-1", Name: "Database" }
+  elsewhere := Server{ OrganizationID: 20, ServerID: "web-1", Name: "Someone else's web" }
+
+  var err error
+  for _, server := range []*Server { &web, &database, &elsewhere } {
+    if *server, err = storage.PutServer(*server); err != nil {
+      return err
+    } else if server.ID == 0 {
+      return fmt.Errorf("server %s was not given an ID", server.ServerID)
+    }
+  }
+
+  if found, err := storage.GetServer(web.ID); err != nil {
+    return err
+  } else if err := expectEqual("server found by ID", found, web); err != nil {
+    return err
+  }
+  if found, err := storage.GetServerByServerID(20, "web-1"); err != nil {
+    return err
+  } else if err := expectEqual("server found by server ID", found, elsewhere); err != nil {
+    return err
+  }
+  if _, err := storage.GetServerByServerID(30, "web-1"); err != ErrServerNotFound {
+    return fmt.Errorf("finding a server in the wrong organization returned %v", err)
+  }
+
+  servers, err := storage.GetServers(10)
+  if err != nil {
+    return err
+  }
+  expected := []Server { web, database }
+  if database.ID < web.ID {
+    expected = []Server { database, web }
+  }
+  if err := expectEqual("organization's servers", servers, expected); err != nil {
+    return err
+  }
+  if servers, err := storage.GetServers(40); err != nil {
+    return err
+  } else if len(servers) != 0 {
+    return fmt.Errorf("an organization with no servers listed %d", len(servers))
+  }
+  if servers, err := storage.GetAllServers(); err != nil {
+    return err
+  } else if len(servers) != 3 {
+    return fmt.Errorf("listing every server found %d, expected 3", len(servers))
+  }
+  return nil
+}
+
+func checkDeleteServer(storage Storage) error {
+  server, err := storage.PutServer(Server{ OrganizationID: 10, ServerID: "web-1" })
+  if err != nil {
+    return err
+  }
+  if err := storage.DeleteServer(server.ID); err != nil {
+    return err
+  }
+  if _, err := storage.GetServer(server.ID); err != ErrServerNotFound {
+    return fmt.Errorf("getting a deleted server returned %v", err)
+  }
+  if _, err := storage.GetServerByServerID(10, "web-1"); err != ErrServerNotFound {
+    return fmt.Errorf("finding a deleted server returned %v", err)
+  }
+  if err := storage.DeleteServer(server.ID); err != ErrServerNotFound {
+    return fmt.Errorf("deleting a deleted server returned %v", err)
+  }
+  return nil
+}
+
+func checkServerCopies(storage Storage) error {
+  server, err := storage.PutServer(Server{
+    OrganizationID: 10,
+    ServerID: "web-1",
+    Labels: []ServerLabel { { Key: "role", Value: "web" } },
+    AvailableCommands: []int64 { 7 },
+  })
+  if err != nil {
+    return err
+  }
+
+  found, err := storage.GetServer(server.ID)
+  if err != nil {
+    return err
+  }
+  found.Labels[0].Value = "changed"
+  found.AvailableCommands[0] = 8
+
+  found, err = storage.GetServer(server.ID)
+  if err != nil {
+    return err
+  }
+  return expectEqual("server after changing a returned copy", found, server)
+}
+
+func checkCommands(storage Storage) error {
+  private := Command{
+    OrganizationID: 10,
+    Name: "Restart",
+    Command: "service web restart",
+    Params: []CommandParam { { Name: "service", Type: "string", PossibleValues: []string { "web", "db" } } },
+    RequiresApproval: true,
+    ApprovalExpirySec: 3600,
+  }
+  public := Command{ OrganizationID: 20, PublicCommand: true, Name: "Uptime", Command: "uptime" }
+
+  var err error
+  for _, command := range []*Command { &private, &public } {
+    if *command, err = storage.PutCommand(*command); err != nil {
+      return err
+    } else if command.ID == 0 {
+      return fmt.Errorf("command %s was not given an ID", command.Name)
+    }
+  }
+
+  if found, err := storage.GetCommand(private.ID); err != nil {
+    return err
+  } else if err := expectEqual("command found by ID", found, private); err != nil {
+    return err
+  }
+  if commands, err := storage.GetCommands(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's commands", commands, []Command { private }); err != nil {
+    return err
+  }
+  if commands, err := storage.GetPublicCommands(0, 10); err != nil {
+    return err
+  } else if err := expectEqual("public commands", commands, []Command { public }); err != nil {
+    return err
+  }
+
+  private.Name = "Restart web"
+  if _, err := storage.PutCommand(private); err != nil {
+    return err
+  }
+  found, err := storage.GetCommand(private.ID)
+  if err != nil {
+    return err
+  }
+  return expectEqual("updated command", found, private)
+}
+
+func checkPublicCommandPages(storage Storage) error {
+  var commands []Command
+  for _, name := range []string { "Uptime", "Disk free", "Load", "Disk usage" } {
+    command, err := storage.PutCommand(Command{ OrganizationID: 20, PublicCommand: true, Name: name })
+    if err != nil {
+      return err
+    }
+    commands = append(commands, command)
+  }
+
+  if page, err := storage.GetPublicCommands(commands[0].ID, 2); err != nil {
+    return err
+  } else if err := expectEqual("page of public commands", page, commands[1:3]); err != nil {
+    return err
+  }
+
+  page, afterID, err := SearchPublicCommands(storage, "disk", 0, 1)
+  if err != nil {
+    return err
+  } else if err := expectEqual("first page of matching commands", page, commands[1:2]); err != nil {
+    return err
+  }
+  page, afterID, err = SearchPublicCommands(storage, "disk", afterID, 1)
+  if err != nil {
+    return err
+  } else if err := expectEqual("second page of matching commands", page, commands[3:4]); err != nil {
+    return err
+  }
+  page, afterID, err = SearchPublicCommands(storage, "disk", afterID, 1)
+  if err != nil {
+    return err
+  } else if err := expectEqual("page after the last matching command", page, []Command {}); err != nil {
+    return err
+  }
+  if err := expectEqual("cursor after the last page", afterID, int64(0)); err != nil {
+    return err
+  }
+
+  // A search that matches nothing for a while stops and hands back where it got to
+  var skipped []Command
+  for i := 0; i < PublicCommandsScanFactor; i++ {
+    command, err := storage.PutCommand(Command{ OrganizationID: 20, PublicCommand: true, Name: "Uptime" })
+    if err != nil {
+      return err
+    }
+    skipped = append(skipped, command)
+  }
+  memory, err := storage.PutCommand(Command{ OrganizationID: 20, PublicCommand: true, Name: "Memory" })
+  if err != nil {
+    return err
+  }
+  page, afterID, err = SearchPublicCommands(storage, "memory", commands[3].ID, 1)
+  if err != nil {
+    return err
+  } else if err := expectEqual("page that scanned as far as it may", page, []Command {}); err != nil {
+    return err
+  } else if err := expectEqual("cursor after the scanned commands", afterID, skipped[len(skipped) - 1].ID); err != nil {
+    return err
+  }
+  page, _, err = SearchPublicCommands(storage, "memory", afterID, 1)
+  if err != nil {
+    return err
+  }
+  return expectEqual("page after the scanned commands", page, []Command { memory })
+}
+
+func checkDeleteCommand(storage Storage) error {
+  command, err := storage.PutCommand(Command{ OrganizationID: 10, Name: "Uptime", Command: "uptime" })
+  if err != nil {
+    return err
+  }
+  if err := storage.DeleteCommand(command.ID); err != nil {
+    return err
+  }
+  if _, err := storage.GetCommand(command.ID); err != ErrCommandNotFound {
+    return fmt.Errorf("getting a deleted command returned %v", err)
+  }
+  if commands, err := storage.GetCommands(10); err != nil {
+    return err
+  } else if len(commands) != 0 {
+    return fmt.Errorf("deleted command is still listed")
+  }
+  if err := storage.DeleteCommand(command.ID); err != ErrCommandNotFound {
+    return fmt.Errorf("deleting a deleted command returned %v", err)
+  }
+  return nil
+}
+
+func checkGetOrCreateUser(storage Storage) error {
+  const racers = 5
+  users := make(chan User, racers)
+  errs := make(chan error, racers)
+  for i := 0; i < racers; i++ {
+    go func () {
+      user, err := storage.GetOrCreateUser("new@example.com")
+      users <- user
+      errs <- err
+    }()
+  }
+
+  var first User
+  for i := 0; i < racers; i++ {
+    user := <-users
+    if err := <-errs; err != nil {
+      return err
+    } else if i == 0 {
+      first = user
+    } else if err := expectEqual("user got by a racing call", user, first); err != nil {
+      return err
+    }
+  }
+  if first.ID == 0 || first.Email != "new@example.com" {
+    return fmt.Errorf("created user was %+v", first)
+  }
+
+  if found, err := storage.GetUserByEmail("new@example.com"); err != nil {
+    return err
+  } else if err := expectEqual("created user found by email", found, first); err != nil {
+    return err
+  }
+  existing, err := storage.PutUser(User{ Email: "existing@example.com", OrganizationID: 10 })
+  if err != nil {
+    return err
+  }
+  found, err := storage.GetOrCreateUser("existing@example.com")
+  if err != nil {
+    return err
+  }
+  return expectEqual("existing user", found, existing)
+}
+
+func checkMigrateUserEntities(storage Storage) error {
+  legacy, err := storage.PutServer(Server{ UserID: 1, ServerID: "legacy" })
+  if err != nil {
+    return err
+  }
+  moved, err := storage.PutServer(Server{ UserID: 1, OrganizationID: 20, ServerID: "moved" })
+  if err != nil {
+    return err
+  }
+  command, err := storage.PutCommand(Command{ UserID: 1, Name: "Uptime" })
+  if err != nil {
+    return err
+  }
+  other, err := storage.PutCommand(Command{ UserID: 2, Name: "Uptime" })
+  if err != nil {
+    return err
+  }
+
+  if err := storage.MigrateUserEntities(1, 10); err != nil {
+    return err
+  }
+  legacy.OrganizationID = 10
+  command.OrganizationID = 10
+  for _, expected := range []Server { legacy, moved } {
+    if found, err := storage.GetServer(expected.ID); err != nil {
+      return err
+    } else if err := expectEqual("server after migrating", found, expected); err != nil {
+      return err
+    }
+  }
+  for _, expected := range []Command { command, other } {
+    if found, err := storage.GetCommand(expected.ID); err != nil {
+      return err
+    } else if err := expectEqual("command after migrating", found, expected); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func checkOrganizations(storage Storage) error {
+  hashed, err := storage.PutOrganization(Organization{ Name: "Hashed", ServerAPIKeyHash: "current", PreviousServerAPIKeyHash: "previous" })
+  if err != nil {
+    return err
+  }
+  legacy, err := storage.PutOrganization(Organization{ Name: "Legacy", ServerAPIKey: "plain", PreviousServerAPIKey: "old-plain" })
+  if err != nil {
+    return err
+  }
+  personal, err := storage.PutOrganization(Organization{ Name: "someone@example.com", PersonalUserID: 7 })
+  if err != nil {
+    return err
+  }
+
+  for _, lookup := range []struct {
+    what string
+    find func() (Organization, error)
+    expected Organization
+  }{
+    { "organization found by ID", func () (Organization, error) { return storage.GetOrganization(hashed.ID) }, hashed },
+    { "organization found by key hash", func () (Organization, error) { return storage.GetOrganizationByServerAPIKeyHash("current") }, hashed },
+    { "organization found by previous key hash", func () (Organization, error) { return storage.GetOrganizationByServerAPIKeyHash("previous") }, hashed },
+    { "organization found by legacy key", func () (Organization, error) { return storage.GetOrganizationByLegacyServerAPIKey("plain") }, legacy },
+    { "organization found by previous legacy key", func () (Organization, error) { return storage.GetOrganizationByLegacyServerAPIKey("old-plain") }, legacy },
+    { "personal organization", func () (Organization, error) { return storage.GetPersonalOrganization(7) }, personal },
+  } {
+    if found, err := lookup.find(); err != nil {
+      return fmt.Errorf("%s: %v", lookup.what, err)
+    } else if err := expectEqual(lookup.what, found, lookup.expected); err != nil {
+      return err
+    }
+  }
+
+  if _, err := storage.GetOrganization(12345); err != ErrOrganizationNotFound {
+    return fmt.Errorf("getting a missing organization returned %v", err)
+  }
+  if _, err := storage.GetOrganizationByServerAPIKeyHash("unknown"); err != ErrOrganizationNotFound {
+    return fmt.Errorf("finding an unknown key hash returned %v", err)
+  }
+  if _, err := storage.GetOrganizationByLegacyServerAPIKey(""); err != ErrOrganizationNotFound {
+    return fmt.Errorf("finding an empty legacy key returned %v", err)
+  }
+  if _, err := storage.GetPersonalOrganization(8); err != ErrOrganizationNotFound {
+    return fmt.Errorf("finding a missing personal organization returned %v", err)
+  }
+  return nil
+}
+
+func checkMemberships(storage Storage) error {
+  memberships := []Membership {
+    { OrganizationID: 10, UserID: 2, Email: "two@example.com", Role: "admin" },
+    { OrganizationID: 10, UserID: 1, Email: "one@example.com", Role: "viewer" },
+    { OrganizationID: 20, UserID: 1, Email: "one@example.com", Role: "admin" },
+  }
+  for _, membership := range memberships {
+    if _, err := storage.PutMembership(membership); err != nil {
+      return err
+    }
+  }
+
+  if found, err := storage.GetMembership(10, 1); err != nil {
+    return err
+  } else if err := expectEqual("membership", found, memberships[1]); err != nil {
+    return err
+  }
+  if found, err := storage.GetMemberships(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's memberships", found, []Membership { memberships[1], memberships[0] }); err != nil {
+    return err
+  }
+  if found, err := storage.GetUserMemberships(1); err != nil {
+    return err
+  } else if err := expectEqual("user's memberships", found, []Membership { memberships[1], memberships[2] }); err != nil {
+    return err
+  }
+
+  // Putting a membership for the same organization and user replaces it
+  memberships[1].Role = "operator"
+  if _, err := storage.PutMembership(memberships[1]); err != nil {
+    return err
+  }
+  if found, err := storage.GetMemberships(10); err != nil {
+    return err
+  } else if err := expectEqual("memberships after a change", found, []Membership { memberships[1], memberships[0] }); err != nil {
+    return err
+  }
+
+  if err := storage.DeleteMembership(10, 1); err != nil {
+    return err
+  }
+  if _, err := storage.GetMembership(10, 1); err != ErrMembershipNotFound {
+    return fmt.Errorf("getting a deleted membership returned %v", err)
+  }
+  if err := storage.DeleteMembership(10, 1); err != ErrMembershipNotFound {
+    return fmt.Errorf("deleting a deleted membership returned %v", err)
+  }
+  return nil
+}
+
+func checkInvitations(storage Storage) error {
+  pending, err := storage.PutInvitation(Invitation{ OrganizationID: 10, Email: "new@example.com", Role: "viewer", State: InvitationStatePending })
+  if err != nil {
+    return err
+  }
+  if _, err := storage.PutInvitation(Invitation{ OrganizationID: 20, Email: "new@example.com", State: InvitationStateDeclined }); err != nil {
+    return err
+  }
+  if _, err := storage.PutInvitation(Invitation{ OrganizationID: 20, Email: "other@example.com", State: InvitationStatePending }); err != nil {
+    return err
+  }
+
+  if found, err := storage.GetInvitation(pending.ID); err != nil {
+    return err
+  } else if err := expectEqual("invitation found by ID", found, pending); err != nil {
+    return err
+  }
+  if found, err := storage.GetPendingInvitations("new@example.com"); err != nil {
+    return err
+  } else if err := expectEqual("pending invitations", found, []Invitation { pending }); err != nil {
+    return err
+  }
+  if _, err := storage.GetInvitation(12345); err != ErrInvitationNotFound {
+    return fmt.Errorf("getting a missing invitation returned %v", err)
+  }
+  return nil
+}
+
+func checkCommandVersions(storage Storage) error {
+  command, err := storage.PutCommand(Command{ OrganizationID: 10, Name: "Uptime", Version: 2 })
+  if err != nil {
+    return err
+  }
+  second := CommandVersion{ CommandID: command.ID, Version: 2, OrganizationID: 10, Name: "Uptime", Params: []CommandParam { { Name: "host" } } }
+  first := CommandVersion{ CommandID: command.ID, Version: 1, OrganizationID: 10, Name: "Uptyme" }
+  for _, version := range []CommandVersion { second, first } {
+    if _, err := storage.PutCommandVersion(version); err != nil {
+      return err
+    }
+  }
+
+  if found, err := storage.GetCommandVersion(command.ID, 2); err != nil {
+    return err
+  } else if err := expectEqual("command version", found, second); err != nil {
+    return err
+  }
+  if found, err := storage.GetCommandVersions(command.ID); err != nil {
+    return err
+  } else if err := expectEqual("command's versions", found, []CommandVersion { first, second }); err != nil {
+    return err
+  }
+  if _, err := storage.GetCommandVersion(command.ID, 3); err != ErrCommandVersionNotFound {
+    return fmt.Errorf("getting a missing version returned %v", err)
+  }
+
+  // Versions outlive their command
+  if err := storage.DeleteCommand(command.ID); err != nil {
+    return err
+  }
+  if found, err := storage.GetCommandVersions(command.ID); err != nil {
+    return err
+  } else if len(found) != 2 {
+    return fmt.Errorf("deleted command has %d versions, expected 2", len(found))
+  }
+  return nil
+}
+
+func checkInvocations(storage Storage) error {
+  invocations := []Invocation {
+    { OrganizationID: 10, ServerID: 1, State: InvocationStateQueued, CreatedTime: 300, Params: []InvocationParam { { Name: "host", Value: "web-1" } } },
+    { OrganizationID: 10, ServerID: 1, State: InvocationStateQueued, CreatedTime: 100 },
+    { OrganizationID: 10, ServerID: 2, State: InvocationStateQueued, CreatedTime: 200 },
+    { OrganizationID: 10, ServerID: 1, State: InvocationStatePendingApproval, CreatedTime: 400, ApprovalExpiresTime: 1000 },
+    { OrganizationID: 20, ServerID: 3, State: InvocationStatePendingApproval, CreatedTime: 500, ApprovalExpiresTime: 2000 },
+  }
+  for i := range invocations {
+    var err error
+    if invocations[i], err = storage.PutInvocation(invocations[i]); err != nil {
+      return err
+    }
+  }
+
+  if found, err := storage.GetInvocation(invocations[0].ID); err != nil {
+    return err
+  } else if err := expectEqual("invocation found by ID", found, invocations[0]); err != nil {
+    return err
+  }
+  if found, err := storage.GetInvocations(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's invocations", found, []Invocation { invocations[3], invocations[0], invocations[2], invocations[1] }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetQueuedInvocationIDs(1); err != nil {
+    return err
+  } else if err := expectEqual("server's queued invocations", ids, []int64 { invocations[1].ID, invocations[0].ID }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetExpiredApprovalIDs(1500); err != nil {
+    return err
+  } else if err := expectEqual("expired approvals", ids, []int64 { invocations[3].ID }); err != nil {
+    return err
+  }
+  if _, err := storage.GetInvocation(12345); err != ErrInvocationNotFound {
+    return fmt.Errorf("getting a missing invocation returned %v", err)
+  }
+  return nil
+}
+
+func checkOutput(storage Storage) error {
+  if stream, err := storage.GetOutputStream(1); err != nil {
+    return err
+  } else if err := expectEqual("missing output stream", stream, OutputStream{}); err != nil {
+    return err
+  }
+  if err := storage.PutOutputStream(1, OutputStream{ Chunks: 3, Bytes: 9 }); err != nil {
+    return err
+  }
+  if stream, err := storage.GetOutputStream(1); err != nil {
+    return err
+  } else if err := expectEqual("output stream", stream, OutputStream{ Chunks: 3, Bytes: 9 }); err != nil {
+    return err
+  }
+
+  chunks := []OutputChunk {
+    { Sequence: 2, Stream: "stderr", Data: "def", Offset: 3, EndOffset: 6 },
+    { Sequence: 1, Stream: "stdout", Data: "abc", Offset: 0, EndOffset: 3 },
+    { Sequence: 3, Stream: "stdout", Data: "ghi", Offset: 6, EndOffset: 9 },
+  }
+  for _, chunk := range chunks {
+    if err := storage.PutOutputChunk(1, chunk); err != nil {
+      return err
+    }
+  }
+  if err := storage.PutOutputChunk(2, OutputChunk{ Sequence: 1, Data: "other", EndOffset: 5 }); err != nil {
+    return err
+  }
+
+  if found, err := storage.GetOutputChunk(1, 2); err != nil {
+    return err
+  } else if err := expectEqual("output chunk", found, chunks[0]); err != nil {
+    return err
+  }
+  if _, err := storage.GetOutputChunk(1, 4); err != ErrOutputChunkNotFound {
+    return fmt.Errorf("getting a missing chunk returned %v", err)
+  }
+  if found, err := storage.GetOutputChunks(1, 2, 2); err != nil {
+    return err
+  } else if err := expectEqual("chunks after an offset", found, []OutputChunk { chunks[1], chunks[0] }); err != nil {
+    return err
+  }
+  if found, err := storage.GetOutputChunks(1, 9, 2); err != nil {
+    return err
+  } else if len(found) != 0 {
+    return fmt.Errorf("chunks after the end were %+v", found)
+  }
+  return nil
+}
+
+func checkSchedules(storage Storage) error {
+  due, err := storage.PutSchedule(Schedule{ OrganizationID: 10, CommandID: 5, NextRunTime: 100, Params: []InvocationParam { { Name: "a", Value: "b" } } })
+  if err != nil {
+    return err
+  }
+  paused, err := storage.PutSchedule(Schedule{ OrganizationID: 10, CommandID: 5, NextRunTime: 100, Paused: true })
+  if err != nil {
+    return err
+  }
+  later, err := storage.PutSchedule(Schedule{ OrganizationID: 20, CommandID: 6, NextRunTime: 300 })
+  if err != nil {
+    return err
+  }
+
+  if found, err := storage.GetSchedule(due.ID); err != nil {
+    return err
+  } else if err := expectEqual("schedule found by ID", found, due); err != nil {
+    return err
+  }
+  if found, err := storage.GetSchedules(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's schedules", found, []Schedule { due, paused }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetDueScheduleIDs(200); err != nil {
+    return err
+  } else if err := expectEqual("due schedules", ids, []int64 { due.ID }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetCommandScheduleIDs(5); err != nil {
+    return err
+  } else if err := expectEqual("command's schedules", ids, []int64 { due.ID, paused.ID }); err != nil {
+    return err
+  }
+
+  if err := storage.DeleteSchedule(later.ID); err != nil {
+    return err
+  }
+  if _, err := storage.GetSchedule(later.ID); err != ErrScheduleNotFound {
+    return fmt.Errorf("getting a deleted schedule returned %v", err)
+  }
+  if err := storage.DeleteSchedule(later.ID); err != ErrScheduleNotFound {
+    return fmt.Errorf("deleting a deleted schedule returned %v", err)
+  }
+  return nil
+}
+
+func checkTokens(storage Storage) error {
+  enrollment, err := storage.PutEnrollmentToken(EnrollmentToken{ OrganizationID: 10, TokenHash: "enroll", Description: "web" })
+  if err != nil {
+    return err
+  }
+  personal, err := storage.PutPersonalAccessToken(PersonalAccessToken{ UserID: 1, OrganizationID: 10, TokenHash: "personal", Scopes: []string { "servers:read" } })
+  if err != nil {
+    return err
+  }
+
+  if found, err := storage.GetEnrollmentToken(enrollment.ID); err != nil {
+    return err
+  } else if err := expectEqual("enrollment token found by ID", found, enrollment); err != nil {
+    return err
+  }
+  if found, err := storage.GetEnrollmentTokenByHash("enroll"); err != nil {
+    return err
+  } else if err := expectEqual("enrollment token found by hash", found, enrollment); err != nil {
+    return err
+  }
+  if found, err := storage.GetEnrollmentTokens(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's enrollment tokens", found, []EnrollmentToken { enrollment }); err != nil {
+    return err
+  }
+  if _, err := storage.GetEnrollmentTokenByHash("personal"); err != ErrEnrollmentTokenNotFound {
+    return fmt.Errorf("finding an unknown enrollment token returned %v", err)
+  }
+
+  if found, err := storage.GetPersonalAccessToken(personal.ID); err != nil {
+    return err
+  } else if err := expectEqual("personal access token found by ID", found, personal); err != nil {
+    return err
+  }
+  if found, err := storage.GetPersonalAccessTokenByHash("personal"); err != nil {
+    return err
+  } else if err := expectEqual("personal access token found by hash", found, personal); err != nil {
+    return err
+  }
+  if found, err := storage.GetPersonalAccessTokens(1); err != nil {
+    return err
+  } else if err := expectEqual("user's personal access tokens", found, []PersonalAccessToken { personal }); err != nil {
+    return err
+  }
+  if _, err := storage.GetPersonalAccessTokenByHash("enroll"); err != ErrPersonalAccessTokenNotFound {
+    return fmt.Errorf("finding an unknown personal access token returned %v", err)
+  }
+  return nil
+}
+
+func checkAuditEvents(storage Storage) error {
+  if _, err := storage.GetAuditChain(10); err != ErrAuditChainNotFound {
+    return fmt.Errorf("getting a missing audit chain returned %v", err)
+  }
+  if err := storage.PutAuditChain(10, AuditChain{ LastSequence: 4, LastHash: "four" }); err != nil {
+    return err
+  }
+  if chain, err := storage.GetAuditChain(10); err != nil {
+    return err
+  } else if err := expectEqual("audit chain", chain, AuditChain{ LastSequence: 4, LastHash: "four" }); err != nil {
+    return err
+  }
+
+  var events []AuditEvent
+  for sequence := int64(1); sequence <= 4; sequence++ {
+    events = append(events, AuditEvent{ OrganizationID: 10, Sequence: sequence, Action: "server.create" })
+  }
+  if err := storage.PutAuditEvents(events); err != nil {
+    return err
+  }
+  if err := storage.PutAuditEvents([]AuditEvent { { OrganizationID: 20, Sequence: 1, Action: "server.delete" } }); err != nil {
+    return err
+  }
+  for i := range events {
+    events[i].ID = events[i].Sequence
+  }
+
+  if found, err := storage.GetAuditEvents(10, 0, 2); err != nil {
+    return err
+  } else if err := expectEqual("newest audit events", found, []AuditEvent { events[3], events[2] }); err != nil {
+    return err
+  }
+  if found, err := storage.GetAuditEvents(10, 3, 5); err != nil {
+    return err
+  } else if err := expectEqual("audit events before a sequence", found, []AuditEvent { events[1], events[0] }); err != nil {
+    return err
+  }
+  if found, err := storage.GetAuditEventsAfter(10, 1, 2); err != nil {
+    return err
+  } else if err := expectEqual("audit events after a sequence", found, []AuditEvent { events[1], events[2] }); err != nil {
+    return err
+  }
+  return nil
+}
+
+func checkWebhooks(storage Storage) error {
+  completed, err := storage.PutWebhook(Webhook{ OrganizationID: 10, URL: "https://example.com/a", Events: []string { "invocation.completed", "server.offline" } })
+  if err != nil {
+    return err
+  }
+  offline, err := storage.PutWebhook(Webhook{ OrganizationID: 10, URL: "https://example.com/b", Events: []string { "server.offline" } })
+  if err != nil {
+    return err
+  }
+  if _, err := storage.PutWebhook(Webhook{ OrganizationID: 20, URL: "https://example.com/c", Events: []string { "invocation.completed" } }); err != nil {
+    return err
+  }
+
+  if found, err := storage.GetWebhook(completed.ID); err != nil {
+    return err
+  } else if err := expectEqual("webhook found by ID", found, completed); err != nil {
+    return err
+  }
+  if found, err := storage.GetWebhooks(10); err != nil {
+    return err
+  } else if err := expectEqual("organization's webhooks", found, []Webhook { completed, offline }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetEventWebhookIDs(10, "invocation.completed"); err != nil {
+    return err
+  } else if err := expectEqual("webhooks for an event", ids, []int64 { completed.ID }); err != nil {
+    return err
+  }
+
+  deliveries := []WebhookDelivery {
+    { WebhookID: completed.ID, State: WebhookDeliveryStatePending, NextAttemptTime: 100, CreatedTime: 100 },
+    { WebhookID: completed.ID, State: WebhookDeliveryStatePending, NextAttemptTime: 300, CreatedTime: 200 },
+    { WebhookID: completed.ID, State: WebhookDeliveryStateDelivered, NextAttemptTime: 100, CreatedTime: 300 },
+  }
+  for i := range deliveries {
+    if deliveries[i], err = storage.PutWebhookDelivery(deliveries[i]); err != nil {
+      return err
+    }
+  }
+  if found, err := storage.GetWebhookDeliveries(completed.ID); err != nil {
+    return err
+  } else if err := expectEqual("webhook's deliveries", found, []WebhookDelivery { deliveries[2], deliveries[1], deliveries[0] }); err != nil {
+    return err
+  }
+  if ids, err := storage.GetDueWebhookDeliveryIDs(200); err != nil {
+    return err
+  } else if err := expectEqual("due deliveries", ids, []int64 { deliveries[0].ID }); err != nil {
+    return err
+  }
+
+  if err := storage.DeleteWebhook(offline.ID); err != nil {
+    return err
+  }
+  if _, err := storage.GetWebhook(offline.ID); err != ErrWebhookNotFound {
+    return fmt.Errorf("getting a deleted webhook returned %v", err)
+  }
+  if _, err := storage.GetWebhookDelivery(12345); err != ErrWebhookDeliveryNotFound {
+    return fmt.Errorf("getting a missing delivery returned %v", err)
+  }
+  return nil
+}
+
+func checkTransactions(storage Storage) error {
+  server, err := storage.PutServer(Server{ OrganizationID: 10, ServerID: "web-1", PendingCommands: 1 })
+  if err != nil {
+    return err
+  }
+
+  var invocation Invocation
+  err = storage.RunInTransaction(func (tx Storage) error {
+    var err error
+    if invocation, err = tx.PutInvocation(Invocation{ OrganizationID: 10, ServerID: server.ID, State: InvocationStateQueued }); err != nil {
+      return err
+    }
+    server.PendingCommands++
+    server, err = tx.PutServer(server)
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  if found, err := storage.GetInvocation(invocation.ID); err != nil {
+    return fmt.Errorf("invocation put in a committed transaction: %v", err)
+  }  else if err := expectEqual("invocation put in a committed transaction", found, invocation); err != nil {
+    return err
+  }
+  if found, err := storage.GetServer(server.ID); err != nil {
+    return err
+  } else if err := expectEqual("server put in a committed transaction", found, server); err != nil {
+    return err
+  }
+
+  failed := fmt.Errorf("failed")
+  var rolledBack Invocation
+  err = storage.RunInTransaction(func (tx Storage) error {
+    var err error
+    if rolledBack, err = tx.PutInvocation(Invocation{ OrganizationID: 10, ServerID: server.ID }); err != nil {
+      return err
+    }
+    changed := server
+    changed.PendingCommands = 5
+    if _, err := tx.PutServer(changed); err != nil {
+      return err
+    }
+    if err := tx.DeleteCommand(12345); err != ErrCommandNotFound {
+      return fmt.Errorf("deleting a missing command in a transaction returned %v", err)
+    }
+    if err := tx.RunInTransaction(func (Storage) error { return nil }); err != ErrNestedTransaction {
+      return fmt.Errorf("nesting a transaction returned %v", err)
+    }
+    return failed
+  })
+  if err != failed {
+    return fmt.Errorf("failing transaction returned %v", err)
+  }
+  if _, err := storage.GetInvocation(rolledBack.ID); err != ErrInvocationNotFound {
+    return fmt.Errorf("getting an invocation put in a failed transaction returned %v", err)
+  }
+  found, err := storage.GetServer(server.ID)
+  if err != nil {
+    return err
+  }
+  return expectEqual("server changed in a failed transaction", found, server)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+  "encoding/gob"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+)
+
+// FileStorage is a MemoryStorage that writes everything to a single file after every change and reads it back when
+// opened. The file is replaced in one rename so a crash leaves either the old contents or the new. Only one process
+// should have a file open at a time.
+type FileStorage struct {
+  *MemoryStorage
+  path string
+}
+
+// Opens the store kept in the file at path, starting an empty one if the file doesn't exist yet.
+func OpenFileStorage(path string) (*FileStorage, error) {
+  storage := &FileStorage{ MemoryStorage: NewMemoryStorage(), path: path }
+
+  file, err := os.Open(path)
+  if err == nil {
+    defer file.Close()
+    data := newMemoryData()
+    if err := gob.NewDecoder(file).Decode(&data); err != nil {
+      return nil, err
+    }
+    *storage.data = data
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+
+  storage.save = storage.writeFile
+  return storage, nil
+}
+
+func (storage *FileStorage) writeFile(data memoryData) error {
+  file, err := ioutil.TempFile(filepath.Dir(storage.path), filepath.Base(storage.path) + ".tmp")
+  if err != nil {
+    return err
+  }
+  tempPath := file.Name()
+
+  err = gob.NewEncoder(file).Encode(data)
+  if err == nil {
+    err = file.Sync()
+  }
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Rename(tempPath, storage.path)
+  }
+  if err != nil {
+    os.Remove(tempPath)
+  }
+  return err
+}
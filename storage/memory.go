@@ -0,0 +1,884 @@
+package storage
+
+import (
+  "reflect"
+  "sort"
+  "strconv"
+  "sync"
+)
+
+// Everything a memory backed store holds. The file backend writes it out whole after every change. Entities keyed by
+// more than one ID are keyed by their IDs joined with dashes, see compositeKey.
+type memoryData struct {
+  NextID int64
+  Users map[int64]User
+  Organizations map[int64]Organization
+  Memberships map[string]Membership
+  Invitations map[int64]Invitation
+  Servers map[int64]Server
+  ServerEvents map[int64]ServerEvent
+  Commands map[int64]Command
+  CommandVersions map[string]CommandVersion
+  Invocations map[int64]Invocation
+  OutputStreams map[int64]OutputStream
+  OutputChunks map[string]OutputChunk
+  Schedules map[int64]Schedule
+  EnrollmentTokens map[int64]EnrollmentToken
+  PersonalAccessTokens map[int64]PersonalAccessToken
+  AuditChains map[int64]AuditChain
+  AuditEvents map[string]AuditEvent
+  Webhooks map[int64]Webhook
+  WebhookDeliveries map[int64]WebhookDelivery
+}
+
+// MemoryStorage keeps everything in maps and forgets it when the process exits. Entities are copied in and out so
+// callers can't change what is stored by holding on to a slice.
+type MemoryStorage struct {
+  lock *sync.Mutex
+  data *memoryData
+  // Called with the lock held after every change, a failure undoes the change
+  save func(data memoryData) error
+  // Set on the Storage a transaction runs against, which already holds the lock
+  transaction *memoryTransaction
+}
+
+// The changes made so far in a transaction, undone in reverse if it fails.
+type memoryTransaction struct {
+  undo []func()
+}
+
+func NewMemoryStorage() *MemoryStorage {
+  data := newMemoryData()
+  return &MemoryStorage{ lock: &sync.Mutex{}, data: &data }
+}
+
+func newMemoryData() memoryData {
+  return memoryData{
+    Users: make(map[int64]User),
+    Organizations: make(map[int64]Organization),
+    Memberships: make(map[string]Membership),
+    Invitations: make(map[int64]Invitation),
+    Servers: make(map[int64]Server),
+    ServerEvents: make(map[int64]ServerEvent),
+    Commands: make(map[int64]Command),
+    CommandVersions: make(map[string]CommandVersion),
+    Invocations: make(map[int64]Invocation),
+    OutputStreams: make(map[int64]OutputStream),
+    OutputChunks: make(map[string]OutputChunk),
+    Schedules: make(map[int64]Schedule),
+    EnrollmentTokens: make(map[int64]EnrollmentToken),
+    PersonalAccessTokens: make(map[int64]PersonalAccessToken),
+    AuditChains: make(map[int64]AuditChain),
+    AuditEvents: make(map[string]AuditEvent),
+    Webhooks: make(map[int64]Webhook),
+    WebhookDeliveries: make(map[int64]WebhookDelivery),
+  }
+}
+
+func compositeKey(first int64, second int64) string {
+  return strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(second, 10)
+}
+
+// Runs fn holding the lock, unless this is a transaction's Storage which holds it already.
+func (storage *MemoryStorage) locked(fn func() error) error {
+  if storage.transaction == nil {
+    storage.lock.Lock()
+    defer storage.lock.Unlock()
+  }
+  return fn()
+}
+
+// Saves a change that has just been made, undoing it if that fails. Inside a transaction the change is only saved
+// once the transaction commits.
+func (storage *MemoryStorage) saveChange(undo func()) error {
+  if storage.transaction != nil {
+    storage.transaction.undo = append(storage.transaction.undo, undo)
+    return nil
+  } else if storage.save == nil {
+    return nil
+  }
+  if err := storage.save(*storage.data); err != nil {
+    undo()
+    return err
+  }
+  return nil
+}
+
+func (storage *MemoryStorage) RunInTransaction(fn func(tx Storage) error) error {
+  if storage.transaction != nil {
+    return ErrNestedTransaction
+  }
+  storage.lock.Lock()
+  defer storage.lock.Unlock()
+
+  transaction := &memoryTransaction{}
+  err := fn(&MemoryStorage{ lock: storage.lock, data: storage.data, transaction: transaction })
+  if err == nil && len(transaction.undo) > 0 && storage.save != nil {
+    err = storage.save(*storage.data)
+  }
+  if err != nil {
+    for i := len(transaction.undo) - 1; i >= 0; i-- {
+      transaction.undo[i]()
+    }
+  }
+  return err
+}
+
+// Returns the ID to store an entity under, handing out a new one when it has none. Call with the lock held.
+func (storage *MemoryStorage) entityID(id int64) int64 {
+  if id == 0 {
+    storage.data.NextID++
+    return storage.data.NextID
+  } else if id > storage.data.NextID {
+    storage.data.NextID = id
+  }
+  return id
+}
+
+// Copies an entity along with its slices and maps.
+func cloneValue(value reflect.Value) reflect.Value {
+  switch value.Kind() {
+    case reflect.Slice:
+      if value.IsNil() {
+        return value
+      }
+      clone := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+      for i := 0; i < value.Len(); i++ {
+        clone.Index(i).Set(cloneValue(value.Index(i)))
+      }
+      return clone
+    case reflect.Map:
+      if value.IsNil() {
+        return value
+      }
+      clone := reflect.MakeMap(value.Type())
+      for _, key := range value.MapKeys() {
+        clone.SetMapIndex(key, cloneValue(value.MapIndex(key)))
+      }
+      return clone
+    case reflect.Struct:
+      clone := reflect.New(value.Type()).Elem()
+      clone.Set(value)
+      for i := 0; i < value.NumField(); i++ {
+        clone.Field(i).Set(cloneValue(value.Field(i)))
+      }
+      return clone
+  }
+  return value
+}
+
+type mapKeys []reflect.Value
+
+func (keys mapKeys) Len() int { return len(keys) }
+func (keys mapKeys) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys mapKeys) Less(i, j int) bool {
+  if keys[i].Kind() == reflect.String {
+    return keys[i].String() < keys[j].String()
+  }
+  return keys[i].Int() < keys[j].Int()
+}
+
+// Sorts a slice of entities on an int64 field, keeping the order of entities with the same value.
+type entitiesByField struct {
+  entities reflect.Value
+  field string
+  descending bool
+}
+
+func (sorter entitiesByField) Len() int { return sorter.entities.Len() }
+func (sorter entitiesByField) Less(i, j int) bool {
+  first, second := sorter.entities.Index(i).FieldByName(sorter.field).Int(), sorter.entities.Index(j).FieldByName(sorter.field).Int()
+  if sorter.descending {
+    return first > second
+  }
+  return first < second
+}
+func (sorter entitiesByField) Swap(i, j int) {
+  swapped := reflect.New(sorter.entities.Type().Elem()).Elem()
+  swapped.Set(sorter.entities.Index(i))
+  sorter.entities.Index(i).Set(sorter.entities.Index(j))
+  sorter.entities.Index(j).Set(swapped)
+}
+
+// Sorts a slice of entities listed in ID order on a time field, newest first and the latest ID first within a time.
+func sortNewestFirst(entities interface{}, field string) {
+  slice := reflect.ValueOf(entities)
+  for i, j := 0, slice.Len() - 1; i < j; i, j = i + 1, j - 1 {
+    entitiesByField{ entities: slice }.Swap(i, j)
+  }
+  sort.Stable(entitiesByField{ entities: slice, field: field, descending: true })
+}
+
+// Copies what entities, a map, holds under key into what entity points to.
+func (storage *MemoryStorage) getEntity(entities interface{}, key interface{}, entity interface{}, notFound error) error {
+  return storage.locked(func () error {
+    stored := reflect.ValueOf(entities).MapIndex(reflect.ValueOf(key))
+    if !stored.IsValid() {
+      return notFound
+    }
+    reflect.ValueOf(entity).Elem().Set(cloneValue(stored))
+    return nil
+  })
+}
+
+// Stores a copy of entity in entities under key. Call with the lock held.
+func (storage *MemoryStorage) storeEntity(entities interface{}, key interface{}, entity interface{}) error {
+  table, mapKey := reflect.ValueOf(entities), reflect.ValueOf(key)
+  previous := table.MapIndex(mapKey)
+  table.SetMapIndex(mapKey, cloneValue(reflect.ValueOf(entity)))
+  return storage.saveChange(func () {
+    // A zero previous value, when there was nothing stored, removes the entry again
+    table.SetMapIndex(mapKey, previous)
+  })
+}
+
+func (storage *MemoryStorage) putEntity(entities interface{}, key interface{}, entity interface{}) error {
+  return storage.locked(func () error {
+    return storage.storeEntity(entities, key, entity)
+  })
+}
+
+// Stores a copy of what entity points to, first giving it a new ID through id if it has none.
+func (storage *MemoryStorage) putIdentifiedEntity(entities interface{}, id *int64, entity interface{}) error {
+  return storage.locked(func () error {
+    *id = storage.entityID(*id)
+    return storage.storeEntity(entities, *id, reflect.ValueOf(entity).Elem().Interface())
+  })
+}
+
+func (storage *MemoryStorage) deleteEntity(entities interface{}, key interface{}, notFound error) error {
+  return storage.locked(func () error {
+    table, mapKey := reflect.ValueOf(entities), reflect.ValueOf(key)
+    previous := table.MapIndex(mapKey)
+    if !previous.IsValid() {
+      return notFound
+    }
+    table.SetMapIndex(mapKey, reflect.Value{})
+    return storage.saveChange(func () {
+      table.SetMapIndex(mapKey, previous)
+    })
+  })
+}
+
+// Appends copies of the entities matches accepts to the slice found points to, in key order. matches is a func taking
+// the entity and returning whether it matches.
+func (storage *MemoryStorage) findEntities(entities interface{}, matches interface{}, found interface{}) error {
+  return storage.locked(func () error {
+    table, matcher, results := reflect.ValueOf(entities), reflect.ValueOf(matches), reflect.ValueOf(found).Elem()
+    keys := table.MapKeys()
+    sort.Sort(mapKeys(keys))
+    for _, key := range keys {
+      entity := table.MapIndex(key)
+      if matcher.Call([]reflect.Value { entity })[0].Bool() {
+        results.Set(reflect.Append(results, cloneValue(entity)))
+      }
+    }
+    return nil
+  })
+}
+
+// Returns the ID fields of a slice of entities.
+func entityIDs(entities interface{}) []int64 {
+  slice := reflect.ValueOf(entities)
+  ids := []int64 {}
+  for i := 0; i < slice.Len(); i++ {
+    ids = append(ids, slice.Index(i).FieldByName("ID").Int())
+  }
+  return ids
+}
+
+func (storage *MemoryStorage) GetUser(id int64) (User, error) {
+  var user User
+  err := storage.getEntity(storage.data.Users, id, &user, ErrUserNotFound)
+  return user, err
+}
+
+func (storage *MemoryStorage) GetUserByEmail(email string) (User, error) {
+  users := []User {}
+  if err := storage.findEntities(storage.data.Users, func (user User) bool {
+    return user.Email == email
+  }, &users); err != nil || len(users) == 0 {
+    return User{}, ErrUserNotFound
+  }
+  return users[0], nil
+}
+
+func (storage *MemoryStorage) GetUserByServerAPIKey(serverAPIKey string) (User, error) {
+  users := []User {}
+  if err := storage.findEntities(storage.data.Users, func (user User) bool {
+    return serverAPIKey != "" && user.ServerAPIKey == serverAPIKey
+  }, &users); err != nil || len(users) == 0 {
+    return User{}, ErrUserNotFound
+  }
+  return users[0], nil
+}
+
+func (storage *MemoryStorage) GetOrCreateUser(email string) (User, error) {
+  var user User
+  err := storage.locked(func () error {
+    for _, existing := range storage.data.Users {
+      if existing.Email == email && (user.ID == 0 || existing.ID < user.ID) {
+        user = existing
+      }
+    }
+    if user.ID != 0 {
+      return nil
+    }
+    user = User{ ID: storage.entityID(0), Email: email }
+    return storage.storeEntity(storage.data.Users, user.ID, user)
+  })
+  if err != nil {
+    return User{}, err
+  }
+  return user, nil
+}
+
+func (storage *MemoryStorage) PutUser(user User) (User, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Users, &user.ID, &user); err != nil {
+    return User{}, err
+  }
+  return user, nil
+}
+
+func (storage *MemoryStorage) MigrateUserEntities(userID int64, organizationID int64) error {
+  return storage.locked(func () error {
+    owned := []interface{} { storage.data.Servers, storage.data.Commands, storage.data.Invocations, storage.data.Schedules, storage.data.ServerEvents }
+    for _, entities := range owned {
+      table := reflect.ValueOf(entities)
+      for _, key := range table.MapKeys() {
+        entity := cloneValue(table.MapIndex(key))
+        if entity.FieldByName("UserID").Int() != userID || entity.FieldByName("OrganizationID").Int() != 0 {
+          continue
+        }
+        entity.FieldByName("OrganizationID").SetInt(organizationID)
+        if err := storage.storeEntity(entities, key.Interface(), entity.Interface()); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+}
+
+func (storage *MemoryStorage) GetOrganization(id int64) (Organization, error) {
+  var organization Organization
+  err := storage.getEntity(storage.data.Organizations, id, &organization, ErrOrganizationNotFound)
+  return organization, err
+}
+
+func (storage *MemoryStorage) GetOrganizationByServerAPIKeyHash(serverAPIKeyHash string) (Organization, error) {
+  return storage.findOrganization(func (organization Organization) bool {
+    return serverAPIKeyHash != "" &&
+      (organization.ServerAPIKeyHash == serverAPIKeyHash || organization.PreviousServerAPIKeyHash == serverAPIKeyHash)
+  })
+}
+
+func (storage *MemoryStorage) GetOrganizationByLegacyServerAPIKey(serverAPIKey string) (Organization, error) {
+  return storage.findOrganization(func (organization Organization) bool {
+    return serverAPIKey != "" &&
+      (organization.ServerAPIKey == serverAPIKey || organization.PreviousServerAPIKey == serverAPIKey)
+  })
+}
+
+func (storage *MemoryStorage) GetPersonalOrganization(userID int64) (Organization, error) {
+  return storage.findOrganization(func (organization Organization) bool {
+    return organization.PersonalUserID == userID
+  })
+}
+
+func (storage *MemoryStorage) findOrganization(matches func(Organization) bool) (Organization, error) {
+  organizations := []Organization {}
+  if err := storage.findEntities(storage.data.Organizations, matches, &organizations); err != nil || len(organizations) == 0 {
+    return Organization{}, ErrOrganizationNotFound
+  }
+  return organizations[0], nil
+}
+
+func (storage *MemoryStorage) PutOrganization(organization Organization) (Organization, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Organizations, &organization.ID, &organization); err != nil {
+    return Organization{}, err
+  }
+  return organization, nil
+}
+
+func (storage *MemoryStorage) GetMembership(organizationID int64, userID int64) (Membership, error) {
+  var membership Membership
+  err := storage.getEntity(storage.data.Memberships, compositeKey(organizationID, userID), &membership, ErrMembershipNotFound)
+  return membership, err
+}
+
+func (storage *MemoryStorage) GetMemberships(organizationID int64) ([]Membership, error) {
+  return storage.findMemberships(func (membership Membership) bool {
+    return membership.OrganizationID == organizationID
+  })
+}
+
+func (storage *MemoryStorage) GetUserMemberships(userID int64) ([]Membership, error) {
+  return storage.findMemberships(func (membership Membership) bool {
+    return membership.UserID == userID
+  })
+}
+
+func (storage *MemoryStorage) findMemberships(matches func(Membership) bool) ([]Membership, error) {
+  memberships := []Membership {}
+  err := storage.findEntities(storage.data.Memberships, matches, &memberships)
+  sort.Sort(membershipsByKey(memberships))
+  return memberships, err
+}
+
+func (storage *MemoryStorage) PutMembership(membership Membership) (Membership, error) {
+  if err := storage.putEntity(storage.data.Memberships, compositeKey(membership.OrganizationID, membership.UserID), membership); err != nil {
+    return Membership{}, err
+  }
+  return membership, nil
+}
+
+func (storage *MemoryStorage) DeleteMembership(organizationID int64, userID int64) error {
+  return storage.deleteEntity(storage.data.Memberships, compositeKey(organizationID, userID), ErrMembershipNotFound)
+}
+
+func (storage *MemoryStorage) GetInvitation(id int64) (Invitation, error) {
+  var invitation Invitation
+  err := storage.getEntity(storage.data.Invitations, id, &invitation, ErrInvitationNotFound)
+  return invitation, err
+}
+
+func (storage *MemoryStorage) GetPendingInvitations(email string) ([]Invitation, error) {
+  invitations := []Invitation {}
+  err := storage.findEntities(storage.data.Invitations, func (invitation Invitation) bool {
+    return invitation.Email == email && invitation.State == InvitationStatePending
+  }, &invitations)
+  return invitations, err
+}
+
+func (storage *MemoryStorage) PutInvitation(invitation Invitation) (Invitation, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Invitations, &invitation.ID, &invitation); err != nil {
+    return Invitation{}, err
+  }
+  return invitation, nil
+}
+
+func (storage *MemoryStorage) GetServer(id int64) (Server, error) {
+  var server Server
+  err := storage.getEntity(storage.data.Servers, id, &server, ErrServerNotFound)
+  return server, err
+}
+
+func (storage *MemoryStorage) GetServerByServerID(organizationID int64, serverID string) (Server, error) {
+  servers := []Server {}
+  if err := storage.findEntities(storage.data.Servers, func (server Server) bool {
+    return server.OrganizationID == organizationID && server.ServerID == serverID
+  }, &servers); err != nil || len(servers) == 0 {
+    return Server{}, ErrServerNotFound
+  }
+  return servers[0], nil
+}
+
+func (storage *MemoryStorage) GetServers(organizationID int64) ([]Server, error) {
+  servers := []Server {}
+  err := storage.findEntities(storage.data.Servers, func (server Server) bool {
+    return server.OrganizationID == organizationID
+  }, &servers)
+  return servers, err
+}
+
+func (storage *MemoryStorage) GetAllServers() ([]Server, error) {
+  servers := []Server {}
+  err := storage.findEntities(storage.data.Servers, func (server Server) bool {
+    return true
+  }, &servers)
+  return servers, err
+}
+
+func (storage *MemoryStorage) PutServer(server Server) (Server, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Servers, &server.ID, &server); err != nil {
+    return Server{}, err
+  }
+  return server, nil
+}
+
+func (storage *MemoryStorage) DeleteServer(id int64) error {
+  return storage.deleteEntity(storage.data.Servers, id, ErrServerNotFound)
+}
+
+func (storage *MemoryStorage) GetServerEvents(serverID int64) ([]ServerEvent, error) {
+  events := []ServerEvent {}
+  err := storage.findEntities(storage.data.ServerEvents, func (event ServerEvent) bool {
+    return event.ServerID == serverID
+  }, &events)
+  sortNewestFirst(events, "Time")
+  return events, err
+}
+
+func (storage *MemoryStorage) PutServerEvent(event ServerEvent) (ServerEvent, error) {
+  if err := storage.putIdentifiedEntity(storage.data.ServerEvents, &event.ID, &event); err != nil {
+    return ServerEvent{}, err
+  }
+  return event, nil
+}
+
+func (storage *MemoryStorage) GetCommand(id int64) (Command, error) {
+  var command Command
+  err := storage.getEntity(storage.data.Commands, id, &command, ErrCommandNotFound)
+  return command, err
+}
+
+func (storage *MemoryStorage) GetCommands(organizationID int64) ([]Command, error) {
+  commands := []Command {}
+  err := storage.findEntities(storage.data.Commands, func (command Command) bool {
+    return command.OrganizationID == organizationID
+  }, &commands)
+  return commands, err
+}
+
+func (storage *MemoryStorage) GetPublicCommands(afterID int64, limit int) ([]Command, error) {
+  commands := []Command {}
+  err := storage.findEntities(storage.data.Commands, func (command Command) bool {
+    return command.PublicCommand && command.ID > afterID
+  }, &commands)
+  if len(commands) > limit {
+    commands = commands[:limit]
+  }
+  return commands, err
+}
+
+func (storage *MemoryStorage) PutCommand(command Command) (Command, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Commands, &command.ID, &command); err != nil {
+    return Command{}, err
+  }
+  return command, nil
+}
+
+func (storage *MemoryStorage) DeleteCommand(id int64) error {
+  return storage.deleteEntity(storage.data.Commands, id, ErrCommandNotFound)
+}
+
+func (storage *MemoryStorage) GetCommandVersion(commandID int64, version int64) (CommandVersion, error) {
+  var commandVersion CommandVersion
+  err := storage.getEntity(storage.data.CommandVersions, compositeKey(commandID, version), &commandVersion, ErrCommandVersionNotFound)
+  return commandVersion, err
+}
+
+func (storage *MemoryStorage) GetCommandVersions(commandID int64) ([]CommandVersion, error) {
+  versions := []CommandVersion {}
+  err := storage.findEntities(storage.data.CommandVersions, func (version CommandVersion) bool {
+    return version.CommandID == commandID
+  }, &versions)
+  sort.Stable(entitiesByField{ entities: reflect.ValueOf(versions), field: "Version" })
+  return versions, err
+}
+
+func (storage *MemoryStorage) PutCommandVersion(version CommandVersion) (CommandVersion, error) {
+  if err := storage.putEntity(storage.data.CommandVersions, compositeKey(version.CommandID, version.Version), version); err != nil {
+    return CommandVersion{}, err
+  }
+  return version, nil
+}
+
+func (storage *MemoryStorage) GetInvocation(id int64) (Invocation, error) {
+  var invocation Invocation
+  err := storage.getEntity(storage.data.Invocations, id, &invocation, ErrInvocationNotFound)
+  return invocation, err
+}
+
+func (storage *MemoryStorage) GetInvocations(organizationID int64) ([]Invocation, error) {
+  invocations := []Invocation {}
+  err := storage.findEntities(storage.data.Invocations, func (invocation Invocation) bool {
+    return invocation.OrganizationID == organizationID
+  }, &invocations)
+  sortNewestFirst(invocations, "CreatedTime")
+  return invocations, err
+}
+
+func (storage *MemoryStorage) GetQueuedInvocationIDs(serverID int64) ([]int64, error) {
+  invocations := []Invocation {}
+  err := storage.findEntities(storage.data.Invocations, func (invocation Invocation) bool {
+    return invocation.ServerID == serverID && invocation.State == InvocationStateQueued
+  }, &invocations)
+  sort.Stable(entitiesByField{ entities: reflect.ValueOf(invocations), field: "CreatedTime" })
+  return entityIDs(invocations), err
+}
+
+func (storage *MemoryStorage) GetExpiredApprovalIDs(now int64) ([]int64, error) {
+  invocations := []Invocation {}
+  err := storage.findEntities(storage.data.Invocations, func (invocation Invocation) bool {
+    return invocation.State == InvocationStatePendingApproval && invocation.ApprovalExpiresTime < now
+  }, &invocations)
+  return entityIDs(invocations), err
+}
+
+func (storage *MemoryStorage) PutInvocation(invocation Invocation) (Invocation, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Invocations, &invocation.ID, &invocation); err != nil {
+    return Invocation{}, err
+  }
+  return invocation, nil
+}
+
+func (storage *MemoryStorage) GetOutputStream(invocationID int64) (OutputStream, error) {
+  var stream OutputStream
+  err := storage.getEntity(storage.data.OutputStreams, invocationID, &stream, nil)
+  return stream, err
+}
+
+func (storage *MemoryStorage) PutOutputStream(invocationID int64, stream OutputStream) error {
+  return storage.putEntity(storage.data.OutputStreams, invocationID, stream)
+}
+
+func (storage *MemoryStorage) GetOutputChunk(invocationID int64, sequence int64) (OutputChunk, error) {
+  var chunk OutputChunk
+  err := storage.getEntity(storage.data.OutputChunks, compositeKey(invocationID, sequence), &chunk, ErrOutputChunkNotFound)
+  return chunk, err
+}
+
+func (storage *MemoryStorage) GetOutputChunks(invocationID int64, afterOffset int64, limit int) ([]OutputChunk, error) {
+  chunks := []OutputChunk {}
+  prefix := strconv.FormatInt(invocationID, 10) + "-"
+  err := storage.locked(func () error {
+    for key, chunk := range storage.data.OutputChunks {
+      if len(key) > len(prefix) && key[:len(prefix)] == prefix && chunk.EndOffset > afterOffset {
+        chunks = append(chunks, chunk)
+      }
+    }
+    return nil
+  })
+  sort.Sort(entitiesByField{ entities: reflect.ValueOf(chunks), field: "EndOffset" })
+  if len(chunks) > limit {
+    chunks = chunks[:limit]
+  }
+  return chunks, err
+}
+
+func (storage *MemoryStorage) PutOutputChunk(invocationID int64, chunk OutputChunk) error {
+  return storage.putEntity(storage.data.OutputChunks, compositeKey(invocationID, chunk.Sequence), chunk)
+}
+
+func (storage *MemoryStorage) GetSchedule(id int64) (Schedule, error) {
+  var schedule Schedule
+  err := storage.getEntity(storage.data.Schedules, id, &schedule, ErrScheduleNotFound)
+  return schedule, err
+}
+
+func (storage *MemoryStorage) GetSchedules(organizationID int64) ([]Schedule, error) {
+  schedules := []Schedule {}
+  err := storage.findEntities(storage.data.Schedules, func (schedule Schedule) bool {
+    return schedule.OrganizationID == organizationID
+  }, &schedules)
+  return schedules, err
+}
+
+func (storage *MemoryStorage) GetDueScheduleIDs(now int64) ([]int64, error) {
+  schedules := []Schedule {}
+  err := storage.findEntities(storage.data.Schedules, func (schedule Schedule) bool {
+    return !schedule.Paused && schedule.NextRunTime <= now
+  }, &schedules)
+  return entityIDs(schedules), err
+}
+
+func (storage *MemoryStorage) GetCommandScheduleIDs(commandID int64) ([]int64, error) {
+  schedules := []Schedule {}
+  err := storage.findEntities(storage.data.Schedules, func (schedule Schedule) bool {
+    return schedule.CommandID == commandID
+  }, &schedules)
+  return entityIDs(schedules), err
+}
+
+func (storage *MemoryStorage) PutSchedule(schedule Schedule) (Schedule, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Schedules, &schedule.ID, &schedule); err != nil {
+    return Schedule{}, err
+  }
+  return schedule, nil
+}
+
+func (storage *MemoryStorage) DeleteSchedule(id int64) error {
+  return storage.deleteEntity(storage.data.Schedules, id, ErrScheduleNotFound)
+}
+
+func (storage *MemoryStorage) GetEnrollmentToken(id int64) (EnrollmentToken, error) {
+  var token EnrollmentToken
+  err := storage.getEntity(storage.data.EnrollmentTokens, id, &token, ErrEnrollmentTokenNotFound)
+  return token, err
+}
+
+func (storage *MemoryStorage) GetEnrollmentTokenByHash(tokenHash string) (EnrollmentToken, error) {
+  tokens := []EnrollmentToken {}
+  if err := storage.findEntities(storage.data.EnrollmentTokens, func (token EnrollmentToken) bool {
+    return token.TokenHash == tokenHash
+  }, &tokens); err != nil || len(tokens) == 0 {
+    return EnrollmentToken{}, ErrEnrollmentTokenNotFound
+  }
+  return tokens[0], nil
+}
+
+func (storage *MemoryStorage) GetEnrollmentTokens(organizationID int64) ([]EnrollmentToken, error) {
+  tokens := []EnrollmentToken {}
+  err := storage.findEntities(storage.data.EnrollmentTokens, func (token EnrollmentToken) bool {
+    return token.OrganizationID == organizationID
+  }, &tokens)
+  return tokens, err
+}
+
+func (storage *MemoryStorage) PutEnrollmentToken(token EnrollmentToken) (EnrollmentToken, error) {
+  if err := storage.putIdentifiedEntity(storage.data.EnrollmentTokens, &token.ID, &token); err != nil {
+    return EnrollmentToken{}, err
+  }
+  return token, nil
+}
+
+func (storage *MemoryStorage) GetPersonalAccessToken(id int64) (PersonalAccessToken, error) {
+  var token PersonalAccessToken
+  err := storage.getEntity(storage.data.PersonalAccessTokens, id, &token, ErrPersonalAccessTokenNotFound)
+  return token, err
+}
+
+func (storage *MemoryStorage) GetPersonalAccessTokenByHash(tokenHash string) (PersonalAccessToken, error) {
+  tokens := []PersonalAccessToken {}
+  if err := storage.findEntities(storage.data.PersonalAccessTokens, func (token PersonalAccessToken) bool {
+    return token.TokenHash == tokenHash
+  }, &tokens); err != nil || len(tokens) == 0 {
+    return PersonalAccessToken{}, ErrPersonalAccessTokenNotFound
+  }
+  return tokens[0], nil
+}
+
+func (storage *MemoryStorage) GetPersonalAccessTokens(userID int64) ([]PersonalAccessToken, error) {
+  tokens := []PersonalAccessToken {}
+  err := storage.findEntities(storage.data.PersonalAccessTokens, func (token PersonalAccessToken) bool {
+    return token.UserID == userID
+  }, &tokens)
+  return tokens, err
+}
+
+func (storage *MemoryStorage) PutPersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error) {
+  if err := storage.putIdentifiedEntity(storage.data.PersonalAccessTokens, &token.ID, &token); err != nil {
+    return PersonalAccessToken{}, err
+  }
+  return token, nil
+}
+
+func (storage *MemoryStorage) GetAuditChain(organizationID int64) (AuditChain, error) {
+  var chain AuditChain
+  err := storage.getEntity(storage.data.AuditChains, organizationID, &chain, ErrAuditChainNotFound)
+  return chain, err
+}
+
+func (storage *MemoryStorage) PutAuditChain(organizationID int64, chain AuditChain) error {
+  return storage.putEntity(storage.data.AuditChains, organizationID, chain)
+}
+
+func (storage *MemoryStorage) GetAuditEvents(organizationID int64, beforeSequence int64, limit int) ([]AuditEvent, error) {
+  events := []AuditEvent {}
+  err := storage.findEntities(storage.data.AuditEvents, func (event AuditEvent) bool {
+    return event.OrganizationID == organizationID && (beforeSequence == 0 || event.Sequence < beforeSequence)
+  }, &events)
+  sort.Sort(entitiesByField{ entities: reflect.ValueOf(events), field: "Sequence", descending: true })
+  if len(events) > limit {
+    events = events[:limit]
+  }
+  return events, err
+}
+
+func (storage *MemoryStorage) GetAuditEventsAfter(organizationID int64, afterSequence int64, limit int) ([]AuditEvent, error) {
+  events := []AuditEvent {}
+  err := storage.findEntities(storage.data.AuditEvents, func (event AuditEvent) bool {
+    return event.OrganizationID == organizationID && event.Sequence > afterSequence
+  }, &events)
+  sort.Sort(entitiesByField{ entities: reflect.ValueOf(events), field: "Sequence" })
+  if len(events) > limit {
+    events = events[:limit]
+  }
+  return events, err
+}
+
+func (storage *MemoryStorage) PutAuditEvents(events []AuditEvent) error {
+  return storage.locked(func () error {
+    for _, event := range events {
+      event.ID = event.Sequence
+      if err := storage.storeEntity(storage.data.AuditEvents, compositeKey(event.OrganizationID, event.Sequence), event); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+func (storage *MemoryStorage) GetWebhook(id int64) (Webhook, error) {
+  var webhook Webhook
+  err := storage.getEntity(storage.data.Webhooks, id, &webhook, ErrWebhookNotFound)
+  return webhook, err
+}
+
+func (storage *MemoryStorage) GetWebhooks(organizationID int64) ([]Webhook, error) {
+  webhooks := []Webhook {}
+  err := storage.findEntities(storage.data.Webhooks, func (webhook Webhook) bool {
+    return webhook.OrganizationID == organizationID
+  }, &webhooks)
+  return webhooks, err
+}
+
+func (storage *MemoryStorage) GetEventWebhookIDs(organizationID int64, event string) ([]int64, error) {
+  webhooks := []Webhook {}
+  err := storage.findEntities(storage.data.Webhooks, func (webhook Webhook) bool {
+    if webhook.OrganizationID != organizationID {
+      return false
+    }
+    for _, subscribed := range webhook.Events {
+      if subscribed == event {
+        return true
+      }
+    }
+    return false
+  }, &webhooks)
+  return entityIDs(webhooks), err
+}
+
+func (storage *MemoryStorage) PutWebhook(webhook Webhook) (Webhook, error) {
+  if err := storage.putIdentifiedEntity(storage.data.Webhooks, &webhook.ID, &webhook); err != nil {
+    return Webhook{}, err
+  }
+  return webhook, nil
+}
+
+func (storage *MemoryStorage) DeleteWebhook(id int64) error {
+  return storage.deleteEntity(storage.data.Webhooks, id, ErrWebhookNotFound)
+}
+
+func (storage *MemoryStorage) GetWebhookDelivery(id int64) (WebhookDelivery, error) {
+  var delivery WebhookDelivery
+  err := storage.getEntity(storage.data.WebhookDeliveries, id, &delivery, ErrWebhookDeliveryNotFound)
+  return delivery, err
+}
+
+func (storage *MemoryStorage) GetWebhookDeliveries(webhookID int64) ([]WebhookDelivery, error) {
+  deliveries := []WebhookDelivery {}
+  err := storage.findEntities(storage.data.WebhookDeliveries, func (delivery WebhookDelivery) bool {
+    return delivery.WebhookID == webhookID
+  }, &deliveries)
+  sortNewestFirst(deliveries, "CreatedTime")
+  return deliveries, err
+}
+
+func (storage *MemoryStorage) GetDueWebhookDeliveryIDs(now int64) ([]int64, error) {
+  deliveries := []WebhookDelivery {}
+  err := storage.findEntities(storage.data.WebhookDeliveries, func (delivery WebhookDelivery) bool {
+    return delivery.State == WebhookDeliveryStatePending && delivery.NextAttemptTime <= now
+  }, &deliveries)
+  return entityIDs(deliveries), err
+}
+
+func (storage *MemoryStorage) PutWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+  if err := storage.putIdentifiedEntity(storage.data.WebhookDeliveries, &delivery.ID, &delivery); err != nil {
+    return WebhookDelivery{}, err
+  }
+  return delivery, nil
+}
+
+type membershipsByKey []Membership
+
+func (memberships membershipsByKey) Len() int { return len(memberships) }
+func (memberships membershipsByKey) Swap(i, j int) { memberships[i], memberships[j] = memberships[j], memberships[i] }
+func (memberships membershipsByKey) Less(i, j int) bool {
+  if memberships[i].OrganizationID != memberships[j].OrganizationID {
+    return memberships[i].OrganizationID < memberships[j].OrganizationID
+  }
+  return memberships[i].UserID < memberships[j].UserID
+}
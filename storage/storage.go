@@ -0,0 +1,499 @@
+// Package storage keeps everything biboop stores behind an interface so it can live somewhere other than the App Engine
+// datastore. The App Engine backend works on the same entities the app has always stored, and the memory and file
+// backends need nothing but the standard library.
+package storage
+
+import (
+  "errors"
+  "strings"
+)
+
+var ErrUserNotFound = errors.New("User not found")
+var ErrServerNotFound = errors.New("Server not found")
+var ErrCommandNotFound = errors.New("Command not found")
+var ErrOrganizationNotFound = errors.New("Organization not found")
+var ErrMembershipNotFound = errors.New("Not a member of this organization")
+var ErrInvitationNotFound = errors.New("Invitation not found")
+var ErrInvocationNotFound = errors.New("Invocation not found")
+var ErrCommandVersionNotFound = errors.New("Command version not found")
+var ErrOutputChunkNotFound = errors.New("Output chunk not found")
+var ErrScheduleNotFound = errors.New("Schedule not found")
+var ErrEnrollmentTokenNotFound = errors.New("Enrollment token not found")
+var ErrPersonalAccessTokenNotFound = errors.New("Personal access token not found")
+var ErrAuditChainNotFound = errors.New("Audit chain not found")
+var ErrWebhookNotFound = errors.New("Webhook not found")
+var ErrWebhookDeliveryNotFound = errors.New("Webhook delivery not found")
+var ErrNestedTransaction = errors.New("Transactions can't be nested")
+
+const (
+  InvocationStateQueued = "queued"
+  InvocationStateDispatched = "dispatched"
+  InvocationStateCompleted = "completed"
+  InvocationStateFailed = "failed"
+  InvocationStatePendingApproval = "pending_approval"
+  InvocationStateRejected = "rejected"
+  InvocationStateExpired = "expired"
+)
+
+const (
+  InvitationStatePending = "pending"
+  InvitationStateAccepted = "accepted"
+  InvitationStateDeclined = "declined"
+)
+
+const (
+  WebhookDeliveryStatePending = "pending"
+  WebhookDeliveryStateDelivered = "delivered"
+  WebhookDeliveryStateFailed = "failed"
+)
+
+type User struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  Email string `json:"email,omitempty"`
+  ServerAPIKey string `json:"serverAPIKey,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  // Set while what the user owned from before organizations is still being moved into their organization
+  OrganizationMigrationPending bool `json:"organizationMigrationPending,omitempty"`
+}
+
+type ServerLabel struct {
+  Key string `json:"key"`
+  Value string `json:"value"`
+}
+
+type Server struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  ServerID string `json:"serverId,omitempty"`
+  Name string `json:"name,omitempty"`
+  Description string `json:"description,omitempty"`
+  LastPollTime int64 `json:"lastPollTime,omitempty"`
+  PollIntervalSec int `json:"pollIntervalSec,omitempty"`
+  Status string `json:"status,omitempty"`
+  Labels []ServerLabel `json:"labels,omitempty"`
+  AgentLabels []ServerLabel `json:"agentLabels,omitempty"`
+  PendingCommands int `json:"pendingCommands,omitempty"`
+  // IDs of the commands the server may run
+  AvailableCommands []int64 `json:"availableCommands,omitempty"`
+  CredentialHash string `json:"-" datastore:",noindex"`
+  CredentialIssuedTime int64 `json:"credentialIssuedTime,omitempty"`
+  CredentialRevokedTime int64 `json:"credentialRevokedTime,omitempty"`
+}
+
+type CommandParam struct {
+  Name string `json:"name,omitempty"`
+  Type string `json:"type,omitempty"`
+  PossibleValues []string `json:"PossibleValues,omitempty"`
+  Description string `json:"description,omitempty"`
+  DefaultValue string `json:"defaultValue,omitempty"`
+  Pattern string `json:"pattern,omitempty"`
+}
+
+type Command struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  PublicCommand bool `json:"publicCommand,omitempty"`
+  Name string `json:"name,omitempty"`
+  Description string `json:"description,omitempty"`
+  Command string `json:"command,omitempty"`
+  Params []CommandParam `json:"params,omitempty"`
+  ForkedFromID int64 `json:"forkedFromId,omitempty"`
+  RequiresApproval bool `json:"requiresApproval,omitempty"`
+  ApprovalExpirySec int `json:"approvalExpirySec,omitempty"`
+  Version int64 `json:"version,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  UpdatedTime int64 `json:"updatedTime,omitempty"`
+}
+
+// Reports whether the command's name or description contains search, ignoring case. Everything matches an empty search.
+func (command Command) Matches(search string) bool {
+  search = strings.ToLower(strings.TrimSpace(search))
+  return search == "" ||
+    strings.Contains(strings.ToLower(command.Name), search) ||
+    strings.Contains(strings.ToLower(command.Description), search)
+}
+
+type Organization struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  Name string `json:"name,omitempty"`
+  // Plain text keys from before keys were hashed, hashed and cleared the first time they are used
+  ServerAPIKey string `json:"-"`
+  ServerAPIKeyHash string `json:"-"`
+  ServerAPIKeyHint string `json:"serverAPIKeyHint,omitempty" datastore:",noindex"`
+  ServerAPIKeyCreatedTime int64 `json:"serverAPIKeyCreatedTime,omitempty"`
+  ServerAPIKeyLastUsedTime int64 `json:"serverAPIKeyLastUsedTime,omitempty"`
+  PreviousServerAPIKey string `json:"-"`
+  PreviousServerAPIKeyHash string `json:"-"`
+  PreviousServerAPIKeyExpiresTime int64 `json:"previousServerAPIKeyExpiresTime,omitempty"`
+  PreviousServerAPIKeyLastUsedTime int64 `json:"previousServerAPIKeyLastUsedTime,omitempty"`
+  PersonalUserID int64 `json:"personalUserId,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+}
+
+// Memberships are keyed by organization and user, there is at most one for each pair.
+type Membership struct {
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  UserID int64 `json:"userId,omitempty"`
+  Email string `json:"email,omitempty"`
+  Role string `json:"role,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+}
+
+type Invitation struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  OrganizationName string `json:"organizationName,omitempty"`
+  Email string `json:"email,omitempty"`
+  Role string `json:"role,omitempty"`
+  InvitedByUserID int64 `json:"invitedByUserId,omitempty"`
+  State string `json:"state,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  RespondedTime int64 `json:"respondedTime,omitempty"`
+}
+
+// A command as it was at one version. Versions are keyed by their command and version number and are never changed
+// or deleted, so invocations can always be traced back to what they ran, even after the command is deleted.
+type CommandVersion struct {
+  CommandID int64 `json:"commandId,omitempty" datastore:"-"`
+  Version int64 `json:"version,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  EditedByUserID int64 `json:"editedByUserId,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  PublicCommand bool `json:"publicCommand,omitempty"`
+  Name string `json:"name,omitempty"`
+  Description string `json:"description,omitempty"`
+  Command string `json:"command,omitempty"`
+  Params []CommandParam `json:"params,omitempty"`
+  RequiresApproval bool `json:"requiresApproval,omitempty"`
+  ApprovalExpirySec int `json:"approvalExpirySec,omitempty"`
+}
+
+type InvocationParam struct {
+  Name string `json:"name,omitempty"`
+  Value string `json:"value,omitempty"`
+}
+
+type Invocation struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  CommandID int64 `json:"commandId,omitempty"`
+  CommandVersion int64 `json:"commandVersion,omitempty"`
+  ServerID int64 `json:"serverId,omitempty"`
+  Command string `json:"command,omitempty" datastore:",noindex"`
+  Params []InvocationParam `json:"params,omitempty"`
+  State string `json:"state,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  DispatchedTime int64 `json:"dispatchedTime,omitempty"`
+  ScheduleID int64 `json:"scheduleId,omitempty"`
+  CompletedTime int64 `json:"completedTime,omitempty"`
+  ExitCode int `json:"exitCode"`
+  Stdout string `json:"stdout,omitempty" datastore:",noindex"`
+  Stderr string `json:"stderr,omitempty" datastore:",noindex"`
+  StartedTime int64 `json:"startedTime,omitempty"`
+  FinishedTime int64 `json:"finishedTime,omitempty"`
+  DurationMs int64 `json:"durationMs,omitempty"`
+  OutputChunks int64 `json:"outputChunks,omitempty"`
+  OutputBytes int64 `json:"outputBytes,omitempty"`
+  ApprovalExpiresTime int64 `json:"approvalExpiresTime,omitempty"`
+  ReviewedByUserID int64 `json:"reviewedByUserId,omitempty"`
+  ReviewedByEmail string `json:"reviewedByEmail,omitempty"`
+  ReviewComment string `json:"reviewComment,omitempty" datastore:",noindex"`
+  ReviewedTime int64 `json:"reviewedTime,omitempty"`
+}
+
+// How much output an invocation has, keyed by the invocation's ID. Its chunks are stored apart from the invocation, so
+// appending output never contends with changes to the invocation itself. The invocation's own counts are brought up
+// to date when it finishes.
+type OutputStream struct {
+  Chunks int64
+  Bytes int64
+}
+
+// A piece of an invocation's output. Chunks are numbered from 1 by the agent and keyed by the invocation and that
+// number, so a retried chunk lands on the same key. Offset is where the chunk starts in the invocation's combined
+// stdout and stderr.
+type OutputChunk struct {
+  Sequence int64 `json:"sequence"`
+  Stream string `json:"stream,omitempty" datastore:",noindex"`
+  Data string `json:"data" datastore:",noindex"`
+  Offset int64 `json:"offset"`
+  EndOffset int64 `json:"-"`
+  Time int64 `json:"time,omitempty" datastore:",noindex"`
+}
+
+type Schedule struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  CommandID int64 `json:"commandId,omitempty"`
+  ServerID int64 `json:"serverId,omitempty"`
+  Expression string `json:"expression,omitempty"`
+  TimeZone string `json:"timeZone,omitempty"`
+  Params []InvocationParam `json:"params,omitempty"`
+  Paused bool `json:"paused"`
+  NextRunTime int64 `json:"nextRunTime,omitempty"`
+  LastRunTime int64 `json:"lastRunTime,omitempty"`
+  LastInvocationID int64 `json:"lastInvocationId,omitempty"`
+  LastError string `json:"lastError,omitempty" datastore:",noindex"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+}
+
+type EnrollmentToken struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  CreatedByUserID int64 `json:"createdByUserId,omitempty"`
+  Description string `json:"description,omitempty" datastore:",noindex"`
+  TokenHash string `json:"-"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  ExpiresTime int64 `json:"expiresTime,omitempty"`
+  UsedTime int64 `json:"usedTime,omitempty"`
+  UsedByServerID int64 `json:"usedByServerId,omitempty"`
+  RevokedTime int64 `json:"revokedTime,omitempty"`
+}
+
+// A token a user mints to call the API from scripts, acting as them in the organization it was made in. Only its hash
+// is stored.
+type PersonalAccessToken struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  Email string `json:"email,omitempty" datastore:",noindex"`
+  Name string `json:"name,omitempty" datastore:",noindex"`
+  TokenHash string `json:"-"`
+  Hint string `json:"hint,omitempty" datastore:",noindex"`
+  Scopes []string `json:"scopes,omitempty" datastore:",noindex"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+  ExpiresTime int64 `json:"expiresTime,omitempty"`
+  LastUsedTime int64 `json:"lastUsedTime,omitempty" datastore:",noindex"`
+  RevokedTime int64 `json:"revokedTime,omitempty"`
+}
+
+type ServerEvent struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  UserID int64 `json:"userId,omitempty"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  ServerID int64 `json:"serverId,omitempty"`
+  FromStatus string `json:"fromStatus,omitempty"`
+  ToStatus string `json:"toStatus,omitempty"`
+  Time int64 `json:"time,omitempty"`
+  DurationSec int64 `json:"durationSec,omitempty" datastore:"-"`
+}
+
+// The head of an organization's audit log, keyed by the organization's ID. Each event carries the hash of the one
+// before it so an edited, removed or reordered event breaks the chain from that point on.
+type AuditChain struct {
+  LastSequence int64
+  LastHash string `datastore:",noindex"`
+}
+
+// Audit events are keyed by their organization and sequence, and ID is always the sequence.
+type AuditEvent struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  Sequence int64 `json:"sequence,omitempty"`
+  Time int64 `json:"time,omitempty"`
+  ActorUserID int64 `json:"actorUserId,omitempty"`
+  ActorEmail string `json:"actorEmail,omitempty"`
+  Action string `json:"action,omitempty"`
+  TargetKind string `json:"targetKind,omitempty"`
+  TargetID int64 `json:"targetId,omitempty"`
+  RequestID string `json:"requestId,omitempty" datastore:",noindex"`
+  SourceIP string `json:"sourceIp,omitempty" datastore:",noindex"`
+  Diff string `json:"diff,omitempty" datastore:",noindex"`
+  PreviousHash string `json:"previousHash,omitempty" datastore:",noindex"`
+  Hash string `json:"hash,omitempty" datastore:",noindex"`
+}
+
+type Webhook struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  UserID int64 `json:"userId,omitempty"`
+  URL string `json:"url,omitempty" datastore:",noindex"`
+  Events []string `json:"events,omitempty"`
+  Secret string `json:"secret,omitempty" datastore:",noindex"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+}
+
+type WebhookDelivery struct {
+  ID int64 `json:"id,omitempty" datastore:"-"`
+  OrganizationID int64 `json:"organizationId,omitempty"`
+  WebhookID int64 `json:"webhookId,omitempty"`
+  Event string `json:"event,omitempty"`
+  Payload string `json:"payload,omitempty" datastore:",noindex"`
+  State string `json:"state,omitempty"`
+  Attempts int `json:"attempts"`
+  NextAttemptTime int64 `json:"nextAttemptTime,omitempty"`
+  LastAttemptTime int64 `json:"lastAttemptTime,omitempty"`
+  LastStatusCode int `json:"lastStatusCode,omitempty"`
+  LastResponse string `json:"lastResponse,omitempty" datastore:",noindex"`
+  LastError string `json:"lastError,omitempty" datastore:",noindex"`
+  RedeliveryOfID int64 `json:"redeliveryOfId,omitempty"`
+  CreatedTime int64 `json:"createdTime,omitempty"`
+}
+
+// How many public commands SearchPublicCommands returns when not given a limit, and the most it will return.
+const (
+  DefaultPublicCommandsLimit = 50
+  MaxPublicCommandsLimit = 200
+)
+
+// How many public commands SearchPublicCommands looks at for each one it may return, so a search matching little
+// doesn't read the whole catalog in one request.
+const PublicCommandsScanFactor = 5
+
+// Pages through the public commands matching search in ID order, starting after the command with ID afterID. Returns
+// up to limit commands and the afterID to pass for the next page, which is 0 once there are no more. A page stops
+// early, possibly empty, once it has looked at PublicCommandsScanFactor times limit commands.
+func SearchPublicCommands(storage Storage, search string, afterID int64, limit int) ([]Command, int64, error) {
+  if limit <= 0 {
+    limit = DefaultPublicCommandsLimit
+  } else if limit > MaxPublicCommandsLimit {
+    limit = MaxPublicCommandsLimit
+  }
+
+  commands := []Command {}
+  for scanned := 0; scanned < limit * PublicCommandsScanFactor; {
+    publicCommands, err := storage.GetPublicCommands(afterID, limit)
+    if err != nil {
+      return commands, 0, err
+    }
+    for _, command := range publicCommands {
+      afterID = command.ID
+      scanned++
+      if command.Matches(search) {
+        commands = append(commands, command)
+        if len(commands) == limit {
+          return commands, afterID, nil
+        }
+      }
+    }
+    if len(publicCommands) < limit {
+      return commands, 0, nil
+    }
+  }
+  return commands, afterID, nil
+}
+
+// Storage is implemented by every backend. Putting an entity with no ID creates it and returns it with its new ID,
+// putting one with an ID replaces whatever is stored under that ID. Lists come back in ID order unless noted otherwise.
+// Getting or deleting something that isn't there returns the kind's not found error.
+type Storage interface {
+  GetUser(id int64) (User, error)
+  GetUserByEmail(email string) (User, error)
+  GetUserByServerAPIKey(serverAPIKey string) (User, error)
+  // Returns the user with the email, creating them if there's none. Racing calls for one email get the same user.
+  GetOrCreateUser(email string) (User, error)
+  PutUser(user User) (User, error)
+  // Moves everything the user owned from before organizations into the organization
+  MigrateUserEntities(userID int64, organizationID int64) error
+
+  GetOrganization(id int64) (Organization, error)
+  // Finds the organization whose current or previous server API key has the hash
+  GetOrganizationByServerAPIKeyHash(serverAPIKeyHash string) (Organization, error)
+  // Finds the organization still holding serverAPIKey in plain text as its current or previous key
+  GetOrganizationByLegacyServerAPIKey(serverAPIKey string) (Organization, error)
+  GetPersonalOrganization(userID int64) (Organization, error)
+  PutOrganization(organization Organization) (Organization, error)
+
+  GetMembership(organizationID int64, userID int64) (Membership, error)
+  // Memberships are listed by organization then user
+  GetMemberships(organizationID int64) ([]Membership, error)
+  GetUserMemberships(userID int64) ([]Membership, error)
+  PutMembership(membership Membership) (Membership, error)
+  DeleteMembership(organizationID int64, userID int64) error
+
+  GetInvitation(id int64) (Invitation, error)
+  // Invitations addressed to email that haven't been responded to
+  GetPendingInvitations(email string) ([]Invitation, error)
+  PutInvitation(invitation Invitation) (Invitation, error)
+
+  GetServer(id int64) (Server, error)
+  GetServerByServerID(organizationID int64, serverID string) (Server, error)
+  GetServers(organizationID int64) ([]Server, error)
+  GetAllServers() ([]Server, error)
+  PutServer(server Server) (Server, error)
+  DeleteServer(id int64) error
+
+  // Newest first
+  GetServerEvents(serverID int64) ([]ServerEvent, error)
+  PutServerEvent(event ServerEvent) (ServerEvent, error)
+
+  GetCommand(id int64) (Command, error)
+  GetCommands(organizationID int64) ([]Command, error)
+  // The first limit public commands with IDs after afterID
+  GetPublicCommands(afterID int64, limit int) ([]Command, error)
+  PutCommand(command Command) (Command, error)
+  DeleteCommand(id int64) error
+
+  GetCommandVersion(commandID int64, version int64) (CommandVersion, error)
+  // Oldest first
+  GetCommandVersions(commandID int64) ([]CommandVersion, error)
+  // Stores the version under its CommandID and Version, which must both be set
+  PutCommandVersion(version CommandVersion) (CommandVersion, error)
+
+  GetInvocation(id int64) (Invocation, error)
+  // Newest first
+  GetInvocations(organizationID int64) ([]Invocation, error)
+  // The server's queued invocations, oldest first
+  GetQueuedInvocationIDs(serverID int64) ([]int64, error)
+  // Invocations still waiting on approval that expired before now
+  GetExpiredApprovalIDs(now int64) ([]int64, error)
+  PutInvocation(invocation Invocation) (Invocation, error)
+
+  // An invocation with no output stream yet has an empty one
+  GetOutputStream(invocationID int64) (OutputStream, error)
+  PutOutputStream(invocationID int64, stream OutputStream) error
+  GetOutputChunk(invocationID int64, sequence int64) (OutputChunk, error)
+  // The first limit chunks ending after afterOffset, in the order they end
+  GetOutputChunks(invocationID int64, afterOffset int64, limit int) ([]OutputChunk, error)
+  // Stores the chunk under the invocation and its Sequence
+  PutOutputChunk(invocationID int64, chunk OutputChunk) error
+
+  GetSchedule(id int64) (Schedule, error)
+  GetSchedules(organizationID int64) ([]Schedule, error)
+  // Unpaused schedules due to run at or before now
+  GetDueScheduleIDs(now int64) ([]int64, error)
+  GetCommandScheduleIDs(commandID int64) ([]int64, error)
+  PutSchedule(schedule Schedule) (Schedule, error)
+  DeleteSchedule(id int64) error
+
+  GetEnrollmentToken(id int64) (EnrollmentToken, error)
+  GetEnrollmentTokenByHash(tokenHash string) (EnrollmentToken, error)
+  GetEnrollmentTokens(organizationID int64) ([]EnrollmentToken, error)
+  PutEnrollmentToken(token EnrollmentToken) (EnrollmentToken, error)
+
+  GetPersonalAccessToken(id int64) (PersonalAccessToken, error)
+  GetPersonalAccessTokenByHash(tokenHash string) (PersonalAccessToken, error)
+  GetPersonalAccessTokens(userID int64) ([]PersonalAccessToken, error)
+  PutPersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error)
+
+  GetAuditChain(organizationID int64) (AuditChain, error)
+  PutAuditChain(organizationID int64, chain AuditChain) error
+  // The first limit events before beforeSequence, newest first. A beforeSequence of 0 starts from the newest.
+  GetAuditEvents(organizationID int64, beforeSequence int64, limit int) ([]AuditEvent, error)
+  // The first limit events after afterSequence, oldest first
+  GetAuditEventsAfter(organizationID int64, afterSequence int64, limit int) ([]AuditEvent, error)
+  // Stores each event under its OrganizationID and Sequence
+  PutAuditEvents(events []AuditEvent) error
+
+  GetWebhook(id int64) (Webhook, error)
+  GetWebhooks(organizationID int64) ([]Webhook, error)
+  // The organization's webhooks subscribed to event
+  GetEventWebhookIDs(organizationID int64, event string) ([]int64, error)
+  PutWebhook(webhook Webhook) (Webhook, error)
+  DeleteWebhook(id int64) error
+
+  GetWebhookDelivery(id int64) (WebhookDelivery, error)
+  // Newest first
+  GetWebhookDeliveries(webhookID int64) ([]WebhookDelivery, error)
+  // Pending deliveries due to be attempted at or before now
+  GetDueWebhookDeliveryIDs(now int64) ([]int64, error)
+  PutWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error)
+
+  // Runs fn against a Storage whose changes are all made or, when fn returns an error, none are. Only gets, puts and
+  // deletes may be used inside a transaction, and transactions can't be nested.
+  RunInTransaction(fn func(tx Storage) error) error
+}
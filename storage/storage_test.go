@@ -0,0 +1,120 @@
+package storage
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func expectConformance(t *testing.T, newStorage func() (Storage, error)) {
+  for _, failure := range CheckConformance(newStorage) {
+    t.Error(failure)
+  }
+}
+
+func TestMemoryStorageConforms(t *testing.T) {
+  expectConformance(t, func() (Storage, error) {
+    return NewMemoryStorage(), nil
+  })
+}
+
+func TestFileStorageConforms(t *testing.T) {
+  dir, err := ioutil.TempDir("", "biboop-storage")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  stores := 0
+  expectConformance(t, func() (Storage, error) {
+    stores++
+    return OpenFileStorage(filepath.Join(dir, fmt.Sprintf("store-%d.json", stores)))
+  })
+}
+
+func TestFileStorageReopens(t *testing.T) {
+  dir, err := ioutil.TempDir("", "biboop-storage")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "store.json")
+
+  store, err := OpenFileStorage(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  user, err := store.PutUser(User{ Email: "someone@example.com", OrganizationID: 1 })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := store.PutServer(Server{ OrganizationID: 1, ServerID: "web-1", AvailableCommands: []int64 { 3 } }); err != nil {
+    t.Fatal(err)
+  }
+
+  reopened, err := OpenFileStorage(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got, err := reopened.GetUser(user.ID); err != nil || got != user {
+    t.Errorf("reopened user = %v, %v, expected %v", got, err, user)
+  }
+  if servers, err := reopened.GetServers(1); err != nil || len(servers) != 1 || len(servers[0].AvailableCommands) != 1 {
+    t.Errorf("reopened servers = %v, %v, expected web-1 with one command", servers, err)
+  }
+  if next, err := reopened.PutUser(User{ Email: "someone-else@example.com" }); err != nil || next.ID == user.ID {
+    t.Errorf("new user after reopening = %v, %v, expected a fresh ID", next, err)
+  }
+}
+
+func TestMemoryCache(t *testing.T) {
+  cache := NewMemoryCache()
+
+  var value string
+  if err := cache.Get("missing", &value); err != ErrCacheMiss {
+    t.Errorf("getting a missing key returned %v, expected %v", err, ErrCacheMiss)
+  }
+  if err := cache.Set("key", "first", 0); err != nil {
+    t.Fatal(err)
+  }
+  if err := cache.Add("key", "second", 0); err != ErrNotStored {
+    t.Errorf("adding over a cached key returned %v, expected %v", err, ErrNotStored)
+  }
+  if err := cache.Get("key", &value); err != nil || value != "first" {
+    t.Errorf("cached value = %q, %v, expected first", value, err)
+  }
+
+  if err := cache.Set("expired", "gone", time.Nanosecond); err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(time.Millisecond)
+  if err := cache.Get("expired", &value); err != ErrCacheMiss {
+    t.Errorf("getting an expired key returned %v, expected %v", err, ErrCacheMiss)
+  }
+  if err := cache.Add("expired", "back", 0); err != nil {
+    t.Errorf("adding over an expired key returned %v", err)
+  }
+
+  if err := cache.Delete("key", "missing"); err != nil {
+    t.Fatal(err)
+  }
+  if err := cache.Get("key", &value); err != ErrCacheMiss {
+    t.Errorf("getting a deleted key returned %v, expected %v", err, ErrCacheMiss)
+  }
+
+  for _, step := range []struct {
+    delta int64
+    expected uint64
+  }{
+    { 0, 5 },
+    { 1, 6 },
+    { -10, 0 },
+  } {
+    if count, err := cache.Increment("counter", step.delta, 5); err != nil || count != step.expected {
+      t.Errorf("incrementing by %d returned %d, %v, expected %d", step.delta, count, err, step.expected)
+    }
+  }
+}
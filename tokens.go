@@ -0,0 +1,203 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "errors"
+  "strings"
+  "time"
+)
+
+var ErrPersonalAccessTokenNotFound = storage.ErrPersonalAccessTokenNotFound
+var ErrPersonalAccessTokenInvalid = errors.New("Personal access token is invalid, expired or revoked")
+var ErrInvalidTokenScope = errors.New("scopes may only name servers:read, commands:manage and commands:run")
+var ErrInvalidTokenExpiry = errors.New("expiresInSec must be between 0 and 31536000")
+var ErrTokenScopeRequired = errors.New("This personal access token does not have the scope this needs")
+var ErrTokenNotAllowed = errors.New("Personal access tokens can't be used for this")
+
+const (
+  ScopeReadServers = "servers:read"
+  ScopeManageCommands = "commands:manage"
+  ScopeRunCommands = "commands:run"
+)
+
+var tokenScopes = []string { ScopeReadServers, ScopeManageCommands, ScopeRunCommands }
+
+const (
+  personalAccessTokenPrefix = "bbp_"
+  personalAccessTokenHintLength = len(personalAccessTokenPrefix) + 8
+  MaxTokenExpirySec = 365 * 24 * 60 * 60
+)
+
+const personalAccessTokenCacheExpiration = 5 * time.Minute
+
+func personalAccessTokenCacheKey(tokenHash string) string {
+  return "PersonalAccessToken-" + tokenHash
+}
+
+func IsPersonalAccessToken(token string) bool {
+  return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
+
+func TokenHasScope(token storage.PersonalAccessToken, scope string) bool {
+  for _, tokenScope := range token.Scopes {
+    if tokenScope == scope {
+      return true
+    }
+  }
+  return false
+}
+
+func tokenIsValid(token storage.PersonalAccessToken, now int64) bool {
+  return token.RevokedTime == 0 && (token.ExpiresTime == 0 || now < token.ExpiresTime)
+}
+
+func validateTokenScopes(scopes []string) error {
+  for _, scope := range scopes {
+    valid := false
+    for _, tokenScope := range tokenScopes {
+      valid = valid || scope == tokenScope
+    }
+    if !valid {
+      return ErrInvalidTokenScope
+    }
+  }
+  return nil
+}
+
+// Mints a personal access token for the user. A token made without scopes gets all of them. The token itself is only
+// returned here.
+func CreatePersonalAccessTokenNoCache(ctx Context, user storage.User, name string, scopes []string, expiresInSec int) (storage.PersonalAccessToken, string, error) {
+  var personalAccessToken storage.PersonalAccessToken
+
+  if err := validateTokenScopes(scopes); err != nil {
+    return personalAccessToken, "", err
+  } else if expiresInSec < 0 || expiresInSec > MaxTokenExpirySec {
+    return personalAccessToken, "", ErrInvalidTokenExpiry
+  }
+  if len(scopes) == 0 {
+    scopes = append([]string(nil), tokenScopes...)
+  }
+
+  random, err := randomHex(32)
+  if err != nil {
+    return personalAccessToken, "", err
+  }
+  token := personalAccessTokenPrefix + random
+
+  personalAccessToken.UserID = user.ID
+  personalAccessToken.OrganizationID = user.OrganizationID
+  personalAccessToken.Email = user.Email
+  personalAccessToken.Name = name
+  personalAccessToken.TokenHash = hashSecret(token)
+  personalAccessToken.Hint = token[:personalAccessTokenHintLength]
+  personalAccessToken.Scopes = scopes
+  personalAccessToken.CreatedTime = time.Now().UTC().Unix()
+  if expiresInSec > 0 {
+    personalAccessToken.ExpiresTime = personalAccessToken.CreatedTime + int64(expiresInSec)
+  }
+
+  personalAccessToken, err = ctx.Storage().PutPersonalAccessToken(personalAccessToken)
+  if err != nil {
+    return personalAccessToken, "", err
+  }
+  return personalAccessToken, token, nil
+}
+
+func GetPersonalAccessTokensNoCache(ctx Context, user storage.User) ([]storage.PersonalAccessToken, error) {
+  personalAccessTokens, err := ctx.Storage().GetPersonalAccessTokens(user.ID)
+  if personalAccessTokens == nil {
+    personalAccessTokens = []storage.PersonalAccessToken {}
+  }
+  return personalAccessTokens, err
+}
+
+// Stops one of the user's tokens working straight away.
+func RevokePersonalAccessTokenNoCache(ctx Context, user storage.User, personalAccessTokenID int64) (storage.PersonalAccessToken, error) {
+  var personalAccessToken storage.PersonalAccessToken
+
+  err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    var err error
+    if personalAccessToken, err = tx.GetPersonalAccessToken(personalAccessTokenID); err != nil {
+      return err
+    } else if personalAccessToken.UserID != user.ID {
+      return ErrPersonalAccessTokenNotFound
+    }
+
+    if personalAccessToken.RevokedTime == 0 {
+      personalAccessToken.RevokedTime = time.Now().UTC().Unix()
+    }
+    personalAccessToken, err = tx.PutPersonalAccessToken(personalAccessToken)
+    return err
+  })
+  if err != nil {
+    return personalAccessToken, err
+  }
+
+  ctx.Cache().Delete(personalAccessTokenCacheKey(personalAccessToken.TokenHash))
+  return personalAccessToken, nil
+}
+
+// Finds the token and the user it belongs to, acting in the token's organization. Expired and revoked tokens are
+// refused even while cached.
+func AuthenticatePersonalAccessToken(ctx Context, token string) (storage.PersonalAccessToken, storage.User, error) {
+  var personalAccessToken storage.PersonalAccessToken
+  tokenHash := hashSecret(token)
+  cacheKey := personalAccessTokenCacheKey(tokenHash)
+
+  if err := ctx.Cache().Get(cacheKey, &personalAccessToken); err == storage.ErrCacheMiss {
+    if personalAccessToken, err = findPersonalAccessTokenNoCache(ctx, tokenHash); err != nil {
+      return personalAccessToken, storage.User{}, err
+    }
+    ctx.Cache().Set(cacheKey, personalAccessToken, personalAccessTokenCacheExpiration)
+  } else if err != nil {
+    return personalAccessToken, storage.User{}, err
+  }
+
+  now := time.Now().UTC().Unix()
+  if !secretMatches(token, personalAccessToken.TokenHash) || !tokenIsValid(personalAccessToken, now) {
+    return storage.PersonalAccessToken{}, storage.User{}, ErrPersonalAccessTokenInvalid
+  }
+
+  user, err := GetOrCreateUser(ctx, personalAccessToken.Email)
+  if err != nil {
+    return personalAccessToken, user, err
+  } else if user.ID != personalAccessToken.UserID || personalAccessToken.OrganizationID == 0 {
+    return storage.PersonalAccessToken{}, storage.User{}, ErrPersonalAccessTokenInvalid
+  }
+
+  // The token stops working if its user leaves the organization it was made in
+  if _, err := GetMembership(ctx, personalAccessToken.OrganizationID, user.ID); err == ErrNotMember {
+    return storage.PersonalAccessToken{}, storage.User{}, ErrPersonalAccessTokenInvalid
+  } else if err != nil {
+    return personalAccessToken, user, err
+  }
+  user.OrganizationID = personalAccessToken.OrganizationID
+
+  recordUsage(ctx, personalAccessTokenCacheKey(personalAccessToken.TokenHash), personalAccessToken.LastUsedTime, recordPersonalAccessTokenUseTask{
+    tokenID: personalAccessToken.ID,
+    now: now,
+  })
+  return personalAccessToken, user, nil
+}
+
+func findPersonalAccessTokenNoCache(ctx Context, tokenHash string) (storage.PersonalAccessToken, error) {
+  personalAccessToken, err := ctx.Storage().GetPersonalAccessTokenByHash(tokenHash)
+  if err == ErrPersonalAccessTokenNotFound {
+    return storage.PersonalAccessToken{}, ErrPersonalAccessTokenInvalid
+  }
+  return personalAccessToken, err
+}
+
+func recordPersonalAccessTokenUseNoCache(ctx Context, personalAccessTokenID int64, now int64) error {
+  return ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+    personalAccessToken, err := tx.GetPersonalAccessToken(personalAccessTokenID)
+    if err == ErrPersonalAccessTokenNotFound {
+      return nil
+    } else if err != nil {
+      return err
+    }
+    personalAccessToken.LastUsedTime = now
+    _, err = tx.PutPersonalAccessToken(personalAccessToken)
+    return err
+  })
+}
@@ -1,17 +1,22 @@
 package biboop
 
 import (
-  "appengine"
-  "appengine/user"
   "github.com/dbrain/soggy"
   "net/http"
 )
 
+// Sends anyone not signed in to sign in. Runtimes that leave signing in to whatever sits in front of them have no login
+// page, so those requests are refused instead.
 func WebUserRequired(ctx *soggy.Context) {
-  if ctx.Env["googleUser"] == nil {
-    aeCtx := ctx.Env["aeCtx"].(appengine.Context)
-    url, _ := user.LoginURL(aeCtx, ctx.Req.URL.Path)
-    http.Redirect(ctx.Res, ctx.Req.Request, url, 302)
+  if ctx.Env["identity"] == nil {
+    url, err := ctx.Env["runtime"].(Runtime).LoginURL(ctx.Env["appCtx"].(Context), ctx.Req.URL.Path)
+    if err != nil {
+      ctx.Next(err)
+    } else if url == "" {
+      http.Error(ctx.Res, "This page requires authorization", http.StatusUnauthorized)
+    } else {
+      http.Redirect(ctx.Res, ctx.Req.Request, url, 302)
+    }
     return
   }
   ctx.Next(nil)
@@ -26,10 +31,13 @@ func WebDashboard(ctx *soggy.Context) (string, interface{}) {
 }
 
 func WebMe(ctx *soggy.Context) (int, interface{}) {
-  return http.StatusOK, map[string]interface{} { "googleUser": ctx.Env["googleUser"], "user": ctx.Env["user"] }
+  return http.StatusOK, map[string]interface{} { "identity": ctx.Env["identity"], "user": ctx.Env["user"] }
 }
 
 func WebLogout(ctx *soggy.Context) {
-  url, _ := user.LogoutURL(ctx.Env["aeCtx"].(appengine.Context), "/")
+  url, err := ctx.Env["runtime"].(Runtime).LogoutURL(ctx.Env["appCtx"].(Context), "/")
+  if err != nil || url == "" {
+    url = "/"
+  }
   http.Redirect(ctx.Res, ctx.Req.Request, url, 302)
 }
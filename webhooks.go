@@ -0,0 +1,326 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+)
+
+var ErrWebhookNotFound = storage.ErrWebhookNotFound
+var ErrWebhookDeliveryNotFound = storage.ErrWebhookDeliveryNotFound
+var ErrInvalidWebhookURL = errors.New("Webhook URL must be an absolute http or https URL")
+var ErrInvalidWebhookEvent = errors.New("Webhook events must be one or more of invocation.completed, invocation.failed, server.offline and server.created")
+
+const (
+  WebhookEventInvocationCompleted = "invocation.completed"
+  WebhookEventInvocationFailed = "invocation.failed"
+  WebhookEventServerOffline = "server.offline"
+  WebhookEventServerCreated = "server.created"
+)
+
+var webhookEvents = map[string]bool {
+  WebhookEventInvocationCompleted: true,
+  WebhookEventInvocationFailed: true,
+  WebhookEventServerOffline: true,
+  WebhookEventServerCreated: true,
+}
+
+const (
+  WebhookDeliveryStatePending = storage.WebhookDeliveryStatePending
+  WebhookDeliveryStateDelivered = storage.WebhookDeliveryStateDelivered
+  WebhookDeliveryStateFailed = storage.WebhookDeliveryStateFailed
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256, using the webhook's secret, of the timestamp
+// header, the delivery header and the body joined by dots. Receivers should check the timestamp is recent and remember
+// delivery IDs they've seen so a captured delivery can't be replayed.
+const (
+  WebhookEventHeader = "X-Biboop-Event"
+  WebhookDeliveryHeader = "X-Biboop-Delivery"
+  WebhookTimestampHeader = "X-Biboop-Timestamp"
+  WebhookSignatureHeader = "X-Biboop-Signature"
+)
+
+// Deliveries are attempted by cron, backing off from a minute and doubling up to an hour between attempts. A delivery
+// is given up on once it has failed WebhookMaxAttempts times.
+const (
+  WebhookMaxAttempts = 10
+  webhookMinBackoffSec = 60
+  webhookMaxBackoffSec = 60 * 60
+  // How long an attempt holds a delivery so an overlapping cron run doesn't send it twice
+  webhookAttemptLeaseSec = 5 * 60
+  // How much of the receiver's response is kept in the delivery log
+  webhookResponseLimit = 1024
+)
+
+// Sends webhook requests. Usually the context's HTTPClient, but a stand in will do.
+type WebhookClient interface {
+  Do(req *http.Request) (*http.Response, error)
+}
+
+type WebhookPayload struct {
+  Event string `json:"event"`
+  Time int64 `json:"time"`
+  OrganizationID int64 `json:"organizationId"`
+  Data map[string]interface{} `json:"data"`
+}
+
+func SignWebhookPayload(secret string, timestamp string, deliveryID string, payload []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(timestamp + "." + deliveryID + "."))
+  mac.Write(payload)
+  return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoffSec(attempts int) int64 {
+  backoff := int64(webhookMinBackoffSec)
+  for i := 1; i < attempts && backoff < webhookMaxBackoffSec; i++ {
+    backoff *= 2
+  }
+  if backoff > webhookMaxBackoffSec {
+    backoff = webhookMaxBackoffSec
+  }
+  return backoff
+}
+
+func CreateWebhookNoCache(ctx Context, user storage.User, webhookURL string, events []string) (storage.Webhook, error) {
+  var webhook storage.Webhook
+
+  if parsed, err := url.Parse(webhookURL); err != nil || !parsed.IsAbs() || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+    return webhook, ErrInvalidWebhookURL
+  }
+  if len(events) == 0 {
+    return webhook, ErrInvalidWebhookEvent
+  }
+  for _, event := range events {
+    if !webhookEvents[event] {
+      return webhook, ErrInvalidWebhookEvent
+    }
+  }
+
+  secret, err := randomHex(32)
+  if err != nil {
+    return webhook, err
+  }
+
+  webhook.OrganizationID = user.OrganizationID
+  webhook.UserID = user.ID
+  webhook.URL = webhookURL
+  webhook.Events = events
+  webhook.Secret = secret
+  webhook.CreatedTime = time.Now().UTC().Unix()
+
+  return ctx.Storage().PutWebhook(webhook)
+}
+
+// Lists the webhooks in the user's current organization. Secrets are only ever shown when a webhook is created.
+func GetWebhooksNoCache(ctx Context, user storage.User) ([]storage.Webhook, error) {
+  webhooks, err := ctx.Storage().GetWebhooks(user.OrganizationID)
+  if err != nil {
+    return []storage.Webhook {}, err
+  }
+
+  for i := range webhooks {
+    webhooks[i].Secret = ""
+  }
+  return webhooks, nil
+}
+
+func getWebhookNoCache(ctx Context, organizationID int64, webhookID int64) (storage.Webhook, error) {
+  webhook, err := ctx.Storage().GetWebhook(webhookID)
+  if err != nil {
+    return webhook, err
+  } else if webhook.OrganizationID != organizationID {
+    return storage.Webhook{}, ErrWebhookNotFound
+  }
+  return webhook, nil
+}
+
+// Deletes the webhook. Deliveries still waiting to be sent are given up on when their turn comes.
+func DeleteWebhookNoCache(ctx Context, user storage.User, webhookID int64) (storage.Webhook, error) {
+  webhook, err := getWebhookNoCache(ctx, user.OrganizationID, webhookID)
+  if err != nil {
+    return webhook, err
+  }
+  webhook.Secret = ""
+  return webhook, ctx.Storage().DeleteWebhook(webhookID)
+}
+
+// Lists a webhook's deliveries newest first.
+func GetWebhookDeliveriesNoCache(ctx Context, user storage.User, webhookID int64) ([]storage.WebhookDelivery, error) {
+  if _, err := getWebhookNoCache(ctx, user.OrganizationID, webhookID); err != nil {
+    return []storage.WebhookDelivery {}, err
+  }
+
+  deliveries, err := ctx.Storage().GetWebhookDeliveries(webhookID)
+  if deliveries == nil {
+    deliveries = []storage.WebhookDelivery {}
+  }
+  return deliveries, err
+}
+
+// Queues a delivery of the event to every webhook in the organization that subscribes to it.
+func QueueWebhookEventNoCache(ctx Context, organizationID int64, event string, data map[string]interface{}) error {
+  webhookIDs, err := ctx.Storage().GetEventWebhookIDs(organizationID, event)
+  if err != nil || len(webhookIDs) == 0 {
+    return err
+  }
+
+  now := time.Now().UTC().Unix()
+  payload, err := json.Marshal(WebhookPayload{ Event: event, Time: now, OrganizationID: organizationID, Data: data })
+  if err != nil {
+    return err
+  }
+
+  for _, webhookID := range webhookIDs {
+    delivery := storage.WebhookDelivery{
+      OrganizationID: organizationID,
+      WebhookID: webhookID,
+      Event: event,
+      Payload: string(payload),
+      State: WebhookDeliveryStatePending,
+      NextAttemptTime: now,
+      CreatedTime: now,
+    }
+    if _, err := ctx.Storage().PutWebhookDelivery(delivery); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Queues a fresh delivery with the same payload as an earlier one. The original stays in the log untouched.
+func RedeliverWebhookNoCache(ctx Context, user storage.User, webhookID int64, deliveryID int64) (storage.WebhookDelivery, error) {
+  if _, err := getWebhookNoCache(ctx, user.OrganizationID, webhookID); err != nil {
+    return storage.WebhookDelivery{}, err
+  }
+  original, err := ctx.Storage().GetWebhookDelivery(deliveryID)
+  if err != nil {
+    return original, err
+  } else if original.WebhookID != webhookID {
+    return storage.WebhookDelivery{}, ErrWebhookDeliveryNotFound
+  }
+
+  now := time.Now().UTC().Unix()
+  delivery := storage.WebhookDelivery{
+    OrganizationID: original.OrganizationID,
+    WebhookID: webhookID,
+    Event: original.Event,
+    Payload: original.Payload,
+    State: WebhookDeliveryStatePending,
+    NextAttemptTime: now,
+    RedeliveryOfID: deliveryID,
+    CreatedTime: now,
+  }
+  return ctx.Storage().PutWebhookDelivery(delivery)
+}
+
+// Attempts every pending delivery that is due. Driven by cron. Returns how many deliveries were attempted.
+func DeliverWebhooksNoCache(ctx Context, client WebhookClient, now time.Time) (int, error) {
+  nowUnix := now.UTC().Unix()
+
+  deliveryIDs, err := ctx.Storage().GetDueWebhookDeliveryIDs(nowUnix)
+  if err != nil {
+    return 0, err
+  }
+
+  attempted := 0
+  for _, deliveryID := range deliveryIDs {
+    // Claim the delivery so an overlapping run leaves it alone while we send it
+    var delivery storage.WebhookDelivery
+    err := ctx.Storage().RunInTransaction(func (tx storage.Storage) error {
+      var err error
+      if delivery, err = tx.GetWebhookDelivery(deliveryID); err != nil {
+        return err
+      }
+      if delivery.State != WebhookDeliveryStatePending || delivery.NextAttemptTime > nowUnix {
+        return ErrWebhookDeliveryNotFound
+      }
+      delivery.NextAttemptTime = nowUnix + webhookAttemptLeaseSec
+      delivery, err = tx.PutWebhookDelivery(delivery)
+      return err
+    })
+    if err == ErrWebhookDeliveryNotFound {
+      continue
+    } else if err != nil {
+      return attempted, err
+    }
+
+    webhook, err := getWebhookNoCache(ctx, delivery.OrganizationID, delivery.WebhookID)
+    if err == ErrWebhookNotFound {
+      delivery.State = WebhookDeliveryStateFailed
+      delivery.NextAttemptTime = 0
+      delivery.LastError = err.Error()
+    } else if err != nil {
+      return attempted, err
+    } else {
+      attemptWebhookDelivery(client, webhook, &delivery, nowUnix)
+      attempted++
+    }
+
+    if _, err := ctx.Storage().PutWebhookDelivery(delivery); err != nil {
+      return attempted, err
+    }
+  }
+
+  return attempted, nil
+}
+
+// Sends the delivery once and records the outcome on it, scheduling the next attempt if it failed. The caller saves
+// the delivery.
+func attemptWebhookDelivery(client WebhookClient, webhook storage.Webhook, delivery *storage.WebhookDelivery, now int64) {
+  delivery.Attempts++
+  delivery.LastAttemptTime = now
+  delivery.LastStatusCode = 0
+  delivery.LastResponse = ""
+  delivery.LastError = ""
+
+  payload := []byte(delivery.Payload)
+  req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+  if err == nil {
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "biboop-webhooks")
+    timestamp := strconv.FormatInt(now, 10)
+    deliveryID := strconv.FormatInt(delivery.ID, 10)
+    req.Header.Set(WebhookEventHeader, delivery.Event)
+    req.Header.Set(WebhookDeliveryHeader, deliveryID)
+    req.Header.Set(WebhookTimestampHeader, timestamp)
+    req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, deliveryID, payload))
+
+    var resp *http.Response
+    if resp, err = client.Do(req); err == nil {
+      body, _ := ioutil.ReadAll(&io.LimitedReader{ R: resp.Body, N: webhookResponseLimit })
+      resp.Body.Close()
+      delivery.LastStatusCode = resp.StatusCode
+      delivery.LastResponse = string(body)
+    }
+  }
+
+  switch {
+  case err == nil && delivery.LastStatusCode >= 200 && delivery.LastStatusCode < 300:
+    delivery.State = WebhookDeliveryStateDelivered
+    delivery.NextAttemptTime = 0
+    return
+  case err != nil:
+    delivery.LastError = err.Error()
+  default:
+    delivery.LastError = "Receiver responded with " + strconv.Itoa(delivery.LastStatusCode)
+  }
+
+  if delivery.Attempts >= WebhookMaxAttempts {
+    delivery.State = WebhookDeliveryStateFailed
+    delivery.NextAttemptTime = 0
+  } else {
+    delivery.NextAttemptTime = now + webhookBackoffSec(delivery.Attempts)
+  }
+}
@@ -0,0 +1,397 @@
+package biboop
+
+import (
+  "github.com/dbrain/biboop-server/storage"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Receives webhook deliveries, answering with whatever status the test has set.
+type testWebhookReceiver struct {
+  *httptest.Server
+  lock sync.Mutex
+  status int
+  received []testWebhookRequest
+}
+
+type testWebhookRequest struct {
+  header http.Header
+  body string
+}
+
+func newTestWebhookReceiver() *testWebhookReceiver {
+  receiver := &testWebhookReceiver{ status: http.StatusOK }
+  receiver.Server = httptest.NewServer(http.HandlerFunc(receiver.serve))
+  return receiver
+}
+
+func (receiver *testWebhookReceiver) serve(res http.ResponseWriter, req *http.Request) {
+  body, _ := ioutil.ReadAll(req.Body)
+  receiver.lock.Lock()
+  receiver.received = append(receiver.received, testWebhookRequest{ header: req.Header, body: string(body) })
+  status := receiver.status
+  receiver.lock.Unlock()
+  res.WriteHeader(status)
+  res.Write([]byte("status " + strconv.Itoa(status)))
+}
+
+func (receiver *testWebhookReceiver) setStatus(status int) {
+  receiver.lock.Lock()
+  defer receiver.lock.Unlock()
+  receiver.status = status
+}
+
+func (receiver *testWebhookReceiver) requests() []testWebhookRequest {
+  receiver.lock.Lock()
+  defer receiver.lock.Unlock()
+  return append([]testWebhookRequest {}, receiver.received...)
+}
+
+// Calls through to another client, first running whatever the test wants to happen mid request.
+type testWebhookClient struct {
+  client WebhookClient
+  during func()
+}
+
+func (client testWebhookClient) Do(req *http.Request) (*http.Response, error) {
+  if client.during != nil {
+    client.during()
+  }
+  return client.client.Do(req)
+}
+
+func getWebhookDelivery(t *testing.T, ctx Context, deliveryID int64) storage.WebhookDelivery {
+  delivery, err := ctx.Storage().GetWebhookDelivery(deliveryID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return delivery
+}
+
+// Queues one event for the webhook and returns the delivery it was given.
+func queueTestWebhookEvent(t *testing.T, ctx Context, user storage.User, webhookID int64) storage.WebhookDelivery {
+  if err := QueueWebhookEventNoCache(ctx, user.OrganizationID, WebhookEventServerCreated, map[string]interface{} { "serverId": 7 }); err != nil {
+    t.Fatal(err)
+  }
+  deliveries, err := GetWebhookDeliveriesNoCache(ctx, user, webhookID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(deliveries) != 1 {
+    t.Fatalf("queued %d deliveries, expected 1", len(deliveries))
+  }
+  return deliveries[0]
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+  mac := hmac.New(sha256.New, []byte("secret"))
+  mac.Write([]byte(`1500000000.42.{"event":"server.created"}`))
+  expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+  if got := SignWebhookPayload("secret", "1500000000", "42", []byte(`{"event":"server.created"}`)); got != expected {
+    t.Errorf("SignWebhookPayload returned %s, expected %s", got, expected)
+  }
+
+  // Each part is covered by the signature
+  changed := []string {
+    SignWebhookPayload("other", "1500000000", "42", []byte(`{"event":"server.created"}`)),
+    SignWebhookPayload("secret", "1500000001", "42", []byte(`{"event":"server.created"}`)),
+    SignWebhookPayload("secret", "1500000000", "43", []byte(`{"event":"server.created"}`)),
+    SignWebhookPayload("secret", "1500000000", "42", []byte(`{"event":"server.offline"}`)),
+  }
+  for i, signature := range changed {
+    if signature == expected {
+      t.Errorf("signature %d didn't change with its input", i)
+    }
+  }
+}
+
+func TestWebhookBackoffSec(t *testing.T) {
+  tests := []struct {
+    attempts int
+    expected int64
+  }{
+    { 0, 60 },
+    { 1, 60 },
+    { 2, 120 },
+    { 3, 240 },
+    { 4, 480 },
+    { 5, 960 },
+    { 6, 1920 },
+    { 7, 3600 },
+    { 8, 3600 },
+    { WebhookMaxAttempts, 3600 },
+  }
+
+  for _, test := range tests {
+    if got := webhookBackoffSec(test.attempts); got != test.expected {
+      t.Errorf("webhookBackoffSec(%d) = %d, expected %d", test.attempts, got, test.expected)
+    }
+  }
+}
+
+func TestDeliverWebhooksSignsAndRetries(t *testing.T) {
+  ctx := newTestContext(t)
+  receiver := newTestWebhookReceiver()
+  defer receiver.Close()
+  user := storage.User{ ID: 1, OrganizationID: 2 }
+
+  webhook, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerCreated })
+  if err != nil {
+    t.Fatal(err)
+  }
+  queued := queueTestWebhookEvent(t, ctx, user, webhook.ID)
+  now := time.Now().UTC()
+
+  // The first attempt is refused and backed off
+  receiver.setStatus(http.StatusServiceUnavailable)
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, now); err != nil || attempted != 1 {
+    t.Fatalf("DeliverWebhooksNoCache returned %d, %v, expected 1 attempt", attempted, err)
+  }
+  delivery := getWebhookDelivery(t, ctx, queued.ID)
+  if delivery.State != WebhookDeliveryStatePending || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusServiceUnavailable ||
+    delivery.LastResponse != "status 503" || delivery.NextAttemptTime != now.Unix() + webhookBackoffSec(1) {
+    t.Errorf("delivery after a refused attempt was %+v", delivery)
+  }
+
+  requests := receiver.requests()
+  if len(requests) != 1 {
+    t.Fatalf("receiver got %d requests, expected 1", len(requests))
+  }
+  header := requests[0].header
+  timestamp := strconv.FormatInt(now.Unix(), 10)
+  deliveryID := strconv.FormatInt(queued.ID, 10)
+  if header.Get(WebhookEventHeader) != WebhookEventServerCreated || header.Get(WebhookDeliveryHeader) != deliveryID || header.Get(WebhookTimestampHeader) != timestamp {
+    t.Errorf("delivery was sent with headers %v", header)
+  }
+  if requests[0].body != queued.Payload {
+    t.Errorf("delivery was sent with body %s, expected %s", requests[0].body, queued.Payload)
+  }
+  if expected := SignWebhookPayload(webhook.Secret, timestamp, deliveryID, []byte(queued.Payload)); header.Get(WebhookSignatureHeader) != expected {
+    t.Errorf("delivery was signed %s, expected %s", header.Get(WebhookSignatureHeader), expected)
+  }
+
+  // Nothing is sent again until the backoff has passed
+  receiver.setStatus(http.StatusOK)
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, now.Add(time.Duration(webhookBackoffSec(1) - 1) * time.Second)); err != nil || attempted != 0 {
+    t.Errorf("DeliverWebhooksNoCache before the backoff returned %d, %v, expected no attempts", attempted, err)
+  }
+  retryTime := now.Add(time.Duration(webhookBackoffSec(1)) * time.Second)
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, retryTime); err != nil || attempted != 1 {
+    t.Fatalf("DeliverWebhooksNoCache after the backoff returned %d, %v, expected 1 attempt", attempted, err)
+  }
+  delivery = getWebhookDelivery(t, ctx, queued.ID)
+  if delivery.State != WebhookDeliveryStateDelivered || delivery.Attempts != 2 || delivery.LastStatusCode != http.StatusOK ||
+    delivery.LastError != "" || delivery.NextAttemptTime != 0 || delivery.LastAttemptTime != retryTime.Unix() {
+    t.Errorf("delivery after a successful attempt was %+v", delivery)
+  }
+
+  // A retry is signed for its own timestamp
+  requests = receiver.requests()
+  if len(requests) != 2 {
+    t.Fatalf("receiver got %d requests, expected 2", len(requests))
+  }
+  retryTimestamp := strconv.FormatInt(retryTime.Unix(), 10)
+  if expected := SignWebhookPayload(webhook.Secret, retryTimestamp, deliveryID, []byte(queued.Payload)); requests[1].header.Get(WebhookSignatureHeader) != expected {
+    t.Errorf("retry was signed %s, expected %s", requests[1].header.Get(WebhookSignatureHeader), expected)
+  }
+
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, retryTime.Add(time.Hour)); err != nil || attempted != 0 {
+    t.Errorf("DeliverWebhooksNoCache after delivery returned %d, %v, expected no attempts", attempted, err)
+  }
+}
+
+func TestDeliverWebhooksGivesUp(t *testing.T) {
+  ctx := newTestContext(t)
+  receiver := newTestWebhookReceiver()
+  defer receiver.Close()
+  receiver.setStatus(http.StatusInternalServerError)
+  user := storage.User{ ID: 1, OrganizationID: 2 }
+
+  webhook, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerCreated })
+  if err != nil {
+    t.Fatal(err)
+  }
+  queued := queueTestWebhookEvent(t, ctx, user, webhook.ID)
+
+  // Each failure waits longer, up to the limit, until the last attempt gives up
+  now := time.Now().UTC()
+  for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+    if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, now); err != nil || attempted != 1 {
+      t.Fatalf("attempt %d: DeliverWebhooksNoCache returned %d, %v, expected 1 attempt", attempt, attempted, err)
+    }
+    delivery := getWebhookDelivery(t, ctx, queued.ID)
+    if delivery.Attempts != attempt || delivery.LastError != "Receiver responded with 500" {
+      t.Fatalf("attempt %d: delivery was %+v", attempt, delivery)
+    }
+    if attempt == WebhookMaxAttempts {
+      if delivery.State != WebhookDeliveryStateFailed || delivery.NextAttemptTime != 0 {
+        t.Errorf("delivery after the last attempt was %+v, expected it to have failed", delivery)
+      }
+      break
+    }
+    if delivery.State != WebhookDeliveryStatePending || delivery.NextAttemptTime != now.Unix() + webhookBackoffSec(attempt) {
+      t.Fatalf("attempt %d: delivery was %+v, expected it to back off %d seconds", attempt, delivery, webhookBackoffSec(attempt))
+    }
+    now = time.Unix(delivery.NextAttemptTime, 0).UTC()
+  }
+
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, now.Add(24 * time.Hour)); err != nil || attempted != 0 {
+    t.Errorf("DeliverWebhooksNoCache after giving up returned %d, %v, expected no attempts", attempted, err)
+  }
+  if requests := receiver.requests(); len(requests) != WebhookMaxAttempts {
+    t.Errorf("receiver got %d requests, expected %d", len(requests), WebhookMaxAttempts)
+  }
+}
+
+func TestDeliverWebhooksLeasesDeliveries(t *testing.T) {
+  ctx := newTestContext(t)
+  receiver := newTestWebhookReceiver()
+  defer receiver.Close()
+  user := storage.User{ ID: 1, OrganizationID: 2 }
+
+  webhook, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerCreated })
+  if err != nil {
+    t.Fatal(err)
+  }
+  queued := queueTestWebhookEvent(t, ctx, user, webhook.ID)
+  now := time.Now().UTC()
+
+  // A run that overlaps one already sending the delivery leaves it alone
+  overlapping := -1
+  client := testWebhookClient{ client: http.DefaultClient, during: func () {
+    var err error
+    if overlapping, err = DeliverWebhooksNoCache(ctx, http.DefaultClient, now); err != nil {
+      t.Errorf("overlapping DeliverWebhooksNoCache returned %v", err)
+    }
+  }}
+  receiver.setStatus(http.StatusInternalServerError)
+  if attempted, err := DeliverWebhooksNoCache(ctx, client, now); err != nil || attempted != 1 {
+    t.Fatalf("DeliverWebhooksNoCache returned %d, %v, expected 1 attempt", attempted, err)
+  }
+  if overlapping != 0 {
+    t.Errorf("overlapping run attempted %d deliveries, expected none", overlapping)
+  }
+  if requests := receiver.requests(); len(requests) != 1 {
+    t.Errorf("receiver got %d requests, expected 1", len(requests))
+  }
+
+  // A run that claimed the delivery and never finished holds it for the lease, then it's tried again
+  delivery := getWebhookDelivery(t, ctx, queued.ID)
+  claimTime := time.Unix(delivery.NextAttemptTime, 0).UTC()
+  delivery.NextAttemptTime = claimTime.Unix() + webhookAttemptLeaseSec
+  if _, err := ctx.Storage().PutWebhookDelivery(delivery); err != nil {
+    t.Fatal(err)
+  }
+  receiver.setStatus(http.StatusOK)
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, claimTime.Add((webhookAttemptLeaseSec - 1) * time.Second)); err != nil || attempted != 0 {
+    t.Errorf("DeliverWebhooksNoCache during the lease returned %d, %v, expected no attempts", attempted, err)
+  }
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, claimTime.Add(webhookAttemptLeaseSec * time.Second)); err != nil || attempted != 1 {
+    t.Errorf("DeliverWebhooksNoCache once the lease ran out returned %d, %v, expected 1 attempt", attempted, err)
+  }
+  if delivery = getWebhookDelivery(t, ctx, queued.ID); delivery.State != WebhookDeliveryStateDelivered || delivery.Attempts != 2 {
+    t.Errorf("delivery after the lease ran out was %+v", delivery)
+  }
+}
+
+func TestDeliverWebhooksFailsForDeletedWebhooks(t *testing.T) {
+  ctx := newTestContext(t)
+  receiver := newTestWebhookReceiver()
+  defer receiver.Close()
+  user := storage.User{ ID: 1, OrganizationID: 2 }
+
+  webhook, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerCreated })
+  if err != nil {
+    t.Fatal(err)
+  }
+  queued := queueTestWebhookEvent(t, ctx, user, webhook.ID)
+  if _, err := DeleteWebhookNoCache(ctx, user, webhook.ID); err != nil {
+    t.Fatal(err)
+  }
+
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, time.Now().UTC()); err != nil || attempted != 0 {
+    t.Errorf("DeliverWebhooksNoCache returned %d, %v, expected no attempts", attempted, err)
+  }
+  if delivery := getWebhookDelivery(t, ctx, queued.ID); delivery.State != WebhookDeliveryStateFailed || delivery.LastError != ErrWebhookNotFound.Error() {
+    t.Errorf("delivery for a deleted webhook was %+v", delivery)
+  }
+  if requests := receiver.requests(); len(requests) != 0 {
+    t.Errorf("receiver got %d requests, expected none", len(requests))
+  }
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+  ctx := newTestContext(t)
+  receiver := newTestWebhookReceiver()
+  defer receiver.Close()
+  user := storage.User{ ID: 1, OrganizationID: 2 }
+
+  webhook, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerCreated })
+  if err != nil {
+    t.Fatal(err)
+  }
+  other, err := CreateWebhookNoCache(ctx, user, receiver.URL, []string { WebhookEventServerOffline })
+  if err != nil {
+    t.Fatal(err)
+  }
+  queued := queueTestWebhookEvent(t, ctx, user, webhook.ID)
+  now := time.Now().UTC()
+  if _, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, now); err != nil {
+    t.Fatal(err)
+  }
+  original := getWebhookDelivery(t, ctx, queued.ID)
+
+  // Only the webhook's own deliveries, in the user's organization, can be redelivered
+  outsider := storage.User{ ID: 3, OrganizationID: 4 }
+  if _, err := RedeliverWebhookNoCache(ctx, outsider, webhook.ID, queued.ID); err != ErrWebhookNotFound {
+    t.Errorf("redelivering from another organization returned %v, expected %v", err, ErrWebhookNotFound)
+  }
+  if _, err := RedeliverWebhookNoCache(ctx, user, other.ID, queued.ID); err != ErrWebhookDeliveryNotFound {
+    t.Errorf("redelivering through another webhook returned %v, expected %v", err, ErrWebhookDeliveryNotFound)
+  }
+  if _, err := RedeliverWebhookNoCache(ctx, user, webhook.ID, queued.ID + 1000); err != ErrWebhookDeliveryNotFound {
+    t.Errorf("redelivering a missing delivery returned %v, expected %v", err, ErrWebhookDeliveryNotFound)
+  }
+
+  redelivery, err := RedeliverWebhookNoCache(ctx, user, webhook.ID, queued.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if redelivery.ID == queued.ID || redelivery.RedeliveryOfID != queued.ID || redelivery.Payload != queued.Payload ||
+    redelivery.State != WebhookDeliveryStatePending || redelivery.Attempts != 0 {
+    t.Errorf("redelivery was %+v", redelivery)
+  }
+
+  redeliveryTime := now.Add(time.Second)
+  if attempted, err := DeliverWebhooksNoCache(ctx, http.DefaultClient, redeliveryTime); err != nil || attempted != 1 {
+    t.Fatalf("DeliverWebhooksNoCache returned %d, %v, expected the redelivery to be attempted", attempted, err)
+  }
+  requests := receiver.requests()
+  if len(requests) != 2 {
+    t.Fatalf("receiver got %d requests, expected 2", len(requests))
+  }
+  // The redelivery has its own ID, so a receiver that remembers the first doesn't take it for a replay
+  header := requests[1].header
+  timestamp := strconv.FormatInt(redeliveryTime.Unix(), 10)
+  deliveryID := strconv.FormatInt(redelivery.ID, 10)
+  if header.Get(WebhookDeliveryHeader) != deliveryID || requests[1].body != queued.Payload ||
+    header.Get(WebhookSignatureHeader) != SignWebhookPayload(webhook.Secret, timestamp, deliveryID, []byte(queued.Payload)) {
+    t.Errorf("redelivery was sent with headers %v and body %s", header, requests[1].body)
+  }
+
+  if delivery := getWebhookDelivery(t, ctx, queued.ID); delivery.Attempts != original.Attempts || delivery.LastAttemptTime != original.LastAttemptTime {
+    t.Errorf("original delivery changed to %+v", delivery)
+  }
+  if delivery := getWebhookDelivery(t, ctx, redelivery.ID); delivery.State != WebhookDeliveryStateDelivered {
+    t.Errorf("redelivery after it was sent was %+v", delivery)
+  }
+}